@@ -1,17 +1,21 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/4r7hur0/PBL-2/api/client"
 	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/openapi"
 	"github.com/4r7hur0/PBL-2/api/router"
 	"github.com/4r7hur0/PBL-2/api/state"
 	rc "github.com/4r7hur0/PBL-2/registry/registry_client"
@@ -22,21 +26,20 @@ import (
 
 var (
 	// Variáveis globais para a configuração desta instância da API
-	enterpriseName  string
-	ownedCity       string
-	postsQuantity   int
-	stateMgr        *state.StateManager
-	allSystemCities []string
-	registryClient  *rc.RegistryClient // Cliente do Registry
-	myAPIURL        string
-	cpWorkerIDs     []string // IDs dos Charging Point Workers registrados nesta API
+	enterpriseName string
+	ownedCity      string
+	stateMgr       *state.StateManager
+	cityDir        *cityDirectory     // Cidades ativas, obtidas do Registry
+	registryClient *rc.RegistryClient // Cliente do Registry
+	myAPIURL       string
+	// Coordenadas da cidade gerenciada (CITY_LATITUDE / CITY_LONGITUDE)
+	ownedCityLocation *schemas.GeoPoint
 )
 
 func main() {
 
 	enterpriseName = os.Getenv("ENTERPRISE_NAME") // Renomeado para atribuição direta
 	enterprisePort := os.Getenv("ENTERPRISE_PORT")
-	workerIDsStr := os.Getenv("CP_WORKER_IDS") // Lê a nova variável
 	ownedCity = os.Getenv("OWNED_CITY")
 	registryURL := os.Getenv("REGISTRY_URL") // Ex: http://localhost:9000
 
@@ -48,40 +51,107 @@ func main() {
 		fmt.Println("AVISO: ENTERPRISE_PORT não definido. Usando '8080'.")
 		enterprisePort = "8080"
 	}
-	if workerIDsStr == "" {
-		log.Println("AVISO: CP_WORKER_IDS não definido. Usando 'CP001' como padrão.")
-		cpWorkerIDs = []string{"CP001"}
-	} else {
-		cpWorkerIDs = strings.Split(workerIDsStr, ",") // Separa a string em uma lista de IDs
+	location, err := schemas.ParseGeoPoint(os.Getenv("CITY_LATITUDE"), os.Getenv("CITY_LONGITUDE"))
+	if err != nil {
+		log.Printf("AVISO: Coordenadas da cidade ignoradas: %v", err)
 	}
+	ownedCityLocation = location
 
-	postsQuantity = len(cpWorkerIDs) // A quantidade de postos é o tamanho da lista
+	log.Printf("Iniciando API para a empresa: %s na porta %s, gerenciando a cidade: %s.", enterpriseName, enterprisePort, ownedCity)
 
-	log.Printf("Iniciando API para a empresa: %s na porta %s, gerenciando a cidade: %s com %d postos.", enterpriseName, enterprisePort, ownedCity, postsQuantity)
+	// A identidade MSP assina o registro no Registry e as chamadas entre APIs
+	var mspCredentials *rc.Credentials
+	if credentials, err := loadMSPCredentials(); err != nil {
+		log.Printf("[%s] AVISO: Identidade MSP não carregada: %v", enterpriseName, err)
+	} else {
+		mspCredentials = &credentials
+	}
+	if err := loadPeerSecurity(mspCredentials); err != nil {
+		log.Fatalf("[%s] Falha ao configurar a segurança entre APIs: %v", enterpriseName, err)
+	}
 
-	myAPIURL = fmt.Sprintf("http://%v:%s", enterpriseName, enterprisePort) // Ajuste se estiver atrás de um proxy ou em rede Docker diferente
+	myAPIURL = fmt.Sprintf("%s://%v:%s", apiScheme(), enterpriseName, enterprisePort) // Ajuste se estiver atrás de um proxy ou em rede Docker diferente
 
 	// Inicializar o StateManager APENAS para a cidade que esta API possui
-	stateMgr = state.NewStateManager(ownedCity, postsQuantity, myAPIURL, cpWorkerIDs)
+	// Os workers se anunciam pelo MQTT (veja setupWorkerRegistry)
+	stateMgr = state.NewStateManager(ownedCity, myAPIURL)
+	stateMgr.SetWorkerProtocolLookup(workerProtocolVersion)
+	stateMgr.SetWorkerLookup(eligibleWorkers)
+	stateMgr.SetWorkerScheduleLookup(workerSchedule)
+	loadAllocationConfig(stateMgr)
+	loadRetentionConfig(stateMgr)
+	go stateMgr.CollectReservations()
+	loadPrepareTimeoutConfig(stateMgr)
+	go stateMgr.WatchPrepareTimeouts()
 
 	// Inicializar e usar o Registry Client
 	registryClient = rc.NewRegistryClient(registryURL)
+	if mspCredentials != nil {
+		registryClient.SetCredentials(*mspCredentials)
+	} else {
+		log.Printf("[%s] AVISO: Registro no Registry será enviado sem assinatura.", enterpriseName)
+	}
 
-	err := registryClient.RegisterService(enterpriseName, ownedCity, myAPIURL)
+	loadOperatorConfig()
+	_, _, err = registryClient.RegisterService(schemas.RegisterRequest{
+		EnterpriseName:  enterpriseName,
+		CityManaged:     ownedCity,
+		ApiURL:          myAPIURL,
+		Location:        ownedCityLocation,
+		InstanceID:      os.Getenv("INSTANCE_ID"), // Vazio: o Registry usa a URL da API
+		Metadata:        currentMetadata(),
+		ProtocolVersion: schemas.ProtocolVersion,
+	})
 	if err != nil {
 		log.Fatalf("[%s] Falha ao registrar no Registry: %v", enterpriseName, err)
 	} else {
 		log.Printf("[%s] Registrado com sucesso no Registry como gerenciador de '%s' em %s", enterpriseName, ownedCity, myAPIURL)
 	}
 
-	allSystemCities = []string{"Salvador", "Feira de Santana", "Ilheus"}
+	// Cancelado no desligamento: encerra os listeners MQTT e suas assinaturas
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+
+	// Mantém o lease do Registry vivo e remove o registro ao desligar
+	stopHeartbeat := make(chan struct{})
+	heartbeatDone := registryClient.StartHeartbeat(stopHeartbeat)
+	startMetadataUpdater(5 * time.Second)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Printf("[%s] Desligando. Removendo registro do Registry...", enterpriseName)
+		close(stopHeartbeat)
+		select {
+		case <-heartbeatDone:
+		case <-time.After(5 * time.Second):
+		}
+		shutdown()
+		mqtt.Disconnect()
+		os.Exit(0)
+	}()
+
+	registryClient.StartWatch() // Visão local dos serviços, usada na descoberta de participantes
+	cityDir = newCityDirectory()
+	cityDir.StartRefreshing(cityRefreshInterval())
 
 	// Inicializar MQTT
 
-	mqtt.InitializeMQTT("tcp://mosquitto:1883")
-	messageChannel := mqtt.StartListening(enterpriseName, 10)
+	if err := mqtt.Connect(mqtt.ConfigFromEnv("tcp://mosquitto:1883")); err != nil {
+		log.Fatalf("[%s] Falha ao configurar o cliente MQTT: %v", enterpriseName, err)
+	}
+	// Sob sobrecarga, novos pedidos de rota são descartados (o carro pode pedir de novo);
+	// rotas escolhidas nunca são descartadas, pois iniciam reservas.
+	routeRequests, err := mqtt.Listen(shutdownCtx, enterpriseName, mqtt.ListenOptions{BufferSize: 50, Overflow: mqtt.OverflowDropNewest})
+	if err != nil {
+		log.Fatalf("[%s] %v", enterpriseName, err)
+	}
 	chosenRouteTopic := fmt.Sprintf("car/route/%s", enterpriseName)
-	chosenRouteMessageChannel := mqtt.StartListening(chosenRouteTopic, 10)
+	chosenRoutes, err := mqtt.Listen(shutdownCtx, chosenRouteTopic, mqtt.ListenOptions{BufferSize: 50, Overflow: mqtt.OverflowQueue})
+	if err != nil {
+		log.Fatalf("[%s] %v", enterpriseName, err)
+	}
+	messageChannel := routeRequests.C
+	chosenRouteMessageChannel := chosenRoutes.C
 
 	// Goroutine para processar os pedidos de rota e retornar as opções de rota
 
@@ -91,18 +161,13 @@ func main() {
 
 			// 1. Deserializar a mensagem recebida (payload) para schemas.RouteRequest
 			var routeReq schemas.RouteRequest
-
-			err := json.Unmarshal([]byte(messagePayload), &routeReq)
+			env, err := schemas.DecodeMessage([]byte(messagePayload), schemas.MsgRouteRequest, &routeReq)
 			if err != nil {
 				log.Printf("[%s] Erro ao deserializar RouteRequest: %v. Mensagem original: %s", enterpriseName, err, messagePayload)
 				continue
 			}
-
-			// Validar se o VehicleID foi recebido
-			if routeReq.VehicleID == "" {
-				log.Printf("[%s] VehicleID está vazio na requisição. Mensagem: %s", enterpriseName, messagePayload)
-				continue
-			}
+			// 2. Responder ao carro na mesma versão de mensagem que ele usou
+			rememberVehicleVersion(routeReq.VehicleID, env.Version)
 
 			// 3. Gerar um RequestID único
 			requestID := uuid.New().String()
@@ -111,7 +176,7 @@ func main() {
 
 			if routeReq.Origin != "" && routeReq.Destination != "" {
 				// Chamar a função do pacote 'router'
-				possibleRoutes = router.GeneratePossibleRoutes(routeReq.Origin, routeReq.Destination, allSystemCities)
+				possibleRoutes = router.GeneratePossibleRoutes(routeReq.Origin, routeReq.Destination, cityDir.Graph())
 				if len(possibleRoutes) == 0 {
 					log.Printf("[%s] Nenhuma rota retornada pelo módulo de roteamento para '%s' -> '%s'.", enterpriseName, routeReq.Origin, routeReq.Destination)
 				}
@@ -126,24 +191,13 @@ func main() {
 				Routes:    possibleRoutes,
 			}
 
-			// 5. Serializar o objeto de resposta para JSON
-			responseBytes, err := json.Marshal(response)
-			if err != nil {
-				log.Printf("[%s] Erro ao serializar RouteReservationRespose para VehicleID %s: %v", enterpriseName, routeReq.VehicleID, err)
-				continue
-			}
-
-			// 6. Publicar a resposta JSON para o tópico MQTT do carro (O carro escuta em um tópico que é o seu próprio ID)
-
+			// 5. Publicar a resposta para o tópico MQTT do carro (O carro escuta em um tópico que é o seu próprio ID)
 			responseTopic := routeReq.VehicleID
-			mqtt.Publish(responseTopic, string(responseBytes))
-
-			var formattedResp schemas.RouteReservationOptions
-			_ = json.Unmarshal(responseBytes, &formattedResp)
+			publishMessage(responseTopic, schemas.MsgRouteOptions, env.Version, response)
 
 			fmt.Printf("[%s] Resposta enviada para o tópico %s:\n", enterpriseName, responseTopic)
-			fmt.Printf("Request ID: %s\n", formattedResp.RequestID)
-			fmt.Printf("Vehicle ID: %s\n\n", formattedResp.VehicleID)
+			fmt.Printf("Request ID: %s\n", response.RequestID)
+			fmt.Printf("Vehicle ID: %s\n\n", response.VehicleID)
 		}
 	}()
 
@@ -157,15 +211,12 @@ func main() {
 
 			// 1. Deserializar a mensagem recebida (payload) para ChosenRouteMsg
 			var chosenRoute schemas.ChosenRouteMsg
-			err := json.Unmarshal([]byte(messagePayload), &chosenRoute)
+			env, err := schemas.DecodeMessage([]byte(messagePayload), schemas.MsgChosenRoute, &chosenRoute)
 			if err != nil {
-				log.Printf("[%s] Erro ao deserializar ChosenRouteMsg: %v. Mensagem original: %s", enterpriseName, err, messagePayload)
-				continue
-			}
-			if chosenRoute.VehicleID == "" || chosenRoute.RequestID == "" {
-				log.Printf("[%s] TX[%s]: VehicleID ou RequestID ausente na ChosenRouteMsg. Payload: %s", enterpriseName, transactionID, messagePayload)
+				log.Printf("[%s] TX[%s]: Erro ao deserializar ChosenRouteMsg: %v. Mensagem original: %s", enterpriseName, transactionID, err, messagePayload)
 				continue
 			}
+			rememberVehicleVersion(chosenRoute.VehicleID, env.Version)
 			if len(chosenRoute.Route) == 0 {
 				log.Printf("[%s] TX[%s]: Rota escolhida está vazia para VehicleID %s.", enterpriseName, transactionID, chosenRoute.VehicleID)
 				publishReservationStatus(chosenRoute.VehicleID, transactionID, "REJECTED", "Rota escolhida estava vazia", nil, enterpriseName)
@@ -184,66 +235,25 @@ func main() {
 					log.Printf("[%s] TX[%s]: Iniciando PREPARE LOCAL via StateManager para %s", enterpriseName, transactionID, cityToReserve)
 
 					// Agora o StateManager cuida de tudo, incluindo a comunicação com o worker.
-					success, err := stateMgr.PrepareReservation(transactionID, chosenRoute.VehicleID, chosenRoute.RequestID, windowToReserve, myAPIURL)
-					if !success || err != nil {
-						log.Printf("[%s] TX[%s]: FALHA PREPARE LOCAL (via StateManager) para %s: %v", enterpriseName, transactionID, cityToReserve, err)
-						prepareOverallSuccess = false
-						break // Sai do loop de segmentos se a preparação local falhar
-					}
-
-					// Se chegou aqui, o StateManager já preparou a si mesmo e o worker.
-					preparedParticipants[cityToReserve] = "local"
-					log.Printf("[%s] TX[%s]: SUCESSO PREPARE LOCAL para %s", enterpriseName, transactionID, cityToReserve)
-
-				} else { // Reserva REMOTA
-					log.Printf("[%s] TX[%s]: Descobrindo API para cidade remota '%s'", enterpriseName, transactionID, cityToReserve)
-					discoveredService, err_discover := registryClient.DiscoverService(cityToReserve)
-					if err_discover != nil || !discoveredService.Found {
-						log.Printf("[%s] TX[%s]: FALHA ao descobrir API para cidade remota '%s': %v. Found: %v", enterpriseName, transactionID, cityToReserve, err_discover, discoveredService.Found)
-						prepareOverallSuccess = false
-						break
-					}
-					remoteAPIURL := discoveredService.ApiURL
-					log.Printf("[%s] TX[%s]: Iniciando PREPARE REMOTO para %s em %s (API: %s)", enterpriseName, transactionID, chosenRoute.VehicleID, cityToReserve, remoteAPIURL)
-
-					remoteReqPayload := schemas.RemotePrepareRequest{
-						TransactionID:     transactionID,
-						VehicleID:         chosenRoute.VehicleID,
-						RequestID:         chosenRoute.RequestID,
-						City:              cityToReserve, // Importante: enviar a cidade correta
-						ReservationWindow: windowToReserve,
-					}
-					remoteReqPayload.CoordinatorURL = myAPIURL // Adiciona a URL da própria API como coordenadora
-					payloadBytes, _ := json.Marshal(remoteReqPayload)
-
-					httpClient := &http.Client{Timeout: time.Second * 10} // Adicionar timeout
-					resp, httpErr := httpClient.Post(fmt.Sprintf("%s/2pc_remote/prepare", remoteAPIURL), "application/json", bytes.NewBuffer(payloadBytes))
-
-					if httpErr != nil {
-						log.Printf("[%s] TX[%s]: ERRO HTTP no PREPARE REMOTO para %s: %v", enterpriseName, transactionID, cityToReserve, httpErr)
-						prepareOverallSuccess = false
-						break
-					}
-
-					var remoteResp schemas.RemotePrepareResponse
-					bodyBytes, _ := io.ReadAll(resp.Body)
-					resp.Body.Close() // Fechar o corpo
-
-					if err := json.Unmarshal(bodyBytes, &remoteResp); err != nil {
-						log.Printf("[%s] TX[%s]: Erro ao deserializar resposta PREPARE REMOTO de %s (Status: %s, Corpo: %s): %v", enterpriseName, transactionID, cityToReserve, resp.Status, string(bodyBytes), err)
-						prepareOverallSuccess = false
-						break
+					_, err := stateMgr.PrepareReservation(transactionID, chosenRoute.VehicleID, chosenRoute.RequestID, windowToReserve, myAPIURL, chosenRoute.Vehicle)
+					if err == nil {
+						// Se chegou aqui, o StateManager já preparou a si mesmo e o worker.
+						preparedParticipants[cityToReserve] = "local"
+						log.Printf("[%s] TX[%s]: SUCESSO PREPARE LOCAL para %s", enterpriseName, transactionID, cityToReserve)
+						continue
 					}
+					// Outros operadores da mesma cidade ainda podem atender o trecho
+					log.Printf("[%s] TX[%s]: FALHA PREPARE LOCAL (via StateManager) para %s: %v. Tentando operadores concorrentes.", enterpriseName, transactionID, cityToReserve, err)
+				}
 
-					if resp.StatusCode == http.StatusOK && remoteResp.Status == schemas.StatusReservationPrepared {
-						log.Printf("[%s] TX[%s]: SUCESSO PREPARE REMOTO para %s", enterpriseName, transactionID, cityToReserve)
-						preparedParticipants[cityToReserve] = remoteAPIURL
-					} else {
-						log.Printf("[%s] TX[%s]: FALHA PREPARE REMOTO para %s. Status: %s, Resposta: %+v", enterpriseName, transactionID, cityToReserve, resp.Status, remoteResp)
-						prepareOverallSuccess = false
-						break
-					}
+				// Reserva REMOTA
+				remoteAPIURL, err := prepareRemoteSegment(transactionID, chosenRoute, segment)
+				if err != nil {
+					log.Printf("[%s] TX[%s]: FALHA PREPARE REMOTO para %s: %v", enterpriseName, transactionID, cityToReserve, err)
+					prepareOverallSuccess = false
+					break // Sai do loop de segmentos se a preparação falhar
 				}
+				preparedParticipants[cityToReserve] = remoteAPIURL
 			}
 
 			// Fase de COMMIT ou ABORT
@@ -251,26 +261,18 @@ func main() {
 				log.Printf("[%s] TX[%s]: FASE DE PREPARAÇÃO GLOBAL SUCESSO. Iniciando COMMIT.", enterpriseName, transactionID)
 				for city, participantTypeOrURL := range preparedParticipants {
 					if participantTypeOrURL == "local" {
-						stateMgr.CommitReservation(transactionID)
-						log.Printf("[%s] TX[%s]: COMMIT LOCAL para %s", enterpriseName, transactionID, city)
+						if _, err := stateMgr.CommitReservation(transactionID); err != nil {
+							log.Printf("[%s] TX[%s]: ERRO no COMMIT LOCAL para %s: %v. A transação pode ficar inconsistente.", enterpriseName, transactionID, city, err)
+						} else {
+							log.Printf("[%s] TX[%s]: COMMIT LOCAL para %s", enterpriseName, transactionID, city)
+						}
 					} else {
 						// Enviar COMMIT REMOTO
 						log.Printf("[%s] TX[%s]: Enviando COMMIT REMOTO para %s (API: %s)", enterpriseName, transactionID, city, participantTypeOrURL)
-						remoteCmdPayload := schemas.RemoteCommitAbortRequest{TransactionID: transactionID}
-						payloadBytes, _ := json.Marshal(remoteCmdPayload)
-						httpClient := &http.Client{Timeout: time.Second * 10}
-						resp, httpErr := httpClient.Post(fmt.Sprintf("%s/2pc_remote/commit", participantTypeOrURL), "application/json", bytes.NewBuffer(payloadBytes))
-						if httpErr != nil {
-							log.Printf("[%s] TX[%s]: ERRO HTTP no COMMIT REMOTO para %s: %v. A transação pode ficar inconsistente.", enterpriseName, transactionID, city, httpErr)
+						if result, err := sendRemoteDecision(participantTypeOrURL, transactionID, true); err != nil {
+							log.Printf("[%s] TX[%s]: ERRO no COMMIT REMOTO para %s: %v. A transação pode ficar inconsistente.", enterpriseName, transactionID, city, err)
 						} else {
-							if resp.StatusCode != http.StatusOK {
-								bodyBytes, _ := io.ReadAll(resp.Body)
-								log.Printf("[%s] TX[%s]: AVISO - COMMIT REMOTO para %s falhou. Status: %s, Corpo: %s. A transação pode ficar inconsistente.", enterpriseName, transactionID, city, resp.Status, string(bodyBytes))
-								resp.Body.Close()
-							} else {
-								resp.Body.Close()
-								log.Printf("[%s] TX[%s]: COMMIT REMOTO para %s enviado com sucesso.", enterpriseName, transactionID, city)
-							}
+							log.Printf("[%s] TX[%s]: COMMIT REMOTO para %s enviado com sucesso (repetido: %t).", enterpriseName, transactionID, city, result.Duplicate)
 						}
 					}
 				}
@@ -299,7 +301,14 @@ func main() {
 						log.Printf("[%s] TX[%s]: ERRO - Falha ao submeter 'RegisterReserve' na blockchain: %v", enterpriseName, transactionID, err)
 					} else {
 						log.Printf("[%s] TX[%s]: SUCESSO - Transação registrada na blockchain.", enterpriseName, transactionID)
-						stateMgr.StartCoordinatingTransaction(transactionID, chosenRoute.VehicleID, chosenRoute.Route)
+						participants := make(map[string]string, len(preparedParticipants))
+						for city, participantTypeOrURL := range preparedParticipants {
+							if participantTypeOrURL == "local" {
+								participantTypeOrURL = myAPIURL
+							}
+							participants[city] = participantTypeOrURL
+						}
+						stateMgr.StartCoordinatingTransaction(transactionID, chosenRoute.VehicleID, chosenRoute.Route, participants)
 					}
 				}
 				publishReservationStatus(chosenRoute.VehicleID, transactionID, "CONFIRMED", "Reserva confirmada com sucesso", &chosenRoute, enterpriseName)
@@ -307,21 +316,18 @@ func main() {
 				log.Printf("[%s] TX[%s]: FASE DE PREPARAÇÃO GLOBAL FALHOU. Iniciando ABORT.", enterpriseName, transactionID)
 				for city, participantTypeOrURL := range preparedParticipants { // Abortar apenas os que foram preparados
 					if participantTypeOrURL == "local" {
-						stateMgr.AbortReservation(transactionID)
-						log.Printf("[%s] TX[%s]: ABORT LOCAL para %s", enterpriseName, transactionID, city)
+						if _, err := stateMgr.AbortReservation(transactionID); err != nil {
+							log.Printf("[%s] TX[%s]: ERRO no ABORT LOCAL para %s: %v.", enterpriseName, transactionID, city, err)
+						} else {
+							log.Printf("[%s] TX[%s]: ABORT LOCAL para %s", enterpriseName, transactionID, city)
+						}
 					} else {
 						// Enviar ABORT REMOTO
 						log.Printf("[%s] TX[%s]: Enviando ABORT REMOTO para %s (API: %s)", enterpriseName, transactionID, city, participantTypeOrURL)
-						// ... (lógica de chamada HTTP POST para /2pc_remote/abort, similar ao commit) ...
-						remoteCmdPayload := schemas.RemoteCommitAbortRequest{TransactionID: transactionID}
-						payloadBytes, _ := json.Marshal(remoteCmdPayload)
-						httpClient := &http.Client{Timeout: time.Second * 10}
-						resp, httpErr := httpClient.Post(fmt.Sprintf("%s/2pc_remote/abort", participantTypeOrURL), "application/json", bytes.NewBuffer(payloadBytes))
-						if httpErr != nil {
-							log.Printf("[%s] TX[%s]: ERRO HTTP no ABORT REMOTO para %s: %v.", enterpriseName, transactionID, city, httpErr)
+						if result, err := sendRemoteDecision(participantTypeOrURL, transactionID, false); err != nil {
+							log.Printf("[%s] TX[%s]: ERRO no ABORT REMOTO para %s: %v.", enterpriseName, transactionID, city, err)
 						} else {
-							resp.Body.Close() // Sempre fechar
-							log.Printf("[%s] TX[%s]: ABORT REMOTO para %s enviado. Status: %s", enterpriseName, transactionID, city, resp.Status)
+							log.Printf("[%s] TX[%s]: ABORT REMOTO para %s enviado. Status: %s", enterpriseName, transactionID, city, result.Status)
 						}
 					}
 				}
@@ -330,17 +336,129 @@ func main() {
 		}
 	}()
 
-	setupWorkerEventListener(stateMgr, enterpriseName, ownedCity)
+	setupWorkerEventListener(shutdownCtx, stateMgr, enterpriseName, ownedCity)
+	setupWorkerRegistry(shutdownCtx, enterpriseName, func(workerID string) {
+		stateMgr.MigrateReservations(workerID)
+	})
+	setupChargingPointInfoListener(shutdownCtx, enterpriseName)
+	startOCPPCentral(shutdownCtx)
 	// Configurar e iniciar o servidor Gin (HTTP)
 	r := gin.Default()
 	setupRouter(r, stateMgr, enterpriseName) // Passar dependências
+	// A divergência é barrada por TestRoutesMatchOpenAPI; aqui só fica o aviso
+	if err := openapi.CheckRoutes(r.Routes()); err != nil {
+		log.Printf("[%s] AVISO: %v", enterpriseName, err)
+	}
 	log.Printf("[%s] Servidor HTTP escutando na porta %s", enterpriseName, enterprisePort)
-	if err := r.Run(":" + enterprisePort); err != nil {
+	if err := runServer(r, enterprisePort); err != nil {
 		log.Fatalf("Falha ao iniciar o servidor Gin: %v", err)
 	}
 
 }
 
+// discoverCandidates retorna os operadores de uma cidade a partir da visão local do Registry.
+// Enquanto a visão não estiver sincronizada, consulta o Registry diretamente.
+func discoverCandidates(city string) ([]schemas.ServiceInfo, error) {
+	if candidates, ok := registryClient.Candidates(city); ok {
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("nenhuma API registrada para cidade '%s'", city)
+		}
+		return candidates, nil
+	}
+
+	log.Printf("[%s] Visão local do Registry ainda não sincronizada. Descobrindo API para '%s' diretamente.", enterpriseName, city)
+	discoveredService, err := registryClient.DiscoverService(city)
+	if err != nil || !discoveredService.Found {
+		return nil, fmt.Errorf("falha ao descobrir API para cidade '%s': %v (found: %v)", city, err, discoveredService.Found)
+	}
+	if len(discoveredService.Candidates) == 0 { // Registry antigo: apenas um serviço por cidade
+		return []schemas.ServiceInfo{{CityManaged: discoveredService.CityName, ApiURL: discoveredService.ApiURL, EnterpriseName: discoveredService.EnterpriseName}}, nil
+	}
+	return discoveredService.Candidates, nil
+}
+
+// prepareRemoteSegment descobre os operadores da cidade do trecho e envia PREPARE a cada um,
+// na ordem definida por OPERATOR_SELECTION, até que um deles aceite. Retorna a URL de quem aceitou.
+func prepareRemoteSegment(transactionID string, chosenRoute schemas.ChosenRouteMsg, segment schemas.RouteSegment) (string, error) {
+	cityToReserve := segment.City
+	candidates, err := discoverCandidates(cityToReserve)
+	if err != nil {
+		return "", err
+	}
+
+	remoteReqPayload := schemas.RemotePrepareRequest{
+		TransactionID:     transactionID,
+		VehicleID:         chosenRoute.VehicleID,
+		RequestID:         chosenRoute.RequestID,
+		City:              cityToReserve, // Importante: enviar a cidade correta
+		ReservationWindow: segment.ReservationWindow,
+		CoordinatorURL:    myAPIURL, // Adiciona a URL da própria API como coordenadora
+		Vehicle:           chosenRoute.Vehicle,
+	}
+
+	for _, candidate := range rankCandidates(candidates, operatorSelection) {
+		if candidate.ApiURL == myAPIURL {
+			continue // Esta própria instância já foi tentada localmente
+		}
+		remoteAPIURL := candidate.ApiURL
+		log.Printf("[%s] TX[%s]: Iniciando PREPARE REMOTO para %s em %s (Operador: %s, Instância: %s, API: %s)", enterpriseName, transactionID, chosenRoute.VehicleID, cityToReserve, candidate.EnterpriseName, candidate.InstanceID, remoteAPIURL)
+
+		peer := newPeerClient(remoteAPIURL, schemas.NegotiateVersion(candidate.ProtocolVersion), 10*time.Second)
+		remoteResp, err := peer.Prepare(context.Background(), remoteReqPayload)
+		if err == nil && remoteResp.Status == schemas.StatusReservationPrepared {
+			log.Printf("[%s] TX[%s]: SUCESSO PREPARE REMOTO para %s com %s", enterpriseName, transactionID, cityToReserve, candidate.EnterpriseName)
+			return remoteAPIURL, nil
+		}
+		var apiErr *client.APIError
+		if err != nil && !errors.As(err, &apiErr) {
+			log.Printf("[%s] TX[%s]: ERRO no PREPARE REMOTO para %s em %s: %v", enterpriseName, transactionID, cityToReserve, remoteAPIURL, err)
+			continue // Tenta a próxima instância/operador
+		}
+		log.Printf("[%s] TX[%s]: PREPARE REMOTO rejeitado por %s (%s). Erro: %v, Resposta: %+v", enterpriseName, transactionID, candidate.EnterpriseName, remoteAPIURL, err, remoteResp)
+	}
+
+	return "", fmt.Errorf("nenhum operador aceitou a reserva na cidade '%s'", cityToReserve)
+}
+
+// Tentativas de entregar COMMIT ou ABORT a um participante remoto
+const (
+	decisionAttempts = 3
+	decisionBackoff  = time.Second
+)
+
+// sendRemoteDecision entrega o COMMIT (commit true) ou o ABORT ao participante remoto.
+// Repete a requisição, com espera crescente, em falhas de rede e nas recusas que o
+// participante marca como repetíveis (PREPARE ainda em curso); as demais recusas
+// (transação abortada, confirmada ou desconhecida) são definitivas e retornam de imediato.
+func sendRemoteDecision(participantURL, transactionID string, commit bool) (schemas.RemoteResult, error) {
+	peer := newPeerClient(participantURL, peerVersion(participantURL), 10*time.Second)
+	var (
+		result schemas.RemoteResult
+		err    error
+	)
+	backoff := decisionBackoff
+	for attempt := 1; attempt <= decisionAttempts; attempt++ {
+		if commit {
+			result, err = peer.Commit(context.Background(), transactionID)
+		} else {
+			result, err = peer.Abort(context.Background(), transactionID)
+		}
+		var apiErr *client.APIError
+		if err == nil || (errors.As(err, &apiErr) && !result.Retryable) {
+			break
+		}
+		if attempt < decisionAttempts {
+			log.Printf("[%s] TX[%s]: Falha repetível na decisão para %s (tentativa %d/%d): %v", enterpriseName, transactionID, participantURL, attempt, decisionAttempts, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if err != nil && result.Code != "" {
+		return result, fmt.Errorf("%w (código %s)", err, result.Code)
+	}
+	return result, err
+}
+
 // setupRouter configura as rotas HTTP, incluindo os endpoints para 2PC remoto
 func setupRouter(r *gin.Engine, sm *state.StateManager, entName string) {
 	// Exemplo de endpoint de status da cidade gerenciada
@@ -354,16 +472,13 @@ func setupRouter(r *gin.Engine, sm *state.StateManager, entName string) {
 		})
 	})
 
-	r.POST("/report-segment-completion", func(c *gin.Context) {
+	// Rotas chamadas apenas por outras APIs exigem TLS mútuo e requisição assinada
+	r.POST("/report-segment-completion", requirePeerAuth, func(c *gin.Context) {
 		handleSegmentCompletion(c, sm, entName)
 	})
 
-	r.POST("/cost-update", func(c *gin.Context) {
-		handleCostUpdate(c, entName)
-	})
-
 	// Endpoints para serem chamados por outras APIs (participantes remotos do 2PC)
-	remoteGroup := r.Group("/2pc_remote")
+	remoteGroup := r.Group("/2pc_remote", requirePeerAuth)
 	{
 		remoteGroup.POST("/prepare", func(c *gin.Context) {
 			handleRemotePrepare(c, sm, entName)
@@ -381,6 +496,21 @@ func setupRouter(r *gin.Engine, sm *state.StateManager, entName string) {
 	r.GET("/ping", handleQueryPing)
 
 	r.POST("/transactions/:id/register-payment", handleRegisterPayment)
+	r.GET("/transactions/:id/geojson", func(c *gin.Context) {
+		handleRouteGeoJSON(c, sm)
+	})
+	r.GET("/charging-points/nearest", handleNearestChargingPoint)
+	r.GET("/workers", handleListWorkers)
+	r.GET("/workers/:id/schedule", handleWorkerSchedule)
+	r.GET("/schedule/free-slots", handleFreeSlots)
+	r.GET("/schedule/window", handleWindowAvailability)
+	r.GET("/metrics/mqtt", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"listeners": mqtt.Stats()})
+	})
+	r.GET("/openapi.json", openapi.Handler())
+
+	// Pontos de recarga OCPP 1.6-J (WebSocket)
+	r.GET("/ocpp/:chargePointId", ocppCentral.Handler())
 }
 
 // Handlers para os endpoints /2pc_remote/* (podem ficar aqui ou em um arquivo separado)
@@ -432,21 +562,30 @@ func handleRegisterPayment(c *gin.Context) {
 
 func handleSegmentCompletion(c *gin.Context, sm *state.StateManager, localEntName string) {
 	var payload schemas.CostUpdatePayload
-	if err := c.ShouldBindJSON(&payload); err != nil {
+	env, err := bindMessage(c, schemas.MsgSegmentCompletion, &payload)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "payload inválido", "details": err.Error()})
 		return
 	}
 
 	log.Printf("[%s] TX[%s]: Recebido relatório de conclusão do segmento '%s' via HTTP", localEntName, payload.TransactionID, payload.SegmentCity)
 
-	allDone, totalCost := sm.RecordSegmentCompletion(payload)
+	// Só a API que reservou o trecho pode relatar a conclusão dele
+	if participantURL, ok := sm.SegmentParticipant(payload.TransactionID, payload.SegmentCity); ok && !peerOwnsURL(c, participantURL) {
+		reason := fmt.Sprintf("'%s' não é a API participante do trecho '%s'", c.GetString("peerEnterprise"), payload.SegmentCity)
+		log.Printf("[%s] TX[%s]: Relatório de conclusão RECUSADO: %s", localEntName, payload.TransactionID, reason)
+		respondMessage(c, http.StatusForbidden, schemas.MsgRemoteResult, env.Version, schemas.RemoteResult{Status: schemas.StatusRejected, TransactionID: payload.TransactionID, Code: schemas.TxErrForbidden, Reason: reason})
+		return
+	}
+
+	allDone, totalCost, totalEnergy := sm.RecordSegmentCompletion(payload)
 
 	if allDone {
 		// Chame a função unificada!
-		go finalizeJourney(sm, payload.TransactionID, totalCost, localEntName)
+		go finalizeJourney(sm, payload.TransactionID, totalCost, totalEnergy, localEntName)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "segment report received"})
+	respondMessage(c, http.StatusOK, schemas.MsgRemoteResult, env.Version, schemas.RemoteResult{Status: "segment report received", TransactionID: payload.TransactionID})
 }
 
 // handlePing invoca a função Ping do chaincode para escrever no ledger.
@@ -551,93 +690,117 @@ func handleGetTransactionDetails(c *gin.Context) {
 	var history []map[string]interface{} // Use a generic type if HistoricState does not exist
 	json.Unmarshal(historyBytes, &history)
 
-	// 3. Retornar ambos os resultados
-	c.JSON(http.StatusOK, gin.H{
+	// 3. Obter os desfechos já registrados dos trechos (opcional)
+	var segments []schemas.SegmentOutcome
+	if segmentsBytes, err := contract.EvaluateTransaction("QuerySegments", transactionID); err != nil {
+		log.Printf("Erro ao consultar 'QuerySegments' para TX %s: %v", transactionID, err)
+	} else {
+		json.Unmarshal(segmentsBytes, &segments)
+	}
+
+	// 4. Retornar os resultados
+	response := gin.H{
 		"currentState": currentState,
 		"history":      history,
-	})
+	}
+	if len(segments) > 0 {
+		response["segments"] = segments
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func handleRemotePrepare(c *gin.Context, sm *state.StateManager, localEntName string) {
 	var req schemas.RemotePrepareRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: "Payload inválido: " + err.Error()})
+	env, err := bindMessage(c, schemas.MsgRemotePrepare, &req)
+	if err != nil {
+		respondMessage(c, http.StatusBadRequest, schemas.MsgRemotePrepareResponse, env.Version, schemas.RemotePrepareResponse{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: schemas.TxErrInvalidPayload, Reason: "Payload inválido: " + err.Error()})
 		return
 	}
 	// Validação importante: esta API deve ser a "dona" da req.City
 	if req.City != ownedCity { // ownedCity é a variável global desta instância
 		errMsg := fmt.Sprintf("Requisição de PREPARE REMOTO para cidade %s, mas esta API gerencia %s", req.City, ownedCity)
 		log.Printf("[%s] TX[%s]: %s", localEntName, req.TransactionID, errMsg)
-		c.JSON(http.StatusBadRequest, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: errMsg})
+		respondMessage(c, http.StatusBadRequest, schemas.MsgRemotePrepareResponse, env.Version, schemas.RemotePrepareResponse{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: schemas.TxErrWrongCity, Reason: errMsg})
 		return
 	}
 
-	log.Printf("[%s] TX[%s]: Recebido PREPARE REMOTO para VehicleID %s na cidade %s", localEntName, req.TransactionID, req.VehicleID, req.City)
-	success, err := sm.PrepareReservation(req.TransactionID, req.VehicleID, req.RequestID, req.ReservationWindow, req.CoordinatorURL) // Passa a janela
+	// O coordenador é a empresa autenticada: a URL vem do registro dela, não do corpo
+	coordinatorURL, ok := peerAPIURL(c, req.CoordinatorURL)
+	if !ok {
+		errMsg := fmt.Sprintf("A empresa '%s' não tem a API '%s' registrada no Registry", c.GetString("peerEnterprise"), req.CoordinatorURL)
+		log.Printf("[%s] TX[%s]: %s", localEntName, req.TransactionID, errMsg)
+		respondMessage(c, http.StatusForbidden, schemas.MsgRemotePrepareResponse, env.Version, schemas.RemotePrepareResponse{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: schemas.TxErrForbidden, Reason: errMsg})
+		return
+	}
 
-	if !success || err != nil {
+	log.Printf("[%s] TX[%s]: Recebido PREPARE REMOTO para VehicleID %s na cidade %s", localEntName, req.TransactionID, req.VehicleID, req.City)
+	duplicate, err := sm.PrepareReservation(req.TransactionID, req.VehicleID, req.RequestID, req.ReservationWindow, coordinatorURL, req.Vehicle) // Passa a janela
+	if err != nil {
 		log.Printf("[%s] TX[%s]: FALHA PREPARE REMOTO (interno): %v", localEntName, req.TransactionID, err)
-		c.JSON(http.StatusConflict, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: err.Error()})
+		txErr := asTxError(req.TransactionID, err)
+		respondMessage(c, txErrorStatus(c, txErr), schemas.MsgRemotePrepareResponse, env.Version, schemas.RemotePrepareResponse{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: txErr.Code, Retryable: txErr.Retryable(), Reason: txErr.Reason})
 		return
 	}
 	log.Printf("[%s] TX[%s]: SUCESSO PREPARE REMOTO (interno)", localEntName, req.TransactionID)
-	c.JSON(http.StatusOK, schemas.RemotePrepareResponse{Status: schemas.StatusReservationPrepared, TransactionID: req.TransactionID})
+	respondMessage(c, http.StatusOK, schemas.MsgRemotePrepareResponse, env.Version, schemas.RemotePrepareResponse{Status: schemas.StatusReservationPrepared, TransactionID: req.TransactionID, Duplicate: duplicate})
 }
 
-func handleCostUpdate(c *gin.Context, localEntName string) {
-	var payload schemas.CostUpdatePayload // Supondo que esta struct exista em schemas/company.go
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload", "details": err.Error()})
-		return
-	}
+func handleRemoteCommit(c *gin.Context, sm *state.StateManager, localEntName string) {
+	handleRemoteDecision(c, sm, schemas.MsgRemoteCommit, localEntName, "COMMIT", state.TxCommitted, sm.CommitReservation)
+}
 
-	log.Printf("[%s] TX[%s]: Recebido UPDATE DE CUSTO da cidade '%s'. Custo: %.2f", localEntName, payload.TransactionID, payload.SegmentCity, payload.Cost)
+func handleRemoteAbort(c *gin.Context, sm *state.StateManager, localEntName string) {
+	handleRemoteDecision(c, sm, schemas.MsgRemoteAbort, localEntName, "ABORT", state.TxAborted, sm.AbortReservation)
+}
 
-	// Integração com a blockchain: chama o chaincode para atualizar o custo do segmento
-	gw, err := newGateway()
+// handleRemoteDecision atende /2pc_remote/commit e /2pc_remote/abort. A resposta traz o
+// estado alcançado (duplicate se a transação já estava nele) ou REJECTED com o código da
+// recusa: 404 para transação desconhecida, 409 para transição ilegal e 503 (repetível)
+// com o PREPARE ainda em curso. Só o coordenador que fez o PREPARE decide a transação:
+// outra empresa recebe 403.
+func handleRemoteDecision(c *gin.Context, sm *state.StateManager, msgType, localEntName, operation, reached string, apply func(transactionID string) (bool, error)) {
+	var req schemas.RemoteCommitAbortRequest
+	env, err := bindMessage(c, msgType, &req)
 	if err != nil {
-		log.Printf("[%s] TX[%s]: Erro ao conectar ao gateway da Fabric: %v", localEntName, payload.TransactionID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao conectar na rede blockchain"})
+		respondMessage(c, http.StatusBadRequest, schemas.MsgRemoteResult, env.Version, schemas.RemoteResult{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: schemas.TxErrInvalidPayload, Reason: "Payload inválido: " + err.Error()})
 		return
 	}
-	defer gw.Close()
-
-	network := gw.GetNetwork(fabricChannelName)
-	contract := network.GetContract(fabricChaincodeName)
-
-	// Converte o custo para string
-	costStr := fmt.Sprintf("%.2f", payload.Cost)
-	// Define um valor padrão para energia consumida, pois não vem do worker
-	energyConsumedStr := "0.0"
-
-	// Chama a função correta do novo smart contract: EndCharging
-	log.Printf("[%s] TX[%s]: Submetendo 'UpdateChargingSegment' na blockchain com Custo: %s, Energia Consumida: %s", localEntName, payload.TransactionID, costStr, energyConsumedStr)
-	_, err = contract.SubmitTransaction("UpdateChargingSegment", payload.TransactionID, costStr, energyConsumedStr)
+	log.Printf("[%s] TX[%s]: Recebido %s REMOTO", localEntName, req.TransactionID, operation)
+	if coordinatorURL, ok := sm.GetCoordinatorURL(req.TransactionID); ok && !peerOwnsURL(c, coordinatorURL) {
+		reason := fmt.Sprintf("'%s' não é o coordenador da transação", c.GetString("peerEnterprise"))
+		log.Printf("[%s] TX[%s]: %s REMOTO RECUSADO: %s", localEntName, req.TransactionID, operation, reason)
+		respondMessage(c, http.StatusForbidden, schemas.MsgRemoteResult, env.Version, schemas.RemoteResult{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: schemas.TxErrForbidden, Reason: reason})
+		return
+	}
+	duplicate, err := apply(req.TransactionID)
 	if err != nil {
-		log.Printf("[%s] TX[%s]: ERRO ao submeter 'EndCharging' na blockchain: %v", localEntName, payload.TransactionID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao finalizar recarga na blockchain", "details": err.Error()})
+		txErr := asTxError(req.TransactionID, err)
+		respondMessage(c, txErrorStatus(c, txErr), schemas.MsgRemoteResult, env.Version, schemas.RemoteResult{Status: schemas.StatusRejected, TransactionID: req.TransactionID, Code: txErr.Code, Retryable: txErr.Retryable(), Reason: txErr.Reason})
 		return
 	}
+	respondMessage(c, http.StatusOK, schemas.MsgRemoteResult, env.Version, schemas.RemoteResult{Status: reached, TransactionID: req.TransactionID, Duplicate: duplicate})
 }
 
-func handleRemoteCommit(c *gin.Context, sm *state.StateManager, localEntName string) {
-	var req schemas.RemoteCommitAbortRequest
-	if err := c.ShouldBindJSON(&req); err != nil { /* ... erro ... */
-		return
+// asTxError trata um erro inesperado do StateManager como falha temporária dos workers:
+// só uma recusa explícita (NO_CAPACITY) diz que não há posto na janela.
+func asTxError(transactionID string, err error) *state.TxError {
+	var txErr *state.TxError
+	if errors.As(err, &txErr) {
+		return txErr
 	}
-	log.Printf("[%s] TX[%s]: Recebido COMMIT REMOTO", localEntName, req.TransactionID)
-	sm.CommitReservation(req.TransactionID)
-	c.JSON(http.StatusOK, gin.H{"status": schemas.StatusReservationCommitted, "transaction_id": req.TransactionID})
+	return &state.TxError{TransactionID: transactionID, Code: schemas.TxErrWorkerUnavailable, Reason: err.Error()}
 }
 
-func handleRemoteAbort(c *gin.Context, sm *state.StateManager, localEntName string) {
-	var req schemas.RemoteCommitAbortRequest
-	if err := c.ShouldBindJSON(&req); err != nil { /* ... erro ... */
-		return
+// txErrorStatus escolhe o status HTTP da recusa; nas repetíveis, sugere quando tentar de novo.
+func txErrorStatus(c *gin.Context, txErr *state.TxError) int {
+	switch {
+	case txErr.Retryable():
+		c.Header("Retry-After", "1")
+		return http.StatusServiceUnavailable
+	case txErr.Code == schemas.TxErrUnknownTransaction:
+		return http.StatusNotFound
 	}
-	log.Printf("[%s] TX[%s]: Recebido ABORT REMOTO", localEntName, req.TransactionID)
-	sm.AbortReservation(req.TransactionID)
-	c.JSON(http.StatusOK, gin.H{"status": "ABORTED", "transaction_id": req.TransactionID})
+	return http.StatusConflict
 }
 
 // Função auxiliar para publicar o status da reserva (ajustada para incluir enterpriseName nos logs)
@@ -655,89 +818,196 @@ func publishReservationStatus(vehicleID, transactionID, status, message string,
 			statusPayload.ConfirmedRoute = chosenRoute.Route
 		}
 	}
-	payloadBytes, _ := json.Marshal(statusPayload)
-	mqtt.Publish(topic, string(payloadBytes))
+	publishMessage(topic, schemas.MsgReservationStatus, vehicleVersion(vehicleID), statusPayload)
 	log.Printf("[%s] TX[%s]: Status da reserva '%s' publicado para VehicleID %s no tópico %s.", pubEnterpriseName, transactionID, status, vehicleID, topic)
 }
 
-// Função para escutar eventos dos ChargingPointWorkers e acionar o cost-update
-func setupWorkerEventListener(sm *state.StateManager, enterpriseName, ownedCity string) {
+// Função para escutar eventos dos ChargingPointWorkers e registrar o desfecho dos trechos
+func setupWorkerEventListener(ctx context.Context, sm *state.StateManager, enterpriseName, ownedCity string) {
 	eventTopic := fmt.Sprintf("enterprise/%s/cp/+/event", enterpriseName)
-	eventChan := mqtt.StartListening(eventTopic, 10)
+	// Eventos geram cobranças: a fila é dez vezes a padrão, e os descartes aparecem em /metrics/mqtt
+	events, err := mqtt.Listen(ctx, eventTopic, mqtt.ListenOptions{BufferSize: 100, Overflow: mqtt.OverflowQueue, MaxQueue: 10 * mqtt.DefaultMaxQueue})
+	if err != nil {
+		log.Fatalf("[%s] %v", enterpriseName, err)
+	}
+	eventChan := events.C
 
 	go func() {
 		for payload := range eventChan {
-			var event map[string]interface{}
-			if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			env, err := schemas.ParseMessage([]byte(payload))
+			if err != nil {
 				log.Printf("Erro ao decodificar evento do worker: %v", err)
 				continue
 			}
 
-			if event["command"] == "VEHICLE_PASSED_AND_CHARGED" {
-				transactionID, _ := event["transaction_id"].(string)
-				cost, _ := event["cost"].(float64)
+			switch env.Type {
+			case schemas.MsgMeterValues:
+				var reading schemas.MeterValuesEvent
+				if err := env.DecodePayload(&reading); err != nil {
+					log.Printf("[%s] Leitura de medidor inválida: %v", enterpriseName, err)
+					continue
+				}
+				if !fromCurrentWorker(sm, enterpriseName, env.Type, reading.TransactionID, reading.WorkerID) {
+					continue
+				}
+				log.Printf("[%s] TX[%s]: Medidor do worker '%s': %.3f kWh, %.1f kW, SOC %.1f%%", enterpriseName, reading.TransactionID, reading.WorkerID, reading.EnergyKWh, reading.PowerKW, reading.StateOfChargePct)
 
-				if transactionID != "" {
-					sm.FinalizeReservation(transactionID, "charged")
+			case schemas.MsgVehicleArrived, schemas.MsgVehiclePluggedIn, schemas.MsgVehicleUnplugged:
+				var event schemas.SessionEvent
+				if err := env.DecodePayload(&event); err != nil {
+					log.Printf("[%s] Evento %s inválido: %v", enterpriseName, env.Type, err)
+					continue
+				}
+				if !fromCurrentWorker(sm, enterpriseName, env.Type, event.TransactionID, event.WorkerID) {
+					continue
 				}
+				log.Printf("[%s] TX[%s]: %s no worker '%s' (conector %d) em %s", enterpriseName, event.TransactionID, env.Type, event.WorkerID, event.ConnectorID, event.Timestamp.Format(time.RFC3339))
 
-				isCoordinator := sm.IsCoordinator(transactionID)
+			case schemas.MsgVehicleNoShow:
+				var event schemas.NoShowEvent
+				if err := env.DecodePayload(&event); err != nil {
+					log.Printf("[%s] Evento de não comparecimento inválido: %v", enterpriseName, err)
+					continue
+				}
+				if !fromCurrentWorker(sm, enterpriseName, env.Type, event.TransactionID, event.WorkerID) {
+					continue
+				}
+				log.Printf("[%s] TX[%s]: Veículo não compareceu ao worker '%s' em %ds. Reserva liberada.", enterpriseName, event.TransactionID, event.WorkerID, event.GracePeriodSeconds)
+				sm.FinalizeReservation(event.TransactionID, schemas.StatusReservationNoShow)
+				completeSegment(sm, enterpriseName, schemas.CostUpdatePayload{
+					TransactionID: event.TransactionID,
+					SegmentCity:   ownedCity,
+					Status:        schemas.SegmentNoShow,
+				})
+
+			case schemas.MsgVehiclePassedAndCharged:
+				var event schemas.VehiclePassedAndChargedEvent
+				if err := env.DecodePayload(&event); err != nil {
+					log.Printf("[%s] Evento de cobrança inválido: %v", enterpriseName, err)
+					continue
+				}
+				if !fromCurrentWorker(sm, enterpriseName, env.Type, event.TransactionID, event.WorkerID) {
+					continue
+				}
+				transactionID, cost := event.TransactionID, event.Cost
+				// Cobra a energia medida e a ociosidade pelas tarifas desta API
+				idleFee := math.Round(event.IdleMinutes*idleFeePerMinute*100) / 100
+				if event.EnergyKWh > 0 || idleFee > 0 {
+					cost = math.Round((event.EnergyKWh*pricePerKWh+idleFee)*100) / 100
+				}
+				status := schemas.SegmentCharged
+				if idleFee > 0 {
+					status = schemas.SegmentChargedWithIdleFee
+				}
+				log.Printf("[%s] TX[%s]: Recarga concluída no worker '%s'. Energia: %.3f kWh, Ociosidade: %.1f min (%.2f), Custo: %.2f", enterpriseName, transactionID, event.WorkerID, event.EnergyKWh, event.IdleMinutes, idleFee, cost)
+				sm.FinalizeReservation(transactionID, schemas.StatusReservationCharged)
 
-				costPayload := schemas.CostUpdatePayload{
+				completeSegment(sm, enterpriseName, schemas.CostUpdatePayload{
 					TransactionID: transactionID,
 					SegmentCity:   ownedCity, // A cidade deste segmento é a cidade que esta API gerencia
 					Cost:          cost,
-				}
+					EnergyKWh:     event.EnergyKWh,
+					Status:        status,
+					IdleFee:       idleFee,
+				})
+			}
+		}
+	}()
+}
 
-				if isCoordinator {
-					// Se sou o coordenador, processo o evento localmente
-					handleSegmentCompletionLocal(sm, enterpriseName, costPayload)
-				} else {
-					// Se não sou o coordenador, reporto para a URL do coordenador
-					coordinatorURL, found := sm.GetCoordinatorURL(transactionID)
-					if !found || coordinatorURL == "" {
-						log.Printf("[%s] TX[%s]: PARTICIPANTE - Não foi possível determinar o coordenador para reportar conclusão.", enterpriseName, transactionID)
-						continue
-					}
+// fromCurrentWorker confere se o evento veio do worker que tem a reserva. Depois de uma
+// transferência, os eventos do worker anterior não encerram nem cobram o trecho.
+func fromCurrentWorker(sm *state.StateManager, enterpriseName, msgType, transactionID, workerID string) bool {
+	current, found := sm.ReservationWorker(transactionID)
+	if !found || current == workerID {
+		return true
+	}
+	log.Printf("[%s] TX[%s]: %s do worker '%s' ignorado: a reserva está no worker '%s'.", enterpriseName, transactionID, msgType, workerID, current)
+	return false
+}
 
-					go func() {
-						reportURL := fmt.Sprintf("%s/report-segment-completion", coordinatorURL)
-						body, _ := json.Marshal(costPayload)
-						resp, err := http.Post(reportURL, "application/json", bytes.NewBuffer(body))
-						if err != nil {
-							log.Printf("[%s] TX[%s]: Falha ao reportar conclusão para %s: %v", enterpriseName, transactionID, reportURL, err)
-							return
-						}
-						defer resp.Body.Close()
-						if resp.StatusCode != http.StatusOK {
-							log.Printf("[%s] TX[%s]: Coordenador retornou status %d ao reportar conclusão.", enterpriseName, transactionID, resp.StatusCode)
-						} else {
-							log.Printf("[%s] TX[%s]: Conclusão do segmento reportada com sucesso ao coordenador.", enterpriseName, transactionID)
-						}
-					}()
-				}
-			}
+// completeSegment registra o desfecho do segmento desta cidade na blockchain e depois o
+// entrega ao coordenador da transação: localmente, se for esta API, ou pela API
+// coordenadora. O registro vem antes para que o EndCharging do coordenador não concorra
+// com ele no mesmo bloco. Não bloqueia quem chama.
+func completeSegment(sm *state.StateManager, enterpriseName string, payload schemas.CostUpdatePayload) {
+	go func() {
+		if err := recordSegmentOnLedger(payload); err != nil {
+			log.Printf("[%s] TX[%s]: ERRO ao registrar o segmento na blockchain: %v", enterpriseName, payload.TransactionID, err)
 		}
+		reportSegment(sm, enterpriseName, payload)
 	}()
 }
 
+// reportSegment entrega o desfecho do segmento ao coordenador da transação.
+func reportSegment(sm *state.StateManager, enterpriseName string, payload schemas.CostUpdatePayload) {
+	transactionID := payload.TransactionID
+	if sm.IsCoordinator(transactionID) {
+		// Se sou o coordenador, processo o evento localmente
+		handleSegmentCompletionLocal(sm, enterpriseName, payload)
+		return
+	}
+	// Se não sou o coordenador, reporto para a URL do coordenador
+	coordinatorURL, found := sm.GetCoordinatorURL(transactionID)
+	if !found || coordinatorURL == "" {
+		log.Printf("[%s] TX[%s]: PARTICIPANTE - Não foi possível determinar o coordenador para reportar conclusão.", enterpriseName, transactionID)
+		return
+	}
+
+	peer := newPeerClient(coordinatorURL, peerVersion(coordinatorURL), 10*time.Second)
+	if _, err := peer.ReportSegmentCompletion(context.Background(), payload); err != nil {
+		log.Printf("[%s] TX[%s]: Falha ao reportar conclusão para %s: %v", enterpriseName, transactionID, coordinatorURL, err)
+	} else {
+		log.Printf("[%s] TX[%s]: Conclusão do segmento reportada com sucesso ao coordenador.", enterpriseName, transactionID)
+	}
+}
+
+// recordSegmentOnLedger registra o desfecho do segmento (CHARGED, CHARGED_WITH_IDLE_FEE
+// ou NO_SHOW) com UpdateChargingSegment.
+func recordSegmentOnLedger(payload schemas.CostUpdatePayload) error {
+	status := payload.Status
+	if status == "" {
+		status = schemas.SegmentCharged // Relatórios no formato legado não informam o desfecho
+	}
+
+	gw, err := newGateway()
+	if err != nil {
+		return fmt.Errorf("falha ao conectar ao gateway da Fabric: %w", err)
+	}
+	defer gw.Close()
+
+	contract := gw.GetNetwork(fabricChannelName).GetContract(fabricChaincodeName)
+	_, err = submitWithRetry(contract, "UpdateChargingSegment",
+		payload.TransactionID,
+		payload.SegmentCity,
+		status,
+		fmt.Sprintf("%.2f", payload.Cost),
+		fmt.Sprintf("%.3f", payload.EnergyKWh),
+		fmt.Sprintf("%.2f", payload.IdleFee),
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao submeter 'UpdateChargingSegment': %w", err)
+	}
+	return nil
+}
+
 func handleSegmentCompletionLocal(sm *state.StateManager, localEntName string, payload schemas.CostUpdatePayload) {
 	log.Printf("[%s] TX[%s]: Recebido relatório de conclusão do segmento LOCAL '%s'", localEntName, payload.TransactionID, payload.SegmentCity)
 
-	allDone, totalCost := sm.RecordSegmentCompletion(payload)
+	allDone, totalCost, totalEnergy := sm.RecordSegmentCompletion(payload)
 
 	if allDone {
 		// Chame a mesma função unificada!
-		go finalizeJourney(sm, payload.TransactionID, totalCost, localEntName)
+		go finalizeJourney(sm, payload.TransactionID, totalCost, totalEnergy, localEntName)
 	}
 }
 
-func finalizeJourney(sm *state.StateManager, transactionID string, totalCost float64, enterpriseName string) {
-	log.Printf("[%s] TX[%s]: Finalizando jornada. Custo total: %.2f", enterpriseName, transactionID, totalCost)
+func finalizeJourney(sm *state.StateManager, transactionID string, totalCost, totalEnergy float64, enterpriseName string) {
+	log.Printf("[%s] TX[%s]: Finalizando jornada. Custo total: %.2f, Energia total: %.3f kWh", enterpriseName, transactionID, totalCost, totalEnergy)
 
 	// 1. Finalizar na Blockchain
 	costStr := fmt.Sprintf("%.2f", totalCost)
-	energyConsumedStr := "0.0" // Pode ser ajustado se tiver essa info
+	energyConsumedStr := fmt.Sprintf("%.3f", totalEnergy)
 
 	gw, err := newGateway()
 	if err != nil {
@@ -749,7 +1019,7 @@ func finalizeJourney(sm *state.StateManager, transactionID string, totalCost flo
 	network := gw.GetNetwork(fabricChannelName)
 	contract := network.GetContract(fabricChaincodeName)
 
-	_, err = contract.SubmitTransaction("EndCharging", transactionID, costStr, energyConsumedStr)
+	_, err = submitWithRetry(contract, "EndCharging", transactionID, costStr, energyConsumedStr)
 	if err != nil {
 		log.Printf("[%s] TX[%s]: ERRO FINAL ao submeter 'EndCharging': %v", enterpriseName, transactionID, err)
 		// Mesmo com erro na blockchain, ainda tentamos notificar o carro.
@@ -761,9 +1031,14 @@ func finalizeJourney(sm *state.StateManager, transactionID string, totalCost flo
 	vehicleID, found := sm.GetVehicleIDForTransaction(transactionID)
 	if found {
 		finishTopic := fmt.Sprintf("car/journey/finished/%s", vehicleID)
-		finishPayload := fmt.Sprintf(`{"status":"completed", "transaction_id":"%s", "message":"Seu trajeto foi concluído com sucesso!"}`, transactionID)
-
-		mqtt.Publish(finishTopic, finishPayload)
+		finishPayload := schemas.JourneyFinished{
+			Status:        "completed",
+			TransactionID: transactionID,
+			Message:       "Seu trajeto foi concluído com sucesso!",
+			TotalCost:     totalCost,
+			TotalEnergy:   totalEnergy,
+		}
+		publishMessage(finishTopic, schemas.MsgJourneyFinished, vehicleVersion(vehicleID), finishPayload)
 		log.Printf("[%s] TX[%s]: Mensagem de finalização de trajeto enviada para o veículo %s.", enterpriseName, transactionID, vehicleID)
 	} else {
 		log.Printf("[%s] TX[%s]: AVISO - Não foi possível encontrar o VehicleID para notificar o fim do trajeto.", enterpriseName, transactionID)
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/4r7hur0/PBL-2/api/openapi"
+	"github.com/gin-gonic/gin"
+)
+
+// As rotas registradas por setupRouter precisam coincidir com api/openapi/openapi.json.
+func TestRoutesMatchOpenAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	setupRouter(r, nil, "test") // Só registra as rotas; os handlers não são chamados
+	if err := openapi.CheckRoutes(r.Routes()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/router"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// Localização e conectores anunciados por cada charging point worker desta empresa
+	chargingPoints    = make(map[string]schemas.ChargingPointInfo)
+	chargingPointsAt  = make(map[string]time.Time) // Quando a info de cada worker foi recebida
+	chargingPointsMux sync.RWMutex
+)
+
+// setupChargingPointInfoListener escuta as mensagens retidas de info (localização e
+// ocupação dos conectores) dos workers.
+func setupChargingPointInfoListener(ctx context.Context, enterpriseName string) {
+	infoTopic := fmt.Sprintf("enterprise/%s/cp/+/info", enterpriseName)
+	// Só a info mais recente importa; mensagens antigas podem ser descartadas
+	info, err := mqtt.Listen(ctx, infoTopic, mqtt.ListenOptions{BufferSize: 10, Overflow: mqtt.OverflowDropOldest})
+	if err != nil {
+		log.Printf("[%s] AVISO: Localização dos workers indisponível: %v", enterpriseName, err)
+		return
+	}
+	infoChan := info.C
+
+	go func() {
+		for payload := range infoChan {
+			var info schemas.ChargingPointInfo
+			if _, err := schemas.DecodeMessage([]byte(payload), schemas.MsgChargingPointInfo, &info); err != nil || info.WorkerID == "" {
+				log.Printf("[%s] Erro ao decodificar info do worker: %v. Mensagem: %s", enterpriseName, err, payload)
+				continue
+			}
+			chargingPointsMux.Lock()
+			chargingPoints[info.WorkerID] = info
+			chargingPointsAt[info.WorkerID] = time.Now().UTC()
+			chargingPointsMux.Unlock()
+			log.Printf("[%s] Info do worker '%s' atualizada: localização %+v, %d conector(es)", enterpriseName, info.WorkerID, info.Location, len(info.Connectors))
+		}
+	}()
+}
+
+// workerProtocolVersion retorna a versão de mensagem anunciada pelo worker (0 se desconhecido).
+func workerProtocolVersion(workerID string) int {
+	chargingPointsMux.RLock()
+	defer chargingPointsMux.RUnlock()
+	return chargingPoints[workerID].ProtocolVersion
+}
+
+// workerSchedule retorna os conectores e reservas anunciados pelo worker (nil se desconhecidos).
+func workerSchedule(workerID string) []schemas.ConnectorStatus {
+	chargingPointsMux.RLock()
+	defer chargingPointsMux.RUnlock()
+	return chargingPoints[workerID].Connectors
+}
+
+// handleNearestChargingPoint responde GET /charging-points/nearest?lat=..&lon=..
+func handleNearestChargingPoint(c *gin.Context) {
+	origin, err := schemas.ParseGeoPoint(c.Query("lat"), c.Query("lon"))
+	if err != nil || origin == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parâmetros 'lat' e 'lon' são obrigatórios e devem ser coordenadas válidas"})
+		return
+	}
+
+	chargingPointsMux.RLock()
+	defer chargingPointsMux.RUnlock()
+
+	var (
+		nearest  schemas.NearestChargingPointResponse
+		foundAny bool
+	)
+	for _, cp := range chargingPoints {
+		if cp.Location == nil {
+			continue
+		}
+		distance := router.HaversineKm(*origin, *cp.Location)
+		if !foundAny || distance < nearest.DistanceKm {
+			nearest = schemas.NearestChargingPointResponse{ChargingPoint: cp, City: ownedCity, DistanceKm: distance}
+			foundAny = true
+		}
+	}
+
+	if !foundAny {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nenhum ponto de recarga com localização conhecida"})
+		return
+	}
+	c.JSON(http.StatusOK, nearest)
+}
+
+// handleRouteGeoJSON responde GET /transactions/:id/geojson com a rota confirmada em GeoJSON.
+// Apenas a API coordenadora da transação conhece a rota completa.
+func handleRouteGeoJSON(c *gin.Context, sm *state.StateManager) {
+	transactionID := c.Param("id")
+	route, found := sm.GetCoordinatedRoute(transactionID)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rota não encontrada. Consulte a API coordenadora da transação."})
+		return
+	}
+
+	// Completa coordenadas ausentes com o que o grafo atual conhece
+	graph := cityDir.Graph()
+	for i := range route {
+		if route[i].Location == nil {
+			route[i].Location, _ = graph.Location(route[i].City)
+		}
+	}
+
+	c.Header("Content-Type", "application/geo+json")
+	c.JSON(http.StatusOK, router.RouteToGeoJSON(transactionID, route))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/router"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// cityDirectory mantém o conjunto de cidades ativas e o grafo de estradas,
+// montados a partir da lista de serviços do Registry.
+type cityDirectory struct {
+	mu         sync.RWMutex
+	graph      *router.RoadGraph
+	httpClient *http.Client
+}
+
+func newCityDirectory() *cityDirectory {
+	return &cityDirectory{
+		graph:      router.NewRoadGraph([]string{ownedCity}, ownLocations()),
+		httpClient: newPeerHTTPClient(2 * time.Second),
+	}
+}
+
+// Graph retorna o grafo de estradas mais recente.
+func (d *cityDirectory) Graph() *router.RoadGraph {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.graph
+}
+
+// Refresh lê os serviços da visão local do Registry (ou do próprio Registry, se a visão
+// ainda não estiver pronta) e mantém apenas as cidades cuja API responde.
+func (d *cityDirectory) Refresh() error {
+	services, ok := registryClient.CachedServices()
+	if !ok {
+		var err error
+		if services, err = registryClient.ListServices(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		liveMu    sync.Mutex
+		live      = []string{ownedCity} // A cidade desta API está sempre disponível
+		locations = ownLocations()
+	)
+	for _, service := range services {
+		if service.CityManaged == ownedCity {
+			continue
+		}
+		wg.Add(1)
+		go func(service schemas.ServiceInfo) {
+			defer wg.Done()
+			if !d.isOnline(service) {
+				log.Printf("[%s] Cidade '%s' ignorada: API de '%s' (%s) está offline.", enterpriseName, service.CityManaged, service.EnterpriseName, service.ApiURL)
+				return
+			}
+			liveMu.Lock()
+			live = append(live, service.CityManaged)
+			if service.Location != nil {
+				locations[service.CityManaged] = *service.Location
+			}
+			liveMu.Unlock()
+		}(service)
+	}
+	wg.Wait()
+
+	graph := router.NewRoadGraph(live, locations)
+	d.mu.Lock()
+	d.graph = graph
+	d.mu.Unlock()
+
+	log.Printf("[%s] Lista de cidades atualizada: %v", enterpriseName, graph.Cities())
+	return nil
+}
+
+// ownLocations retorna o mapa inicial de coordenadas, contendo apenas a cidade desta API.
+func ownLocations() map[string]schemas.GeoPoint {
+	locations := make(map[string]schemas.GeoPoint)
+	if ownedCityLocation != nil {
+		locations[ownedCity] = *ownedCityLocation
+	}
+	return locations
+}
+
+func (d *cityDirectory) isOnline(service schemas.ServiceInfo) bool {
+	resp, err := d.httpClient.Get(fmt.Sprintf("%s/status", service.ApiURL))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// StartRefreshing atualiza a lista de cidades periodicamente em background.
+func (d *cityDirectory) StartRefreshing(interval time.Duration) {
+	go func() {
+		for {
+			if err := d.Refresh(); err != nil {
+				log.Printf("[%s] AVISO: Falha ao atualizar lista de cidades a partir do Registry: %v", enterpriseName, err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// cityRefreshInterval lê CITY_REFRESH_INTERVAL (ex: "30s"), com padrão de 30 segundos.
+func cityRefreshInterval() time.Duration {
+	raw := os.Getenv("CITY_REFRESH_INTERVAL")
+	if raw == "" {
+		return 30 * time.Second
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		log.Printf("AVISO: CITY_REFRESH_INTERVAL inválido ('%s'). Usando 30s.", raw)
+		return 30 * time.Second
+	}
+	return interval
+}
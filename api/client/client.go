@@ -0,0 +1,210 @@
+// Package client é o cliente Go da API REST das empresas, descrita em api/openapi/openapi.json.
+// É usado pelas APIs entre si (2PC remoto e relatórios de custo) e por quem integra com elas.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Client fala com uma API de empresa.
+type Client struct {
+	BaseURL    string // Ex: https://solatlantico:8080
+	HTTPClient *http.Client
+
+	// Sender identifica quem envia nos envelopes; Version é a versão de mensagem negociada
+	// com a API de destino (0: formato legado).
+	Sender  string
+	Version int
+
+	// SignRequest, se definido, assina as requisições das rotas entre APIs
+	// (/2pc_remote/*, /report-segment-completion).
+	SignRequest func(req *http.Request, body []byte) error
+}
+
+// New cria um cliente para a API em baseURL. httpClient nil usa um cliente com timeout de 10s.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: httpClient,
+		Version:    schemas.ProtocolVersion,
+	}
+}
+
+// APIError é uma resposta com status diferente de 2xx.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API respondeu %s: %s", e.Status, e.Body)
+}
+
+// --- Rotas entre APIs (mensagens com envelope, requisições assinadas) ---
+
+// Prepare pede à API participante que reserve um trecho (fase 1 do 2PC). Uma rejeição
+// (status 4xx) retorna a resposta decodificada junto com um *APIError.
+func (c *Client) Prepare(ctx context.Context, req schemas.RemotePrepareRequest) (schemas.RemotePrepareResponse, error) {
+	var resp schemas.RemotePrepareResponse
+	err := c.sendMessage(ctx, "/2pc_remote/prepare", schemas.MsgRemotePrepare, req, schemas.MsgRemotePrepareResponse, &resp)
+	return resp, err
+}
+
+// Commit confirma a reserva preparada da transação (fase 2 do 2PC).
+func (c *Client) Commit(ctx context.Context, transactionID string) (schemas.RemoteResult, error) {
+	var resp schemas.RemoteResult
+	err := c.sendMessage(ctx, "/2pc_remote/commit", schemas.MsgRemoteCommit, schemas.RemoteCommitAbortRequest{TransactionID: transactionID}, schemas.MsgRemoteResult, &resp)
+	return resp, err
+}
+
+// Abort desfaz a reserva preparada da transação (fase 2 do 2PC).
+func (c *Client) Abort(ctx context.Context, transactionID string) (schemas.RemoteResult, error) {
+	var resp schemas.RemoteResult
+	err := c.sendMessage(ctx, "/2pc_remote/abort", schemas.MsgRemoteAbort, schemas.RemoteCommitAbortRequest{TransactionID: transactionID}, schemas.MsgRemoteResult, &resp)
+	return resp, err
+}
+
+// ReportSegmentCompletion informa à API coordenadora o custo de um trecho concluído.
+func (c *Client) ReportSegmentCompletion(ctx context.Context, payload schemas.CostUpdatePayload) (schemas.RemoteResult, error) {
+	var resp schemas.RemoteResult
+	err := c.sendMessage(ctx, "/report-segment-completion", schemas.MsgSegmentCompletion, payload, schemas.MsgRemoteResult, &resp)
+	return resp, err
+}
+
+// --- Rotas públicas ---
+
+// Status retorna a disponibilidade da cidade gerenciada pela API.
+func (c *Client) Status(ctx context.Context) (StatusResponse, error) {
+	var resp StatusResponse
+	err := c.doJSON(ctx, http.MethodGet, "/status", &resp)
+	return resp, err
+}
+
+// Transaction retorna o estado atual e o histórico de uma transação no ledger.
+func (c *Client) Transaction(ctx context.Context, transactionID string) (TransactionDetails, error) {
+	var resp TransactionDetails
+	err := c.doJSON(ctx, http.MethodGet, "/transactions/"+url.PathEscape(transactionID), &resp)
+	return resp, err
+}
+
+// RegisterPayment registra no ledger o pagamento de uma transação concluída.
+func (c *Client) RegisterPayment(ctx context.Context, transactionID string) (OperationResult, error) {
+	var resp OperationResult
+	err := c.doJSON(ctx, http.MethodPost, "/transactions/"+url.PathEscape(transactionID)+"/register-payment", &resp)
+	return resp, err
+}
+
+// Ping grava um ping no ledger.
+func (c *Client) Ping(ctx context.Context) (OperationResult, error) {
+	var resp OperationResult
+	err := c.doJSON(ctx, http.MethodPost, "/ping", &resp)
+	return resp, err
+}
+
+// LastPing retorna o último ping gravado no ledger.
+func (c *Client) LastPing(ctx context.Context) (map[string]interface{}, error) {
+	var resp map[string]interface{}
+	err := c.doJSON(ctx, http.MethodGet, "/ping", &resp)
+	return resp, err
+}
+
+// NearestChargingPoint retorna o ponto de recarga da empresa mais próximo das coordenadas.
+func (c *Client) NearestChargingPoint(ctx context.Context, point schemas.GeoPoint) (schemas.NearestChargingPointResponse, error) {
+	var resp schemas.NearestChargingPointResponse
+	query := url.Values{}
+	query.Set("lat", fmt.Sprint(point.Latitude))
+	query.Set("lon", fmt.Sprint(point.Longitude))
+	err := c.doJSON(ctx, http.MethodGet, "/charging-points/nearest?"+query.Encode(), &resp)
+	return resp, err
+}
+
+// --- Transporte ---
+
+// sendMessage envia payload como mensagem msgType e decodifica a resposta (se respType
+// não for vazio) como mensagem respType, na versão que a API devolver.
+func (c *Client) sendMessage(ctx context.Context, path, msgType string, payload any, respType string, out any) error {
+	body, err := schemas.EncodeMessage(msgType, c.Sender, c.Version, payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.SignRequest != nil {
+		if err := c.SignRequest(req, body); err != nil {
+			return fmt.Errorf("falha ao assinar requisição: %w", err)
+		}
+	}
+
+	resp, respBody, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	var decodeErr error
+	if respType != "" && len(respBody) > 0 {
+		_, decodeErr = schemas.DecodeMessage(respBody, respType, out)
+	}
+	if apiErr := checkStatus(resp, respBody); apiErr != nil {
+		return apiErr
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("resposta inválida de %s: %w", path, decodeErr)
+	}
+	return nil
+}
+
+// doJSON faz uma requisição sem corpo e decodifica a resposta JSON em out.
+func (c *Client) doJSON(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, respBody, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if apiErr := checkStatus(resp, respBody); apiErr != nil {
+		return apiErr
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("resposta inválida de %s: %w", path, err)
+	}
+	return nil
+}
+
+// do envia a requisição e lê o corpo inteiro da resposta, já fechado.
+func (c *Client) do(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("falha ao ler resposta: %w", err)
+	}
+	return resp, body, nil
+}
+
+func checkStatus(resp *http.Response, body []byte) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &APIError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(body))}
+}
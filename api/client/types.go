@@ -0,0 +1,26 @@
+package client
+
+import "github.com/4r7hur0/PBL-2/schemas"
+
+// StatusResponse é a resposta de GET /status.
+type StatusResponse struct {
+	Enterprise         string `json:"enterprise"`
+	ManagedCity        string `json:"managed_city"`
+	MaxPosts           int    `json:"max_posts"`
+	ActiveReservations int    `json:"active_reservations"`
+}
+
+// TransactionDetails é a resposta de GET /transactions/{id}.
+type TransactionDetails struct {
+	CurrentState schemas.TransactionState `json:"currentState"`
+	History      []map[string]interface{} `json:"history"`
+	Segments     []schemas.SegmentOutcome `json:"segments,omitempty"` // Desfechos dos trechos já registrados
+	Warning      string                   `json:"warning,omitempty"`  // Presente quando o histórico não pôde ser lido
+}
+
+// OperationResult é a resposta das operações que gravam no ledger (ping, pagamento).
+type OperationResult struct {
+	Status        string `json:"status"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Message       string `json:"message"`
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path"
+	"time"
 
+	rc "github.com/4r7hur0/PBL-2/registry/registry_client"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
@@ -17,6 +22,26 @@ var (
 	fabricChaincodeName = "pbl3"
 )
 
+// ledgerSubmitAttempts é quantas vezes uma transação invalidada por conflito MVCC é submetida.
+const ledgerSubmitAttempts = 4
+
+// submitWithRetry submete a transação e a repete, com espera crescente, quando ela é
+// invalidada por MVCC_READ_CONFLICT: outra transação do mesmo bloco escreveu uma chave
+// que ela leu. Os demais erros são devolvidos na hora.
+func submitWithRetry(contract *client.Contract, name string, args ...string) ([]byte, error) {
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		result, err := contract.SubmitTransaction(name, args...)
+		var commitErr *client.CommitError
+		if err == nil || !errors.As(err, &commitErr) || commitErr.Code != peer.TxValidationCode_MVCC_READ_CONFLICT || attempt == ledgerSubmitAttempts {
+			return result, err
+		}
+		log.Printf("[Fabric] '%s' invalidada por conflito MVCC (tentativa %d/%d). Repetindo em %v.", name, attempt, ledgerSubmitAttempts, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 func newGateway() (*client.Gateway, error) {
 	// Pega todas as configurações necessárias das variáveis de ambiente
 	peerEndpoint := os.Getenv("FABRIC_PEER_ENDPOINT")
@@ -62,6 +87,27 @@ func newGateway() (*client.Gateway, error) {
 	return gw, nil
 }
 
+// loadMSPCredentials monta, a partir da identidade MSP usada na Fabric, as credenciais
+// com que esta API assina seu registro no Registry e as chamadas a outras APIs.
+func loadMSPCredentials() (rc.Credentials, error) {
+	mspID := os.Getenv("FABRIC_MSP_ID")
+	certPath := os.Getenv("FABRIC_CERT_PATH")
+	keyPath := os.Getenv("FABRIC_KEY_PATH")
+	if mspID == "" || certPath == "" || keyPath == "" {
+		return rc.Credentials{}, fmt.Errorf("FABRIC_MSP_ID, FABRIC_CERT_PATH e FABRIC_KEY_PATH são obrigatórias")
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return rc.Credentials{}, fmt.Errorf("falha ao ler arquivo de certificado de identidade (%s): %w", certPath, err)
+	}
+	sign, err := newSign(keyPath)
+	if err != nil {
+		return rc.Credentials{}, err
+	}
+	return rc.Credentials{MSPID: mspID, CertificatePEM: certPEM, Sign: sign}, nil
+}
+
 func loadCertificate(certPath string) (credentials.TransportCredentials, error) {
 	certPEM, err := os.ReadFile(certPath)
 	if err != nil {
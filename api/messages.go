@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// Versão de mensagem usada por cada veículo, aprendida da última mensagem recebida dele.
+// As respostas ao carro usam a mesma versão; veículos desconhecidos recebem o formato legado.
+var (
+	vehicleVersions   = make(map[string]int)
+	vehicleVersionsMu sync.Mutex
+)
+
+func rememberVehicleVersion(vehicleID string, version int) {
+	vehicleVersionsMu.Lock()
+	vehicleVersions[vehicleID] = version
+	vehicleVersionsMu.Unlock()
+}
+
+func vehicleVersion(vehicleID string) int {
+	vehicleVersionsMu.Lock()
+	defer vehicleVersionsMu.Unlock()
+	return vehicleVersions[vehicleID] // Zero (legado) se nunca visto
+}
+
+// peerVersion negocia a versão de mensagem com outra API a partir do que ela anunciou
+// no Registry. APIs fora da visão local recebem o formato legado.
+func peerVersion(apiURL string) int {
+	services, _ := registryClient.CachedServices()
+	for _, service := range services {
+		if service.ApiURL == apiURL {
+			return schemas.NegotiateVersion(service.ProtocolVersion)
+		}
+	}
+	return schemas.LegacyVersion
+}
+
+// publishMessage serializa o payload na versão informada e o publica no tópico.
+func publishMessage(topic, msgType string, version int, payload any) {
+	message, err := schemas.EncodeMessage(msgType, enterpriseName, version, payload)
+	if err != nil {
+		log.Printf("[%s] Erro ao serializar %s para %s: %v", enterpriseName, msgType, topic, err)
+		return
+	}
+	mqtt.Publish(topic, string(message))
+}
+
+// bindMessage lê o corpo da requisição como mensagem do tipo informado. Em caso de erro,
+// o envelope ainda traz a versão (quando legível) para a resposta de erro.
+func bindMessage(c *gin.Context, msgType string, v any) (schemas.Envelope, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return schemas.Envelope{}, fmt.Errorf("falha ao ler corpo: %w", err)
+	}
+	env, err := schemas.DecodeMessage(body, msgType, v)
+	// Nas rotas entre APIs, o remetente do envelope é a empresa autenticada (requirePeerAuth)
+	if enterprise := c.GetString("peerEnterprise"); err == nil && enterprise != "" && env.Sender != "" && env.Sender != enterprise {
+		return env, fmt.Errorf("remetente '%s' difere da empresa autenticada '%s'", env.Sender, enterprise)
+	}
+	return env, err
+}
+
+// respondMessage responde com o payload na mesma versão da requisição.
+func respondMessage(c *gin.Context, status int, msgType string, version int, payload any) {
+	body, err := schemas.EncodeMessage(msgType, enterpriseName, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "falha ao serializar resposta", "details": err.Error()})
+		return
+	}
+	c.Data(status, "application/json", body)
+}
@@ -1,21 +1,249 @@
 package mqtt
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-func StartListening(topic string, bufferSize int) chan string {
-	// Create a buffered channel to hold incoming messages
-	messageChannel := make(chan string, bufferSize)
+// OverflowPolicy define o que fazer quando o consumidor de um Listener não acompanha as mensagens.
+type OverflowPolicy int
+
+const (
+	// OverflowQueue guarda as mensagens que não cabem no buffer em uma fila do próprio
+	// Listener, repassada ao consumidor por uma goroutine. O handler do paho nunca
+	// bloqueia, então um consumidor lento não atrasa as demais assinaturas. A fila tem até
+	// ListenOptions.MaxQueue mensagens; com ela cheia, a que acabou de chegar é descartada
+	// e contada em Dropped (veja ListenerStats.Queued).
+	OverflowQueue OverflowPolicy = iota
+	// OverflowDropOldest descarta a mensagem mais antiga do buffer para abrir espaço.
+	OverflowDropOldest
+	// OverflowDropNewest descarta a mensagem que acabou de chegar.
+	OverflowDropNewest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropNewest:
+		return "drop_newest"
+	default:
+		return "queue"
+	}
+}
+
+// DefaultMaxQueue é o tamanho da fila de OverflowQueue quando ListenOptions.MaxQueue é zero.
+const DefaultMaxQueue = 1000
+
+// ListenOptions configura um Listener.
+type ListenOptions struct {
+	BufferSize int
+	Overflow   OverflowPolicy
+	MaxQueue   int // OverflowQueue: mensagens na fila além do buffer (padrão DefaultMaxQueue)
+}
+
+// Listener entrega em C as mensagens de um tópico. C é fechado quando o contexto
+// passado a Listen é cancelado, depois de cancelada a assinatura.
+type Listener struct {
+	C <-chan string
+
+	topic    string
+	policy   OverflowPolicy
+	maxQueue int
+	ch       chan string
+	mu       sync.Mutex // Protege queue e closed e serializa o fechamento de ch
+	closed   bool
+	queue    []string      // OverflowQueue: mensagens que não couberam no buffer, em ordem
+	wake     chan struct{} // Avisa forward que a fila recebeu mensagens
+	dropped  atomic.Uint64
+	done     <-chan struct{}
+}
+
+// ListenerStats resume o estado de um Listener ativo.
+type ListenerStats struct {
+	Topic    string `json:"topic"`
+	Policy   string `json:"policy"`
+	Buffered int    `json:"buffered"`
+	Capacity int    `json:"capacity"`
+	Queued   int    `json:"queued"` // OverflowQueue: mensagens aguardando espaço no buffer
+	Dropped  uint64 `json:"dropped"`
+}
+
+var (
+	activeListeners   = make(map[*Listener]struct{})
+	activeListenersMu sync.Mutex
+)
+
+// Listen assina o tópico e entrega as mensagens em um Listener até ctx ser cancelado.
+func Listen(ctx context.Context, topic string, opts ListenOptions) (*Listener, error) {
+	if opts.BufferSize < 0 {
+		opts.BufferSize = 0
+	}
+	if opts.MaxQueue <= 0 {
+		opts.MaxQueue = DefaultMaxQueue
+	}
+	ch := make(chan string, opts.BufferSize)
+	l := &Listener{C: ch, topic: topic, policy: opts.Overflow, maxQueue: opts.MaxQueue, ch: ch, wake: make(chan struct{}, 1), done: ctx.Done()}
+
+	release, err := subscribe(topic, l.handle)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao assinar %s: %w", topic, err)
+	}
+
+	activeListenersMu.Lock()
+	activeListeners[l] = struct{}{}
+	activeListenersMu.Unlock()
 
-	// Subscribe to the specified topic
 	go func() {
-		Subscribe(topic, func(client mqtt.Client, msg mqtt.Message) {
-			message := string(msg.Payload())
-			//fmt.Printf("Received message: %s from topic: %s\n", message, msg.Topic())
-			messageChannel <- message
-		})
+		l.forward() // Retorna quando ctx é cancelado
+		release()   // Os demais Listeners do tópico continuam assinados
+
+		activeListenersMu.Lock()
+		delete(activeListeners, l)
+		activeListenersMu.Unlock()
+
+		l.mu.Lock()
+		l.closed = true
+		l.queue = nil
+		close(l.ch) // Só esta goroutine envia fora de mu, então ninguém mais escreve em ch
+		l.mu.Unlock()
 	}()
+	return l, nil
+}
+
+// handle é o handler do paho: aplica a política de overflow ao entregar a mensagem.
+// Nunca bloqueia, para não segurar a goroutine de entrega do paho.
+func (l *Listener) handle(_ mqtt.Client, msg mqtt.Message) {
+	message := string(msg.Payload())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+
+	if l.policy == OverflowQueue && len(l.queue) > 0 {
+		l.enqueue(message) // Mantém a ordem atrás das que já esperam
+		return
+	}
+	select {
+	case l.ch <- message:
+		return
+	default:
+	}
+
+	switch l.policy {
+	case OverflowDropNewest:
+		l.drop("mais recente")
+	case OverflowDropOldest:
+		select {
+		case <-l.ch: // Descarta a mais antiga
+			l.drop("mais antiga")
+		default: // O consumidor esvaziou o buffer nesse meio tempo
+		}
+		select {
+		case l.ch <- message:
+		default:
+			l.drop("mais recente") // Buffer de tamanho zero sem consumidor esperando
+		}
+	default:
+		l.enqueue(message)
+	}
+}
+
+// enqueue guarda a mensagem na fila de OverflowQueue e acorda forward. Com a fila cheia,
+// a mensagem é descartada. Chamada com mu.
+func (l *Listener) enqueue(message string) {
+	if len(l.queue) >= l.maxQueue {
+		l.drop("mais recente")
+		return
+	}
+	l.queue = append(l.queue, message)
+	select {
+	case l.wake <- struct{}{}:
+	default: // Já há um aviso pendente
+	}
+}
+
+// forward repassa a fila de OverflowQueue ao consumidor, esperando espaço em ch fora do
+// handler do paho. Retorna quando o contexto do Listener é cancelado.
+func (l *Listener) forward() {
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 {
+			l.mu.Unlock()
+			select {
+			case <-l.wake:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		message := l.queue[0]
+		l.mu.Unlock()
+
+		select {
+		case l.ch <- message:
+		case <-l.done:
+			return
+		}
+
+		l.mu.Lock()
+		l.queue[0] = ""
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+	}
+}
+
+func (l *Listener) drop(which string) {
+	if total := l.dropped.Add(1); total == 1 || total%100 == 0 {
+		log.Printf("MQTT: Consumidor de %s lento; mensagem %s descartada (%d no total).", l.topic, which, total)
+	}
+}
+
+// Dropped retorna quantas mensagens foram descartadas por falta de espaço.
+func (l *Listener) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// Stats retorna as métricas de todos os Listeners ativos, ordenadas por tópico.
+func Stats() []ListenerStats {
+	activeListenersMu.Lock()
+	defer activeListenersMu.Unlock()
+
+	stats := make([]ListenerStats, 0, len(activeListeners))
+	for l := range activeListeners {
+		l.mu.Lock()
+		queued := len(l.queue)
+		l.mu.Unlock()
+		stats = append(stats, ListenerStats{
+			Topic:    l.topic,
+			Policy:   l.policy.String(),
+			Buffered: len(l.ch),
+			Capacity: cap(l.ch),
+			Queued:   queued,
+			Dropped:  l.Dropped(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Topic < stats[j].Topic })
+	return stats
+}
 
-	return messageChannel
+// StartListening mantém a API antiga: escuta o tópico durante toda a vida do processo,
+// com a política OverflowQueue.
+func StartListening(topic string, bufferSize int) <-chan string {
+	l, err := Listen(context.Background(), topic, ListenOptions{BufferSize: bufferSize, Overflow: OverflowQueue})
+	if err != nil {
+		log.Printf("MQTT: %v", err)
+		ch := make(chan string)
+		close(ch)
+		return ch
+	}
+	return l.C
 }
@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListenerOverflowPolicies(t *testing.T) {
+	// Cada caso publica 1..5 com o consumidor parado e só então lê o canal
+	tests := []struct {
+		name        string
+		opts        ListenOptions
+		want        []string
+		wantDropped uint64
+	}{
+		{
+			name: "queue guarda tudo em ordem",
+			opts: ListenOptions{BufferSize: 2, Overflow: OverflowQueue},
+			want: []string{"1", "2", "3", "4", "5"},
+		},
+		{
+			name: "queue sem buffer",
+			opts: ListenOptions{BufferSize: 0, Overflow: OverflowQueue},
+			want: []string{"1", "2", "3", "4", "5"},
+		},
+		{
+			name:        "queue com a fila cheia descarta as mais recentes",
+			opts:        ListenOptions{BufferSize: 1, Overflow: OverflowQueue, MaxQueue: 2},
+			want:        []string{"1", "2", "3"},
+			wantDropped: 2,
+		},
+		{
+			name:        "drop_oldest mantém as mais recentes",
+			opts:        ListenOptions{BufferSize: 2, Overflow: OverflowDropOldest},
+			want:        []string{"4", "5"},
+			wantDropped: 3,
+		},
+		{
+			name:        "drop_newest mantém as mais antigas",
+			opts:        ListenOptions{BufferSize: 2, Overflow: OverflowDropNewest},
+			want:        []string{"1", "2"},
+			wantDropped: 3,
+		},
+		{
+			name:        "drop_newest sem buffer descarta tudo",
+			opts:        ListenOptions{BufferSize: 0, Overflow: OverflowDropNewest},
+			want:        nil,
+			wantDropped: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newFakeBroker(t)
+			topic := "enterprise/e/cp/" + tt.opts.Overflow.String() + "/event"
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			l, err := Listen(ctx, topic, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, message := range []string{"1", "2", "3", "4", "5"} {
+				delivered := make(chan struct{})
+				go func() {
+					broker.deliver(topic, []byte(message))
+					close(delivered)
+				}()
+				select {
+				case <-delivered:
+				case <-time.After(time.Second):
+					t.Fatalf("handler bloqueou na mensagem %s", message)
+				}
+			}
+
+			var got []string
+			for len(got) < len(tt.want) {
+				select {
+				case message := <-l.C:
+					got = append(got, message)
+				case <-time.After(time.Second):
+					t.Fatalf("recebidas %v, esperadas %v", got, tt.want)
+				}
+			}
+			select {
+			case message := <-l.C:
+				t.Fatalf("mensagem extra %q", message)
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("recebidas %v, esperadas %v", got, tt.want)
+			}
+			if l.Dropped() != tt.wantDropped {
+				t.Fatalf("descartadas %d, esperadas %d", l.Dropped(), tt.wantDropped)
+			}
+
+			cancel()
+			select {
+			case _, open := <-l.C:
+				if open {
+					t.Fatal("canal recebeu mensagem após o cancelamento")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("canal não foi fechado após o cancelamento")
+			}
+		})
+	}
+}
+
+func TestListenersShareSubscription(t *testing.T) {
+	broker := newFakeBroker(t)
+	const topic = "enterprise/e/cp/+/event"
+	subscribed := func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		_, ok := broker.handlers[topic]
+		return ok
+	}
+	receive := func(l *Listener, want string) {
+		t.Helper()
+		select {
+		case got := <-l.C:
+			if got != want {
+				t.Fatalf("recebida %q, esperada %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("mensagem %q não entregue", want)
+		}
+	}
+	closed := func(l *Listener) {
+		t.Helper()
+		for {
+			select {
+			case _, open := <-l.C:
+				if !open {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatal("canal não foi fechado após o cancelamento")
+			}
+		}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	first, err := Listen(ctx1, topic, ListenOptions{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Listen(ctx2, topic, ListenOptions{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.deliver("enterprise/e/cp/w1/event", []byte("1"))
+	receive(first, "1")
+	receive(second, "1")
+
+	// Sair o primeiro não tira a assinatura do segundo
+	cancel1()
+	closed(first)
+	if !subscribed() {
+		t.Fatal("assinatura cancelada no broker com um Listener ainda ativo")
+	}
+	broker.deliver("enterprise/e/cp/w1/event", []byte("2"))
+	receive(second, "2")
+
+	cancel2()
+	closed(second)
+	if subscribed() {
+		t.Fatal("assinatura continua no broker depois que o último Listener saiu")
+	}
+}
@@ -1,33 +1,255 @@
 package mqtt
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 )
 
 var client mqtt.Client
 
+// Config define a conexão com o broker. Veja ConfigFromEnv.
+type Config struct {
+	Broker   string
+	ClientID string // Vazio: gerado aleatoriamente
+	Username string
+	Password string
+
+	// TLS: CACertPath valida o broker; ClientCertPath/ClientKeyPath autenticam este cliente.
+	CACertPath     string
+	ClientCertPath string
+	ClientKeyPath  string
+
+	ConnectRetryInterval time.Duration   // Intervalo entre tentativas de conexão inicial
+	TopicQoS             map[string]byte // Filtro de tópico -> QoS; complementa DefaultTopicQoS
+
+	// Birth é publicada a cada conexão (inclusive reconexões); Will é o last will, publicado
+	// pelo broker se a conexão cair sem Disconnect.
+	Birth *Message
+	Will  *Message
+}
+
+// Message é uma mensagem de presença do cliente (Config.Birth e Config.Will).
+type Message struct {
+	Topic    string
+	Payload  string
+	Retained bool
+}
+
+// DefaultTopicQoS usa QoS 1 para comandos, eventos e respostas de workers e para os sinais
+// de chegada e saída dos carros, que não podem ser perdidos; os demais tópicos usam QoS 0.
+var DefaultTopicQoS = map[string]byte{
+	"car/session/+":             1,
+	"enterprise/+/cp/+/command": 1,
+	"enterprise/+/cp/+/event":   1,
+	"enterprise/+/cp/+/info":    1,
+	"enterprise/+/cp/+/status":  1,
+	"replies/#":                 1,
+}
+
+// ConfigFromEnv lê MQTT_BROKER (padrão: defaultBroker), MQTT_CLIENT_ID, MQTT_USERNAME,
+// MQTT_PASSWORD, MQTT_CA_CERT, MQTT_CLIENT_CERT e MQTT_CLIENT_KEY.
+func ConfigFromEnv(defaultBroker string) Config {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		broker = defaultBroker
+	}
+	return Config{
+		Broker:               broker,
+		ClientID:             os.Getenv("MQTT_CLIENT_ID"),
+		Username:             os.Getenv("MQTT_USERNAME"),
+		Password:             os.Getenv("MQTT_PASSWORD"),
+		CACertPath:           os.Getenv("MQTT_CA_CERT"),
+		ClientCertPath:       os.Getenv("MQTT_CLIENT_CERT"),
+		ClientKeyPath:        os.Getenv("MQTT_CLIENT_KEY"),
+		ConnectRetryInterval: 3 * time.Second,
+	}
+}
+
+// subscription é a assinatura de um tópico no broker, compartilhada por todos os handlers
+// registrados nele. O broker só recebe o UNSUBSCRIBE quando o último handler sai.
+type subscription struct {
+	qos      byte
+	handlers []registeredHandler
+}
+
+type registeredHandler struct {
+	id      uint64
+	handler mqtt.MessageHandler
+}
+
+var (
+	// Assinaturas ativas, refeitas a cada reconexão
+	subscriptions   = make(map[string]*subscription)
+	subscriptionsMu sync.Mutex
+	nextHandlerID   uint64
+	// brokerMu serializa os SUBSCRIBE/UNSUBSCRIBE enviados ao broker, para que um
+	// UNSUBSCRIBE atrasado não desfaça a assinatura de um handler registrado depois.
+	// dispatch não o usa, então as entregas do paho nunca esperam por ele.
+	brokerMu sync.Mutex
+	topicQoS = DefaultTopicQoS
+)
+
+// InitializeMQTT conecta ao broker informado com as demais opções padrão.
 func InitializeMQTT(broker string) {
+	cfg := ConfigFromEnv(broker)
+	cfg.Broker = broker
+	if err := Connect(cfg); err != nil {
+		log.Fatalf("MQTT: %v", err)
+	}
+}
+
+// Connect conecta ao broker, tentando de novo até conseguir. Depois de conectado, o cliente
+// reconecta sozinho e restaura todas as assinaturas feitas com Subscribe/StartListening.
+func Connect(cfg Config) error {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
+	opts.AddBroker(cfg.Broker)
+	if cfg.ClientID == "" {
+		cfg.ClientID = "pbl-" + uuid.New().String()
+	}
+	opts.SetClientID(cfg.ClientID)
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+	if cfg.CACertPath != "" || cfg.ClientCertPath != "" {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if len(cfg.TopicQoS) > 0 {
+		merged := make(map[string]byte, len(DefaultTopicQoS)+len(cfg.TopicQoS))
+		for filter, qos := range DefaultTopicQoS {
+			merged[filter] = qos
+		}
+		for filter, qos := range cfg.TopicQoS {
+			merged[filter] = qos
+		}
+		topicQoS = merged
+	}
 
+	if cfg.Will != nil {
+		opts.SetWill(cfg.Will.Topic, cfg.Will.Payload, QoSFor(cfg.Will.Topic), cfg.Will.Retained)
+	}
+
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(30 * time.Second)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("MQTT: Conexão com o broker perdida: %v. Reconectando...", err)
+	})
+	opts.SetOnConnectHandler(func(_ mqtt.Client) {
+		log.Printf("MQTT: Conectado ao broker %s", cfg.Broker)
+		go func() { // Fora do handler: as publicações e assinaturas aguardam confirmação do broker
+			if cfg.Birth != nil {
+				publish(cfg.Birth.Topic, cfg.Birth.Payload, cfg.Birth.Retained)
+			}
+			resubscribeAll()
+		}()
+	})
+
+	retryInterval := cfg.ConnectRetryInterval
+	if retryInterval <= 0 {
+		retryInterval = 3 * time.Second
+	}
 	client = mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	for {
+		token := client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return nil
+		}
+		log.Printf("MQTT: Broker %s indisponível (%v). Nova tentativa em %s.", cfg.Broker, token.Error(), retryInterval)
+		time.Sleep(retryInterval)
+	}
+}
+
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACertPath != "" {
+		caPEM, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao ler CA do broker (%s): %w", cfg.CACertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("nenhum certificado válido em %s", cfg.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCertPath != "" {
+		keyPair, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao carregar certificado de cliente MQTT: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+	return tlsConfig, nil
+}
+
+// Disconnect encerra a conexão, aguardando até 250ms pelo envio das mensagens pendentes.
+func Disconnect() {
+	if client == nil || !client.IsConnected() {
+		return
 	}
+	client.Disconnect(250)
+	log.Println("MQTT: Desconectado do broker.")
+}
 
-	fmt.Println("MQTT client connected to broker: ", broker)
+// QoSFor retorna o QoS configurado para o tópico (ou filtro de assinatura).
+func QoSFor(topic string) byte {
+	var qos byte
+	for filter, filterQoS := range topicQoS {
+		if topicMatches(filter, topic) && filterQoS > qos {
+			qos = filterQoS
+		}
+	}
+	return qos
+}
+
+// topicMatches diz se topic (que pode ser ele próprio um filtro) é coberto pelo filtro.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
 }
 
 func Publish(topic string, message string) {
+	publish(topic, message, false)
+}
+
+// PublishRetained publica uma mensagem retida, entregue a quem se inscrever depois.
+func PublishRetained(topic string, message string) {
+	publish(topic, message, true)
+}
+
+func publish(topic string, message string, retained bool) {
 	if client == nil {
 		fmt.Println("MQTT client is not initialized")
 		return
 	}
 
-	token := client.Publish(topic, 0, false, message)
+	token := client.Publish(topic, QoSFor(topic), retained, message)
 	token.Wait()
 	if token.Error() != nil {
 		fmt.Printf("Error publishing message: %v\n", token.Error())
@@ -37,24 +259,130 @@ func Publish(topic string, message string) {
 }
 
 func Subscribe(topic string, handler mqtt.MessageHandler) {
+	if _, err := subscribe(topic, handler); err != nil {
+		fmt.Printf("Error subscribing to topic %s: %v\n", topic, err)
+	} else {
+		fmt.Printf("Subscribed to topic: %s\n", topic)
+	}
+}
+
+// subscribe registra o handler no tópico (para ser refeito após reconexões) e, se ele for
+// o primeiro, envia a assinatura ao broker. Se o cliente estiver desconectado, a assinatura
+// é feita quando a conexão voltar. A função retornada remove o handler; o último a sair
+// cancela a assinatura no broker.
+func subscribe(topic string, handler mqtt.MessageHandler) (func(), error) {
 	if client == nil {
-		fmt.Println("MQTT client is not initialized")
-		return
+		return nil, fmt.Errorf("cliente MQTT não inicializado")
 	}
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
 
-	token := client.Subscribe(topic, 0, handler)
-	token.Wait()
-	if token.Error() != nil {
-		fmt.Printf("Error subscribing to topic: %v\n", topic)
-	} else {
-		fmt.Printf("Subscribed to topic: %s\n", topic)
+	subscriptionsMu.Lock()
+	sub, ok := subscriptions[topic]
+	if !ok {
+		sub = &subscription{qos: QoSFor(topic)}
+		subscriptions[topic] = sub
+	}
+	nextHandlerID++
+	id := nextHandlerID
+	sub.handlers = append(sub.handlers, registeredHandler{id: id, handler: handler})
+	subscriptionsMu.Unlock()
+	release := func() { removeHandler(topic, id) }
+
+	if ok || !client.IsConnectionOpen() {
+		return release, nil
+	}
+	token := client.Subscribe(topic, sub.qos, dispatch(topic))
+	if token.Wait() && token.Error() != nil {
+		dropHandler(topic, id) // Quem chamou não recebe release; a próxima tentativa registra de novo
+		return nil, token.Error()
 	}
+	return release, nil
 }
 
+// dispatch entrega a mensagem a todos os handlers registrados no tópico.
+func dispatch(topic string) mqtt.MessageHandler {
+	return func(c mqtt.Client, msg mqtt.Message) {
+		subscriptionsMu.Lock()
+		var handlers []registeredHandler
+		if sub, ok := subscriptions[topic]; ok {
+			handlers = slices.Clone(sub.handlers)
+		}
+		subscriptionsMu.Unlock()
+		for _, h := range handlers {
+			h.handler(c, msg)
+		}
+	}
+}
+
+// dropHandler tira o handler do tópico. Retorna true se ele era o último, caso em que a
+// assinatura também sai da lista. Chamada com brokerMu.
+func dropHandler(topic string, id uint64) bool {
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	sub, ok := subscriptions[topic]
+	if !ok {
+		return false
+	}
+	before := len(sub.handlers)
+	sub.handlers = slices.DeleteFunc(sub.handlers, func(h registeredHandler) bool { return h.id == id })
+	if len(sub.handlers) == before || len(sub.handlers) > 0 {
+		return false
+	}
+	delete(subscriptions, topic)
+	return true
+}
+
+// removeHandler tira o handler do tópico e, se não sobrar nenhum, cancela a assinatura no
+// broker. Chamar de novo com o mesmo handler não tem efeito.
+func removeHandler(topic string, id uint64) {
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+	if dropHandler(topic, id) {
+		unsubscribeBroker(topic)
+	}
+}
+
+func resubscribeAll() {
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+
+	subscriptionsMu.Lock()
+	current := make(map[string]byte, len(subscriptions))
+	for topic, sub := range subscriptions {
+		current[topic] = sub.qos
+	}
+	subscriptionsMu.Unlock()
+
+	for topic, qos := range current {
+		token := client.Subscribe(topic, qos, dispatch(topic))
+		if token.Wait() && token.Error() != nil {
+			log.Printf("MQTT: Falha ao restaurar assinatura de %s: %v", topic, token.Error())
+		}
+	}
+	if len(current) > 0 {
+		log.Printf("MQTT: %d assinatura(s) restaurada(s).", len(current))
+	}
+}
+
+// Unsubscribe remove todos os handlers do tópico e cancela a assinatura no broker.
 func Unsubscribe(topic string) {
 	if client == nil {
 		return
 	}
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+	subscriptionsMu.Lock()
+	delete(subscriptions, topic)
+	subscriptionsMu.Unlock()
+	unsubscribeBroker(topic)
+}
+
+// unsubscribeBroker envia o UNSUBSCRIBE do tópico. Chamada com brokerMu.
+func unsubscribeBroker(topic string) {
+	if !client.IsConnectionOpen() {
+		return // A assinatura já saiu da lista e não é refeita na reconexão
+	}
 	if token := client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
 		log.Printf("MQTT: Erro ao cancelar subscrição do tópico %s: %v", topic, token.Error())
 	} else {
@@ -0,0 +1,144 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+)
+
+// Cliente request/reply sobre MQTT. Todas as respostas do processo chegam em um único
+// tópico curinga (<prefixo>/+); o último nível do tópico é o ID de correlação, usado
+// para entregar cada resposta à chamada que a aguarda.
+
+// RPCRequest é implementada pelas mensagens enviadas com Call. O cliente informa o ID de
+// correlação e o tópico onde a resposta deve ser publicada antes de enviar a mensagem.
+type RPCRequest interface {
+	SetReplyTo(correlationID, responseTopic string)
+}
+
+// Requester envia pedidos e associa as respostas pelo ID de correlação.
+type Requester struct {
+	prefix string
+
+	mu         sync.Mutex
+	pending    map[string]chan []byte // Chave: ID de correlação
+	subscribed bool
+}
+
+var (
+	defaultRequester     *Requester
+	defaultRequesterOnce sync.Once
+)
+
+// NewRequester cria um cliente cujas respostas chegam em <responsePrefix>/<correlação>.
+// O prefixo deve ser exclusivo do processo.
+func NewRequester(responsePrefix string) *Requester {
+	return &Requester{
+		prefix:  strings.TrimRight(responsePrefix, "/"),
+		pending: make(map[string]chan []byte),
+	}
+}
+
+// DefaultRequester retorna o cliente request/reply compartilhado pelo processo.
+func DefaultRequester() *Requester {
+	defaultRequesterOnce.Do(func() {
+		defaultRequester = NewRequester("replies/" + uuid.New().String())
+	})
+	return defaultRequester
+}
+
+// ensureSubscribed assina o tópico curinga de respostas na primeira chamada.
+// Se a assinatura falhar, a próxima chamada tenta de novo.
+func (r *Requester) ensureSubscribed() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscribed {
+		return nil
+	}
+	// Assinatura registrada como as demais, para ser refeita após reconexões
+	if _, err := subscribe(r.prefix+"/+", r.handleResponse); err != nil {
+		return fmt.Errorf("falha ao assinar tópico de respostas %s/+: %w", r.prefix, err)
+	}
+	r.subscribed = true
+	log.Printf("MQTT: Respostas de request/reply em %s/+", r.prefix)
+	return nil
+}
+
+func (r *Requester) handleResponse(_ mqtt.Client, msg mqtt.Message) {
+	correlationID := msg.Topic()[strings.LastIndex(msg.Topic(), "/")+1:]
+
+	r.mu.Lock()
+	waiter, ok := r.pending[correlationID]
+	delete(r.pending, correlationID)
+	r.mu.Unlock()
+
+	if !ok {
+		log.Printf("MQTT: Resposta sem pedido pendente (correlação %s), provavelmente após o timeout.", correlationID)
+		return
+	}
+	waiter <- msg.Payload() // Canal com buffer 1: nunca bloqueia o handler do paho
+}
+
+// Encoder serializa o pedido depois que SetReplyTo foi chamado (ex: em um envelope versionado).
+type Encoder func(request RPCRequest) ([]byte, error)
+
+// Request publica o pedido em topic e aguarda a resposta bruta até o fim de ctx.
+// Se encode for nil, o pedido é serializado como JSON puro.
+func (r *Requester) Request(ctx context.Context, topic string, request RPCRequest, encode Encoder) ([]byte, error) {
+	if err := r.ensureSubscribed(); err != nil {
+		return nil, err
+	}
+
+	correlationID := uuid.New().String()
+	request.SetReplyTo(correlationID, r.prefix+"/"+correlationID)
+	if encode == nil {
+		encode = func(request RPCRequest) ([]byte, error) { return json.Marshal(request) }
+	}
+	payload, err := encode(request)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao serializar pedido: %w", err)
+	}
+
+	waiter := make(chan []byte, 1)
+	r.mu.Lock()
+	r.pending[correlationID] = waiter
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, correlationID)
+		r.mu.Unlock()
+	}()
+
+	token := client.Publish(topic, QoSFor(topic), false, payload)
+	if token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("falha ao publicar pedido em %s: %w", topic, token.Error())
+	}
+
+	select {
+	case response := <-waiter:
+		return response, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("sem resposta de %s: %w", topic, ctx.Err())
+	}
+}
+
+// Call envia o pedido e decodifica a resposta no tipo Resp (ex: schemas.PrepareResponse).
+// A resposta pode vir em envelope versionado ou no formato legado.
+func Call[Resp any](ctx context.Context, r *Requester, topic string, request RPCRequest, encode Encoder) (Resp, error) {
+	var response Resp
+	raw, err := r.Request(ctx, topic, request, encode)
+	if err != nil {
+		return response, err
+	}
+	if _, err := schemas.DecodeMessage(raw, "", &response); err != nil {
+		return response, fmt.Errorf("falha ao decodificar resposta de %s: %w", topic, err)
+	}
+	return response, nil
+}
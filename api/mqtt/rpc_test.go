@@ -0,0 +1,241 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeBroker substitui o cliente paho nos testes: entrega cada publicação aos handlers
+// assinados cujo filtro cobre o tópico, como faria o broker. Cada teste começa sem
+// assinaturas registradas.
+type fakeBroker struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	handlers  map[string]mqtt.MessageHandler
+	onPublish func(topic string, payload []byte)
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	broker := &fakeBroker{handlers: make(map[string]mqtt.MessageHandler)}
+	previous := client
+	client = broker
+	subscriptionsMu.Lock()
+	previousSubscriptions := subscriptions
+	subscriptions = make(map[string]*subscription)
+	subscriptionsMu.Unlock()
+	t.Cleanup(func() {
+		client = previous
+		subscriptionsMu.Lock()
+		subscriptions = previousSubscriptions
+		subscriptionsMu.Unlock()
+	})
+	return broker
+}
+
+func (b *fakeBroker) IsConnectionOpen() bool { return true }
+
+func (b *fakeBroker) Subscribe(topic string, _ byte, handler mqtt.MessageHandler) mqtt.Token {
+	b.mu.Lock()
+	b.handlers[topic] = handler
+	b.mu.Unlock()
+	return doneToken{}
+}
+
+func (b *fakeBroker) Unsubscribe(topics ...string) mqtt.Token {
+	b.mu.Lock()
+	for _, topic := range topics {
+		delete(b.handlers, topic)
+	}
+	b.mu.Unlock()
+	return doneToken{}
+}
+
+func (b *fakeBroker) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	var raw []byte
+	switch p := payload.(type) {
+	case []byte:
+		raw = p
+	case string:
+		raw = []byte(p)
+	}
+	if b.onPublish != nil {
+		b.onPublish(topic, raw)
+	}
+	return doneToken{}
+}
+
+// deliver chama os handlers assinados para o tópico, como o paho faz ao receber a mensagem.
+func (b *fakeBroker) deliver(topic string, payload []byte) {
+	b.mu.Lock()
+	var matched []mqtt.MessageHandler
+	for filter, handler := range b.handlers {
+		if topicMatches(filter, topic) {
+			matched = append(matched, handler)
+		}
+	}
+	b.mu.Unlock()
+	for _, handler := range matched {
+		handler(b, fakeMessage{topic: topic, payload: payload})
+	}
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (doneToken) Error() error { return nil }
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (fakeMessage) Duplicate() bool   { return false }
+func (fakeMessage) Qos() byte         { return 1 }
+func (fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string   { return m.topic }
+func (fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte { return m.payload }
+func (fakeMessage) Ack()              {}
+
+type echoRequest struct {
+	Body          string `json:"body"`
+	CorrelationID string `json:"correlation_id"`
+	ResponseTopic string `json:"response_topic"`
+}
+
+func (r *echoRequest) SetReplyTo(correlationID, responseTopic string) {
+	r.CorrelationID = correlationID
+	r.ResponseTopic = responseTopic
+}
+
+type echoResponse struct {
+	Body string `json:"body"`
+}
+
+func TestRequesterCorrelationAndTimeout(t *testing.T) {
+	// reply decide o que o "worker" responde ao pedido recebido
+	tests := []struct {
+		name    string
+		reply   func(b *fakeBroker, req echoRequest)
+		want    string
+		wantErr error
+	}{
+		{
+			name: "resposta no tópico da correlação",
+			reply: func(b *fakeBroker, req echoRequest) {
+				b.deliver(req.ResponseTopic, []byte(`"eco:`+req.Body+`"`))
+			},
+			want: `"eco:ping"`,
+		},
+		{
+			name: "resposta assíncrona",
+			reply: func(b *fakeBroker, req echoRequest) {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					b.deliver(req.ResponseTopic, []byte(`"tarde"`))
+				}()
+			},
+			want: `"tarde"`,
+		},
+		{
+			name: "resposta de outra correlação é ignorada",
+			reply: func(b *fakeBroker, req echoRequest) {
+				b.deliver(req.ResponseTopic+"-outro", []byte(`"errado"`))
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:    "sem resposta",
+			reply:   func(*fakeBroker, echoRequest) {},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newFakeBroker(t)
+			broker.onPublish = func(topic string, payload []byte) {
+				var req echoRequest
+				if err := json.Unmarshal(payload, &req); err != nil {
+					t.Errorf("pedido inválido em %s: %v", topic, err)
+					return
+				}
+				tt.reply(broker, req)
+			}
+			r := NewRequester("replies/test-" + t.Name())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			got, err := r.Request(ctx, "enterprise/e/cp/cp1/command", &echoRequest{Body: "ping"}, nil)
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("erro = %v, esperado %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("erro inesperado: %v", err)
+			} else if string(got) != tt.want {
+				t.Fatalf("resposta = %s, esperada %s", got, tt.want)
+			}
+
+			r.mu.Lock()
+			pending := len(r.pending)
+			r.mu.Unlock()
+			if pending != 0 {
+				t.Fatalf("%d pedido(s) pendente(s) após o retorno", pending)
+			}
+		})
+	}
+}
+
+func TestRequesterConcurrentCallsGetOwnResponse(t *testing.T) {
+	broker := newFakeBroker(t)
+	// Responde em ordem inversa à chegada para misturar as correlações
+	var mu sync.Mutex
+	var received []echoRequest
+	broker.onPublish = func(_ string, payload []byte) {
+		var req echoRequest
+		_ = json.Unmarshal(payload, &req)
+		mu.Lock()
+		received = append(received, req)
+		if len(received) == 3 {
+			for i := len(received) - 1; i >= 0; i-- {
+				body, _ := json.Marshal(echoResponse{Body: received[i].Body})
+				go broker.deliver(received[i].ResponseTopic, body)
+			}
+		}
+		mu.Unlock()
+	}
+	r := NewRequester("replies/test-concurrent")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, body := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := Call[echoResponse](ctx, r, "enterprise/e/cp/cp1/command", &echoRequest{Body: body}, nil)
+			if err != nil {
+				t.Errorf("%s: %v", body, err)
+			} else if got.Body != body {
+				t.Errorf("pedido %s recebeu a resposta %s", body, got.Body)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,320 @@
+// Package ocpp é a central OCPP 1.6-J (JSON sobre WebSocket) da API. Cada ponto de recarga
+// conectado é exposto nos mesmos tópicos MQTT de um charging point worker, para que o
+// StateManager o gerencie como qualquer outro worker.
+package ocpp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol é o subprotocolo WebSocket do OCPP 1.6-J.
+const Subprotocol = "ocpp1.6"
+
+// Config configura a central.
+type Config struct {
+	Enterprise        string            // Empresa dona dos pontos de recarga (tópicos enterprise/<empresa>/cp/...)
+	PricePerKWh       float64           // Tarifa do custo informado nos eventos de cobrança
+	IdleFeePerMinute  float64           // Taxa por minuto em que o veículo fica conectado além da janela
+	NoShowGrace       time.Duration     // Tolerância para a chegada do veículo após o início da janela
+	HeartbeatInterval time.Duration     // Intervalo de heartbeat informado no BootNotification
+	CallTimeout       time.Duration     // Tempo máximo de espera pela resposta de um ponto de recarga
+	PrepareTimeout    time.Duration     // Validade do ReserveNow de uma reserva ainda sem COMMIT
+	Retention         time.Duration     // Tempo na memória de uma reserva encerrada (padrão schedule.DefaultRetention)
+	Archive           *schedule.Archive // Para onde vão as reservas encerradas; nil: ficam na memória
+
+	// Passwords são as senhas (AuthorizationKey) dos pontos de recarga aceitos, por ID. A
+	// conexão se autentica com HTTP Basic, usuário = ID (perfil de segurança 1 do OCPP 1.6).
+	// Vazio: nenhum ponto de recarga é aceito.
+	Passwords map[string]string
+	// WorkerAnnounced informa se o ID já foi anunciado por um charging point worker MQTT.
+	// Esses IDs são recusados, para que o ponto OCPP não responda pelos tópicos do worker.
+	WorkerAnnounced func(id string) bool
+}
+
+// CentralSystem aceita as conexões dos pontos de recarga.
+type CentralSystem struct {
+	cfg Config
+	ctx context.Context
+
+	mu           sync.Mutex
+	chargePoints map[string]*ChargePoint // Chave: ID do ponto de recarga
+
+	nextID atomic.Int64 // Gera IDs de reserva e de transação OCPP
+}
+
+// NewCentralSystem cria a central. ctx encerra as assinaturas MQTT dos pontos de recarga.
+func NewCentralSystem(ctx context.Context, cfg Config) *CentralSystem {
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 60 * time.Second
+	}
+	if cfg.CallTimeout <= 0 {
+		cfg.CallTimeout = 10 * time.Second
+	}
+	if cfg.NoShowGrace <= 0 {
+		cfg.NoShowGrace = 15 * time.Second
+	}
+	if cfg.PrepareTimeout <= 0 {
+		cfg.PrepareTimeout = 2 * time.Minute
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = schedule.DefaultRetention
+	}
+	cs := &CentralSystem{cfg: cfg, ctx: ctx, chargePoints: make(map[string]*ChargePoint)}
+	cs.nextID.Store(time.Now().Unix() % 1_000_000 * 1000) // Evita repetir IDs após reinícios
+	go cs.collectReservations()
+	return cs
+}
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{Subprotocol},
+	CheckOrigin:  func(*http.Request) bool { return true }, // Pontos de recarga não são navegadores
+}
+
+// Handler atende GET /ocpp/:chargePointId, a URL configurada no ponto de recarga.
+func (cs *CentralSystem) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("chargePointId")
+		password, known := cs.cfg.Passwords[id]
+		if !known {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("ponto de recarga '%s' não autorizado", id)})
+			return
+		}
+		user, given, ok := c.Request.BasicAuth()
+		if !ok || user != id || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+			log.Printf("[OCPP] Credenciais inválidas para '%s' de %s", id, c.ClientIP())
+			c.Header("WWW-Authenticate", `Basic realm="ocpp"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "credenciais do ponto de recarga inválidas"})
+			return
+		}
+		if !cs.known(id) && cs.cfg.WorkerAnnounced != nil && cs.cfg.WorkerAnnounced(id) {
+			log.Printf("[OCPP] Conexão de '%s' recusada: ID já anunciado por um worker MQTT", id)
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("ID '%s' já pertence a um charging point worker", id)})
+			return
+		}
+		if !offersSubprotocol(c.Request) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "subprotocolo " + Subprotocol + " é obrigatório"})
+			return
+		}
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			log.Printf("[OCPP] Falha no upgrade da conexão de '%s': %v", id, err)
+			return
+		}
+		cs.chargePoint(id).serve(conn)
+	}
+}
+
+func offersSubprotocol(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == Subprotocol {
+			return true
+		}
+	}
+	return false
+}
+
+// known informa se o ponto de recarga já se conectou a esta central.
+func (cs *CentralSystem) known(id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	_, ok := cs.chargePoints[id]
+	return ok
+}
+
+// chargePoint retorna o estado do ponto de recarga, que sobrevive às reconexões.
+func (cs *CentralSystem) chargePoint(id string) *ChargePoint {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cp, ok := cs.chargePoints[id]
+	if !ok {
+		cp = newChargePoint(cs, id)
+		cs.chargePoints[id] = cp
+	}
+	return cp
+}
+
+// --- CONEXÃO ---
+
+// connection é uma conexão WebSocket ativa com um ponto de recarga.
+type connection struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan frame // Pedidos da central aguardando resposta
+	closed  chan struct{}
+}
+
+func (c *connection) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// serve processa as mensagens da conexão até ela cair. Uma nova conexão do mesmo ponto
+// de recarga substitui a anterior.
+func (cp *ChargePoint) serve(ws *websocket.Conn) {
+	conn := &connection{ws: ws, pending: make(map[string]chan frame), closed: make(chan struct{})}
+
+	cp.mu.Lock()
+	previous := cp.conn
+	cp.conn = conn
+	cp.mu.Unlock()
+	if previous != nil {
+		previous.ws.Close()
+	}
+	log.Printf("[OCPP] Ponto de recarga '%s' conectado de %s", cp.ID, ws.RemoteAddr())
+
+	defer func() {
+		ws.Close()
+		close(conn.closed)
+		cp.mu.Lock()
+		current := cp.conn == conn
+		if current {
+			cp.conn = nil
+		}
+		cp.mu.Unlock()
+		log.Printf("[OCPP] Ponto de recarga '%s' desconectado", cp.ID)
+		if current { // Substituída por uma nova conexão, o ponto de recarga continua online
+			cp.publishStatus(schemas.WorkerOffline)
+		}
+	}()
+
+	// Sem mensagens por três intervalos de heartbeat, a conexão é considerada perdida
+	readTimeout := 3 * cp.cs.cfg.HeartbeatInterval
+	for {
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("[OCPP] Erro na conexão com '%s': %v", cp.ID, err)
+			}
+			return
+		}
+
+		f, err := parseFrame(data)
+		if err != nil {
+			log.Printf("[OCPP] Mensagem inválida de '%s': %v", cp.ID, err)
+			if f.UniqueID != "" && f.MessageType == messageTypeCall {
+				cp.replyError(conn, f.UniqueID, errorFormationViolation, err.Error())
+			}
+			continue
+		}
+
+		switch f.MessageType {
+		case messageTypeCall:
+			cp.handleCall(conn, f)
+		case messageTypeCallResult, messageTypeCallError:
+			conn.mu.Lock()
+			waiter, ok := conn.pending[f.UniqueID]
+			delete(conn.pending, f.UniqueID)
+			conn.mu.Unlock()
+			if ok {
+				waiter <- f
+			} else {
+				log.Printf("[OCPP] Resposta inesperada de '%s' (ID %s) ignorada", cp.ID, f.UniqueID)
+			}
+		}
+	}
+}
+
+func (cp *ChargePoint) handleCall(conn *connection, f frame) {
+	handler, ok := cp.handlers()[f.Action]
+	if !ok {
+		cp.replyError(conn, f.UniqueID, errorNotImplemented, fmt.Sprintf("ação '%s' não suportada", f.Action))
+		return
+	}
+	result, err := handler(f.Payload)
+	if err != nil {
+		code := errorInternalError
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			code = errorFormationViolation
+		}
+		log.Printf("[OCPP] Erro ao processar %s de '%s': %v", f.Action, cp.ID, err)
+		cp.replyError(conn, f.UniqueID, code, err.Error())
+		return
+	}
+	data, err := encodeCallResult(f.UniqueID, result)
+	if err == nil {
+		err = conn.write(data)
+	}
+	if err != nil {
+		log.Printf("[OCPP] Falha ao responder %s para '%s': %v", f.Action, cp.ID, err)
+	}
+}
+
+func (cp *ChargePoint) replyError(conn *connection, uniqueID, code, description string) {
+	data, err := encodeCallError(uniqueID, code, description)
+	if err == nil {
+		err = conn.write(data)
+	}
+	if err != nil {
+		log.Printf("[OCPP] Falha ao enviar CALLERROR para '%s': %v", cp.ID, err)
+	}
+}
+
+// ErrNotConnected indica que o ponto de recarga não está conectado à central.
+var ErrNotConnected = errors.New("ponto de recarga não conectado")
+
+// call envia um pedido da central ao ponto de recarga e decodifica a resposta em out.
+func (cp *ChargePoint) call(ctx context.Context, action string, payload, out any) error {
+	cp.mu.Lock()
+	conn := cp.conn
+	cp.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	uniqueID := strconv.FormatInt(cp.cs.nextID.Add(1), 10)
+	data, err := encodeCall(uniqueID, action, payload)
+	if err != nil {
+		return err
+	}
+	waiter := make(chan frame, 1)
+	conn.mu.Lock()
+	conn.pending[uniqueID] = waiter
+	conn.mu.Unlock()
+	defer func() {
+		conn.mu.Lock()
+		delete(conn.pending, uniqueID)
+		conn.mu.Unlock()
+	}()
+
+	if err := conn.write(data); err != nil {
+		return fmt.Errorf("falha ao enviar %s: %w", action, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cp.cs.cfg.CallTimeout)
+	defer cancel()
+	select {
+	case f := <-waiter:
+		if f.MessageType == messageTypeCallError {
+			return &CallError{Code: f.ErrorCode, Description: f.ErrorDescription}
+		}
+		if err := json.Unmarshal(f.Payload, out); err != nil {
+			return fmt.Errorf("resposta inválida a %s: %w", action, err)
+		}
+		return nil
+	case <-conn.closed:
+		return ErrNotConnected
+	case <-ctx.Done():
+		return fmt.Errorf("sem resposta a %s: %w", action, ctx.Err())
+	}
+}
@@ -0,0 +1,323 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	testChargePoint = "CP-TESTE"
+	testPassword    = "segredo"
+
+	testResponseTopic = "api-teste/respostas" // Sem cliente MQTT, a resposta do PREPARE não é publicada
+)
+
+// simulatedChargePoint é o lado do ponto de recarga da conexão: envia CALLs à central e
+// aceita todo ReserveNow e CancelReservation recebido, guardando-os em requests.
+type simulatedChargePoint struct {
+	ws       *websocket.Conn
+	writeMu  sync.Mutex
+	requests chan frame
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan frame
+}
+
+// startCentral sobe a central num servidor HTTP de teste e retorna a URL ws de /ocpp/.
+// Sem cliente MQTT, a ponte não é iniciada; os comandos são entregues com handleCommand.
+func startCentral(t *testing.T) (*CentralSystem, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cs := NewCentralSystem(ctx, Config{
+		Enterprise:  "empresa-teste",
+		PricePerKWh: 2,
+		Passwords:   map[string]string{testChargePoint: testPassword},
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ocpp/:chargePointId", cs.Handler())
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return cs, "ws" + strings.TrimPrefix(server.URL, "http") + "/ocpp/"
+}
+
+func dial(baseURL, id, user, password string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}, HandshakeTimeout: 5 * time.Second}
+	header := http.Header{}
+	if user != "" {
+		req, _ := http.NewRequest(http.MethodGet, "http://ocpp", nil)
+		req.SetBasicAuth(user, password)
+		header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	return dialer.Dial(baseURL+id, header)
+}
+
+// connect conecta o ponto de recarga com as credenciais certas e envia o BootNotification.
+func connect(t *testing.T, baseURL string) *simulatedChargePoint {
+	t.Helper()
+	ws, _, err := dial(baseURL, testChargePoint, testChargePoint, testPassword)
+	if err != nil {
+		t.Fatalf("conexão recusada: %v", err)
+	}
+	sim := &simulatedChargePoint{ws: ws, requests: make(chan frame, 10), pending: make(map[string]chan frame)}
+	t.Cleanup(func() { ws.Close() })
+	go sim.read()
+
+	var boot bootNotificationResponse
+	sim.call(t, actionBootNotification, bootNotificationRequest{ChargePointVendor: "Teste", ChargePointModel: "Simulado"}, &boot)
+	if boot.Status != statusAccepted {
+		t.Fatalf("BootNotification: status %s, esperado %s", boot.Status, statusAccepted)
+	}
+	sim.call(t, actionStatusNotification, statusNotificationRequest{ConnectorID: 1, ErrorCode: "NoError", Status: "Available"}, nil)
+	return sim
+}
+
+func (s *simulatedChargePoint) write(message []any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (s *simulatedChargePoint) read() {
+	for {
+		_, data, err := s.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		f, err := parseFrame(data)
+		if err != nil {
+			continue
+		}
+		if f.MessageType == messageTypeCall {
+			s.requests <- f
+			s.write([]any{messageTypeCallResult, f.UniqueID, map[string]string{"status": statusAccepted}})
+			continue
+		}
+		s.mu.Lock()
+		waiter, ok := s.pending[f.UniqueID]
+		delete(s.pending, f.UniqueID)
+		s.mu.Unlock()
+		if ok {
+			waiter <- f
+		}
+	}
+}
+
+// call envia uma ação à central e decodifica o CALLRESULT em out.
+func (s *simulatedChargePoint) call(t *testing.T, action string, payload, out any) {
+	t.Helper()
+	s.mu.Lock()
+	s.nextID++
+	uniqueID := strconv.Itoa(s.nextID)
+	waiter := make(chan frame, 1)
+	s.pending[uniqueID] = waiter
+	s.mu.Unlock()
+
+	if err := s.write([]any{messageTypeCall, uniqueID, action, payload}); err != nil {
+		t.Fatalf("%s: %v", action, err)
+	}
+	select {
+	case f := <-waiter:
+		if f.MessageType != messageTypeCallResult {
+			t.Fatalf("%s: CALLERROR %s: %s", action, f.ErrorCode, f.ErrorDescription)
+		}
+		if out != nil {
+			if err := json.Unmarshal(f.Payload, out); err != nil {
+				t.Fatalf("%s: resposta inválida: %v", action, err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: sem resposta da central", action)
+	}
+}
+
+// expect aguarda o próximo pedido da central e confere a ação.
+func (s *simulatedChargePoint) expect(t *testing.T, action string, out any) {
+	t.Helper()
+	select {
+	case f := <-s.requests:
+		if f.Action != action {
+			t.Fatalf("pedido da central: %s, esperado %s", f.Action, action)
+		}
+		if err := json.Unmarshal(f.Payload, out); err != nil {
+			t.Fatalf("%s: payload inválido: %v", action, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a central não enviou %s", action)
+	}
+}
+
+// command entrega ao ponto de recarga um comando do 2PC, como faria a ponte MQTT.
+func command(t *testing.T, cs *CentralSystem, msgType string, payload any) {
+	t.Helper()
+	data, err := schemas.EncodeMessage(msgType, "api-teste", schemas.ProtocolVersion, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.chargePoint(testChargePoint).handleCommand(string(data))
+}
+
+// reservationStatus retorna o estado da reserva OCPP da transação.
+func reservationStatus(cs *CentralSystem, transactionID string) string {
+	cp := cs.chargePoint(testChargePoint)
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, r := range cp.reservations {
+		if r.transactionID == transactionID {
+			return r.status
+		}
+	}
+	return ""
+}
+
+func testWindow() schemas.ReservationWindow {
+	start := time.Now().UTC().Truncate(time.Second).Add(time.Hour)
+	return schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(time.Hour)}
+}
+
+func TestHandlerRejectsBadCredentials(t *testing.T) {
+	_, baseURL := startCentral(t)
+	tests := []struct {
+		name           string
+		id             string
+		user, password string
+		wantStatus     int
+	}{
+		{name: "sem HTTP Basic", id: testChargePoint, wantStatus: http.StatusUnauthorized},
+		{name: "senha errada", id: testChargePoint, user: testChargePoint, password: "errada", wantStatus: http.StatusUnauthorized},
+		{name: "usuário diferente do ID", id: testChargePoint, user: "OUTRO", password: testPassword, wantStatus: http.StatusUnauthorized},
+		{name: "ponto de recarga desconhecido", id: "DESCONHECIDO", user: "DESCONHECIDO", password: testPassword, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, resp, err := dial(baseURL, tt.id, tt.user, tt.password)
+			if err == nil {
+				ws.Close()
+				t.Fatal("conexão aceita, esperada recusa")
+			}
+			if resp == nil || resp.StatusCode != tt.wantStatus {
+				t.Fatalf("resposta %v, esperado status %d", resp, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReservationLifecycle(t *testing.T) {
+	cs, baseURL := startCentral(t)
+	sim := connect(t, baseURL)
+	const tx = "tx-ocpp-1"
+	window := testWindow()
+
+	command(t, cs, schemas.MsgPrepareReserveWindow, schemas.PrepareReserveWindowCommand{TransactionID: tx, Window: window, ResponseTopic: testResponseTopic, AttemptID: "tentativa-1"})
+	var prepared reserveNowRequest
+	sim.expect(t, actionReserveNow, &prepared)
+	if prepared.ConnectorID != 1 || prepared.IDTag != idTagFor(tx) {
+		t.Fatalf("ReserveNow do PREPARE: %+v", prepared)
+	}
+	if !prepared.ExpiryDate.Before(window.EndTimeUTC) {
+		t.Errorf("ReserveNow do PREPARE válido até %v, esperado só o PREPARE_TIMEOUT", prepared.ExpiryDate)
+	}
+	if got := reservationStatus(cs, tx); got != reservationPrepared {
+		t.Fatalf("depois do PREPARE: %q, esperado %q", got, reservationPrepared)
+	}
+
+	command(t, cs, schemas.MsgCommit, schemas.CommitCommand{TransactionID: tx, AttemptID: "tentativa-1"})
+	var committed reserveNowRequest
+	sim.expect(t, actionReserveNow, &committed)
+	if committed.ReservationID != prepared.ReservationID || !committed.ExpiryDate.Equal(window.EndTimeUTC) {
+		t.Fatalf("ReserveNow do COMMIT: %+v, esperada a reserva %d até %v", committed, prepared.ReservationID, window.EndTimeUTC)
+	}
+	if got := reservationStatus(cs, tx); got != reservationCommitted {
+		t.Fatalf("depois do COMMIT: %q, esperado %q", got, reservationCommitted)
+	}
+
+	var started startTransactionResponse
+	sim.call(t, actionStartTransaction, startTransactionRequest{ConnectorID: 1, IDTag: prepared.IDTag, MeterStart: 1000, ReservationID: &prepared.ReservationID, Timestamp: window.StartTimeUTC}, &started)
+	if started.IDTagInfo.Status != statusAccepted {
+		t.Fatalf("StartTransaction: %s, esperado %s", started.IDTagInfo.Status, statusAccepted)
+	}
+	if got := reservationStatus(cs, tx); got != reservationCharging {
+		t.Fatalf("depois do StartTransaction: %q, esperado %q", got, reservationCharging)
+	}
+
+	sim.call(t, actionMeterValues, meterValuesRequest{ConnectorID: 1, TransactionID: &started.TransactionID, MeterValue: []meterValue{{
+		Timestamp:    window.StartTimeUTC.Add(10 * time.Minute),
+		SampledValue: []sampledValue{{Value: "6000"}, {Value: "22", Measurand: "Power.Active.Import", Unit: "kW"}},
+	}}}, nil)
+	cp := cs.chargePoint(testChargePoint)
+	cp.mu.Lock()
+	s := cp.sessions[started.TransactionID]
+	energy, power := s.energyKWh, s.powerKW
+	cp.mu.Unlock()
+	if energy != 5 || power != 22 {
+		t.Fatalf("MeterValues: %.3f kWh a %.1f kW, esperado 5 kWh a 22 kW", energy, power)
+	}
+
+	var stopped stopTransactionResponse
+	sim.call(t, actionStopTransaction, stopTransactionRequest{TransactionID: started.TransactionID, MeterStop: 11000, Timestamp: window.StartTimeUTC.Add(30 * time.Minute)}, &stopped)
+	if stopped.IDTagInfo == nil || stopped.IDTagInfo.Status != statusAccepted {
+		t.Fatalf("StopTransaction: %+v", stopped)
+	}
+	if got := reservationStatus(cs, tx); got != reservationCharged {
+		t.Fatalf("depois do StopTransaction: %q, esperado %q", got, reservationCharged)
+	}
+
+	// Encerrada, a reserva não ocupa mais o conector
+	cp.mu.Lock()
+	free := cp.freeConnector(window)
+	cp.mu.Unlock()
+	if free != 1 {
+		t.Errorf("conector livre depois da recarga: %d, esperado 1", free)
+	}
+}
+
+func TestAbortCancelsReservation(t *testing.T) {
+	cs, baseURL := startCentral(t)
+	sim := connect(t, baseURL)
+	const tx = "tx-ocpp-2"
+
+	command(t, cs, schemas.MsgPrepareReserveWindow, schemas.PrepareReserveWindowCommand{TransactionID: tx, Window: testWindow(), ResponseTopic: testResponseTopic, AttemptID: "tentativa-1"})
+	var prepared reserveNowRequest
+	sim.expect(t, actionReserveNow, &prepared)
+
+	// ABORT de outra tentativa não desfaz esta reserva
+	command(t, cs, schemas.MsgAbort, schemas.AbortCommand{TransactionID: tx, AttemptID: "tentativa-antiga"})
+	if got := reservationStatus(cs, tx); got != reservationPrepared {
+		t.Fatalf("depois do ABORT de outra tentativa: %q, esperado %q", got, reservationPrepared)
+	}
+
+	command(t, cs, schemas.MsgAbort, schemas.AbortCommand{TransactionID: tx, AttemptID: "tentativa-1"})
+	var cancelled cancelReservationRequest
+	sim.expect(t, actionCancelReservation, &cancelled)
+	if cancelled.ReservationID != prepared.ReservationID {
+		t.Fatalf("CancelReservation %d, esperada a reserva %d", cancelled.ReservationID, prepared.ReservationID)
+	}
+	if got := reservationStatus(cs, tx); got != reservationAborted {
+		t.Fatalf("depois do ABORT: %q, esperado %q", got, reservationAborted)
+	}
+
+	// O veículo da reserva abortada não é mais aceito
+	var auth authorizeResponse
+	sim.call(t, actionAuthorize, authorizeRequest{IDTag: prepared.IDTag}, &auth)
+	if auth.IDTagInfo.Status != statusInvalid {
+		t.Errorf("Authorize depois do ABORT: %s, esperado %s", auth.IDTagInfo.Status, statusInvalid)
+	}
+}
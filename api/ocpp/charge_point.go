@@ -0,0 +1,654 @@
+package ocpp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Estados de uma reserva no ponto de recarga, os mesmos do cpworker.
+const (
+	reservationPrepared  = "prepared"
+	reservationCommitted = "committed"
+	reservationCharging  = "charging"
+	reservationCharged   = schemas.StatusReservationCharged
+	reservationNoShow    = schemas.StatusReservationNoShow
+	reservationAborted   = "aborted"
+)
+
+// reservation é uma janela reservada pelo 2PC e mapeada numa reserva OCPP.
+type reservation struct {
+	transactionID string // Transação do 2PC
+	attemptID     string // Tentativa de PREPARE da API; COMMIT e ABORT de outra tentativa não a atingem
+	reservationID int    // reservationId do ReserveNow
+	idTag         string // idTag que o veículo apresenta no ponto de recarga
+	connectorID   int
+	window        schemas.ReservationWindow
+	status        string
+	preparedUntil time.Time // Validade do ReserveNow enquanto a reserva espera o COMMIT
+	arrivedAt     time.Time // Primeiro Authorize ou StartTransaction do veículo
+	finishedAt    time.Time // Quando a reserva deixou de ocupar o conector (aborted, charged ou no_show)
+}
+
+// session é uma transação OCPP (StartTransaction ... StopTransaction).
+type session struct {
+	reservation *reservation
+	meterStart  int // Wh
+	startedAt   time.Time
+	energyKWh   float64 // Última leitura, descontado meterStart
+	powerKW     float64
+	soc         float64
+}
+
+// ChargePoint é um ponto de recarga conhecido pela central.
+type ChargePoint struct {
+	ID string
+	cs *CentralSystem
+
+	mu              sync.Mutex
+	conn            *connection
+	booted          bool
+	connectorStatus map[int]string
+	connectorErrors map[int]string                     // errorCode do último StatusNotification
+	measurements    map[int]schemas.ConnectorTelemetry // Últimas medições de cada conector
+	reservations    []*reservation                     // Ativas e encerradas ainda não arquivadas
+	index           schedule.Tree[*reservation]        // As mesmas reservas, indexadas pela janela
+	sessions        map[int]*session                   // Chave: transactionId OCPP
+	bridged         bool                               // Já atende o tópico de comandos
+}
+
+func newChargePoint(cs *CentralSystem, id string) *ChargePoint {
+	return &ChargePoint{
+		ID:              id,
+		cs:              cs,
+		connectorStatus: make(map[int]string),
+		connectorErrors: make(map[int]string),
+		measurements:    make(map[int]schemas.ConnectorTelemetry),
+		sessions:        make(map[int]*session),
+	}
+}
+
+func (cp *ChargePoint) topic(kind string) string {
+	return fmt.Sprintf("enterprise/%s/cp/%s/%s", cp.cs.cfg.Enterprise, cp.ID, kind)
+}
+
+// handlers mapeia as ações iniciadas pelo ponto de recarga.
+func (cp *ChargePoint) handlers() map[string]func(json.RawMessage) (any, error) {
+	return map[string]func(json.RawMessage) (any, error){
+		actionBootNotification:   cp.onBootNotification,
+		actionHeartbeat:          cp.onHeartbeat,
+		actionStatusNotification: cp.onStatusNotification,
+		actionAuthorize:          cp.onAuthorize,
+		actionStartTransaction:   cp.onStartTransaction,
+		actionMeterValues:        cp.onMeterValues,
+		actionStopTransaction:    cp.onStopTransaction,
+	}
+}
+
+// --- AÇÕES DO PONTO DE RECARGA ---
+
+// onBootNotification aceita o ponto de recarga, anuncia-o no tópico de info (como faz o
+// cpworker) e passa a atender os comandos do seu tópico.
+func (cp *ChargePoint) onBootNotification(payload json.RawMessage) (any, error) {
+	var req bootNotificationRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	cp.mu.Lock()
+	cp.booted = true
+	startBridge := !cp.bridged
+	cp.bridged = true
+	cp.mu.Unlock()
+	log.Printf("[OCPP] BootNotification de '%s' (%s %s)", cp.ID, req.ChargePointVendor, req.ChargePointModel)
+
+	info := schemas.ChargingPointInfo{WorkerID: cp.ID, Enterprise: cp.cs.cfg.Enterprise, ProtocolVersion: schemas.ProtocolVersion}
+	if infoBytes, err := json.Marshal(info); err == nil {
+		mqtt.PublishRetained(cp.topic("info"), string(infoBytes))
+	}
+	if startBridge {
+		cp.startBridge()
+	}
+	cp.publishStatus(schemas.WorkerOnline)
+	cp.publishHeartbeat()
+	cp.publishTelemetry()
+
+	return bootNotificationResponse{
+		Status:      statusAccepted,
+		CurrentTime: time.Now().UTC(),
+		Interval:    int(cp.cs.cfg.HeartbeatInterval.Seconds()),
+	}, nil
+}
+
+func (cp *ChargePoint) onHeartbeat(json.RawMessage) (any, error) {
+	cp.publishHeartbeat()
+	cp.publishTelemetry()
+	return heartbeatResponse{CurrentTime: time.Now().UTC()}, nil
+}
+
+func (cp *ChargePoint) onStatusNotification(payload json.RawMessage) (any, error) {
+	var req statusNotificationRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	cp.mu.Lock()
+	cp.connectorStatus[req.ConnectorID] = req.Status
+	cp.connectorErrors[req.ConnectorID] = req.ErrorCode
+	cp.mu.Unlock()
+	log.Printf("[OCPP] '%s' conector %d: %s (%s)", cp.ID, req.ConnectorID, req.Status, req.ErrorCode)
+	cp.publishTelemetry()
+	return struct{}{}, nil
+}
+
+// onAuthorize aceita apenas idTags de reservas confirmadas deste ponto de recarga.
+func (cp *ChargePoint) onAuthorize(payload json.RawMessage) (any, error) {
+	var req authorizeRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	cp.mu.Lock()
+	status := statusInvalid
+	var arrival *schemas.SessionEvent
+	if r := cp.findReservation(nil, req.IDTag, reservationCommitted); r != nil {
+		status = statusAccepted
+		arrival = cp.arrive(r, time.Now().UTC())
+	}
+	cp.mu.Unlock()
+	if arrival != nil {
+		cp.publishEvent(schemas.MsgVehicleArrived, *arrival)
+	}
+	return authorizeResponse{IDTagInfo: idTagInfo{Status: status}}, nil
+}
+
+// arrive registra a chegada do veículo à reserva. Retorna o evento a publicar, ou nil se
+// a chegada já tinha sido registrada. Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) arrive(r *reservation, at time.Time) *schemas.SessionEvent {
+	if !r.arrivedAt.IsZero() {
+		return nil
+	}
+	r.arrivedAt = at
+	log.Printf("[OCPP] '%s' TX[%s]: Veículo chegou ao conector %d", cp.ID, r.transactionID, r.connectorID)
+	return &schemas.SessionEvent{TransactionID: r.transactionID, WorkerID: cp.ID, ConnectorID: r.connectorID, Timestamp: at}
+}
+
+// onStartTransaction inicia a sessão de recarga de uma reserva confirmada.
+func (cp *ChargePoint) onStartTransaction(payload json.RawMessage) (any, error) {
+	var req startTransactionRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	transactionID := int(cp.cs.nextID.Add(1))
+
+	cp.mu.Lock()
+	r := cp.findReservation(req.ReservationID, req.IDTag, reservationCommitted)
+	if r == nil {
+		cp.mu.Unlock()
+		// O OCPP exige um transactionId mesmo quando a transação é recusada
+		log.Printf("[OCPP] '%s': StartTransaction recusado, nenhuma reserva confirmada para idTag '%s'", cp.ID, req.IDTag)
+		return startTransactionResponse{IDTagInfo: idTagInfo{Status: statusInvalid}, TransactionID: transactionID}, nil
+	}
+	arrival := cp.arrive(r, req.Timestamp) // Sem Authorize, a chegada é a conexão
+	r.status = reservationCharging
+	cp.sessions[transactionID] = &session{reservation: r, meterStart: req.MeterStart, startedAt: req.Timestamp}
+	pluggedIn := schemas.SessionEvent{TransactionID: r.transactionID, WorkerID: cp.ID, ConnectorID: r.connectorID, Timestamp: req.Timestamp}
+	cp.mu.Unlock()
+
+	if arrival != nil {
+		cp.publishEvent(schemas.MsgVehicleArrived, *arrival)
+	}
+	cp.publishEvent(schemas.MsgVehiclePluggedIn, pluggedIn)
+	log.Printf("[OCPP] '%s' TX[%s]: Recarga iniciada no conector %d (transação OCPP %d)", cp.ID, pluggedIn.TransactionID, req.ConnectorID, transactionID)
+	return startTransactionResponse{IDTagInfo: idTagInfo{Status: statusAccepted}, TransactionID: transactionID}, nil
+}
+
+// onMeterValues repassa as leituras do medidor como METER_VALUES.
+func (cp *ChargePoint) onMeterValues(payload json.RawMessage) (any, error) {
+	var req meterValuesRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	cp.mu.Lock()
+	cp.recordMeasurements(req)
+	cp.mu.Unlock()
+	if req.TransactionID == nil {
+		return struct{}{}, nil // Leituras fora de uma transação não são cobradas
+	}
+
+	cp.mu.Lock()
+	s, ok := cp.sessions[*req.TransactionID]
+	if !ok {
+		cp.mu.Unlock()
+		return struct{}{}, nil
+	}
+	var readings []schemas.MeterValuesEvent
+	for _, mv := range req.MeterValue {
+		reading := schemas.MeterValuesEvent{TransactionID: s.reservation.transactionID, WorkerID: cp.ID, ConnectorID: req.ConnectorID, Timestamp: mv.Timestamp}
+		for _, sv := range mv.SampledValue {
+			value, err := strconv.ParseFloat(sv.Value, 64)
+			if err != nil {
+				continue
+			}
+			switch sv.Measurand {
+			case "", "Energy.Active.Import.Register":
+				s.energyKWh = math.Max(0, toKilo(value, sv.Unit, "Wh")-float64(s.meterStart)/1000)
+			case "Power.Active.Import":
+				s.powerKW = toKilo(value, sv.Unit, "W")
+			case "SoC":
+				s.soc = value
+			}
+		}
+		reading.EnergyKWh, reading.PowerKW, reading.StateOfChargePct = s.energyKWh, s.powerKW, s.soc
+		readings = append(readings, reading)
+	}
+	cp.mu.Unlock()
+
+	for _, reading := range readings {
+		cp.publishEvent(schemas.MsgMeterValues, reading)
+	}
+	return struct{}{}, nil
+}
+
+// onStopTransaction encerra a sessão e publica a desconexão e a cobrança: a energia
+// entregue e, se o veículo saiu depois do fim da janela, a taxa de ociosidade.
+func (cp *ChargePoint) onStopTransaction(payload json.RawMessage) (any, error) {
+	var req stopTransactionRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	cp.mu.Lock()
+	s, ok := cp.sessions[req.TransactionID]
+	if !ok {
+		cp.mu.Unlock()
+		log.Printf("[OCPP] '%s': StopTransaction de transação desconhecida %d ignorado", cp.ID, req.TransactionID)
+		return stopTransactionResponse{}, nil
+	}
+	delete(cp.sessions, req.TransactionID)
+	r := s.reservation
+	r.finish(reservationCharged, time.Now().UTC())
+	energy := math.Round(math.Max(0, float64(req.MeterStop-s.meterStart))) / 1000
+	startedAt, endedAt := s.startedAt, req.Timestamp
+	reason := req.Reason
+	if reason == "" {
+		reason = "Local" // Padrão do OCPP 1.6
+	}
+	var idleMinutes float64
+	if endedAt.After(r.window.EndTimeUTC) {
+		idleMinutes = math.Round(endedAt.Sub(r.window.EndTimeUTC).Minutes()*10) / 10
+	}
+	idleFee := math.Round(idleMinutes*cp.cs.cfg.IdleFeePerMinute*100) / 100
+	unplugged := schemas.SessionEvent{TransactionID: r.transactionID, WorkerID: cp.ID, ConnectorID: r.connectorID, Timestamp: endedAt}
+	event := schemas.VehiclePassedAndChargedEvent{
+		TransactionID:  r.transactionID,
+		Cost:           math.Round((energy*cp.cs.cfg.PricePerKWh+idleFee)*100) / 100,
+		Window:         r.window,
+		WorkerID:       cp.ID,
+		ConnectorID:    r.connectorID,
+		EnergyKWh:      energy,
+		PluggedInAt:    &startedAt,
+		SessionEndedAt: &endedAt,
+		FinalSOCPct:    s.soc,
+		UnpluggedAt:    &endedAt,
+		IdleMinutes:    idleMinutes,
+		IdleFee:        idleFee,
+	}
+	cp.mu.Unlock()
+
+	cp.publishEvent(schemas.MsgVehicleUnplugged, unplugged)
+	cp.publishEvent(schemas.MsgVehiclePassedAndCharged, event)
+	log.Printf("[OCPP] '%s' TX[%s]: Recarga encerrada (%s). Energia: %.3f kWh, ociosidade: %.1f min. Cobrança notificada para API.", cp.ID, event.TransactionID, reason, energy, idleMinutes)
+	return stopTransactionResponse{IDTagInfo: &idTagInfo{Status: statusAccepted}}, nil
+}
+
+// findReservation procura a reserva pelo reservationId ou, na falta dele, pelo idTag.
+// Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) findReservation(reservationID *int, idTag, status string) *reservation {
+	for _, r := range cp.reservations {
+		if r.status != status {
+			continue
+		}
+		if reservationID != nil && r.reservationID == *reservationID {
+			return r
+		}
+		if reservationID == nil && r.idTag == idTag {
+			return r
+		}
+	}
+	return nil
+}
+
+// toKilo converte um valor em base (Wh, W) para kWh/kW, conforme a unidade informada.
+func toKilo(value float64, unit, base string) float64 {
+	if strings.EqualFold(unit, "k"+base) {
+		return value
+	}
+	return value / 1000
+}
+
+// --- PONTE COM OS TÓPICOS MQTT DOS WORKERS ---
+
+// startBridge assina o tópico de comandos do ponto de recarga, como o cpworker. Se a
+// assinatura falhar, o próximo BootNotification tenta de novo.
+func (cp *ChargePoint) startBridge() {
+	commands, err := mqtt.Listen(cp.cs.ctx, cp.topic("command"), mqtt.ListenOptions{BufferSize: 10, Overflow: mqtt.OverflowQueue})
+	if err != nil {
+		log.Printf("[OCPP] '%s': %v", cp.ID, err)
+		cp.mu.Lock()
+		cp.bridged = false
+		cp.mu.Unlock()
+		return
+	}
+	log.Printf("[OCPP] '%s' atendendo comandos em %s", cp.ID, cp.topic("command"))
+	go func() {
+		for payload := range commands.C {
+			cp.handleCommand(payload)
+		}
+	}()
+	go cp.watchNoShows()
+}
+
+// watchNoShows libera as reservas confirmadas cujo veículo não chegou até o fim da
+// tolerância (NoShowGrace): cancela a reserva OCPP e publica VEHICLE_NO_SHOW. Também
+// descarta as reservas preparadas cujo ReserveNow venceu sem COMMIT nem ABORT.
+func (cp *ChargePoint) watchNoShows() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cp.cs.ctx.Done():
+			return
+		case now := <-ticker.C:
+			var noShows []*reservation
+			cp.mu.Lock()
+			for _, r := range cp.reservations {
+				if r.status == reservationPrepared && !now.Before(r.preparedUntil) {
+					r.finish(reservationAborted, now) // O ponto de recarga já descartou o ReserveNow
+					log.Printf("[OCPP] '%s' TX[%s]: Sem decisão do coordenador em %v. Reserva OCPP %d expirada.", cp.ID, r.transactionID, cp.cs.cfg.PrepareTimeout, r.reservationID)
+					continue
+				}
+				if r.status == reservationCommitted && r.arrivedAt.IsZero() && !now.Before(r.window.StartTimeUTC.Add(cp.cs.cfg.NoShowGrace)) {
+					r.finish(reservationNoShow, now)
+					noShows = append(noShows, r)
+				}
+			}
+			cp.mu.Unlock()
+			for _, r := range noShows {
+				cp.releaseNoShow(r)
+			}
+		}
+	}
+}
+
+func (cp *ChargePoint) releaseNoShow(r *reservation) {
+	grace := cp.cs.cfg.NoShowGrace
+	log.Printf("[OCPP] '%s' TX[%s]: Veículo não compareceu em %v. Conector %d liberado.", cp.ID, r.transactionID, grace, r.connectorID)
+	var resp cancelReservationResponse
+	if err := cp.call(cp.cs.ctx, actionCancelReservation, cancelReservationRequest{ReservationID: r.reservationID}, &resp); err != nil {
+		log.Printf("[OCPP] '%s' TX[%s]: Falha no CancelReservation %d: %v", cp.ID, r.transactionID, r.reservationID, err)
+	}
+	cp.publishEvent(schemas.MsgVehicleNoShow, schemas.NoShowEvent{
+		TransactionID:      r.transactionID,
+		WorkerID:           cp.ID,
+		ConnectorID:        r.connectorID,
+		Window:             r.window,
+		GracePeriodSeconds: int(grace.Seconds()),
+		ReleasedAt:         r.window.StartTimeUTC.Add(grace),
+	})
+}
+
+func (cp *ChargePoint) handleCommand(payload string) {
+	env, err := schemas.ParseMessage([]byte(payload))
+	if err != nil {
+		log.Printf("[OCPP] '%s': Erro ao decodificar comando: %v", cp.ID, err)
+		return
+	}
+
+	switch env.Type {
+	case schemas.MsgPrepareReserveWindow:
+		var cmd schemas.PrepareReserveWindowCommand
+		if err := env.DecodePayload(&cmd); err != nil {
+			log.Printf("[OCPP] '%s': %v", cp.ID, err)
+			return
+		}
+		connectorID := cp.prepare(cmd)
+		resp := schemas.PrepareResponse{Success: connectorID != 0, TransactionID: cmd.TransactionID, WorkerID: cp.ID, CorrelationID: cmd.CorrelationID, ConnectorID: connectorID}
+		respBytes, err := schemas.EncodeMessage(schemas.MsgPrepareResponse, cp.ID, env.Version, resp)
+		if err != nil {
+			log.Printf("[OCPP] '%s': Erro ao serializar resposta de PREPARE: %v", cp.ID, err)
+			return
+		}
+		mqtt.Publish(cmd.ResponseTopic, string(respBytes))
+
+	case schemas.MsgCommit:
+		var cmd schemas.CommitCommand
+		if err := env.DecodePayload(&cmd); err != nil {
+			log.Printf("[OCPP] '%s': %v", cp.ID, err)
+			return
+		}
+		cp.commit(cmd.TransactionID, cmd.AttemptID)
+
+	case schemas.MsgAbort:
+		var cmd schemas.AbortCommand
+		if err := env.DecodePayload(&cmd); err != nil {
+			log.Printf("[OCPP] '%s': %v", cp.ID, err)
+			return
+		}
+		cp.abort(cmd.TransactionID, cmd.AttemptID)
+
+	case schemas.MsgQuerySchedule:
+		cp.answerScheduleQuery(env)
+
+	case schemas.MsgQueryWindow:
+		cp.answerWindowQuery(env)
+
+	default:
+		log.Printf("[OCPP] '%s': Comando desconhecido ignorado: '%s'", cp.ID, env.Type)
+	}
+}
+
+// prepare reserva a janela no ponto de recarga com ReserveNow. Até o COMMIT, a reserva
+// vale só PrepareTimeout: se o ABORT se perder, o ponto de recarga a descarta sozinho.
+// Retorna o conector reservado (0 em caso de falha).
+func (cp *ChargePoint) prepare(cmd schemas.PrepareReserveWindowCommand) int {
+	window := cmd.Window
+	cp.mu.Lock()
+	if !cp.booted || cp.conn == nil {
+		cp.mu.Unlock()
+		log.Printf("[OCPP] '%s' TX[%s]: FALHA PREPARE. Ponto de recarga desconectado.", cp.ID, cmd.TransactionID)
+		return 0
+	}
+	connectorID := cp.freeConnector(window)
+	if connectorID == 0 {
+		cp.mu.Unlock()
+		log.Printf("[OCPP] '%s' TX[%s]: FALHA PREPARE. Nenhum conector livre na janela.", cp.ID, cmd.TransactionID)
+		return 0
+	}
+	r := &reservation{
+		transactionID: cmd.TransactionID,
+		attemptID:     cmd.AttemptID,
+		reservationID: int(cp.cs.nextID.Add(1)),
+		idTag:         idTagFor(cmd.TransactionID),
+		connectorID:   connectorID,
+		window:        window,
+		status:        reservationPrepared,
+		preparedUntil: time.Now().UTC().Add(cp.cs.cfg.PrepareTimeout),
+	}
+	if r.preparedUntil.After(window.EndTimeUTC) {
+		r.preparedUntil = window.EndTimeUTC
+	}
+	cp.add(r) // Ocupa a janela enquanto o ReserveNow está em curso
+	cp.mu.Unlock()
+
+	if err := cp.reserveNow(r, r.preparedUntil); err != nil {
+		cp.mu.Lock()
+		r.finish(reservationAborted, time.Now().UTC())
+		cp.mu.Unlock()
+		log.Printf("[OCPP] '%s' TX[%s]: FALHA PREPARE: %v", cp.ID, cmd.TransactionID, err)
+		return 0
+	}
+	log.Printf("[OCPP] '%s' TX[%s]: SUCESSO PREPARE. Reserva OCPP %d no conector %d (idTag %s).", cp.ID, cmd.TransactionID, r.reservationID, r.connectorID, r.idTag)
+	return r.connectorID
+}
+
+// commit confirma a reserva preparada na tentativa attemptID e repete o ReserveNow com o
+// mesmo reservationId, que no OCPP 1.6 substitui a reserva anterior, estendendo-a até o
+// fim da janela.
+func (cp *ChargePoint) commit(transactionID, attemptID string) {
+	cp.mu.Lock()
+	var committed []*reservation
+	for _, r := range cp.reservations {
+		if r.transactionID == transactionID && schemas.SameAttempt(r.attemptID, attemptID) && r.status == reservationPrepared {
+			r.status = reservationCommitted
+			committed = append(committed, r)
+		}
+	}
+	cp.mu.Unlock()
+	if len(committed) == 0 {
+		log.Printf("[OCPP] '%s' TX[%s]: COMMIT sem reserva preparada (expirada ou abortada)", cp.ID, transactionID)
+		return
+	}
+
+	for _, r := range committed {
+		if err := cp.reserveNow(r, r.window.EndTimeUTC); err != nil {
+			// A reserva continua confirmada na central: o veículo ainda é reconhecido pelo idTag
+			log.Printf("[OCPP] '%s' TX[%s]: COMMIT local; falha ao estender a reserva OCPP %d: %v", cp.ID, transactionID, r.reservationID, err)
+			continue
+		}
+		log.Printf("[OCPP] '%s' TX[%s]: SUCESSO COMMIT. Reserva OCPP %d válida até %s.", cp.ID, transactionID, r.reservationID, r.window.EndTimeUTC.Format(time.RFC3339))
+	}
+}
+
+// reserveNow envia o ReserveNow da reserva com a validade informada.
+func (cp *ChargePoint) reserveNow(r *reservation, expiry time.Time) error {
+	var resp reserveNowResponse
+	err := cp.call(cp.cs.ctx, actionReserveNow, reserveNowRequest{
+		ConnectorID:   r.connectorID,
+		ExpiryDate:    expiry,
+		IDTag:         r.idTag,
+		ReservationID: r.reservationID,
+	}, &resp)
+	if err == nil && resp.Status != statusAccepted {
+		err = fmt.Errorf("ReserveNow respondido com %s", resp.Status)
+	}
+	return err
+}
+
+// abort cancela a reserva da transação (só a da tentativa attemptID, se informada) com
+// CancelReservation. Uma reserva confirmada que ainda não começou também é cancelada: a
+// API a transfere quando o ponto entra em falha.
+func (cp *ChargePoint) abort(transactionID, attemptID string) {
+	cp.mu.Lock()
+	var cancelled []*reservation
+	for _, r := range cp.reservations {
+		if r.transactionID == transactionID && schemas.SameAttempt(r.attemptID, attemptID) && (r.status == reservationPrepared || (r.status == reservationCommitted && r.arrivedAt.IsZero())) {
+			r.finish(reservationAborted, time.Now().UTC())
+			cancelled = append(cancelled, r)
+		}
+	}
+	cp.mu.Unlock()
+
+	for _, r := range cancelled {
+		var resp cancelReservationResponse
+		err := cp.call(cp.cs.ctx, actionCancelReservation, cancelReservationRequest{ReservationID: r.reservationID}, &resp)
+		switch {
+		case errors.Is(err, ErrNotConnected):
+			log.Printf("[OCPP] '%s' TX[%s]: ABORT local. Ponto de recarga desconectado; a reserva OCPP %d expira sozinha.", cp.ID, transactionID, r.reservationID)
+		case err != nil:
+			log.Printf("[OCPP] '%s' TX[%s]: Falha no CancelReservation %d: %v", cp.ID, transactionID, r.reservationID, err)
+		default:
+			log.Printf("[OCPP] '%s' TX[%s]: SUCESSO ABORT. CancelReservation %d: %s", cp.ID, transactionID, r.reservationID, resp.Status)
+		}
+	}
+}
+
+// freeConnector escolhe o conector livre na janela de menor ID (veja freeConnectors).
+// Retorna 0 se nenhum estiver livre. Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) freeConnector(window schemas.ReservationWindow) int {
+	if free := cp.freeConnectors(window); len(free) > 0 {
+		return free[0]
+	}
+	return 0
+}
+
+// freeConnectors retorna, em ordem de ID, os conectores sem reserva sobreposta à janela.
+// Cada conector tem a sua agenda; conectores em Faulted ou Unavailable ficam de fora. Sem
+// StatusNotification, o ponto de recarga é tratado como tendo um único conector. Deve ser
+// chamada com cp.mu travado.
+func (cp *ChargePoint) freeConnectors(window schemas.ReservationWindow) []int {
+	var free []int
+	for _, connectorID := range cp.connectorIDs() {
+		if status := cp.connectorStatus[connectorID]; status == connectorFaulted || status == connectorUnavailable {
+			continue
+		}
+		if !cp.reserved(connectorID, window) {
+			free = append(free, connectorID)
+		}
+	}
+	return free
+}
+
+// idTagFor deriva da transação o idTag da reserva (CiString20 no OCPP 1.6).
+func idTagFor(transactionID string) string {
+	tag := strings.ReplaceAll(transactionID, "-", "")
+	if len(tag) > 20 {
+		tag = tag[:20]
+	}
+	return strings.ToUpper(tag)
+}
+
+// publishStatus anuncia a presença do ponto de recarga no tópico de status, como o
+// cpworker. O last will da API não cobre os pontos OCPP; se a API cair, o registro os
+// descarta por falta de heartbeat.
+func (cp *ChargePoint) publishStatus(status string) {
+	msg := schemas.WorkerStatus{WorkerID: cp.ID, Enterprise: cp.cs.cfg.Enterprise, Status: status}
+	payload, err := schemas.EncodeMessage(schemas.MsgWorkerStatus, cp.ID, schemas.ProtocolVersion, msg)
+	if err != nil {
+		log.Printf("[OCPP] '%s': Erro ao serializar status: %v", cp.ID, err)
+		return
+	}
+	mqtt.PublishRetained(cp.topic("status"), string(payload))
+}
+
+// publishHeartbeat repassa o Heartbeat OCPP ao registro de workers da API.
+func (cp *ChargePoint) publishHeartbeat() {
+	cp.mu.Lock()
+	connectors := 0
+	for connectorID := range cp.connectorStatus {
+		if connectorID > 0 {
+			connectors++
+		}
+	}
+	cp.mu.Unlock()
+
+	heartbeat := schemas.WorkerHeartbeat{
+		WorkerID:        cp.ID,
+		Enterprise:      cp.cs.cfg.Enterprise,
+		Timestamp:       time.Now().UTC(),
+		IntervalSeconds: max(1, int(cp.cs.cfg.HeartbeatInterval.Seconds())),
+		Capabilities:    schemas.WorkerCapabilities{ProtocolVersion: schemas.ProtocolVersion, Connectors: max(1, connectors), OCPP: true, Queries: true},
+	}
+	payload, err := schemas.EncodeMessage(schemas.MsgWorkerHeartbeat, cp.ID, schemas.ProtocolVersion, heartbeat)
+	if err != nil {
+		log.Printf("[OCPP] '%s': Erro ao serializar heartbeat: %v", cp.ID, err)
+		return
+	}
+	mqtt.Publish(cp.topic("heartbeat"), string(payload))
+}
+
+func (cp *ChargePoint) publishEvent(msgType string, event any) {
+	eventBytes, err := schemas.EncodeMessage(msgType, cp.ID, schemas.ProtocolVersion, event)
+	if err != nil {
+		log.Printf("[OCPP] '%s': Erro ao serializar evento %s: %v", cp.ID, msgType, err)
+		return
+	}
+	mqtt.Publish(cp.topic("event"), string(eventBytes))
+}
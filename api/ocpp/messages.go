@@ -0,0 +1,228 @@
+package ocpp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// --- ENQUADRAMENTO OCPP-J ---
+//
+// Cada mensagem é um array JSON:
+//   CALL       [2, "<id>", "<ação>", {payload}]
+//   CALLRESULT [3, "<id>", {payload}]
+//   CALLERROR  [4, "<id>", "<código>", "<descrição>", {detalhes}]
+
+const (
+	messageTypeCall       = 2
+	messageTypeCallResult = 3
+	messageTypeCallError  = 4
+)
+
+// Códigos de CALLERROR usados pela central.
+const (
+	errorNotImplemented     = "NotImplemented"
+	errorFormationViolation = "FormationViolation"
+	errorInternalError      = "InternalError"
+)
+
+// frame é uma mensagem OCPP-J decodificada.
+type frame struct {
+	MessageType      int
+	UniqueID         string
+	Action           string          // Apenas CALL
+	Payload          json.RawMessage // CALL e CALLRESULT
+	ErrorCode        string          // Apenas CALLERROR
+	ErrorDescription string          // Apenas CALLERROR
+}
+
+func parseFrame(data []byte) (frame, error) {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return frame{}, fmt.Errorf("mensagem OCPP não é um array JSON: %w", err)
+	}
+	if len(fields) < 3 {
+		return frame{}, errors.New("mensagem OCPP incompleta")
+	}
+	var f frame
+	if err := json.Unmarshal(fields[0], &f.MessageType); err != nil {
+		return frame{}, fmt.Errorf("tipo de mensagem OCPP inválido: %w", err)
+	}
+	if err := json.Unmarshal(fields[1], &f.UniqueID); err != nil {
+		return frame{}, fmt.Errorf("ID de mensagem OCPP inválido: %w", err)
+	}
+
+	switch f.MessageType {
+	case messageTypeCall:
+		if len(fields) != 4 {
+			return f, errors.New("CALL deve ter 4 elementos")
+		}
+		if err := json.Unmarshal(fields[2], &f.Action); err != nil {
+			return f, fmt.Errorf("ação OCPP inválida: %w", err)
+		}
+		f.Payload = fields[3]
+	case messageTypeCallResult:
+		f.Payload = fields[2]
+	case messageTypeCallError:
+		if len(fields) < 4 {
+			return f, errors.New("CALLERROR deve ter 5 elementos")
+		}
+		json.Unmarshal(fields[2], &f.ErrorCode)
+		json.Unmarshal(fields[3], &f.ErrorDescription)
+	default:
+		return f, fmt.Errorf("tipo de mensagem OCPP desconhecido: %d", f.MessageType)
+	}
+	return f, nil
+}
+
+func encodeCall(uniqueID, action string, payload any) ([]byte, error) {
+	return json.Marshal([]any{messageTypeCall, uniqueID, action, payload})
+}
+
+func encodeCallResult(uniqueID string, payload any) ([]byte, error) {
+	return json.Marshal([]any{messageTypeCallResult, uniqueID, payload})
+}
+
+func encodeCallError(uniqueID, code, description string) ([]byte, error) {
+	return json.Marshal([]any{messageTypeCallError, uniqueID, code, description, struct{}{}})
+}
+
+// CallError é a resposta CALLERROR do ponto de recarga a um pedido da central.
+type CallError struct {
+	Code        string
+	Description string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("ponto de recarga respondeu %s: %s", e.Code, e.Description)
+}
+
+// --- PAYLOADS OCPP 1.6 (apenas os campos usados) ---
+
+// Ações iniciadas pelo ponto de recarga.
+const (
+	actionBootNotification   = "BootNotification"
+	actionHeartbeat          = "Heartbeat"
+	actionStatusNotification = "StatusNotification"
+	actionAuthorize          = "Authorize"
+	actionStartTransaction   = "StartTransaction"
+	actionMeterValues        = "MeterValues"
+	actionStopTransaction    = "StopTransaction"
+)
+
+// Ações iniciadas pela central.
+const (
+	actionReserveNow        = "ReserveNow"
+	actionCancelReservation = "CancelReservation"
+)
+
+// Estados de conector do StatusNotification que impedem novas reservas.
+const (
+	connectorFaulted     = "Faulted"
+	connectorUnavailable = "Unavailable"
+)
+
+// Valores de status usados nas respostas.
+const (
+	statusAccepted = "Accepted"
+	statusRejected = "Rejected"
+	statusInvalid  = "Invalid"
+)
+
+type bootNotificationRequest struct {
+	ChargePointVendor       string `json:"chargePointVendor"`
+	ChargePointModel        string `json:"chargePointModel"`
+	ChargePointSerialNumber string `json:"chargePointSerialNumber,omitempty"`
+	FirmwareVersion         string `json:"firmwareVersion,omitempty"`
+}
+
+type bootNotificationResponse struct {
+	Status      string    `json:"status"`
+	CurrentTime time.Time `json:"currentTime"`
+	Interval    int       `json:"interval"` // Intervalo de heartbeat, em segundos
+}
+
+type heartbeatResponse struct {
+	CurrentTime time.Time `json:"currentTime"`
+}
+
+type statusNotificationRequest struct {
+	ConnectorID int    `json:"connectorId"`
+	ErrorCode   string `json:"errorCode"`
+	Status      string `json:"status"` // Available, Preparing, Charging, Reserved, Unavailable, Faulted...
+}
+
+type idTagInfo struct {
+	Status string `json:"status"`
+}
+
+type authorizeRequest struct {
+	IDTag string `json:"idTag"`
+}
+
+type authorizeResponse struct {
+	IDTagInfo idTagInfo `json:"idTagInfo"`
+}
+
+type startTransactionRequest struct {
+	ConnectorID   int       `json:"connectorId"`
+	IDTag         string    `json:"idTag"`
+	MeterStart    int       `json:"meterStart"` // Wh
+	ReservationID *int      `json:"reservationId,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+type startTransactionResponse struct {
+	IDTagInfo     idTagInfo `json:"idTagInfo"`
+	TransactionID int       `json:"transactionId"`
+}
+
+type sampledValue struct {
+	Value     string `json:"value"`
+	Measurand string `json:"measurand,omitempty"` // Vazio: Energy.Active.Import.Register
+	Unit      string `json:"unit,omitempty"`
+}
+
+type meterValue struct {
+	Timestamp    time.Time      `json:"timestamp"`
+	SampledValue []sampledValue `json:"sampledValue"`
+}
+
+type meterValuesRequest struct {
+	ConnectorID   int          `json:"connectorId"`
+	TransactionID *int         `json:"transactionId,omitempty"`
+	MeterValue    []meterValue `json:"meterValue"`
+}
+
+type stopTransactionRequest struct {
+	TransactionID   int          `json:"transactionId"`
+	IDTag           string       `json:"idTag,omitempty"`
+	MeterStop       int          `json:"meterStop"` // Wh
+	Timestamp       time.Time    `json:"timestamp"`
+	Reason          string       `json:"reason,omitempty"`
+	TransactionData []meterValue `json:"transactionData,omitempty"`
+}
+
+type stopTransactionResponse struct {
+	IDTagInfo *idTagInfo `json:"idTagInfo,omitempty"`
+}
+
+type reserveNowRequest struct {
+	ConnectorID   int       `json:"connectorId"`
+	ExpiryDate    time.Time `json:"expiryDate"`
+	IDTag         string    `json:"idTag"`
+	ReservationID int       `json:"reservationId"`
+}
+
+type reserveNowResponse struct {
+	Status string `json:"status"` // Accepted, Faulted, Occupied, Rejected, Unavailable
+}
+
+type cancelReservationRequest struct {
+	ReservationID int `json:"reservationId"`
+}
+
+type cancelReservationResponse struct {
+	Status string `json:"status"` // Accepted, Rejected
+}
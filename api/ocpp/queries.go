@@ -0,0 +1,97 @@
+package ocpp
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// active informa se a reserva ainda ocupa o conector.
+func (r *reservation) active() bool {
+	return r.status != reservationAborted && r.status != reservationCharged && r.status != reservationNoShow
+}
+
+// connectorIDs retorna os conectores conhecidos pelo StatusNotification (ou o conector 1).
+// Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) connectorIDs() []int {
+	var ids []int
+	for connectorID := range cp.connectorStatus {
+		if connectorID > 0 {
+			ids = append(ids, connectorID)
+		}
+	}
+	if len(ids) == 0 {
+		ids = []int{1}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// answerScheduleQuery responde QUERY_SCHEDULE com as reservas de cada conector no
+// intervalo pedido. Tipo e potência dos conectores não são conhecidos pelo OCPP.
+func (cp *ChargePoint) answerScheduleQuery(env schemas.Envelope) {
+	var cmd schemas.QueryScheduleCommand
+	if err := env.DecodePayload(&cmd); err != nil {
+		log.Printf("[OCPP] '%s': %v", cp.ID, err)
+		return
+	}
+	resp := schemas.ScheduleResponse{WorkerID: cp.ID, CorrelationID: cmd.CorrelationID, From: cmd.From, To: cmd.To, GeneratedAt: time.Now().UTC()}
+
+	cp.mu.Lock()
+	for _, connectorID := range cp.connectorIDs() {
+		schedule := schemas.ConnectorSchedule{ConnectorID: connectorID, Status: schemas.ConnectorAvailable, Reservations: []schemas.ScheduledWindow{}}
+		for _, r := range cp.reservations {
+			if r.connectorID != connectorID || !r.active() {
+				continue
+			}
+			switch {
+			case r.status == reservationCharging:
+				schedule.Status = schemas.ConnectorCharging
+			case schedule.Status == schemas.ConnectorAvailable:
+				schedule.Status = schemas.ConnectorReserved
+			}
+			if r.window.EndTimeUTC.After(cmd.From) && r.window.StartTimeUTC.Before(cmd.To) {
+				schedule.Reservations = append(schedule.Reservations, schemas.ScheduledWindow{Window: r.window, Status: r.status})
+			}
+		}
+		if cp.connectorStatus[connectorID] == connectorFaulted {
+			schedule.Status = schemas.ConnectorFaulted
+		}
+		resp.Connectors = append(resp.Connectors, schedule)
+	}
+	cp.mu.Unlock()
+
+	cp.reply(cmd.ResponseTopic, schemas.MsgScheduleResponse, env.Version, resp)
+}
+
+// answerWindowQuery responde QUERY_WINDOW com os conectores livres na janela, os mesmos
+// que o PREPARE poderia reservar (freeConnectors).
+func (cp *ChargePoint) answerWindowQuery(env schemas.Envelope) {
+	var cmd schemas.QueryWindowCommand
+	if err := env.DecodePayload(&cmd); err != nil {
+		log.Printf("[OCPP] '%s': %v", cp.ID, err)
+		return
+	}
+	resp := schemas.WindowResponse{WorkerID: cp.ID, CorrelationID: cmd.CorrelationID, Window: cmd.Window}
+
+	cp.mu.Lock()
+	if cp.booted && cp.conn != nil {
+		resp.ConnectorIDs = cp.freeConnectors(cmd.Window)
+	}
+	cp.mu.Unlock()
+	resp.Available = len(resp.ConnectorIDs) > 0
+
+	cp.reply(cmd.ResponseTopic, schemas.MsgWindowResponse, env.Version, resp)
+}
+
+func (cp *ChargePoint) reply(topic, msgType string, version int, resp any) {
+	respBytes, err := schemas.EncodeMessage(msgType, cp.ID, version, resp)
+	if err != nil {
+		log.Printf("[OCPP] '%s': Erro ao serializar resposta %s: %v", cp.ID, msgType, err)
+		return
+	}
+	mqtt.Publish(topic, string(respBytes))
+}
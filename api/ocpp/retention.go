@@ -0,0 +1,124 @@
+package ocpp
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// archivedReservation é o registro de uma reserva encerrada no arquivo.
+type archivedReservation struct {
+	ChargePointID string                    `json:"charge_point_id"`
+	ConnectorID   int                       `json:"connector_id"`
+	TransactionID string                    `json:"transaction_id"`
+	ReservationID int                       `json:"reservation_id"`
+	Window        schemas.ReservationWindow `json:"window"`
+	Status        string                    `json:"status"`
+	FinishedAt    time.Time                 `json:"finished_at"`
+}
+
+// add coloca a reserva na agenda do ponto de recarga. Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) add(r *reservation) {
+	cp.reservations = append(cp.reservations, r)
+	cp.index.Insert(r.window, r)
+}
+
+// remove tira a reserva da agenda. Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) remove(r *reservation) {
+	cp.reservations = slices.DeleteFunc(cp.reservations, func(other *reservation) bool { return other == r })
+	cp.index.Delete(r.window, r)
+}
+
+// finish encerra a reserva com um estado final; ela fica na agenda até ser arquivada.
+// Deve ser chamada com cp.mu travado.
+func (r *reservation) finish(status string, at time.Time) {
+	r.status, r.finishedAt = status, at
+}
+
+// reserved informa se alguma reserva ativa do conector se sobrepõe à janela. Só as
+// reservas que cruzam a janela são examinadas, pelo índice. Deve ser chamada com cp.mu
+// travado.
+func (cp *ChargePoint) reserved(connectorID int, window schemas.ReservationWindow) bool {
+	for _, r := range cp.index.Overlapping(window) {
+		if r.connectorID == connectorID && r.active() {
+			return true
+		}
+	}
+	return false
+}
+
+// collectReservations arquiva, a cada schedule.SweepInterval, as reservas encerradas há
+// mais que Config.Retention em todos os pontos de recarga. Sem Config.Archive, as
+// reservas encerradas não são removidas. Termina com o contexto da central.
+func (cs *CentralSystem) collectReservations() {
+	if cs.cfg.Archive == nil {
+		return
+	}
+	ticker := time.NewTicker(schedule.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.ctx.Done():
+			return
+		case now := <-ticker.C:
+			cs.mu.Lock()
+			chargePoints := make([]*ChargePoint, 0, len(cs.chargePoints))
+			for _, cp := range cs.chargePoints {
+				chargePoints = append(chargePoints, cp)
+			}
+			cs.mu.Unlock()
+			for _, cp := range chargePoints {
+				cp.archiveFinished(now.UTC())
+			}
+		}
+	}
+}
+
+// archiveFinished grava as reservas encerradas há mais que a retenção no arquivo e só
+// então as tira da agenda: se a gravação falhar, elas ficam para a próxima varredura. A
+// escrita acontece fora do lock. Retorna quantas reservas foram arquivadas.
+func (cp *ChargePoint) archiveFinished(now time.Time) int {
+	archive := cp.cs.cfg.Archive
+	if archive == nil {
+		return 0
+	}
+	var (
+		expired []*reservation
+		records []any
+	)
+	cp.mu.Lock()
+	for _, r := range cp.reservations {
+		if r.active() || now.Sub(r.finishedAt) < cp.cs.cfg.Retention {
+			continue
+		}
+		expired = append(expired, r)
+		records = append(records, archivedReservation{
+			ChargePointID: cp.ID,
+			ConnectorID:   r.connectorID,
+			TransactionID: r.transactionID,
+			ReservationID: r.reservationID,
+			Window:        r.window,
+			Status:        r.status,
+			FinishedAt:    r.finishedAt,
+		})
+	}
+	cp.mu.Unlock()
+	if len(expired) == 0 {
+		return 0
+	}
+
+	if err := archive.Append(records...); err != nil {
+		log.Printf("[OCPP] '%s': ERRO ao arquivar %d reserva(s) encerrada(s): %v", cp.ID, len(expired), err)
+		return 0
+	}
+	cp.mu.Lock()
+	for _, r := range expired {
+		cp.remove(r)
+	}
+	cp.mu.Unlock()
+	log.Printf("[OCPP] '%s': %d reserva(s) encerrada(s) movida(s) para '%s'.", cp.ID, len(expired), archive.Path())
+	return len(expired)
+}
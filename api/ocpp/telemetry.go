@@ -0,0 +1,100 @@
+package ocpp
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// telemetryStatus converte o estado de conector do OCPP 1.6 no estado de telemetria.
+func telemetryStatus(status string) string {
+	switch status {
+	case connectorFaulted:
+		return schemas.TelemetryFaulted
+	case connectorUnavailable:
+		return schemas.TelemetryUnavailable
+	case "Preparing", "Charging", "SuspendedEVSE", "SuspendedEV", "Finishing":
+		return schemas.TelemetryOccupied
+	}
+	return schemas.TelemetryAvailable // Available, Reserved
+}
+
+// recordMeasurements guarda as medições de tensão, corrente, potência e temperatura do
+// conector, dentro ou fora de uma transação. Deve ser chamada com cp.mu travado.
+func (cp *ChargePoint) recordMeasurements(req meterValuesRequest) {
+	m := cp.measurements[req.ConnectorID]
+	for _, mv := range req.MeterValue {
+		for _, sv := range mv.SampledValue {
+			value, err := strconv.ParseFloat(sv.Value, 64)
+			if err != nil {
+				continue
+			}
+			switch sv.Measurand {
+			case "Voltage":
+				m.VoltageV = value
+			case "Current.Import":
+				m.CurrentA = value
+			case "Power.Active.Import":
+				m.PowerKW = toKilo(value, sv.Unit, "W")
+			case "Temperature":
+				m.TemperatureC = value
+				if strings.EqualFold(sv.Unit, "Fahrenheit") {
+					m.TemperatureC = (value - 32) * 5 / 9
+				}
+			}
+		}
+	}
+	cp.measurements[req.ConnectorID] = m
+}
+
+// telemetry monta a telemetria com o último StatusNotification e as últimas medições de
+// cada conector. O conector 0 representa o ponto de recarga inteiro. Deve ser chamada
+// com cp.mu travado.
+func (cp *ChargePoint) telemetry() schemas.WorkerTelemetry {
+	telemetry := schemas.WorkerTelemetry{WorkerID: cp.ID, Enterprise: cp.cs.cfg.Enterprise, Timestamp: time.Now().UTC()}
+	ids := cp.connectorIDs()
+
+	faulted, available := 0, 0
+	for _, connectorID := range ids {
+		connector := cp.measurements[connectorID]
+		connector.ConnectorID = connectorID
+		connector.Status = telemetryStatus(cp.connectorStatus[connectorID])
+		if connector.Status == schemas.TelemetryFaulted {
+			connector.ErrorCode = cp.connectorErrors[connectorID]
+			faulted++
+		}
+		if connector.Status == schemas.TelemetryAvailable {
+			available++
+		}
+		telemetry.Connectors = append(telemetry.Connectors, connector)
+	}
+
+	switch whole := telemetryStatus(cp.connectorStatus[0]); {
+	case whole == schemas.TelemetryFaulted || whole == schemas.TelemetryUnavailable:
+		telemetry.Status = whole
+	case faulted == len(ids):
+		telemetry.Status = schemas.TelemetryFaulted
+	case available == 0:
+		telemetry.Status = schemas.TelemetryOccupied
+	default:
+		telemetry.Status = schemas.TelemetryAvailable
+	}
+	return telemetry
+}
+
+// publishTelemetry publica a telemetria no tópico do ponto de recarga, como o cpworker.
+func (cp *ChargePoint) publishTelemetry() {
+	cp.mu.Lock()
+	telemetry := cp.telemetry()
+	cp.mu.Unlock()
+	payload, err := schemas.EncodeMessage(schemas.MsgWorkerTelemetry, cp.ID, schemas.ProtocolVersion, telemetry)
+	if err != nil {
+		log.Printf("[OCPP] '%s': Erro ao serializar telemetria: %v", cp.ID, err)
+		return
+	}
+	mqtt.Publish(cp.topic("telemetry"), string(payload))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/ocpp"
+	"github.com/4r7hur0/PBL-2/api/schedule"
+)
+
+// ocppCentral atende os pontos de recarga OCPP 1.6-J em /ocpp/:chargePointId.
+var ocppCentral *ocpp.CentralSystem
+
+// startOCPPCentral cria a central OCPP. Os pontos de recarga usam os tópicos MQTT de
+// worker da empresa e se anunciam no registro de workers como um cpworker.
+// OCPP_CHARGE_POINTS lista os pontos aceitos com as suas senhas ("CP-01=senha,...");
+// OCPP_HEARTBEAT_INTERVAL define o heartbeat e NO_SHOW_GRACE a tolerância para a chegada
+// do veículo. As reservas encerradas seguem RESERVATION_RETENTION e vão para
+// OCPP_RESERVATION_ARCHIVE.
+func startOCPPCentral(ctx context.Context) {
+	cfg := ocpp.Config{
+		Enterprise:       enterpriseName,
+		PricePerKWh:      pricePerKWh,
+		IdleFeePerMinute: idleFeePerMinute,
+		PrepareTimeout:   stateMgr.PrepareTimeout(),
+		Retention:        stateMgr.Retention(),
+		Passwords:        make(map[string]string),
+		WorkerAnnounced:  announcedByMQTTWorker,
+	}
+	if raw := os.Getenv("OCPP_HEARTBEAT_INTERVAL"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval <= 0 {
+			log.Printf("AVISO: OCPP_HEARTBEAT_INTERVAL inválido ('%s'). Usando o padrão.", raw)
+		} else {
+			cfg.HeartbeatInterval = interval
+		}
+	}
+	if raw := os.Getenv("NO_SHOW_GRACE"); raw != "" {
+		grace, err := time.ParseDuration(raw)
+		if err != nil || grace <= 0 {
+			log.Printf("AVISO: NO_SHOW_GRACE inválido ('%s'). Usando o padrão.", raw)
+		} else {
+			cfg.NoShowGrace = grace
+		}
+	}
+	archivePath := os.Getenv("OCPP_RESERVATION_ARCHIVE")
+	if archivePath == "" {
+		archivePath = fmt.Sprintf("archive/ocpp-reservations-%s.jsonl", ownedCity)
+	}
+	cfg.Archive = schedule.NewArchive(archivePath)
+	for _, entry := range strings.Split(os.Getenv("OCPP_CHARGE_POINTS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, password, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(id) == "" || password == "" {
+			log.Printf("AVISO: Entrada de OCPP_CHARGE_POINTS sem senha ('%s') ignorada. Use ID=senha.", strings.TrimSpace(id))
+			continue
+		}
+		cfg.Passwords[strings.TrimSpace(id)] = password
+	}
+	if len(cfg.Passwords) == 0 {
+		log.Printf("[%s] OCPP_CHARGE_POINTS vazio: a central OCPP recusa todas as conexões.", enterpriseName)
+	}
+	ocppCentral = ocpp.NewCentralSystem(ctx, cfg)
+}
+
+// announcedByMQTTWorker informa se o ID pertence a um worker MQTT online no registro. Os
+// pontos OCPP também aparecem no registro, mas com a capacidade OCPP no heartbeat; o
+// status retido de um ponto OCPP (sem heartbeat depois de um reinício da API) deixa de
+// contar quando expira, como o de qualquer worker.
+func announcedByMQTTWorker(id string) bool {
+	workersMux.RLock()
+	defer workersMux.RUnlock()
+	p, ok := workers[id]
+	return ok && p.online(time.Now()) && (p.capabilities == nil || !p.capabilities.OCPP)
+}
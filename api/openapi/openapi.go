@@ -0,0 +1,192 @@
+// Package openapi embute a especificação OpenAPI da API das empresas e a confere com as
+// rotas registradas no Gin, para que o contrato publicado não se afaste do código.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed openapi.json
+var specJSON []byte
+
+const componentsPrefix = "#/components/schemas/"
+
+var httpMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Document retorna a especificação completa. Os schemas dos tipos do pacote schemas são
+// gerados a partir das structs e acrescentados a components.schemas.
+func Document() (map[string]any, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(specJSON, &doc); err != nil {
+		return nil, fmt.Errorf("openapi.json inválido: %w", err)
+	}
+	components, _ := doc["components"].(map[string]any)
+	if components == nil {
+		components = make(map[string]any)
+		doc["components"] = components
+	}
+	componentSchemas, _ := components["schemas"].(map[string]any)
+	if componentSchemas == nil {
+		componentSchemas = make(map[string]any)
+		components["schemas"] = componentSchemas
+	}
+
+	builder := schemas.NewSchemaBuilder(componentsPrefix)
+	for _, t := range schemas.AllTypes() {
+		builder.SchemaOf(t)
+	}
+	for name, schema := range builder.Defs {
+		if _, exists := componentSchemas[name]; !exists { // Os escritos à mão prevalecem
+			componentSchemas[name] = schema
+		}
+	}
+	return doc, nil
+}
+
+// Handler serve a especificação em JSON.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, err := Document()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+// Operations lista as operações da especificação no formato "MÉTODO /caminho".
+func Operations(doc map[string]any) []string {
+	paths, _ := doc["paths"].(map[string]any)
+	var operations []string
+	for path, item := range paths {
+		methods, _ := item.(map[string]any)
+		for _, method := range httpMethods {
+			if _, ok := methods[method]; ok {
+				operations = append(operations, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+// CheckRoutes confere se as rotas do Gin e as operações da especificação coincidem e se
+// todas as referências a components.schemas existem.
+func CheckRoutes(routes gin.RoutesInfo) error {
+	doc, err := Document()
+	if err != nil {
+		return err
+	}
+
+	documented := make(map[string]bool)
+	for _, operation := range Operations(doc) {
+		documented[operation] = true
+	}
+	var undocumented []string
+	for _, route := range routes {
+		operation := route.Method + " " + ginPathToOpenAPI(route.Path)
+		if !documented[operation] {
+			undocumented = append(undocumented, operation)
+		}
+		delete(documented, operation)
+	}
+
+	var problems []string
+	if len(undocumented) > 0 {
+		sort.Strings(undocumented)
+		problems = append(problems, fmt.Sprintf("rotas sem documentação: %v", undocumented))
+	}
+	if len(documented) > 0 {
+		var missing []string
+		for operation := range documented {
+			missing = append(missing, operation)
+		}
+		sort.Strings(missing)
+		problems = append(problems, fmt.Sprintf("operações documentadas sem rota: %v", missing))
+	}
+	if unresolved := unresolvedRefs(doc); len(unresolved) > 0 {
+		problems = append(problems, fmt.Sprintf("referências sem schema: %v", unresolved))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("especificação OpenAPI divergente: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ginPathToOpenAPI converte "/transactions/:id" em "/transactions/{id}".
+func ginPathToOpenAPI(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func unresolvedRefs(doc map[string]any) []string {
+	components, _ := doc["components"].(map[string]any)
+	componentSchemas, _ := components["schemas"].(map[string]any)
+	responses, _ := components["responses"].(map[string]any)
+
+	missing := make(map[string]bool)
+	var walk func(node any)
+	walk = func(node any) {
+		switch value := node.(type) {
+		case map[string]any:
+			if ref, ok := value["$ref"].(string); ok {
+				name := ref[strings.LastIndex(ref, "/")+1:]
+				switch {
+				case strings.HasPrefix(ref, componentsPrefix):
+					if _, ok := componentSchemas[name]; !ok {
+						missing[ref] = true
+					}
+				case strings.HasPrefix(ref, "#/components/responses/"):
+					if _, ok := responses[name]; !ok {
+						missing[ref] = true
+					}
+				}
+			}
+			for _, child := range value {
+				walk(child)
+			}
+		case []any:
+			for _, child := range value {
+				walk(child)
+			}
+		case *schemas.JSONSchema:
+			if value.Ref != "" {
+				walk(map[string]any{"$ref": value.Ref})
+			}
+			for _, child := range value.Properties {
+				walk(child)
+			}
+			if value.Items != nil {
+				walk(value.Items)
+			}
+			for _, child := range value.AnyOf {
+				walk(child)
+			}
+			if additional, ok := value.AdditionalProperties.(*schemas.JSONSchema); ok {
+				walk(additional)
+			}
+		}
+	}
+	walk(doc)
+
+	refs := make([]string, 0, len(missing))
+	for ref := range missing {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
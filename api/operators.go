@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Estratégias de escolha entre operadores concorrentes de uma mesma cidade (OPERATOR_SELECTION).
+const (
+	selectByPrice        = "price"        // Menor preço por kWh primeiro
+	selectByAvailability = "availability" // Mais postos livres primeiro
+)
+
+var (
+	operatorSelection = selectByPrice
+	pricePerKWh       = 1.0 // Preço anunciado por esta API no Registry (PRICE_PER_KWH)
+	idleFeePerMinute  = 0.5 // Taxa por minuto de ociosidade além da janela reservada (IDLE_FEE_PER_MINUTE)
+)
+
+// loadOperatorConfig lê OPERATOR_SELECTION, PRICE_PER_KWH e IDLE_FEE_PER_MINUTE.
+func loadOperatorConfig() {
+	switch strategy := os.Getenv("OPERATOR_SELECTION"); strategy {
+	case "", selectByPrice:
+		operatorSelection = selectByPrice
+	case selectByAvailability:
+		operatorSelection = selectByAvailability
+	default:
+		log.Printf("AVISO: OPERATOR_SELECTION inválido ('%s'). Usando '%s'.", strategy, selectByPrice)
+	}
+
+	if raw := os.Getenv("PRICE_PER_KWH"); raw != "" {
+		price, err := strconv.ParseFloat(raw, 64)
+		if err != nil || price < 0 {
+			log.Printf("AVISO: PRICE_PER_KWH inválido ('%s'). Usando %.2f.", raw, pricePerKWh)
+		} else {
+			pricePerKWh = price
+		}
+	}
+
+	if raw := os.Getenv("IDLE_FEE_PER_MINUTE"); raw != "" {
+		fee, err := strconv.ParseFloat(raw, 64)
+		if err != nil || fee < 0 {
+			log.Printf("AVISO: IDLE_FEE_PER_MINUTE inválido ('%s'). Usando %.2f.", raw, idleFeePerMinute)
+		} else {
+			idleFeePerMinute = fee
+		}
+	}
+}
+
+// rankCandidates ordena os candidatos de uma cidade. Instâncias da mesma empresa ficam
+// juntas (a empresa é avaliada pela sua melhor instância) e, dentro da empresa, as
+// instâncias com mais postos livres vêm primeiro.
+func rankCandidates(candidates []schemas.ServiceInfo, strategy string) []schemas.ServiceInfo {
+	type enterpriseScore struct {
+		minPrice       float64
+		availablePosts int
+	}
+	scores := make(map[string]*enterpriseScore)
+	for _, c := range candidates {
+		score, ok := scores[c.EnterpriseName]
+		if !ok {
+			scores[c.EnterpriseName] = &enterpriseScore{minPrice: c.Metadata.PricePerKWh, availablePosts: c.Metadata.AvailablePosts}
+			continue
+		}
+		if c.Metadata.PricePerKWh < score.minPrice {
+			score.minPrice = c.Metadata.PricePerKWh
+		}
+		score.availablePosts += c.Metadata.AvailablePosts
+	}
+
+	ranked := make([]schemas.ServiceInfo, len(candidates))
+	copy(ranked, candidates)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.EnterpriseName != b.EnterpriseName {
+			sa, sb := scores[a.EnterpriseName], scores[b.EnterpriseName]
+			if strategy == selectByAvailability {
+				if sa.availablePosts != sb.availablePosts {
+					return sa.availablePosts > sb.availablePosts
+				}
+				if sa.minPrice != sb.minPrice {
+					return sa.minPrice < sb.minPrice
+				}
+			} else {
+				if sa.minPrice != sb.minPrice {
+					return sa.minPrice < sb.minPrice
+				}
+				if sa.availablePosts != sb.availablePosts {
+					return sa.availablePosts > sb.availablePosts
+				}
+			}
+			return a.EnterpriseName < b.EnterpriseName
+		}
+		return a.Metadata.AvailablePosts > b.Metadata.AvailablePosts
+	})
+	return ranked
+}
+
+// currentMetadata monta os metadados desta API a partir do estado atual.
+func currentMetadata() schemas.ServiceMetadata {
+	return schemas.ServiceMetadata{
+		PricePerKWh:    pricePerKWh,
+		AvailablePosts: stateMgr.AvailablePosts(time.Now().UTC()),
+	}
+}
+
+// startMetadataUpdater atualiza periodicamente os metadados enviados nas renovações do lease.
+func startMetadataUpdater(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			registryClient.UpdateMetadata(currentMetadata())
+		}
+	}()
+}
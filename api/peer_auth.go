@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/client"
+	"github.com/4r7hur0/PBL-2/msp"
+	rc "github.com/4r7hur0/PBL-2/registry/registry_client"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Autenticação entre APIs de empresas diferentes (2PC e relatórios de custo).
+// O canal usa TLS mútuo com certificados emitidos pela CA de TLS do MSP, e cada
+// requisição é assinada com a identidade MSP da empresa, com timestamp e nonce
+// para impedir que uma requisição capturada seja reenviada. Cada empresa tem a sua
+// identidade: o certificado TLS tem o mesmo CN da identidade MSP, que precisa ser a
+// dona (Owner) do registro da empresa no Registry.
+
+const (
+	headerPeerMSPID       = "X-PBL-MSP-ID"
+	headerPeerEnterprise  = "X-PBL-Enterprise"  // Empresa que envia; coberta pela assinatura
+	headerPeerCertificate = "X-PBL-Certificate" // PEM em base64
+	headerPeerTimestamp   = "X-PBL-Timestamp"
+	headerPeerNonce       = "X-PBL-Nonce"
+	headerPeerSignature   = "X-PBL-Signature" // Base64
+
+	peerRequestMaxAge = 2 * time.Minute
+)
+
+var (
+	// Nil: TLS desativado (API_INSECURE_PEERS=true). O servidor aceita clientes sem
+	// certificado (carros, /status, carregadores OCPP); o cliente exige o do servidor.
+	peerServerTLSConfig *tls.Config
+	peerClientTLSConfig *tls.Config
+	peerTLSCertPath     string
+	peerTLSKeyPath      string
+	peerTLSRoots        msp.TrustedRoots // CAs de TLS por MSP
+	peerTrustedMSPs     msp.TrustedRoots
+	peerCredentials     *rc.Credentials // Identidade usada para assinar as requisições enviadas
+	insecurePeers       bool
+
+	seenNonces   = make(map[string]time.Time) // Nonces aceitos dentro da janela de validade
+	seenNoncesMu sync.Mutex
+)
+
+// loadPeerSecurity lê a configuração de segurança entre APIs:
+//   - API_TLS_CERT_PATH / API_TLS_KEY_PATH: certificado TLS desta API (servidor e cliente),
+//     emitido para o hostname da API e com o CN da sua identidade MSP
+//   - API_TLS_CA_PATHS: CAs de TLS por MSP ("Org1MSP=/caminho,..."), que emitem os certificados das APIs
+//   - API_TRUSTED_CA_PATHS: CAs de identidade por MSP ("Org1MSP=/caminho,...")
+//   - API_INSECURE_PEERS=true: desativa tudo isso (apenas desenvolvimento)
+func loadPeerSecurity(credentials *rc.Credentials) error {
+	insecurePeers = os.Getenv("API_INSECURE_PEERS") == "true"
+	if insecurePeers {
+		log.Println("AVISO: API_INSECURE_PEERS=true. Chamadas entre APIs sem TLS e sem assinatura.")
+		return nil
+	}
+	if credentials == nil {
+		return errors.New("identidade MSP não carregada; defina as variáveis FABRIC_* ou API_INSECURE_PEERS=true")
+	}
+	peerCredentials = credentials
+
+	roots, err := msp.LoadTrustedRoots(os.Getenv("API_TRUSTED_CA_PATHS"))
+	if err != nil {
+		return fmt.Errorf("API_TRUSTED_CA_PATHS: %w", err)
+	}
+	if len(roots) == 0 {
+		return errors.New("API_TRUSTED_CA_PATHS não definida")
+	}
+	peerTrustedMSPs = roots
+
+	peerTLSCertPath = os.Getenv("API_TLS_CERT_PATH")
+	peerTLSKeyPath = os.Getenv("API_TLS_KEY_PATH")
+	if peerTLSCertPath == "" || peerTLSKeyPath == "" {
+		return errors.New("API_TLS_CERT_PATH e API_TLS_KEY_PATH são obrigatórias")
+	}
+	keyPair, err := tls.LoadX509KeyPair(peerTLSCertPath, peerTLSKeyPath)
+	if err != nil {
+		return fmt.Errorf("falha ao carregar certificado TLS: %w", err)
+	}
+	tlsRoots, err := msp.LoadTrustedRoots(os.Getenv("API_TLS_CA_PATHS"))
+	if err != nil {
+		return fmt.Errorf("API_TLS_CA_PATHS: %w", err)
+	}
+	if len(tlsRoots) == 0 {
+		return errors.New("API_TLS_CA_PATHS não definida")
+	}
+	peerTLSRoots = tlsRoots
+	tlsCAs := x509.NewCertPool()
+	for _, path := range strings.Split(os.Getenv("API_TLS_CA_PATHS"), ",") {
+		if _, caPath, found := strings.Cut(strings.TrimSpace(path), "="); found {
+			if err := msp.AppendCertsFromPath(tlsCAs, caPath); err != nil {
+				return fmt.Errorf("falha ao carregar CA de TLS: %w", err)
+			}
+		}
+	}
+
+	peerServerTLSConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{keyPair},
+		ClientCAs:    tlsCAs,
+		// Carros e ferramentas consultam endpoints públicos sem certificado; o certificado
+		// do cliente é exigido pelo middleware apenas nas rotas entre empresas.
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	// O hostname do servidor é conferido normalmente; a identidade, em verifyPeerServer
+	peerClientTLSConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{keyPair},
+		RootCAs:      tlsCAs,
+	}
+	log.Printf("TLS mútuo entre APIs ativo. MSPs confiáveis: %v", roots.MSPIDs())
+	return nil
+}
+
+// apiScheme retorna o esquema das URLs anunciadas no Registry.
+func apiScheme() string {
+	if peerServerTLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// newPeerHTTPClient cria um cliente HTTP para falar com outras APIs. Além da cadeia e do
+// hostname, o certificado do servidor precisa pertencer à identidade que registrou a API
+// desse hostname no Registry.
+func newPeerHTTPClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if peerClientTLSConfig != nil {
+		config := peerClientTLSConfig.Clone()
+		config.VerifyConnection = verifyPeerServer
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+	return client
+}
+
+// verifyPeerServer confere, no lado cliente, que o servidor é a API registrada no hostname.
+func verifyPeerServer(cs tls.ConnectionState) error {
+	atHost := func(s schemas.ServiceInfo) bool {
+		u, err := url.Parse(s.ApiURL)
+		return err == nil && strings.EqualFold(u.Hostname(), cs.ServerName)
+	}
+	service, ok := registeredService(atHost)
+	if !ok {
+		return fmt.Errorf("nenhuma API registrada no Registry em '%s'", cs.ServerName)
+	}
+	return checkPeerIdentity(service.Owner, cs.PeerCertificates[0], time.Now())
+}
+
+// registeredService procura um serviço na visão local do Registry, mantida pelo watch.
+// Nunca consulta o Registry: é chamada no handshake TLS e em cada requisição entre APIs.
+// Um serviço que ainda não chegou pelo watch é tratado como desconhecido e recusado.
+func registeredService(match func(schemas.ServiceInfo) bool) (schemas.ServiceInfo, bool) {
+	services, _ := registryClient.CachedServices()
+	for _, service := range services {
+		if match(service) {
+			return service, true
+		}
+	}
+	return schemas.ServiceInfo{}, false
+}
+
+// peerOwnsURL informa se a empresa autenticada por requirePeerAuth registrou no Registry
+// a API em apiURL. Sem autenticação entre APIs (API_INSECURE_PEERS), toda requisição passa.
+func peerOwnsURL(c *gin.Context, apiURL string) bool {
+	if insecurePeers {
+		return true
+	}
+	enterprise := c.GetString("peerEnterprise")
+	_, ok := registeredService(func(s schemas.ServiceInfo) bool { return s.EnterpriseName == enterprise && s.ApiURL == apiURL })
+	return ok
+}
+
+// peerAPIURL retorna a URL que a empresa autenticada por requirePeerAuth registrou no
+// Registry. Se ela tiver mais de uma API registrada, vale a informada na requisição
+// (claimed), desde que seja uma delas. Sem autenticação entre APIs, vale claimed.
+func peerAPIURL(c *gin.Context, claimed string) (string, bool) {
+	if insecurePeers {
+		return claimed, true
+	}
+	enterprise := c.GetString("peerEnterprise")
+	if service, ok := registeredService(func(s schemas.ServiceInfo) bool { return s.EnterpriseName == enterprise && s.ApiURL == claimed }); ok {
+		return service.ApiURL, true
+	}
+	services, _ := registryClient.CachedServices()
+	var registered []string
+	for _, service := range services {
+		if service.EnterpriseName == enterprise && !slices.Contains(registered, service.ApiURL) {
+			registered = append(registered, service.ApiURL)
+		}
+	}
+	if len(registered) != 1 {
+		return "", false
+	}
+	return registered[0], true
+}
+
+// checkPeerIdentity confere que o certificado TLS pertence à identidade MSP owner
+// ("MSPID/CN"): emitido pela CA de TLS do mesmo MSP e com o mesmo CN.
+func checkPeerIdentity(owner string, cert *x509.Certificate, now time.Time) error {
+	mspID, commonName, found := strings.Cut(owner, "/")
+	if !found || commonName == "" {
+		return errors.New("API sem identidade MSP no Registry")
+	}
+	pool, ok := peerTLSRoots[mspID]
+	if !ok {
+		return fmt.Errorf("MSP '%s' sem CA de TLS confiável", mspID)
+	}
+	if err := msp.VerifyChain(cert, pool, now); err != nil {
+		return fmt.Errorf("certificado TLS não emitido pela CA de TLS de %s: %w", mspID, err)
+	}
+	if cert.Subject.CommonName != commonName {
+		return fmt.Errorf("certificado TLS de '%s', mas a API pertence a '%s'", cert.Subject.CommonName, owner)
+	}
+	return nil
+}
+
+// runServer inicia o servidor HTTP, com TLS mútuo se configurado.
+func runServer(r *gin.Engine, port string) error {
+	if peerServerTLSConfig == nil {
+		return r.Run(":" + port)
+	}
+	server := &http.Server{Addr: ":" + port, Handler: r, TLSConfig: peerServerTLSConfig}
+	return server.ListenAndServeTLS(peerTLSCertPath, peerTLSKeyPath)
+}
+
+// peerSigningBytes é a mensagem assinada em cada requisição entre APIs.
+func peerSigningBytes(method, path, enterprise, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{"pbl-peer-request-v2", method, path, enterprise, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n"))
+}
+
+// newPeerClient cria o cliente da API em baseURL, com TLS mútuo (newPeerHTTPClient),
+// requisições assinadas e mensagens na versão informada.
+func newPeerClient(baseURL string, version int, timeout time.Duration) *client.Client {
+	peer := client.New(baseURL, newPeerHTTPClient(timeout))
+	peer.Sender = enterpriseName
+	peer.Version = version
+	peer.SignRequest = signPeerRequest
+	return peer
+}
+
+// signPeerRequest assina a requisição com a identidade MSP da empresa, com timestamp e nonce.
+func signPeerRequest(req *http.Request, body []byte) error {
+	if peerCredentials == nil {
+		return nil
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	nonce := uuid.New().String()
+	digest := sha256.Sum256(peerSigningBytes(req.Method, req.URL.Path, enterpriseName, timestamp, nonce, body))
+	signature, err := peerCredentials.Sign(digest[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerPeerMSPID, peerCredentials.MSPID)
+	req.Header.Set(headerPeerEnterprise, enterpriseName)
+	req.Header.Set(headerPeerCertificate, base64.StdEncoding.EncodeToString(peerCredentials.CertificatePEM))
+	req.Header.Set(headerPeerTimestamp, timestamp)
+	req.Header.Set(headerPeerNonce, nonce)
+	req.Header.Set(headerPeerSignature, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// requirePeerAuth protege as rotas chamadas apenas por outras APIs: exige certificado
+// de cliente TLS válido e assinatura MSP da requisição, com timestamp e nonce inéditos.
+// A identidade do certificado e da assinatura precisa ser a dona da empresa no Registry.
+func requirePeerAuth(c *gin.Context) {
+	if insecurePeers {
+		c.Next()
+		return
+	}
+	identity, enterprise, err := authenticatePeerRequest(c)
+	if err != nil {
+		log.Printf("[%s] Requisição entre APIs REJEITADA em %s de %s: %v", enterpriseName, c.Request.URL.Path, c.ClientIP(), err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Requisição não autenticada", "details": err.Error()})
+		return
+	}
+	c.Set("peerIdentity", identity)
+	c.Set("peerEnterprise", enterprise)
+	c.Next()
+}
+
+func authenticatePeerRequest(c *gin.Context) (identity, enterprise string, err error) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return "", "", errors.New("certificado de cliente TLS ausente")
+	}
+
+	mspID := c.GetHeader(headerPeerMSPID)
+	enterprise = c.GetHeader(headerPeerEnterprise)
+	if enterprise == "" {
+		return "", "", errors.New("empresa remetente não informada")
+	}
+	timestamp := c.GetHeader(headerPeerTimestamp)
+	nonce := c.GetHeader(headerPeerNonce)
+	certPEM, err := base64.StdEncoding.DecodeString(c.GetHeader(headerPeerCertificate))
+	if err != nil {
+		return "", "", errors.New("certificado de identidade inválido")
+	}
+	signature, err := base64.StdEncoding.DecodeString(c.GetHeader(headerPeerSignature))
+	if err != nil || len(signature) == 0 || nonce == "" {
+		return "", "", errors.New("assinatura ausente ou inválida")
+	}
+
+	now := time.Now().UTC()
+	sentAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return "", "", errors.New("timestamp inválido")
+	}
+	if age := now.Sub(sentAt); age > peerRequestMaxAge || age < -peerRequestMaxAge {
+		return "", "", fmt.Errorf("timestamp fora da janela permitida (%s)", peerRequestMaxAge)
+	}
+
+	cert, err := peerTrustedMSPs.VerifyCertificate(mspID, string(certPEM), now)
+	if err != nil {
+		return "", "", err
+	}
+
+	// O corpo é lido para conferir a assinatura e devolvido para o handler
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("falha ao ler corpo: %w", err)
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err := msp.VerifySignature(cert, peerSigningBytes(c.Request.Method, c.Request.URL.Path, enterprise, timestamp, nonce, body), signature); err != nil {
+		return "", "", err
+	}
+
+	// O canal TLS e a assinatura precisam ser da mesma identidade, e ela precisa ser a
+	// dona da empresa no Registry: outro membro do MSP não fala em nome da empresa.
+	identity = msp.Identity(mspID, cert)
+	if err := checkPeerIdentity(identity, c.Request.TLS.VerifiedChains[0][0], now); err != nil {
+		return "", "", err
+	}
+	if _, ok := registeredService(func(s schemas.ServiceInfo) bool { return s.EnterpriseName == enterprise && s.Owner == identity }); !ok {
+		return "", "", fmt.Errorf("identidade '%s' não é a dona da empresa '%s' no Registry", identity, enterprise)
+	}
+
+	// O nonce só é registrado depois da assinatura conferida, para que requisições
+	// forjadas não consumam nonces legítimos.
+	if !rememberNonce(nonce, now) {
+		return "", "", errors.New("requisição repetida (nonce já utilizado)")
+	}
+	return identity, enterprise, nil
+}
+
+// rememberNonce registra o nonce e retorna false se ele já foi visto dentro da janela.
+func rememberNonce(nonce string, now time.Time) bool {
+	seenNoncesMu.Lock()
+	defer seenNoncesMu.Unlock()
+	for n, seenAt := range seenNonces {
+		if now.Sub(seenAt) > 2*peerRequestMaxAge {
+			delete(seenNonces, n)
+		}
+	}
+	if _, seen := seenNonces[nonce]; seen {
+		return false
+	}
+	seenNonces[nonce] = now
+	return true
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"math"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// earthRadiusKm é o raio médio da Terra usado na fórmula de haversine.
+const earthRadiusKm = 6371.0
+
+// HaversineKm calcula a distância em quilômetros entre dois pontos na superfície da Terra.
+func HaversineKm(a, b schemas.GeoPoint) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := (b.Latitude - a.Latitude) * math.Pi / 180
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// RouteDistanceKm soma as distâncias de todos os trechos de uma rota.
+func RouteDistanceKm(route []schemas.RouteSegment) float64 {
+	var total float64
+	for _, segment := range route {
+		total += segment.DistanceKm
+	}
+	return total
+}
+
+// GeoJSONFeatureCollection é o documento GeoJSON (RFC 7946) exportado para o mapa da frota.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// GeoJSONFeature é uma feature GeoJSON com geometria e propriedades livres.
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONGeometry guarda as coordenadas no formato [longitude, latitude] exigido pelo GeoJSON.
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// RouteToGeoJSON converte uma rota confirmada em uma LineString com um ponto por cidade.
+// Trechos sem coordenadas são ignorados.
+func RouteToGeoJSON(transactionID string, route []schemas.RouteSegment) GeoJSONFeatureCollection {
+	collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+
+	var line [][]float64
+	for i, segment := range route {
+		if segment.Location == nil {
+			continue
+		}
+		coords := []float64{segment.Location.Longitude, segment.Location.Latitude}
+		line = append(line, coords)
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "Point", Coordinates: coords},
+			Properties: map[string]interface{}{
+				"transaction_id": transactionID,
+				"step":           i + 1,
+				"city":           segment.City,
+				"start_time_utc": segment.ReservationWindow.StartTimeUTC,
+				"end_time_utc":   segment.ReservationWindow.EndTimeUTC,
+			},
+		})
+	}
+
+	if len(line) >= 2 {
+		collection.Features = append([]GeoJSONFeature{{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "LineString", Coordinates: line},
+			Properties: map[string]interface{}{
+				"transaction_id": transactionID,
+				"distance_km":    RouteDistanceKm(route),
+			},
+		}}, collection.Features...)
+	}
+	return collection
+}
@@ -0,0 +1,97 @@
+package router
+
+import (
+	"sort"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// RoadGraph representa as ligações entre as cidades atendidas pelo sistema.
+// Hoje toda cidade com uma API ativa é ligada a todas as outras.
+type RoadGraph struct {
+	cities    []string
+	adjacency map[string][]string
+	locations map[string]schemas.GeoPoint
+}
+
+// NewRoadGraph monta o grafo de estradas a partir da lista de cidades ativas e,
+// quando conhecidas, das suas coordenadas.
+func NewRoadGraph(cities []string, locations map[string]schemas.GeoPoint) *RoadGraph {
+	sorted := make([]string, 0, len(cities))
+	seen := make(map[string]bool)
+	for _, c := range cities {
+		if c == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		sorted = append(sorted, c)
+	}
+	sort.Strings(sorted)
+
+	adjacency := make(map[string][]string, len(sorted))
+	for _, from := range sorted {
+		adjacency[from] = []string{}
+		for _, to := range sorted {
+			if from != to {
+				adjacency[from] = append(adjacency[from], to)
+			}
+		}
+	}
+	locationsCopy := make(map[string]schemas.GeoPoint, len(locations))
+	for city, location := range locations {
+		if seen[city] {
+			locationsCopy[city] = location
+		}
+	}
+	return &RoadGraph{cities: sorted, adjacency: adjacency, locations: locationsCopy}
+}
+
+// Cities retorna uma cópia da lista de cidades do grafo, em ordem alfabética.
+func (g *RoadGraph) Cities() []string {
+	if g == nil {
+		return nil
+	}
+	citiesCopy := make([]string, len(g.cities))
+	copy(citiesCopy, g.cities)
+	return citiesCopy
+}
+
+// HasCity informa se a cidade faz parte do grafo.
+func (g *RoadGraph) HasCity(city string) bool {
+	if g == nil {
+		return false
+	}
+	_, ok := g.adjacency[city]
+	return ok
+}
+
+// Neighbors retorna as cidades diretamente ligadas à cidade informada.
+func (g *RoadGraph) Neighbors(city string) []string {
+	if g == nil {
+		return nil
+	}
+	return g.adjacency[city]
+}
+
+// Location retorna as coordenadas da cidade, se conhecidas.
+func (g *RoadGraph) Location(city string) (*schemas.GeoPoint, bool) {
+	if g == nil {
+		return nil, false
+	}
+	location, ok := g.locations[city]
+	if !ok {
+		return nil, false
+	}
+	return &location, true
+}
+
+// DistanceKm retorna a distância em linha reta entre duas cidades do grafo.
+// O segundo retorno é false se alguma das cidades não tiver coordenadas.
+func (g *RoadGraph) DistanceKm(from, to string) (float64, bool) {
+	a, okA := g.Location(from)
+	b, okB := g.Location(to)
+	if !okA || !okB {
+		return 0, false
+	}
+	return HaversineKm(*a, *b), true
+}
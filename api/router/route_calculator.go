@@ -2,6 +2,7 @@ package router
 
 import (
 	"log"
+	"sort"
 	"time"
 
 	"github.com/4r7hur0/PBL-2/schemas" 
@@ -18,7 +19,7 @@ func IsValidCity(city string, citiesList []string) bool {
 	return false
 }
 
-func findAllPathsDFS(origin, destination string, citiesList []string) [][]string {
+func findAllPathsDFS(origin, destination string, graph *RoadGraph) [][]string {
 	var paths [][]string
 	var currentPath []string
 	visited := make(map[string]bool)
@@ -33,7 +34,7 @@ func findAllPathsDFS(origin, destination string, citiesList []string) [][]string
 			copy(pathCopy, currentPath)
 			paths = append(paths, pathCopy)
 		} else {
-			for _, neighbor := range citiesList {
+			for _, neighbor := range graph.Neighbors(cityNode) {
 				if !visited[neighbor] {
 					dfs(neighbor)
 				}
@@ -50,12 +51,12 @@ func findAllPathsDFS(origin, destination string, citiesList []string) [][]string
 	return paths
 }
 
-func convertPathsToRouteSegments(paths [][]string) [][]schemas.RouteSegment {
+func convertPathsToRouteSegments(paths [][]string, graph *RoadGraph) [][]schemas.RouteSegment {
 	var routeSegmentsList [][]schemas.RouteSegment
 	for _, path := range paths {
 		var singleRoute []schemas.RouteSegment
 		currentTime := time.Now().UTC() 
-		for _, city := range path {
+		for i, city := range path {
 			segment := schemas.RouteSegment{
 				City: city,
 				ReservationWindow: schemas.ReservationWindow{
@@ -63,6 +64,10 @@ func convertPathsToRouteSegments(paths [][]string) [][]schemas.RouteSegment {
 					EndTimeUTC:   currentTime.Add(1 * time.Minute),
 				},
 			}
+			segment.Location, _ = graph.Location(city)
+			if i > 0 {
+				segment.DistanceKm, _ = graph.DistanceKm(path[i-1], city)
+			}
 			singleRoute = append(singleRoute, segment)
 			currentTime = currentTime.Add(1 * time.Minute)
 		}
@@ -70,13 +75,18 @@ func convertPathsToRouteSegments(paths [][]string) [][]schemas.RouteSegment {
 			routeSegmentsList = append(routeSegmentsList, singleRoute)
 		}
 	}
+
+	// Rotas mais curtas primeiro (quando as coordenadas são conhecidas)
+	sort.SliceStable(routeSegmentsList, func(i, j int) bool {
+		return RouteDistanceKm(routeSegmentsList[i]) < RouteDistanceKm(routeSegmentsList[j])
+	})
 	return routeSegmentsList
 }
 
 // GeneratePossibleRoutes é a função principal exportada para gerar as rotas.
-// Ela recebe a lista de todas as cidades como parâmetro, tornando o pacote mais flexível.
-func GeneratePossibleRoutes(origin, destination string, allCitiesList []string) [][]schemas.RouteSegment {
-	if !IsValidCity(origin, allCitiesList) || !IsValidCity(destination, allCitiesList) {
+// Ela recebe o grafo de estradas atual como parâmetro, tornando o pacote mais flexível.
+func GeneratePossibleRoutes(origin, destination string, graph *RoadGraph) [][]schemas.RouteSegment {
+	if !graph.HasCity(origin) || !graph.HasCity(destination) {
 		log.Printf("ROUTING: Origem '%s' ou Destino '%s' inválido(s) ou não consta(m) na lista de cidades.", origin, destination)
 		return [][]schemas.RouteSegment{}
 	}
@@ -90,13 +100,14 @@ func GeneratePossibleRoutes(origin, destination string, allCitiesList []string)
 				EndTimeUTC:   utcNow.Add(1 * time.Hour),
 			},
 		}
+		segment.Location, _ = graph.Location(origin)
 		return [][]schemas.RouteSegment{{segment}}
 	}
 
-	cityPaths := findAllPathsDFS(origin, destination, allCitiesList)
+	cityPaths := findAllPathsDFS(origin, destination, graph)
 	if len(cityPaths) == 0 {
 		log.Printf("ROUTING: Nenhum caminho encontrado entre '%s' e '%s' usando DFS.", origin, destination)
 	}
-	return convertPathsToRouteSegments(cityPaths)
+	return convertPathsToRouteSegments(cityPaths, graph)
 }
 
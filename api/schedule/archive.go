@@ -0,0 +1,62 @@
+package schedule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultRetention é por quanto tempo uma reserva encerrada fica na memória antes de ir
+// para o arquivo (RESERVATION_RETENTION).
+const DefaultRetention = 24 * time.Hour
+
+// SweepInterval é o intervalo entre as varreduras de reservas encerradas.
+const SweepInterval = time.Minute
+
+// Archive acrescenta registros a um arquivo, um JSON por linha. É seguro para uso concorrente.
+type Archive struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewArchive cria o arquivo de reservas em path; diretório e arquivo são criados na primeira escrita.
+func NewArchive(path string) *Archive {
+	return &Archive{path: path}
+}
+
+// Path retorna o caminho do arquivo.
+func (a *Archive) Path() string {
+	return a.path
+}
+
+// Append grava os registros no fim do arquivo. Ou todos são serializados, ou nada é gravado.
+func (a *Archive) Append(records ...any) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("falha ao serializar registro do arquivo: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if dir := filepath.Dir(a.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("falha ao criar o diretório do arquivo: %w", err)
+		}
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("falha ao abrir o arquivo '%s': %w", a.path, err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("falha ao gravar no arquivo '%s': %w", a.path, err)
+	}
+	return f.Close()
+}
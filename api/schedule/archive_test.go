@@ -0,0 +1,70 @@
+package schedule
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveAppend(t *testing.T) {
+	type record struct {
+		ID    string  `json:"id"`
+		Value float64 `json:"value"`
+	}
+
+	tests := []struct {
+		name    string
+		batches [][]any
+		want    string
+		wantErr bool
+	}{
+		{name: "um registro por linha", batches: [][]any{{record{ID: "a", Value: 1}, record{ID: "b", Value: 2}}}, want: "{\"id\":\"a\",\"value\":1}\n{\"id\":\"b\",\"value\":2}\n"},
+		{name: "acrescenta ao fim", batches: [][]any{{record{ID: "a"}}, {record{ID: "b"}}}, want: "{\"id\":\"a\",\"value\":0}\n{\"id\":\"b\",\"value\":0}\n"},
+		{name: "lote vazio não grava nada", batches: [][]any{{}}, want: ""},
+		// NaN não é serializável: nem o registro válido do mesmo lote é gravado
+		{name: "falha de serialização não grava o lote", batches: [][]any{{record{ID: "a"}, record{ID: "b", Value: math.NaN()}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sub", "reservas.jsonl") // O diretório é criado na escrita
+			archive := NewArchive(path)
+			var err error
+			for _, batch := range tt.batches {
+				if err = archive.Append(batch...); err != nil {
+					break
+				}
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Append sem erro")
+				}
+				if _, statErr := os.Stat(path); !os.IsNotExist(statErr) {
+					t.Fatalf("arquivo criado apesar da falha: %v", statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("conteúdo %q, esperado %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveAppendUnwritablePath(t *testing.T) {
+	dir := t.TempDir()
+	archive := NewArchive(dir) // Um diretório não pode ser aberto para escrita
+	err := archive.Append(map[string]string{"id": "a"})
+	if err == nil || !strings.Contains(err.Error(), "falha ao abrir o arquivo") {
+		t.Fatalf("erro = %v, esperado falha ao abrir", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Package schedule indexa janelas de reserva por tempo e arquiva as reservas encerradas.
+// É usado pela API (StateManager) e pelo cpworker.
+package schedule
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Overlaps informa se duas janelas se sobrepõem. Janelas que apenas se tocam contam como
+// sobrepostas: é o critério do PREPARE desde o início.
+func Overlaps(a, b schemas.ReservationWindow) bool {
+	return !(a.EndTimeUTC.Before(b.StartTimeUTC) || a.StartTimeUTC.After(b.EndTimeUTC))
+}
+
+// sameWindow compara os instantes das janelas. O == de time.Time também compara o fuso e
+// a leitura monotônica, que diferem entre uma janela decodificada e a original.
+func sameWindow(a, b schemas.ReservationWindow) bool {
+	return a.StartTimeUTC.Equal(b.StartTimeUTC) && a.EndTimeUTC.Equal(b.EndTimeUTC)
+}
+
+// Tree é uma árvore de intervalos: guarda valores associados a janelas e encontra os que
+// se sobrepõem a uma janela em O(log n + k). É uma treap ordenada pelo início da janela,
+// em que cada nó guarda o maior fim da sua subárvore. O valor zero é uma árvore vazia.
+// Não é segura para uso concorrente.
+type Tree[V comparable] struct {
+	root *node[V]
+	size int
+}
+
+type node[V comparable] struct {
+	window      schemas.ReservationWindow
+	value       V
+	priority    uint32
+	maxEnd      time.Time // Maior fim de janela na subárvore
+	left, right *node[V]
+}
+
+// Len retorna quantos valores estão na árvore.
+func (t *Tree[V]) Len() int {
+	return t.size
+}
+
+// Insert acrescenta o valor com a sua janela. O mesmo par pode ser inserido mais de uma vez.
+func (t *Tree[V]) Insert(window schemas.ReservationWindow, value V) {
+	t.root = insert(t.root, &node[V]{window: window, value: value, priority: rand.Uint32(), maxEnd: window.EndTimeUTC})
+	t.size++
+}
+
+// Delete remove uma ocorrência do par janela/valor. Retorna false se ele não estava na árvore.
+func (t *Tree[V]) Delete(window schemas.ReservationWindow, value V) bool {
+	var deleted bool
+	t.root, deleted = remove(t.root, window, value)
+	if deleted {
+		t.size--
+	}
+	return deleted
+}
+
+// Overlapping retorna os valores cujas janelas se sobrepõem à janela, em ordem de início.
+func (t *Tree[V]) Overlapping(window schemas.ReservationWindow) []V {
+	var found []V
+	collect(t.root, window, &found)
+	return found
+}
+
+func insert[V comparable](n, added *node[V]) *node[V] {
+	if n == nil {
+		return added
+	}
+	if added.window.StartTimeUTC.Before(n.window.StartTimeUTC) {
+		n.left = insert(n.left, added)
+		if n.left.priority > n.priority {
+			n = rotateRight(n)
+		}
+	} else {
+		n.right = insert(n.right, added)
+		if n.right.priority > n.priority {
+			n = rotateLeft(n)
+		}
+	}
+	n.update()
+	return n
+}
+
+// remove procura o par nos dois lados quando o início empata: as rotações podem deixar
+// janelas com o mesmo início de qualquer lado do nó.
+func remove[V comparable](n *node[V], window schemas.ReservationWindow, value V) (*node[V], bool) {
+	if n == nil {
+		return nil, false
+	}
+	var deleted bool
+	switch {
+	case window.StartTimeUTC.Before(n.window.StartTimeUTC):
+		n.left, deleted = remove(n.left, window, value)
+	case window.StartTimeUTC.After(n.window.StartTimeUTC):
+		n.right, deleted = remove(n.right, window, value)
+	case sameWindow(n.window, window) && n.value == value:
+		return merge(n.left, n.right), true
+	default:
+		if n.left, deleted = remove(n.left, window, value); !deleted {
+			n.right, deleted = remove(n.right, window, value)
+		}
+	}
+	if deleted {
+		n.update()
+	}
+	return n, deleted
+}
+
+func collect[V comparable](n *node[V], window schemas.ReservationWindow, found *[]V) {
+	if n == nil || n.maxEnd.Before(window.StartTimeUTC) {
+		return // Nada na subárvore termina depois do início da janela
+	}
+	collect(n.left, window, found)
+	if Overlaps(n.window, window) {
+		*found = append(*found, n.value)
+	}
+	if n.window.StartTimeUTC.After(window.EndTimeUTC) {
+		return // À direita, tudo começa depois do fim da janela
+	}
+	collect(n.right, window, found)
+}
+
+// merge junta duas subárvores em que toda janela de a começa até o início das de b.
+func merge[V comparable](a, b *node[V]) *node[V] {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority > b.priority:
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	default:
+		b.left = merge(a, b.left)
+		b.update()
+		return b
+	}
+}
+
+func rotateRight[V comparable](n *node[V]) *node[V] {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.update()
+	l.update()
+	return l
+}
+
+func rotateLeft[V comparable](n *node[V]) *node[V] {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.update()
+	r.update()
+	return r
+}
+
+func (n *node[V]) update() {
+	n.maxEnd = n.window.EndTimeUTC
+	for _, child := range []*node[V]{n.left, n.right} {
+		if child != nil && child.maxEnd.After(n.maxEnd) {
+			n.maxEnd = child.maxEnd
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package schedule
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+var day = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// hours monta a janela das from às to horas de um dia fixo.
+func hours(from, to int) schemas.ReservationWindow {
+	return schemas.ReservationWindow{StartTimeUTC: day.Add(time.Duration(from) * time.Hour), EndTimeUTC: day.Add(time.Duration(to) * time.Hour)}
+}
+
+func TestTreeOverlapping(t *testing.T) {
+	var tree Tree[string]
+	tree.Insert(hours(8, 10), "a")
+	tree.Insert(hours(12, 14), "b")
+	tree.Insert(hours(12, 13), "c")
+	tree.Insert(hours(16, 18), "d")
+	tree.Insert(hours(9, 17), "e")
+
+	tests := []struct {
+		name  string
+		query schemas.ReservationWindow
+		want  []string
+	}{
+		{name: "antes de tudo", query: hours(1, 2), want: nil},
+		{name: "depois de tudo", query: hours(20, 22), want: nil},
+		{name: "dentro de uma janela", query: hours(8, 9), want: []string{"a", "e"}},
+		{name: "encosta no fim", query: hours(14, 15), want: []string{"b", "e"}},
+		{name: "encosta no início", query: hours(6, 8), want: []string{"a"}},
+		{name: "entre duas janelas", query: hours(10, 12), want: []string{"a", "e", "b", "c"}},
+		{name: "instante", query: hours(17, 17), want: []string{"e", "d"}},
+		{name: "cobre todas", query: hours(0, 24), want: []string{"a", "e", "b", "c", "d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tree.Overlapping(tt.query)
+			// A ordem entre janelas com o mesmo início depende das rotações
+			slices.Sort(got)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(got, want) {
+				t.Fatalf("Overlapping = %v, esperado %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTreeDelete(t *testing.T) {
+	saoPaulo := time.FixedZone("BRT", -3*60*60)
+	now := time.Now() // Com leitura monotônica
+	monotonic := schemas.ReservationWindow{StartTimeUTC: now, EndTimeUTC: now.Add(time.Hour)}
+	always := schemas.ReservationWindow{EndTimeUTC: now.Add(24 * time.Hour)}
+
+	tests := []struct {
+		name     string
+		inserted []schemas.ReservationWindow
+		deleted  schemas.ReservationWindow
+		value    string
+		want     bool
+		wantLen  int
+	}{
+		{name: "janela idêntica", inserted: []schemas.ReservationWindow{hours(8, 10)}, deleted: hours(8, 10), value: "v", want: true, wantLen: 0},
+		{
+			name:     "mesmo instante em outro fuso",
+			inserted: []schemas.ReservationWindow{hours(8, 10)},
+			deleted:  schemas.ReservationWindow{StartTimeUTC: hours(8, 10).StartTimeUTC.In(saoPaulo), EndTimeUTC: hours(8, 10).EndTimeUTC.In(saoPaulo)},
+			value:    "v", want: true, wantLen: 0,
+		},
+		{
+			name:     "sem a leitura monotônica",
+			inserted: []schemas.ReservationWindow{monotonic},
+			deleted:  schemas.ReservationWindow{StartTimeUTC: monotonic.StartTimeUTC.Round(0).UTC(), EndTimeUTC: monotonic.EndTimeUTC.Round(0).UTC()},
+			value:    "v", want: true, wantLen: 0,
+		},
+		{name: "outro fim", inserted: []schemas.ReservationWindow{hours(8, 10)}, deleted: hours(8, 11), value: "v", want: false, wantLen: 1},
+		{name: "outro valor", inserted: []schemas.ReservationWindow{hours(8, 10)}, deleted: hours(8, 10), value: "w", want: false, wantLen: 1},
+		{name: "árvore vazia", deleted: hours(8, 10), value: "v", want: false, wantLen: 0},
+		{name: "par repetido remove uma ocorrência", inserted: []schemas.ReservationWindow{hours(8, 10), hours(8, 10)}, deleted: hours(8, 10), value: "v", want: true, wantLen: 1},
+		{
+			name:     "mesmo início, fins diferentes",
+			inserted: []schemas.ReservationWindow{hours(8, 9), hours(8, 10), hours(8, 11), hours(8, 12)},
+			deleted:  hours(8, 11), value: "v", want: true, wantLen: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tree Tree[string]
+			for _, w := range tt.inserted {
+				tree.Insert(w, "v")
+			}
+			if got := tree.Delete(tt.deleted, tt.value); got != tt.want {
+				t.Fatalf("Delete = %v, esperado %v", got, tt.want)
+			}
+			if tree.Len() != tt.wantLen {
+				t.Fatalf("Len = %d, esperado %d", tree.Len(), tt.wantLen)
+			}
+			if got := len(tree.Overlapping(always)); got != tt.wantLen {
+				t.Fatalf("%d valor(es) encontrado(s) após a remoção, esperado %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestTreeDeleteKeepsMaxEnd(t *testing.T) {
+	// Remover a janela mais longa não pode deixar a subárvore "lembrando" o fim dela
+	var tree Tree[int]
+	for i := range 50 {
+		tree.Insert(hours(i%10, i%10+1), i)
+	}
+	tree.Insert(hours(0, 20), 100)
+	if !tree.Delete(hours(0, 20), 100) {
+		t.Fatal("janela longa não removida")
+	}
+	if got := tree.Overlapping(hours(15, 16)); len(got) != 0 {
+		t.Fatalf("Overlapping após a remoção = %v", got)
+	}
+	for i := range 50 {
+		if !tree.Delete(hours(i%10, i%10+1), i) {
+			t.Fatalf("valor %d não removido", i)
+		}
+	}
+	if tree.Len() != 0 || tree.root != nil {
+		t.Fatalf("árvore não vazia: Len = %d", tree.Len())
+	}
+}
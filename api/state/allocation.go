@@ -0,0 +1,172 @@
+package state
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Nomes das estratégias de alocação (ALLOCATION_STRATEGY).
+const (
+	StrategyLeastLoaded = "least-loaded"
+	StrategyBestFit     = "best-fit"
+	StrategyRoundRobin  = "round-robin"
+	StrategyConnector   = "connector"
+)
+
+// DefaultPrepareFanout é quantos workers recebem PREPARE ao mesmo tempo (ALLOCATION_FANOUT).
+const DefaultPrepareFanout = 3
+
+// AllocationRequest é o que se sabe da reserva a alocar.
+type AllocationRequest struct {
+	Window  schemas.ReservationWindow
+	Vehicle *schemas.VehicleProfile // Opcional
+}
+
+// WorkerCandidate é um worker online com a sua agenda na visão local da API, montada
+// a partir da última info publicada por ele. Connectors nil: agenda desconhecida.
+type WorkerCandidate struct {
+	WorkerID   string
+	Connectors []schemas.ConnectorStatus
+}
+
+// AllocationStrategy ordena os candidatos a receber PREPARE, do preferido ao último.
+// Os candidatos já vêm filtrados pela visão local (veja fits).
+type AllocationStrategy interface {
+	Name() string
+	Rank(candidates []WorkerCandidate, req AllocationRequest) []WorkerCandidate
+}
+
+// NewAllocationStrategy cria a estratégia pelo nome; vazio usa least-loaded.
+func NewAllocationStrategy(name string) (AllocationStrategy, error) {
+	switch name {
+	case "", StrategyLeastLoaded:
+		return scoredStrategy{name: StrategyLeastLoaded, score: loadScore}, nil
+	case StrategyBestFit:
+		return scoredStrategy{name: StrategyBestFit, score: gapScore}, nil
+	case StrategyRoundRobin:
+		return &roundRobinStrategy{}, nil
+	case StrategyConnector:
+		return scoredStrategy{name: StrategyConnector, score: powerFitScore}, nil
+	}
+	return nil, fmt.Errorf("estratégia de alocação desconhecida: '%s'", name)
+}
+
+// scoredStrategy ordena pela pontuação crescente; empates mantêm a ordem dos IDs.
+type scoredStrategy struct {
+	name  string
+	score func(c WorkerCandidate, req AllocationRequest) float64
+}
+
+func (s scoredStrategy) Name() string { return s.name }
+
+func (s scoredStrategy) Rank(candidates []WorkerCandidate, req AllocationRequest) []WorkerCandidate {
+	scores := make(map[string]float64, len(candidates))
+	for _, c := range candidates {
+		scores[c.WorkerID] = s.score(c, req)
+	}
+	ranked := append([]WorkerCandidate(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool { return scores[ranked[i].WorkerID] < scores[ranked[j].WorkerID] })
+	return ranked
+}
+
+// roundRobinStrategy começa cada alocação pelo worker seguinte ao da anterior.
+type roundRobinStrategy struct {
+	next atomic.Uint64
+}
+
+func (s *roundRobinStrategy) Name() string { return StrategyRoundRobin }
+
+func (s *roundRobinStrategy) Rank(candidates []WorkerCandidate, _ AllocationRequest) []WorkerCandidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+	start := int(s.next.Add(1)-1) % len(candidates)
+	return append(append([]WorkerCandidate(nil), candidates[start:]...), candidates[:start]...)
+}
+
+// --- VISÃO LOCAL DA AGENDA ---
+
+// usableConnectors retorna os conectores sem falha, do tipo pedido pelo veículo e livres na janela.
+func usableConnectors(c WorkerCandidate, req AllocationRequest) []schemas.ConnectorStatus {
+	var usable []schemas.ConnectorStatus
+	for _, connector := range c.Connectors {
+		if connector.Status == schemas.ConnectorFaulted {
+			continue
+		}
+		if req.Vehicle != nil && req.Vehicle.ConnectorType != "" && connector.Type != req.Vehicle.ConnectorType {
+			continue
+		}
+		free := true
+		for _, reserved := range connector.Reservations {
+			if schedule.Overlaps(req.Window, reserved) {
+				free = false
+				break
+			}
+		}
+		if free {
+			usable = append(usable, connector)
+		}
+	}
+	return usable
+}
+
+// fits informa se, pela visão local, o worker pode atender a reserva. Agenda
+// desconhecida é tratada como livre: o worker decide no PREPARE.
+func fits(c WorkerCandidate, req AllocationRequest) bool {
+	return c.Connectors == nil || len(usableConnectors(c, req)) > 0
+}
+
+// loadScore é o tempo total reservado no worker, em horas.
+func loadScore(c WorkerCandidate, _ AllocationRequest) float64 {
+	var load time.Duration
+	for _, connector := range c.Connectors {
+		for _, reserved := range connector.Reservations {
+			load += reserved.EndTimeUTC.Sub(reserved.StartTimeUTC)
+		}
+	}
+	return load.Hours()
+}
+
+// gapScore é o menor intervalo, em horas, entre a janela e uma reserva vizinha num
+// conector utilizável. Encaixar a reserva junto de outras deixa os conectores vazios
+// livres para janelas longas; conector vazio ou agenda desconhecida ficam por último.
+func gapScore(c WorkerCandidate, req AllocationRequest) float64 {
+	best := math.Inf(1)
+	for _, connector := range usableConnectors(c, req) {
+		for _, reserved := range connector.Reservations {
+			var gap time.Duration
+			if !reserved.EndTimeUTC.After(req.Window.StartTimeUTC) {
+				gap = req.Window.StartTimeUTC.Sub(reserved.EndTimeUTC)
+			} else {
+				gap = reserved.StartTimeUTC.Sub(req.Window.EndTimeUTC)
+			}
+			best = math.Min(best, gap.Hours())
+		}
+	}
+	return best
+}
+
+// powerFitScore prefere o conector de menor potência que atende o veículo, deixando os
+// mais rápidos para quem precisa deles; sem nenhum que atenda, o mais potente. Agenda
+// desconhecida fica por último.
+func powerFitScore(c WorkerCandidate, req AllocationRequest) float64 {
+	var requested float64
+	if req.Vehicle != nil {
+		requested = req.Vehicle.MaxChargePowerKW
+	}
+	best := math.Inf(1)
+	for _, connector := range usableConnectors(c, req) {
+		score := connector.PowerKW - requested
+		if score < 0 {
+			score = 1e6 - connector.PowerKW // Abaixo do pedido: atrás de todos os que atendem
+		}
+		best = math.Min(best, score)
+	}
+	return best
+}
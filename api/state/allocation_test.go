@@ -0,0 +1,123 @@
+package state
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// hours monta a janela das from às to horas de um dia fixo.
+func hours(from, to int) schemas.ReservationWindow {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	return schemas.ReservationWindow{StartTimeUTC: day.Add(time.Duration(from) * time.Hour), EndTimeUTC: day.Add(time.Duration(to) * time.Hour)}
+}
+
+func connector(connectorType string, powerKW float64, reservations ...schemas.ReservationWindow) schemas.ConnectorStatus {
+	return schemas.ConnectorStatus{ConnectorID: 1, Type: connectorType, PowerKW: powerKW, Status: schemas.ConnectorAvailable, Reservations: reservations}
+}
+
+func workerIDs(candidates []WorkerCandidate) []string {
+	ids := make([]string, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.WorkerID
+	}
+	return ids
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	candidates := []WorkerCandidate{
+		{WorkerID: "a", Connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50, hours(8, 10))}},
+		{WorkerID: "b", Connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 150, hours(14, 15))}},
+		{WorkerID: "c", Connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorType2, 22, hours(20, 23))}},
+		{WorkerID: "d"}, // Agenda desconhecida
+	}
+	req := AllocationRequest{
+		Window:  hours(12, 13),
+		Vehicle: &schemas.VehicleProfile{BatteryCapacityKWh: 60, MaxChargePowerKW: 100, ConnectorType: schemas.ConnectorCCS2},
+	}
+
+	tests := []struct {
+		strategy string
+		want     []string
+	}{
+		// Horas reservadas: a=2, b=1, c=3, d=0
+		{strategy: "", want: []string{"d", "b", "a", "c"}},
+		{strategy: StrategyLeastLoaded, want: []string{"d", "b", "a", "c"}},
+		// Intervalo até a reserva vizinha: b=1h, a=2h; c (Type2) e d sem vizinha, na ordem de entrada
+		{strategy: StrategyBestFit, want: []string{"b", "a", "c", "d"}},
+		// b atende os 100 kW com folga; a fica abaixo do pedido; c e d sem conector conhecido
+		{strategy: StrategyConnector, want: []string{"b", "a", "c", "d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.strategy, "padrão"), func(t *testing.T) {
+			strategy, err := NewAllocationStrategy(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := workerIDs(strategy.Rank(candidates, req)); !slices.Equal(got, tt.want) {
+				t.Fatalf("ordem %v, esperada %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinRotates(t *testing.T) {
+	candidates := []WorkerCandidate{{WorkerID: "a"}, {WorkerID: "b"}, {WorkerID: "c"}}
+	strategy, err := NewAllocationStrategy(StrategyRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		if got := workerIDs(strategy.Rank(candidates, AllocationRequest{})); !slices.Equal(got, want) {
+			t.Fatalf("ordem %v, esperada %v", got, want)
+		}
+	}
+	if got := strategy.Rank(nil, AllocationRequest{}); got != nil {
+		t.Fatalf("sem candidatos: %v", got)
+	}
+}
+
+func TestUnknownAllocationStrategy(t *testing.T) {
+	if _, err := NewAllocationStrategy("random"); err == nil {
+		t.Fatal("estratégia desconhecida aceita")
+	}
+}
+
+func TestFits(t *testing.T) {
+	ccs2 := &schemas.VehicleProfile{BatteryCapacityKWh: 60, MaxChargePowerKW: 50, ConnectorType: schemas.ConnectorCCS2}
+	faulted := connector(schemas.ConnectorCCS2, 50)
+	faulted.Status = schemas.ConnectorFaulted
+
+	tests := []struct {
+		name       string
+		connectors []schemas.ConnectorStatus
+		vehicle    *schemas.VehicleProfile
+		want       bool
+	}{
+		{name: "agenda desconhecida", connectors: nil, want: true},
+		{name: "conector livre", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50)}, vehicle: ccs2, want: true},
+		{name: "reserva sobreposta", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50, hours(11, 13))}, want: false},
+		// As janelas são fechadas: encostar no início ou no fim também conflita
+		{name: "reserva encostada antes", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50, hours(10, 12))}, want: false},
+		{name: "reserva encostada depois", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50, hours(13, 14))}, want: false},
+		{name: "reserva separada", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50, hours(9, 11), hours(14, 15))}, want: true},
+		{name: "conector em falha", connectors: []schemas.ConnectorStatus{faulted}, want: false},
+		{name: "tipo incompatível", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorType2, 22)}, vehicle: ccs2, want: false},
+		{name: "veículo sem tipo aceita qualquer um", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorType2, 22)}, want: true},
+		{name: "um de dois conectores livre", connectors: []schemas.ConnectorStatus{connector(schemas.ConnectorCCS2, 50, hours(12, 13)), connector(schemas.ConnectorCCS2, 50)}, want: true},
+		{name: "agenda conhecida e vazia", connectors: []schemas.ConnectorStatus{}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := WorkerCandidate{WorkerID: "w", Connectors: tt.connectors}
+			if got := fits(c, AllocationRequest{Window: hours(12, 13), Vehicle: tt.vehicle}); got != tt.want {
+				t.Fatalf("fits = %v, esperado %v", got, tt.want)
+			}
+		})
+	}
+}
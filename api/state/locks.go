@@ -0,0 +1,56 @@
+package state
+
+import "sync"
+
+// keyedMutex é um mutex por chave: operações com chaves diferentes (transações ou workers)
+// não esperam umas pelas outras. As entradas sem uso são removidas, então o mapa não cresce
+// com o histórico. O valor zero está pronto para uso.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int // Quantos estão com o lock ou esperando por ele
+}
+
+// Lock trava a chave e retorna a função que a destrava.
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	l := k.acquire(key)
+	l.mu.Lock()
+	return func() { l.mu.Unlock(); k.release(key, l) }
+}
+
+// TryLock trava a chave se ela estiver livre; senão retorna ok false sem esperar.
+func (k *keyedMutex) TryLock(key string) (unlock func(), ok bool) {
+	l := k.acquire(key)
+	if !l.mu.TryLock() {
+		k.release(key, l)
+		return nil, false
+	}
+	return func() { l.mu.Unlock(); k.release(key, l) }, true
+}
+
+func (k *keyedMutex) acquire(key string) *keyedLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (k *keyedMutex) release(key string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
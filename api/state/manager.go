@@ -2,15 +2,16 @@
 package state
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/schedule"
 	"github.com/4r7hur0/PBL-2/schemas"
 	"github.com/google/uuid"
 )
@@ -19,11 +20,12 @@ type TransactionProgress struct {
 	TotalSegments     int
 	CompletedSegments map[string]schemas.CostUpdatePayload // Mapeia cidade -> dados do custo
 	VehicleID         string
+	Route             []schemas.RouteSegment // Rota confirmada, usada na exportação GeoJSON
+	Participants      map[string]string      // Cidade -> URL da API que reservou o trecho
 	mu                sync.Mutex
 }
 
 type CityState struct {
-	MaxPosts           int
 	ActiveReservations []schemas.ActiveReservation
 }
 
@@ -31,14 +33,77 @@ type StateManager struct {
 	ownedCity               string
 	cityData                *CityState
 	enterpriseName          string
-	cityDataMux             *sync.Mutex
+	cityDataMux             *sync.Mutex // Protege só o estado em memória: nunca é mantido durante I/O
 	myAPIURL                string
-	cpWorkerIDs             []string
 	CoordinatedTransactions map[string]*TransactionProgress
+
+	// Versão de mensagem anunciada por cada worker (nil ou 0: formato legado)
+	workerProtocolVersion func(workerID string) int
+	// Workers online e sem falha no registro da API (nil: nenhum)
+	onlineWorkers func() []string
+	// Conectores e reservas anunciados pelo worker na última info (nil: desconhecidos)
+	workerSchedule func(workerID string) []schemas.ConnectorStatus
+
+	strategy      AllocationStrategy // Ordem em que os workers recebem PREPARE
+	prepareFanout int                // Quantos workers recebem PREPARE ao mesmo tempo
+
+	// Reservas PREPARED e COMMITTED indexadas pela janela; protegido por cityDataMux
+	active    schedule.Tree[activeEntry]
+	retention time.Duration     // Tempo na memória de uma reserva encerrada
+	archive   *schedule.Archive // Destino das reservas encerradas (nil: não arquiva)
+
+	// Estado de cada transação nesta API como participante do 2PC; protegido por cityDataMux
+	transactions   map[string]*participantTx
+	prepareTimeout time.Duration // Tempo máximo em PREPARED sem decisão do coordenador
+
+	// Meio usado para falar com os workers
+	transport WorkerTransport
+	// Locks por transação e por worker, mantidos durante a troca de mensagens com os
+	// workers. A ordem é sempre worker, transação e por último cityDataMux.
+	txLocks     keyedMutex
+	workerLocks keyedMutex
+}
+
+// SetWorkerScheduleLookup informa como obter a agenda anunciada por cada worker, usada
+// pela alocação para não mandar PREPARE a quem já está ocupado.
+func (m *StateManager) SetWorkerScheduleLookup(lookup func(workerID string) []schemas.ConnectorStatus) {
+	m.workerSchedule = lookup
+}
+
+// SetAllocation define a estratégia de alocação e quantos workers recebem PREPARE ao mesmo tempo.
+func (m *StateManager) SetAllocation(strategy AllocationStrategy, fanout int) {
+	m.strategy = strategy
+	m.prepareFanout = max(1, fanout)
+}
+
+// SetWorkerLookup informa como listar os workers online e sem falha, que são os únicos a receber PREPARE.
+func (m *StateManager) SetWorkerLookup(lookup func() []string) {
+	m.onlineWorkers = lookup
+}
+
+// workerIDs retorna os workers elegíveis, na ordem em que devem ser tentados.
+func (m *StateManager) workerIDs() []string {
+	if m.onlineWorkers == nil {
+		return nil
+	}
+	return m.onlineWorkers()
+}
+
+// SetWorkerProtocolLookup informa como descobrir a versão de mensagem entendida por cada worker.
+func (m *StateManager) SetWorkerProtocolLookup(lookup func(workerID string) int) {
+	m.workerProtocolVersion = lookup
 }
 
-func NewStateManager(ownedCity string, initialPosts int, myAPIURL string, workerIDs []string) *StateManager {
-	log.Printf("[StateManager] Inicializando para a cidade: %s com %d postos.", ownedCity, initialPosts)
+// workerMessageVersion retorna a versão negociada com o worker.
+func (m *StateManager) workerMessageVersion(workerID string) int {
+	if m.workerProtocolVersion == nil {
+		return schemas.LegacyVersion
+	}
+	return schemas.NegotiateVersion(m.workerProtocolVersion(workerID))
+}
+
+func NewStateManager(ownedCity string, myAPIURL string) *StateManager {
+	log.Printf("[StateManager] Inicializando para a cidade: %s.", ownedCity)
 
 	// Extrai o nome da empresa da URL da API (ex: http://solatlantico:8080)
 	// Esta é uma forma simples; pode ser melhorado se a URL for mais complexa.
@@ -47,39 +112,60 @@ func NewStateManager(ownedCity string, initialPosts int, myAPIURL string, worker
 		entName = strings.Split(u.Hostname(), ".")[0]
 	}
 
-	return &StateManager{
+	m := &StateManager{
 		ownedCity:      ownedCity,
 		enterpriseName: entName, // Adicionado
 		myAPIURL:       myAPIURL,
-		cpWorkerIDs:    workerIDs, // Adicionado
 		cityData: &CityState{
-			MaxPosts:           initialPosts,
 			ActiveReservations: []schemas.ActiveReservation{},
 		},
 		cityDataMux:             &sync.Mutex{},
 		CoordinatedTransactions: make(map[string]*TransactionProgress),
+		strategy:                scoredStrategy{name: StrategyLeastLoaded, score: loadScore},
+		prepareFanout:           DefaultPrepareFanout,
+		retention:               schedule.DefaultRetention,
+		transactions:            make(map[string]*participantTx),
+		prepareTimeout:          DefaultPrepareTimeout,
 	}
+	m.transport = mqttTransport{enterpriseName: entName, version: m.workerMessageVersion}
+	return m
 }
 
 // PrepareReservation verifica e "pré-aloca" um posto na cidade gerenciada.
-// VERSÃO ATUALIZADA DA FUNÇÃO PrepareReservation
-func (m *StateManager) PrepareReservation(transactionID, vehicleID, requestID string, window schemas.ReservationWindow, coordinatorURL string) (bool, error) {
+// vehicle (opcional) é repassado ao worker para a simulação da recarga.
+// Um PREPARE repetido de uma transação já preparada (ou confirmada) retorna true com
+// duplicate; as recusas do estado da transação e a falta de posto vêm como *TxError.
+// A troca de mensagens com os workers acontece só com o lock da transação: as demais
+// transações e as consultas ao estado da cidade seguem enquanto isso.
+func (m *StateManager) PrepareReservation(transactionID, vehicleID, requestID string, window schemas.ReservationWindow, coordinatorURL string, vehicle *schemas.VehicleProfile) (duplicate bool, err error) {
+	unlock := m.txLocks.Lock(transactionID)
+	defer unlock()
+
+	// 1. INIT -> PREPARED só uma vez por transação: evita preparar vários workers para a mesma TX.
 	m.cityDataMux.Lock()
-	defer m.cityDataMux.Unlock()
-
-	// 1. Verificar se já existe uma reserva PREPARADA para esta mesma transação.
-	// Isso evita tentar preparar múltiplos workers para a mesma TX na mesma API.
-	for _, res := range m.cityData.ActiveReservations {
-		if res.TransactionID == transactionID && res.Status == schemas.StatusReservationPrepared {
-			log.Printf("[StateManager-%s] TX[%s]: AVISO - Tentativa de preparar uma transação já preparada localmente.", m.ownedCity, transactionID)
-			return true, nil // Considera sucesso, pois já está preparado.
-		}
+	state := m.txState(transactionID)
+	switch state {
+	case TxPrepared, TxCommitted:
+		m.cityDataMux.Unlock()
+		log.Printf("[StateManager-%s] TX[%s]: PREPARE repetido de uma transação já %s. Nada a fazer.", m.ownedCity, transactionID, state)
+		return true, nil
+	case TxInit, TxAborted:
+		m.cityDataMux.Unlock()
+		return false, rejectTransition(transactionID, state, "PREPARE")
 	}
+	m.setTxState(transactionID, TxInit)
+	m.cityDataMux.Unlock()
 
 	// 2. Tentar preparar um worker disponível. A verificação de capacidade é delegada.
-	preparedWorkerID, err := m.attemptToPrepareWorker(transactionID, window)
+	attemptID := uuid.New().String()
+	prepared, err := m.attemptToPrepareWorker(transactionID, attemptID, window, vehicle)
+
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
 	if err != nil {
 		log.Printf("[StateManager-%s] TX[%s]: FALHA PREPARE - Não foi possível preparar um worker: %v", m.ownedCity, transactionID, err)
+		// Sem posto, a transação volta a ser desconhecida: o voto é NÃO e nada ficou reservado
+		delete(m.transactions, transactionID)
 		return false, err
 	}
 
@@ -92,115 +178,303 @@ func (m *StateManager) PrepareReservation(transactionID, vehicleID, requestID st
 		ReservationWindow: window,
 		Status:            schemas.StatusReservationPrepared,
 		CoordinatorURL:    coordinatorURL,
-		WorkerID:          preparedWorkerID, // Salva o ID do worker que confirmou a preparação.
+		WorkerID:          prepared.WorkerID, // Salva o ID do worker que confirmou a preparação.
+		ConnectorID:       prepared.ConnectorID,
+		AttemptID:         attemptID,
+		Vehicle:           vehicle,
 	}
 	m.cityData.ActiveReservations = append(m.cityData.ActiveReservations, newRes)
-	log.Printf("[StateManager-%s] TX[%s]: SUCESSO PREPARE. Worker '%s' alocado. Reserva: %+v", m.ownedCity, transactionID, preparedWorkerID, newRes)
-	return true, nil
+	m.active.Insert(window, activeEntry{TransactionID: transactionID, WorkerID: prepared.WorkerID})
+	m.setTxState(transactionID, TxPrepared)
+	log.Printf("[StateManager-%s] TX[%s]: SUCESSO PREPARE. Worker '%s' alocado. Reserva: %+v", m.ownedCity, transactionID, prepared.WorkerID, newRes)
+	return false, nil
 }
 
-// NOVA FUNÇÃO para tentar preparar um worker diretamente.
-func (m *StateManager) attemptToPrepareWorker(transactionID string, window schemas.ReservationWindow) (string, error) {
-	// Itera sobre todos os workers gerenciados por esta API
-	for _, workerID := range m.cpWorkerIDs {
-		log.Printf("[StateManager-%s] TX[%s]: Tentando preparar o worker '%s'", m.ownedCity, transactionID, workerID)
-
-		// Cria um tópico de resposta único para esta tentativa específica
-		responseTopic := fmt.Sprintf("enterprise/%s/cp/%s/response/%s", m.enterpriseName, workerID, uuid.New().String())
+// attemptToPrepareWorker escolhe e prepara um worker para a reserva. Os workers online
+// que cabem na janela pela visão local são ordenados pela estratégia de alocação e
+// recebem PREPARE em lotes de prepareFanout, ao mesmo tempo, todos com o attemptID.
+// Retorna a resposta do worker preparado, que informa o conector reservado, ou um *TxError:
+// WORKER_UNAVAILABLE se nenhum worker está online ou algum não respondeu ao PREPARE
+// (repetir pode dar certo) e NO_CAPACITY se todos os consultados recusaram a janela.
+// Deve ser chamada sem cityDataMux travado.
+func (m *StateManager) attemptToPrepareWorker(transactionID, attemptID string, window schemas.ReservationWindow, vehicle *schemas.VehicleProfile) (schemas.PrepareResponse, error) {
+	req := AllocationRequest{Window: window, Vehicle: vehicle}
+	workerIDs := m.workerIDs()
+	if len(workerIDs) == 0 {
+		return schemas.PrepareResponse{}, &TxError{TransactionID: transactionID, Code: schemas.TxErrWorkerUnavailable, Reason: fmt.Sprintf("nenhum charging point worker online na cidade %s", m.ownedCity)}
+	}
 
-		// Prepara para escutar a resposta
-		respChan := mqtt.StartListening(responseTopic, 1)
+	var candidates []WorkerCandidate
+	m.cityDataMux.Lock()
+	for _, workerID := range workerIDs {
+		candidate := m.workerCandidate(workerID)
+		if !fits(candidate, req) {
+			log.Printf("[StateManager-%s] TX[%s]: Worker '%s' ignorado: sem conector compatível livre na agenda conhecida.", m.ownedCity, transactionID, workerID)
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	m.cityDataMux.Unlock()
+	if len(candidates) == 0 {
+		return schemas.PrepareResponse{}, &TxError{TransactionID: transactionID, Code: schemas.TxErrNoCapacity, Reason: fmt.Sprintf("nenhum charging point worker com conector compatível livre na janela na cidade %s", m.ownedCity)}
+	}
 
-		// Monta e publica a mensagem de preparação
-		prepareMsg := map[string]interface{}{
-			"command":        "PREPARE_RESERVE_WINDOW",
-			"window":         window,
-			"transaction_id": transactionID,
-			"response_topic": responseTopic,
+	ranked := m.strategy.Rank(candidates, req)
+	order := make([]string, len(ranked))
+	for i, c := range ranked {
+		order[i] = c.WorkerID
+	}
+	log.Printf("[StateManager-%s] TX[%s]: Ordem de alocação (%s): %v", m.ownedCity, transactionID, m.strategy.Name(), order)
+
+	unanswered := 0
+	for start := 0; start < len(ranked); start += m.prepareFanout {
+		batch := ranked[start:min(start+m.prepareFanout, len(ranked))]
+		resp, ok, failed := m.prepareBatch(transactionID, attemptID, req, batch)
+		if ok {
+			return resp, nil
 		}
-		prepareBytes, _ := json.Marshal(prepareMsg)
-		commandTopic := fmt.Sprintf("enterprise/%s/cp/%s/command", m.enterpriseName, workerID)
-		mqtt.Publish(commandTopic, string(prepareBytes))
-
-		// Aguarda a resposta do worker ou um timeout
-		select {
-		case respPayload := <-respChan:
-			var resp map[string]interface{}
-			if err := json.Unmarshal([]byte(respPayload), &resp); err != nil {
-				log.Printf("[StateManager-%s] TX[%s]: Erro ao decodificar resposta de PREPARE do worker '%s': %v", m.ownedCity, transactionID, workerID, err)
-				mqtt.Unsubscribe(responseTopic)
-				continue // Tenta o próximo worker
+		unanswered += failed
+	}
+
+	// Se o loop terminar, nenhum worker conseguiu ser preparado.
+	if unanswered > 0 {
+		return schemas.PrepareResponse{}, &TxError{TransactionID: transactionID, Code: schemas.TxErrWorkerUnavailable, Reason: fmt.Sprintf("%d charging point worker(s) sem resposta ao PREPARE na cidade %s", unanswered, m.ownedCity)}
+	}
+	return schemas.PrepareResponse{}, &TxError{TransactionID: transactionID, Code: schemas.TxErrNoCapacity, Reason: fmt.Sprintf("nenhum charging point worker aceitou a janela na cidade %s", m.ownedCity)}
+}
+
+// workerCandidate monta a visão local da agenda do worker: a ocupação anunciada na
+// última info, completada com as reservas desta API ainda não refletidas nela.
+// Deve ser chamada com cityDataMux travado.
+func (m *StateManager) workerCandidate(workerID string) WorkerCandidate {
+	candidate := WorkerCandidate{WorkerID: workerID}
+	if m.workerSchedule == nil {
+		return candidate
+	}
+	announced := m.workerSchedule(workerID)
+	if announced == nil {
+		return candidate // Agenda desconhecida
+	}
+	candidate.Connectors = make([]schemas.ConnectorStatus, len(announced))
+	for i, connector := range announced {
+		connector.Reservations = append([]schemas.ReservationWindow(nil), connector.Reservations...)
+		for _, res := range m.cityData.ActiveReservations {
+			if res.WorkerID != workerID || res.ConnectorID != connector.ConnectorID ||
+				(res.Status != schemas.StatusReservationPrepared && res.Status != schemas.StatusReservationCommitted) {
+				continue
 			}
+			if !slices.Contains(connector.Reservations, res.ReservationWindow) {
+				connector.Reservations = append(connector.Reservations, res.ReservationWindow)
+			}
+		}
+		candidate.Connectors[i] = connector
+	}
+	return candidate
+}
+
+type prepareResult struct {
+	rank int
+	resp schemas.PrepareResponse
+	err  error
+}
 
-			// Verifica se o worker respondeu com sucesso
-			if success, ok := resp["success"].(bool); ok && success {
-				log.Printf("[StateManager-%s] TX[%s]: SUCESSO! Worker '%s' preparado.", m.ownedCity, transactionID, workerID)
-				mqtt.Unsubscribe(responseTopic)
-				return workerID, nil // Sucesso! Retorna o ID do worker e encerra a função.
-			} else {
-				log.Printf("[StateManager-%s] TX[%s]: Worker '%s' respondeu com falha (provavelmente ocupado).", m.ownedCity, transactionID, workerID)
-				mqtt.Unsubscribe(responseTopic)
-				continue // Continua para tentar o próximo worker
+// prepareBatch envia PREPARE a todos os workers do lote ao mesmo tempo e fica com o
+// melhor colocado que aceitar, assim que todos os mais bem colocados tiverem recusado.
+// Os demais que aceitarem, inclusive os que responderem depois, recebem ABORT. Sem
+// vencedor, retorna também quantos workers do lote não responderam ao PREPARE.
+func (m *StateManager) prepareBatch(transactionID, attemptID string, req AllocationRequest, batch []WorkerCandidate) (schemas.PrepareResponse, bool, int) {
+	results := make(chan prepareResult, len(batch))
+	for i, candidate := range batch {
+		go func() {
+			resp, err := m.prepareWorker(transactionID, attemptID, candidate.WorkerID, req)
+			results <- prepareResult{rank: i, resp: resp, err: err}
+		}()
+	}
+
+	accepted := func(r *prepareResult) bool { return r != nil && r.err == nil && r.resp.Success }
+	outcomes := make([]*prepareResult, len(batch)) // nil: ainda sem resposta
+	winner, received := -1, 0
+	for winner < 0 && received < len(batch) {
+		r := <-results
+		received++
+		outcomes[r.rank] = &r
+		for i := range outcomes {
+			if outcomes[i] == nil {
+				break // Um mais bem colocado ainda não respondeu
 			}
+			if accepted(outcomes[i]) {
+				winner = i
+				break
+			}
+		}
+	}
 
-		case <-time.After(5 * time.Second): // Timeout para a resposta
-			log.Printf("[StateManager-%s] TX[%s]: Timeout esperando resposta de PREPARE do worker '%s'", m.ownedCity, transactionID, workerID)
-			mqtt.Unsubscribe(responseTopic)
-			continue // Continua para tentar o próximo worker
+	for i, r := range outcomes {
+		if i != winner && accepted(r) {
+			m.sendCommandToWorker(workerTarget{batch[i].WorkerID, attemptID}, transactionID, schemas.WorkerCommandAbort)
+		}
+	}
+	// As respostas atrasadas são drenadas aqui, ainda sob o lock da transação: o ABORT
+	// de um worker que aceitou tarde precisa sair antes de qualquer COMMIT ou novo
+	// PREPARE da mesma transação. A espera é limitada pelo workerPrepareTimeout.
+	for ; received < len(batch); received++ {
+		if r := <-results; accepted(&r) {
+			m.sendCommandToWorker(workerTarget{batch[r.rank].WorkerID, attemptID}, transactionID, schemas.WorkerCommandAbort)
 		}
 	}
 
-	// Se o loop terminar, nenhum worker conseguiu ser preparado.
-	return "", fmt.Errorf("nenhum charging point worker disponível ou falha na comunicação na cidade %s", m.ownedCity)
+	if winner < 0 {
+		failed := 0
+		for _, r := range outcomes {
+			if r.err != nil {
+				failed++
+			}
+		}
+		return schemas.PrepareResponse{}, false, failed
+	}
+	resp := outcomes[winner].resp
+	resp.WorkerID = batch[winner].WorkerID
+	log.Printf("[StateManager-%s] TX[%s]: SUCESSO! Worker '%s' preparado (conector %d).", m.ownedCity, transactionID, resp.WorkerID, resp.ConnectorID)
+	return resp, true, 0
+}
+
+// prepareWorker envia PREPARE a um worker e aguarda a resposta ou um timeout.
+func (m *StateManager) prepareWorker(transactionID, attemptID, workerID string, req AllocationRequest) (schemas.PrepareResponse, error) {
+	log.Printf("[StateManager-%s] TX[%s]: Tentando preparar o worker '%s'", m.ownedCity, transactionID, workerID)
+
+	command := schemas.PrepareReserveWindowCommand{
+		TransactionID: transactionID,
+		Window:        req.Window,
+		Vehicle:       req.Vehicle,
+		AttemptID:     attemptID,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), workerPrepareTimeout)
+	defer cancel()
+	resp, err := m.transport.Prepare(ctx, workerID, command)
+	if err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: Sem resposta válida de PREPARE do worker '%s': %v", m.ownedCity, transactionID, workerID, err)
+		return resp, err
+	}
+	if !resp.Success {
+		log.Printf("[StateManager-%s] TX[%s]: Worker '%s' respondeu com falha (sem conector compatível livre).", m.ownedCity, transactionID, workerID)
+	}
+	return resp, nil
 }
 
-func (m *StateManager) CommitReservation(transactionID string) {
+// CommitReservation leva a transação de PREPARED a COMMITTED e confirma a reserva no
+// worker. Um COMMIT repetido retorna duplicate; nos demais estados, *TxError. Com o
+// PREPARE em curso, recusa na hora (PREPARE_IN_PROGRESS) em vez de esperar por ele.
+func (m *StateManager) CommitReservation(transactionID string) (duplicate bool, err error) {
+	if state := m.TransactionState(transactionID); state == TxInit {
+		txErr := rejectTransition(transactionID, state, "COMMIT")
+		log.Printf("[StateManager-%s] TX[%s]: COMMIT RECUSADO: %v", m.ownedCity, transactionID, txErr)
+		return false, txErr
+	}
+	unlock := m.txLocks.Lock(transactionID)
+	defer unlock()
+
+	targets, duplicate, err := m.commitPrepared(transactionID)
+	if err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: COMMIT RECUSADO: %v", m.ownedCity, transactionID, err)
+		return false, err
+	}
+	// Notifica os workers reservados, já fora de cityDataMux
+	for _, target := range targets {
+		m.sendCommandToWorker(target, transactionID, schemas.WorkerCommandCommit)
+	}
+	return duplicate, nil
+}
+
+// commitPrepared confirma as reservas PREPARED da transação no estado local e retorna os
+// workers que devem receber COMMIT.
+func (m *StateManager) commitPrepared(transactionID string) (targets []workerTarget, duplicate bool, err error) {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
 
-	found := false
+	switch state := m.txState(transactionID); state {
+	case TxCommitted:
+		log.Printf("[StateManager-%s] TX[%s]: COMMIT repetido. Nada a fazer.", m.ownedCity, transactionID)
+		return nil, true, nil
+	case TxPrepared:
+	default:
+		return nil, false, rejectTransition(transactionID, state, "COMMIT")
+	}
+
 	for i, res := range m.cityData.ActiveReservations {
 		if res.TransactionID == transactionID && res.Status == schemas.StatusReservationPrepared {
 			m.cityData.ActiveReservations[i].Status = schemas.StatusReservationCommitted
-
-			// Notifica o worker específico que foi reservado!
 			if res.WorkerID != "" {
-				m.sendCommandToWorker(res.WorkerID, transactionID, "COMMIT")
+				targets = append(targets, workerTarget{res.WorkerID, res.AttemptID})
 			}
-
 			log.Printf("[StateManager-%s] TX[%s]: SUCESSO COMMIT. Reserva: %+v", m.ownedCity, transactionID, m.cityData.ActiveReservations[i])
-			found = true
-			// Não precisa retornar, pode haver múltiplos segmentos para a mesma TX (embora não neste modelo de cidade única por API)
 		}
 	}
-	if !found {
-		log.Printf("[StateManager-%s] TX[%s]: AVISO COMMIT - Nenhuma reserva PREPARED encontrada para este TransactionID.", m.ownedCity, transactionID)
+	m.setTxState(transactionID, TxCommitted)
+	return targets, false, nil
+}
+
+// AbortReservation leva a transação a ABORTED e libera a reserva no worker. Um ABORT
+// repetido retorna duplicate. Um ABORT de transação desconhecida também é aceito (o
+// PREPARE pode ter se perdido) e recusa um PREPARE atrasado da mesma transação. Depois do
+// COMMIT ou com o PREPARE em curso, retorna *TxError.
+func (m *StateManager) AbortReservation(transactionID string) (duplicate bool, err error) {
+	if state := m.TransactionState(transactionID); state == TxInit {
+		txErr := rejectTransition(transactionID, state, "ABORT")
+		log.Printf("[StateManager-%s] TX[%s]: ABORT RECUSADO: %v", m.ownedCity, transactionID, txErr)
+		return false, txErr
+	}
+	unlock := m.txLocks.Lock(transactionID)
+	defer unlock()
+
+	targets, duplicate, err := m.abortTransaction(transactionID)
+	if err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: ABORT RECUSADO: %v", m.ownedCity, transactionID, err)
+		return false, err
+	}
+	for _, target := range targets {
+		m.sendCommandToWorker(target, transactionID, schemas.WorkerCommandAbort)
 	}
+	return duplicate, nil
 }
 
-func (m *StateManager) AbortReservation(transactionID string) {
+// abortTransaction leva a transação a ABORTED no estado local e retorna os workers que
+// devem receber ABORT.
+func (m *StateManager) abortTransaction(transactionID string) (targets []workerTarget, duplicate bool, err error) {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
 
+	switch state := m.txState(transactionID); state {
+	case TxAborted:
+		log.Printf("[StateManager-%s] TX[%s]: ABORT repetido. Nada a fazer.", m.ownedCity, transactionID)
+		return nil, true, nil
+	case TxPrepared:
+		targets = m.abortPrepared(transactionID)
+	case "":
+		log.Printf("[StateManager-%s] TX[%s]: ABORT de uma transação não preparada nesta API. Registrada como abortada.", m.ownedCity, transactionID)
+	default:
+		return nil, false, rejectTransition(transactionID, state, "ABORT")
+	}
+	m.setTxState(transactionID, TxAborted)
+	return targets, false, nil
+}
+
+// abortPrepared remove as reservas PREPARED da transação e retorna os workers que devem
+// liberá-las (ABORT). Deve ser chamada com cityDataMux travado.
+func (m *StateManager) abortPrepared(transactionID string) (targets []workerTarget) {
 	var keptReservations []schemas.ActiveReservation
-	aborted := false
 	for _, res := range m.cityData.ActiveReservations {
 		if res.TransactionID == transactionID && res.Status == schemas.StatusReservationPrepared {
-
 			if res.WorkerID != "" {
-				m.sendCommandToWorker(res.WorkerID, transactionID, "ABORT")
+				targets = append(targets, workerTarget{res.WorkerID, res.AttemptID})
 			}
-
+			m.active.Delete(res.ReservationWindow, activeEntry{TransactionID: transactionID, WorkerID: res.WorkerID})
 			log.Printf("[StateManager-%s] TX[%s]: SUCESSO ABORT. Removendo reserva: %+v", m.ownedCity, transactionID, res)
-			aborted = true
 		} else {
 			keptReservations = append(keptReservations, res)
 		}
 	}
 	m.cityData.ActiveReservations = keptReservations
-	if !aborted {
-		log.Printf("[StateManager-%s] TX[%s]: AVISO ABORT - Nenhuma reserva PREPARED encontrada para este TransactionID.", m.ownedCity, transactionID)
-	}
+	return targets
 }
 
 // GetCoordinatorURL encontra e retorna a URL da API coordenadora para uma dada transação.
@@ -219,6 +493,20 @@ func (m *StateManager) GetCoordinatorURL(transactionID string) (string, bool) {
 	return "", false
 }
 
+// ReservationWorker retorna o worker que tem a reserva da transação. Ele muda quando a
+// reserva é transferida para outro worker (veja MigrateReservations).
+func (m *StateManager) ReservationWorker(transactionID string) (string, bool) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == transactionID {
+			return res.WorkerID, true
+		}
+	}
+	return "", false
+}
+
 // IsCoordinator retorna true se esta instância é a coordenadora da transação.
 func (m *StateManager) IsCoordinator(transactionID string) bool {
 	m.cityDataMux.Lock()
@@ -236,26 +524,48 @@ func (m *StateManager) IsCoordinator(transactionID string) bool {
 
 // GetCityAvailability - pode ser útil para um endpoint de status
 func (m *StateManager) GetCityAvailability() (string, int, []schemas.ActiveReservation) {
+	online := len(m.workerIDs())
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
 	// Retorna uma cópia para evitar race conditions se o chamador modificar o slice
 	reservationsCopy := make([]schemas.ActiveReservation, len(m.cityData.ActiveReservations))
 	copy(reservationsCopy, m.cityData.ActiveReservations)
-	return m.ownedCity, m.cityData.MaxPosts, reservationsCopy
+	return m.ownedCity, online, reservationsCopy
+}
+
+// AvailablePosts retorna quantos postos online não têm reserva ativa (preparada ou confirmada) no instante informado.
+func (m *StateManager) AvailablePosts(at time.Time) int {
+	free := make(map[string]bool)
+	for _, workerID := range m.workerIDs() {
+		free[workerID] = true
+	}
+
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	for _, entry := range m.active.Overlapping(schemas.ReservationWindow{StartTimeUTC: at, EndTimeUTC: at}) {
+		delete(free, entry.WorkerID)
+	}
+	return len(free)
+}
+
+// workerTarget é a reserva que uma tentativa de PREPARE fez num worker. COMMIT e ABORT
+// levam o attemptID para não atingir a reserva de outra tentativa da mesma transação.
+type workerTarget struct {
+	workerID  string
+	attemptID string
 }
 
-func (m *StateManager) sendCommandToWorker(workerID, transactionID, command string) {
-	msg := map[string]interface{}{
-		"command":        command,
-		"transaction_id": transactionID,
+// sendCommandToWorker envia COMMIT ou ABORT ao worker. Deve ser chamada sem cityDataMux travado.
+func (m *StateManager) sendCommandToWorker(target workerTarget, transactionID, command string) {
+	if err := m.transport.Send(target.workerID, command, transactionID, target.attemptID); err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: Falha ao enviar '%s' para worker '%s': %v", m.ownedCity, transactionID, command, target.workerID, err)
+		return
 	}
-	msgBytes, _ := json.Marshal(msg)
-	topic := fmt.Sprintf("enterprise/%s/cp/%s/command", m.enterpriseName, workerID)
-	mqtt.Publish(topic, string(msgBytes))
-	log.Printf("[StateManager-%s] TX[%s]: Comando '%s' enviado para worker '%s'", m.ownedCity, transactionID, command, workerID)
+	log.Printf("[StateManager-%s] TX[%s]: Comando '%s' enviado para worker '%s'", m.ownedCity, transactionID, command, target.workerID)
 }
 
-// FinalizeReservation atualiza o status de uma reserva para um estado final, como "charged".
+// FinalizeReservation atualiza o status de uma reserva para um estado final, como
+// schemas.StatusReservationCharged.
 func (m *StateManager) FinalizeReservation(transactionID, finalStatus string) {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
@@ -264,7 +574,10 @@ func (m *StateManager) FinalizeReservation(transactionID, finalStatus string) {
 	for i, res := range m.cityData.ActiveReservations {
 		if res.TransactionID == transactionID {
 			log.Printf("[StateManager-%s] TX[%s]: Reserva encontrada, mudando status de '%s' para '%s'.", m.ownedCity, transactionID, res.Status, finalStatus)
+			finishedAt := time.Now().UTC()
 			m.cityData.ActiveReservations[i].Status = finalStatus
+			m.cityData.ActiveReservations[i].FinishedAt = &finishedAt
+			m.active.Delete(res.ReservationWindow, activeEntry{TransactionID: transactionID, WorkerID: res.WorkerID})
 			found = true
 			break
 		}
@@ -273,12 +586,12 @@ func (m *StateManager) FinalizeReservation(transactionID, finalStatus string) {
 	if !found {
 		log.Printf("[StateManager-%s] TX[%s]: AVISO FinalizeReservation - Nenhuma reserva encontrada para este TransactionID.", m.ownedCity, transactionID)
 	}
-	// Para o futuro: Você pode querer adicionar uma outra rotina de limpeza que remove
-	// reservas no estado "charged" ou "aborted" após algum tempo (ex: 24 horas) para não
-	// manter a memória a crescer indefinidamente.
+	// A reserva encerrada vai para o arquivo depois do prazo de retenção (veja CollectReservations)
 }
 
-func (m *StateManager) StartCoordinatingTransaction(txID, vehicleID string, route []schemas.RouteSegment) {
+// StartCoordinatingTransaction passa a acompanhar os trechos de uma transação coordenada
+// por esta API. participants diz qual API reservou cada cidade da rota.
+func (m *StateManager) StartCoordinatingTransaction(txID, vehicleID string, route []schemas.RouteSegment, participants map[string]string) {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
 
@@ -290,14 +603,20 @@ func (m *StateManager) StartCoordinatingTransaction(txID, vehicleID string, rout
 		TotalSegments:     len(route),
 		CompletedSegments: make(map[string]schemas.CostUpdatePayload),
 		VehicleID:         vehicleID,
+		Route:             route,
+		Participants:      participants,
 	}
 	log.Printf("[StateManager-%s] TX[%s]: Começando a coordenar transação com %d segmentos.", m.ownedCity, txID, len(route))
 }
 
-func (m *StateManager) RecordSegmentCompletion(payload schemas.CostUpdatePayload) (bool, float64) {
+// RecordSegmentCompletion registra a conclusão de um trecho. Quando todos os trechos
+// terminaram, retorna true com o custo e a energia totais da viagem.
+func (m *StateManager) RecordSegmentCompletion(payload schemas.CostUpdatePayload) (bool, float64, float64) {
+	m.cityDataMux.Lock()
 	txProgress, exists := m.CoordinatedTransactions[payload.TransactionID]
+	m.cityDataMux.Unlock()
 	if !exists {
-		return false, 0 // Não sou o coordenador desta transação
+		return false, 0, 0 // Não sou o coordenador desta transação
 	}
 
 	txProgress.mu.Lock()
@@ -305,7 +624,7 @@ func (m *StateManager) RecordSegmentCompletion(payload schemas.CostUpdatePayload
 
 	// Evita processar o mesmo segmento duas vezes
 	if _, done := txProgress.CompletedSegments[payload.SegmentCity]; done {
-		return false, 0
+		return false, 0, 0
 	}
 
 	txProgress.CompletedSegments[payload.SegmentCity] = payload
@@ -313,15 +632,16 @@ func (m *StateManager) RecordSegmentCompletion(payload schemas.CostUpdatePayload
 
 	// Verifica se todos os segmentos estão completos
 	if len(txProgress.CompletedSegments) == txProgress.TotalSegments {
-		var totalCost float64
+		var totalCost, totalEnergy float64
 		for _, p := range txProgress.CompletedSegments {
 			totalCost += p.Cost
+			totalEnergy += p.EnergyKWh
 		}
-		log.Printf("[StateManager-%s] TX[%s]: TODOS OS SEGMENTOS COMPLETOS! Custo total: %.2f", m.enterpriseName, payload.TransactionID, totalCost)
-		return true, totalCost
+		log.Printf("[StateManager-%s] TX[%s]: TODOS OS SEGMENTOS COMPLETOS! Custo total: %.2f, Energia total: %.3f kWh", m.enterpriseName, payload.TransactionID, totalCost, totalEnergy)
+		return true, totalCost, totalEnergy
 	}
 
-	return false, 0
+	return false, 0, 0
 }
 
 func (sm *StateManager) GetVehicleIDForTransaction(txID string) (string, bool) {
@@ -334,3 +654,32 @@ func (sm *StateManager) GetVehicleIDForTransaction(txID string) (string, bool) {
 	}
 	return details.VehicleID, true
 }
+
+// SegmentParticipant retorna a URL da API que reservou o trecho da cidade numa transação
+// coordenada por esta API. ok é false se a transação não é coordenada aqui ou se a
+// cidade não faz parte da rota.
+func (sm *StateManager) SegmentParticipant(txID, city string) (apiURL string, ok bool) {
+	sm.cityDataMux.Lock()
+	defer sm.cityDataMux.Unlock()
+
+	details, found := sm.CoordinatedTransactions[txID]
+	if !found {
+		return "", false
+	}
+	apiURL, ok = details.Participants[city]
+	return apiURL, ok
+}
+
+// GetCoordinatedRoute retorna uma cópia da rota confirmada de uma transação coordenada por esta API.
+func (sm *StateManager) GetCoordinatedRoute(txID string) ([]schemas.RouteSegment, bool) {
+	sm.cityDataMux.Lock()
+	defer sm.cityDataMux.Unlock()
+
+	details, found := sm.CoordinatedTransactions[txID]
+	if !found {
+		return nil, false
+	}
+	routeCopy := make([]schemas.RouteSegment, len(details.Route))
+	copy(routeCopy, details.Route)
+	return routeCopy, true
+}
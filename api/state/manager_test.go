@@ -0,0 +1,410 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// fakeWorkers simula os charging point workers: um conector por worker, latência e
+// falhas de comunicação aleatórias. Guarda o que cada worker reservou para conferir, no
+// fim, que ele concorda com o StateManager.
+type fakeWorkers struct {
+	mu           sync.Mutex
+	ids          []string
+	faulted      map[string]bool
+	reservations map[string]map[string]*fakeReservation // worker -> transação
+	failRate     float64
+	problems     []string
+}
+
+type fakeReservation struct {
+	window    schemas.ReservationWindow
+	attemptID string
+	committed bool
+}
+
+func newFakeWorkers(n int) *fakeWorkers {
+	f := &fakeWorkers{faulted: make(map[string]bool), reservations: make(map[string]map[string]*fakeReservation), failRate: 0.05}
+	for i := range n {
+		id := fmt.Sprintf("w%d", i+1)
+		f.ids = append(f.ids, id)
+		f.reservations[id] = make(map[string]*fakeReservation)
+	}
+	return f
+}
+
+func (f *fakeWorkers) Prepare(ctx context.Context, workerID string, command schemas.PrepareReserveWindowCommand) (schemas.PrepareResponse, error) {
+	time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+	if rand.Float64() < f.failRate {
+		return schemas.PrepareResponse{}, errors.New("timeout simulado")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for txID, r := range f.reservations[workerID] {
+		if txID != command.TransactionID && schedule.Overlaps(r.window, command.Window) {
+			return schemas.PrepareResponse{TransactionID: command.TransactionID}, nil
+		}
+	}
+	f.reservations[workerID][command.TransactionID] = &fakeReservation{window: command.Window, attemptID: command.AttemptID}
+	return schemas.PrepareResponse{Success: true, TransactionID: command.TransactionID, ConnectorID: 1}, nil
+}
+
+func (f *fakeWorkers) Send(workerID, command, transactionID, attemptID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.reservations[workerID][transactionID]
+	ok = ok && schemas.SameAttempt(r.attemptID, attemptID)
+	switch command {
+	case schemas.WorkerCommandCommit:
+		if !ok {
+			f.problems = append(f.problems, fmt.Sprintf("COMMIT de %s no worker %s sem PREPARE da tentativa %q", transactionID, workerID, attemptID))
+			return nil
+		}
+		r.committed = true
+	case schemas.WorkerCommandAbort:
+		if ok {
+			delete(f.reservations[workerID], transactionID)
+		}
+	}
+	return nil
+}
+
+func (f *fakeWorkers) online() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.DeleteFunc(slices.Clone(f.ids), func(id string) bool { return f.faulted[id] })
+}
+
+func (f *fakeWorkers) schedule(workerID string) []schemas.ConnectorStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	connector := schemas.ConnectorStatus{ConnectorID: 1, Type: schemas.ConnectorCCS2, Status: schemas.ConnectorAvailable}
+	for _, r := range f.reservations[workerID] {
+		connector.Reservations = append(connector.Reservations, r.window)
+	}
+	return []schemas.ConnectorStatus{connector}
+}
+
+func (f *fakeWorkers) fault(workerID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faulted[workerID] = true
+}
+
+func quietLogs(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func newTestManager(transport WorkerTransport, lookup func() []string) *StateManager {
+	m := NewStateManager("Salvador", "http://solatlantico:8080")
+	m.SetWorkerTransport(transport)
+	m.SetWorkerLookup(lookup)
+	return m
+}
+
+// checkConsistency confere que o estado das transações, as reservas da cidade, o índice
+// de janelas e os workers concordam entre si.
+func checkConsistency(m *StateManager, f *fakeWorkers) error {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.problems) > 0 {
+		return errors.New(f.problems[0])
+	}
+	local := make(map[string][]schemas.ActiveReservation)
+	for _, res := range m.cityData.ActiveReservations {
+		local[res.TransactionID] = append(local[res.TransactionID], res)
+	}
+	active := 0
+	for txID, tx := range m.transactions {
+		holders := make(map[string]*fakeReservation)
+		for workerID, reservations := range f.reservations {
+			if r, ok := reservations[txID]; ok {
+				holders[workerID] = r
+			}
+		}
+		switch tx.state {
+		case TxCommitted:
+			if len(local[txID]) != 1 || local[txID][0].Status != schemas.StatusReservationCommitted {
+				return fmt.Errorf("%s COMMITTED com reservas locais %+v", txID, local[txID])
+			}
+			workerID := local[txID][0].WorkerID
+			if len(holders) != 1 || holders[workerID] == nil || !holders[workerID].committed {
+				return fmt.Errorf("%s COMMITTED no worker %s, mas os workers guardam %v", txID, workerID, holders)
+			}
+			active++
+		case TxAborted:
+			if len(local[txID]) > 0 || len(holders) > 0 {
+				return fmt.Errorf("%s ABORTED com reservas locais %+v e nos workers %v", txID, local[txID], holders)
+			}
+		default:
+			return fmt.Errorf("%s terminou no estado %s", txID, tx.state)
+		}
+	}
+	for workerID, reservations := range f.reservations {
+		for txID := range reservations {
+			if m.transactions[txID] == nil {
+				return fmt.Errorf("worker %s guarda %s, desconhecida na API", workerID, txID)
+			}
+		}
+	}
+	if m.active.Len() != active {
+		return fmt.Errorf("índice com %d janelas para %d reservas confirmadas", m.active.Len(), active)
+	}
+	return nil
+}
+
+// TestConcurrentTransactions roda PREPARE, COMMIT e ABORT de muitas transações ao mesmo
+// tempo, com decisões repetidas e conflitantes, consultas ao estado da cidade, timeouts
+// de PREPARE e a migração de um worker em falha. Deve ser rodado com -race.
+func TestConcurrentTransactions(t *testing.T) {
+	quietLogs(t)
+	workers := newFakeWorkers(5)
+	m := newTestManager(workers, workers.online)
+	m.SetWorkerScheduleLookup(workers.schedule)
+	m.SetAllocation(m.strategy, 2)
+	m.SetPrepareTimeout(0)
+
+	base := time.Now().UTC().Truncate(time.Hour).Add(2 * time.Hour)
+	const transactions = 300
+	var wg sync.WaitGroup
+	for i := range transactions {
+		txID := fmt.Sprintf("tx-%03d", i)
+		start := base.Add(time.Duration(rand.IntN(20)) * time.Hour)
+		window := schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(30 * time.Minute)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var duplicate sync.WaitGroup
+			if i%4 == 0 {
+				// PREPARE repetido enquanto o primeiro ainda está em curso
+				duplicate.Add(1)
+				go func() {
+					defer duplicate.Done()
+					m.PrepareReservation(txID, "vehicle", "req", window, "http://coordinator", nil)
+				}()
+			}
+			_, err := m.PrepareReservation(txID, "vehicle", "req", window, "http://coordinator", nil)
+			duplicate.Wait()
+
+			if err != nil || i%3 == 2 {
+				for {
+					_, err := m.AbortReservation(txID)
+					var txErr *TxError
+					if !errors.As(err, &txErr) || !txErr.Retryable() {
+						break
+					}
+				}
+				return
+			}
+			// COMMIT e ABORT da mesma transação ao mesmo tempo, cada um repetido
+			var decided sync.WaitGroup
+			results := make([]bool, 4) // true: decisão aplicada (nem recusada, nem repetida)
+			for j, decide := range []func(string) (bool, error){m.CommitReservation, m.AbortReservation, m.CommitReservation, m.AbortReservation} {
+				if i%3 == 0 && j%2 == 1 {
+					continue // Só COMMIT
+				}
+				decided.Add(1)
+				go func() {
+					defer decided.Done()
+					dup, err := decide(txID)
+					results[j] = err == nil && !dup
+				}()
+			}
+			decided.Wait()
+			commits, aborts := results[0] || results[2], results[1] || results[3]
+			if (results[0] && results[2]) || (results[1] && results[3]) || (commits && aborts) {
+				t.Errorf("%s: decisões aplicadas mais de uma vez ou conflitantes: %v", txID, results)
+			}
+			if state := m.TransactionState(txID); (commits && state != TxCommitted) || (aborts && state != TxAborted) {
+				t.Errorf("%s: decisão aplicada, mas o estado é %s", txID, state)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	for r := range 4 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.AvailablePosts(base.Add(time.Duration(rand.IntN(20)) * time.Hour))
+				m.GetCityAvailability()
+				m.TransactionState(fmt.Sprintf("tx-%03d", rand.IntN(transactions)))
+				// Transações coordenadas começando enquanto as outras registram trechos
+				coordinated := fmt.Sprintf("coord-%d-%d", r, n)
+				m.StartCoordinatingTransaction(coordinated, "vehicle", []schemas.RouteSegment{{}, {}}, nil)
+				m.RecordSegmentCompletion(schemas.CostUpdatePayload{TransactionID: fmt.Sprintf("coord-%d-%d", (r+1)%4, n), SegmentCity: "city", Cost: 1})
+				m.GetVehicleIDForTransaction(coordinated)
+				m.GetCoordinatedRoute(coordinated)
+			}
+		}()
+	}
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				m.expirePrepared(time.Now().UTC())
+			}
+		}
+	}()
+	go func() {
+		defer background.Done()
+		time.Sleep(20 * time.Millisecond)
+		workers.fault("w1")
+		m.MigrateReservations("w1")
+	}()
+
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	// Os ABORT dos workers preparados a mais no lote saem antes do fim do PREPARE
+	if err := checkConsistency(m, workers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lateWorker aplica o primeiro PREPARE de cada transação num worker na hora, mas só
+// responde depois de delay, como uma resposta que se atrasa na rede.
+type lateWorker struct {
+	*fakeWorkers
+	workerID string
+	delay    time.Duration
+	answered sync.Map // transação -> struct{}
+}
+
+func (l *lateWorker) Prepare(ctx context.Context, workerID string, command schemas.PrepareReserveWindowCommand) (schemas.PrepareResponse, error) {
+	resp, err := l.fakeWorkers.Prepare(ctx, workerID, command)
+	if workerID != l.workerID {
+		return resp, err
+	}
+	if _, seen := l.answered.LoadOrStore(command.TransactionID, struct{}{}); !seen {
+		time.Sleep(l.delay)
+	}
+	return resp, err
+}
+
+// TestLateAbortAfterMigration confere que o ABORT de um worker que aceitou o PREPARE
+// tarde não desfaz a reserva que a migração transferiu depois para ele.
+func TestLateAbortAfterMigration(t *testing.T) {
+	quietLogs(t)
+	workers := newFakeWorkers(2)
+	workers.failRate = 0
+	transport := &lateWorker{fakeWorkers: workers, workerID: "w2", delay: 100 * time.Millisecond}
+	m := newTestManager(transport, workers.online)
+	m.SetAllocation(m.strategy, 2) // w1 e w2 no mesmo lote; w1 vence pela ordem dos IDs
+
+	start := time.Now().UTC().Add(time.Hour)
+	window := schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(time.Hour)}
+	if _, err := m.PrepareReservation("tx-1", "vehicle", "req", window, "http://coordinator", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CommitReservation("tx-1"); err != nil {
+		t.Fatal(err)
+	}
+	workers.fault("w1")
+	if moved, _ := m.MigrateReservations("w1"); moved != 1 {
+		t.Fatalf("%d reserva(s) transferida(s), esperada 1", moved)
+	}
+
+	time.Sleep(2 * transport.delay) // Tempo para uma resposta atrasada ainda pendente
+	if workerID, _ := m.ReservationWorker("tx-1"); workerID != "w2" {
+		t.Fatalf("reserva no worker %q, esperada em w2", workerID)
+	}
+	if err := checkConsistency(m, workers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingTransport segura o PREPARE de uma transação até release ser fechado.
+type blockingTransport struct {
+	transactionID string
+	started       chan struct{}
+	release       chan struct{}
+}
+
+func (b *blockingTransport) Prepare(ctx context.Context, workerID string, command schemas.PrepareReserveWindowCommand) (schemas.PrepareResponse, error) {
+	if command.TransactionID == b.transactionID {
+		close(b.started)
+		<-b.release
+	}
+	return schemas.PrepareResponse{Success: true, TransactionID: command.TransactionID, ConnectorID: 1}, nil
+}
+
+func (b *blockingTransport) Send(workerID, command, transactionID, attemptID string) error {
+	return nil
+}
+
+// TestPrepareDoesNotBlockOtherOperations confere que, com um PREPARE esperando o worker,
+// as consultas e as outras transações seguem e a decisão da mesma transação é recusada
+// na hora como PREPARE_IN_PROGRESS.
+func TestPrepareDoesNotBlockOtherOperations(t *testing.T) {
+	quietLogs(t)
+	transport := &blockingTransport{transactionID: "slow", started: make(chan struct{}), release: make(chan struct{})}
+	m := newTestManager(transport, func() []string { return []string{"w1"} })
+	start := time.Now().UTC().Add(time.Hour)
+	window := schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(time.Hour)}
+
+	prepared := make(chan error, 1)
+	go func() {
+		_, err := m.PrepareReservation("slow", "vehicle", "req", window, "http://coordinator", nil)
+		prepared <- err
+	}()
+	<-transport.started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if state := m.TransactionState("slow"); state != TxInit {
+			t.Errorf("estado durante o PREPARE: %s, esperado %s", state, TxInit)
+		}
+		m.AvailablePosts(start)
+		m.GetCityAvailability()
+		var txErr *TxError
+		if _, err := m.CommitReservation("slow"); !errors.As(err, &txErr) || txErr.Code != schemas.TxErrPrepareInProgress {
+			t.Errorf("COMMIT durante o PREPARE: %v, esperado %s", err, schemas.TxErrPrepareInProgress)
+		}
+		if _, err := m.PrepareReservation("fast", "vehicle", "req", window, "http://coordinator", nil); err != nil {
+			t.Errorf("PREPARE de outra transação: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("operações bloqueadas pelo PREPARE em curso")
+	}
+
+	close(transport.release)
+	if err := <-prepared; err != nil {
+		t.Fatalf("PREPARE: %v", err)
+	}
+	if state := m.TransactionState("slow"); state != TxPrepared {
+		t.Fatalf("estado depois do PREPARE: %s, esperado %s", state, TxPrepared)
+	}
+}
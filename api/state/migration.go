@@ -0,0 +1,98 @@
+package state
+
+import (
+	"log"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/google/uuid"
+)
+
+// migrationCandidate é o que a migração precisa de uma reserva, copiado sob cityDataMux.
+type migrationCandidate struct {
+	transactionID string
+	window        schemas.ReservationWindow
+	vehicle       *schemas.VehicleProfile
+}
+
+// MigrateReservations transfere para outros workers da cidade as reservas confirmadas do
+// worker em falha cuja janela ainda não começou. Cada reserva passa por um novo PREPARE,
+// com uma tentativa própria (que já deixa de fora o worker em falha), recebe COMMIT no
+// worker novo e ABORT no antigo, que libera a janela. O ABORT leva a tentativa antiga: se
+// o worker novo for um que recusou ou perdeu uma tentativa anterior, um ABORT atrasado
+// dela não desfaz a reserva transferida. Reservas sem worker substituto ficam onde estão: o worker
+// ainda pode se recuperar antes da janela.
+// Só uma migração por worker acontece de cada vez; os PREPARE são feitos com o lock da
+// transação, sem cityDataMux.
+// Retorna quantas reservas foram transferidas e quantas não puderam ser.
+func (m *StateManager) MigrateReservations(workerID string) (moved, failed int) {
+	unlock := m.workerLocks.Lock(workerID)
+	defer unlock()
+
+	now := time.Now().UTC()
+	var candidates []migrationCandidate
+	m.cityDataMux.Lock()
+	for _, res := range m.cityData.ActiveReservations {
+		if res.WorkerID == workerID && res.Status == schemas.StatusReservationCommitted && now.Before(res.ReservationWindow.StartTimeUTC) {
+			candidates = append(candidates, migrationCandidate{transactionID: res.TransactionID, window: res.ReservationWindow, vehicle: res.Vehicle})
+		}
+	}
+	m.cityDataMux.Unlock()
+
+	for _, candidate := range candidates {
+		if m.migrateReservation(workerID, candidate) {
+			moved++
+		} else {
+			failed++
+		}
+	}
+	if moved+failed > 0 {
+		log.Printf("[StateManager-%s] Worker '%s' em falha: %d reserva(s) transferida(s), %d sem substituto.", m.ownedCity, workerID, moved, failed)
+	}
+	return moved, failed
+}
+
+// migrateReservation transfere uma reserva do worker em falha. Se ela tiver sido encerrada
+// ou transferida enquanto o PREPARE estava em curso, o worker novo recebe ABORT.
+func (m *StateManager) migrateReservation(workerID string, candidate migrationCandidate) bool {
+	transactionID := candidate.transactionID
+	unlock := m.txLocks.Lock(transactionID)
+	defer unlock()
+
+	attemptID := uuid.New().String()
+	prepared, err := m.attemptToPrepareWorker(transactionID, attemptID, candidate.window, candidate.vehicle)
+	if err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: FALHA MIGRAÇÃO - Reserva continua no worker '%s': %v", m.ownedCity, transactionID, workerID, err)
+		return false
+	}
+
+	m.cityDataMux.Lock()
+	var res *schemas.ActiveReservation
+	for i := range m.cityData.ActiveReservations {
+		r := &m.cityData.ActiveReservations[i]
+		if r.TransactionID == transactionID && r.WorkerID == workerID && r.Status == schemas.StatusReservationCommitted {
+			res = r
+			break
+		}
+	}
+	newTarget := workerTarget{prepared.WorkerID, attemptID}
+	if res == nil {
+		m.cityDataMux.Unlock()
+		log.Printf("[StateManager-%s] TX[%s]: FALHA MIGRAÇÃO - Reserva mudou durante o PREPARE no worker '%s'.", m.ownedCity, transactionID, prepared.WorkerID)
+		m.sendCommandToWorker(newTarget, transactionID, schemas.WorkerCommandAbort)
+		return false
+	}
+	oldTarget := workerTarget{workerID, res.AttemptID}
+	if res.MigratedFrom == "" {
+		res.MigratedFrom = workerID
+	}
+	m.active.Delete(res.ReservationWindow, activeEntry{TransactionID: transactionID, WorkerID: workerID})
+	m.active.Insert(res.ReservationWindow, activeEntry{TransactionID: transactionID, WorkerID: prepared.WorkerID})
+	res.WorkerID, res.ConnectorID, res.AttemptID = prepared.WorkerID, prepared.ConnectorID, attemptID
+	m.cityDataMux.Unlock()
+
+	m.sendCommandToWorker(newTarget, transactionID, schemas.WorkerCommandCommit)
+	m.sendCommandToWorker(oldTarget, transactionID, schemas.WorkerCommandAbort)
+	log.Printf("[StateManager-%s] TX[%s]: SUCESSO MIGRAÇÃO. Reserva transferida do worker '%s' para '%s' (conector %d).", m.ownedCity, transactionID, workerID, prepared.WorkerID, prepared.ConnectorID)
+	return true
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Estados de uma transação no participante do 2PC. INIT dura enquanto o PREPARE está em
+// curso; COMMITTED e ABORTED são finais.
+const (
+	TxInit      = "INIT"
+	TxPrepared  = schemas.StatusReservationPrepared
+	TxCommitted = schemas.StatusReservationCommitted
+	TxAborted   = schemas.StatusAborted
+)
+
+// DefaultPrepareTimeout é quanto tempo uma transação fica PREPARED esperando a decisão
+// do coordenador antes de ser abortada localmente (PREPARE_TIMEOUT).
+const DefaultPrepareTimeout = 2 * time.Minute
+
+// participantTx é o estado de uma transação nesta API. Protegido por cityDataMux; as
+// transições que envolvem os workers também seguram o lock da transação (txLocks).
+type participantTx struct {
+	state     string
+	updatedAt time.Time // Última transição
+}
+
+// TxError é a recusa de uma operação do 2PC, com o código devolvido ao coordenador.
+type TxError struct {
+	TransactionID string
+	Code          string // schemas.TxErr*
+	State         string // Estado da transação quando a operação foi recusada
+	Reason        string
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("transação %s recusada (%s): %s", e.TransactionID, e.Code, e.Reason)
+}
+
+// Retryable informa se a mesma operação pode dar certo se repetida mais tarde.
+func (e *TxError) Retryable() bool {
+	return e.Code == schemas.TxErrPrepareInProgress || e.Code == schemas.TxErrWorkerUnavailable
+}
+
+// TransactionState retorna o estado da transação nesta API ("" se desconhecida).
+func (m *StateManager) TransactionState(transactionID string) string {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.txState(transactionID)
+}
+
+// txState é TransactionState com cityDataMux já travado.
+func (m *StateManager) txState(transactionID string) string {
+	if tx, ok := m.transactions[transactionID]; ok {
+		return tx.state
+	}
+	return ""
+}
+
+// SetPrepareTimeout define quanto tempo uma transação pode ficar PREPARED sem decisão.
+func (m *StateManager) SetPrepareTimeout(timeout time.Duration) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.prepareTimeout = timeout
+}
+
+// PrepareTimeout retorna quanto tempo uma transação pode ficar PREPARED sem decisão.
+func (m *StateManager) PrepareTimeout() time.Duration {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.prepareTimeout
+}
+
+// setTxState registra a transição. Deve ser chamada com cityDataMux travado.
+func (m *StateManager) setTxState(transactionID, state string) {
+	from := "-"
+	tx, ok := m.transactions[transactionID]
+	if !ok {
+		tx = &participantTx{}
+		m.transactions[transactionID] = tx
+	} else {
+		from = tx.state
+	}
+	tx.state, tx.updatedAt = state, time.Now().UTC()
+	log.Printf("[StateManager-%s] TX[%s]: %s -> %s", m.ownedCity, transactionID, from, state)
+}
+
+// rejectTransition monta a recusa de uma operação pedida no estado atual da transação.
+func rejectTransition(transactionID, state, operation string) *TxError {
+	err := &TxError{TransactionID: transactionID, State: state}
+	switch state {
+	case "":
+		err.Code, err.Reason = schemas.TxErrUnknownTransaction, fmt.Sprintf("%s de uma transação não preparada nesta API", operation)
+	case TxInit:
+		err.Code, err.Reason = schemas.TxErrPrepareInProgress, fmt.Sprintf("%s recebido com o PREPARE ainda em curso", operation)
+	case TxAborted:
+		err.Code, err.Reason = schemas.TxErrAlreadyAborted, fmt.Sprintf("%s de uma transação já abortada", operation)
+	case TxCommitted:
+		err.Code, err.Reason = schemas.TxErrAlreadyCommitted, fmt.Sprintf("%s de uma transação já confirmada", operation)
+	}
+	return err
+}
+
+// WatchPrepareTimeouts aborta as transações que ficaram PREPARED por mais que o timeout
+// sem COMMIT nem ABORT do coordenador, liberando os postos. Um COMMIT que chegar depois é
+// recusado com ALREADY_ABORTED. Não retorna; deve ser chamada numa goroutine.
+func (m *StateManager) WatchPrepareTimeouts() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.expirePrepared(time.Now().UTC())
+	}
+}
+
+// expirePrepared aborta as transações vencidas. Uma transação com outra operação em curso
+// fica para a próxima varredura, se ainda estiver PREPARED.
+func (m *StateManager) expirePrepared(now time.Time) {
+	expired := func(tx *participantTx) bool {
+		return tx != nil && tx.state == TxPrepared && now.Sub(tx.updatedAt) >= m.prepareTimeout
+	}
+	m.cityDataMux.Lock()
+	var candidates []string
+	for transactionID, tx := range m.transactions {
+		if expired(tx) {
+			candidates = append(candidates, transactionID)
+		}
+	}
+	m.cityDataMux.Unlock()
+
+	for _, transactionID := range candidates {
+		unlock, ok := m.txLocks.TryLock(transactionID)
+		if !ok {
+			continue
+		}
+		m.cityDataMux.Lock()
+		var targets []workerTarget
+		if expired(m.transactions[transactionID]) {
+			log.Printf("[StateManager-%s] TX[%s]: Sem decisão do coordenador em %v. ABORT POR TIMEOUT.", m.ownedCity, transactionID, m.prepareTimeout)
+			targets = m.abortPrepared(transactionID)
+			m.setTxState(transactionID, TxAborted)
+		}
+		m.cityDataMux.Unlock()
+		for _, target := range targets {
+			m.sendCommandToWorker(target, transactionID, schemas.WorkerCommandAbort)
+		}
+		unlock()
+	}
+}
+
+// forgetDecided esquece as transações decididas há mais que a retenção e sem reserva na
+// memória. Deve ser chamada com cityDataMux travado.
+func (m *StateManager) forgetDecided(now time.Time, retention time.Duration) {
+	inUse := make(map[string]bool, len(m.cityData.ActiveReservations))
+	for _, res := range m.cityData.ActiveReservations {
+		inUse[res.TransactionID] = true
+	}
+	for transactionID, tx := range m.transactions {
+		if (tx.state == TxCommitted || tx.state == TxAborted) && !inUse[transactionID] && now.Sub(tx.updatedAt) >= retention {
+			delete(m.transactions, transactionID)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package state
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// scriptedWorker responde a todo PREPARE do mesmo jeito: aceita, recusa ou não responde.
+type scriptedWorker struct {
+	reply string // "aceita", "recusa" ou "sem resposta"
+}
+
+func (w scriptedWorker) Prepare(_ context.Context, _ string, command schemas.PrepareReserveWindowCommand) (schemas.PrepareResponse, error) {
+	switch w.reply {
+	case "aceita":
+		return schemas.PrepareResponse{Success: true, TransactionID: command.TransactionID, ConnectorID: 1}, nil
+	case "recusa":
+		return schemas.PrepareResponse{TransactionID: command.TransactionID}, nil
+	}
+	return schemas.PrepareResponse{}, context.DeadlineExceeded
+}
+
+func (scriptedWorker) Send(string, string, string, string) error { return nil }
+
+func TestParticipantTransitions(t *testing.T) {
+	const tx = "tx-1"
+	tests := []struct {
+		name          string
+		setup         []string // Operações aplicadas antes, com o worker aceitando
+		reply         string   // Resposta do worker à operação testada (padrão: aceita)
+		offline       bool     // Nenhum worker online
+		operation     string
+		wantDuplicate bool
+		wantCode      string // Vazio: operação aceita
+		wantRetryable bool
+		wantState     string
+	}{
+		{name: "PREPARE de transação nova", operation: "PREPARE", wantState: TxPrepared},
+		{name: "PREPARE repetido", setup: []string{"PREPARE"}, operation: "PREPARE", wantDuplicate: true, wantState: TxPrepared},
+		{name: "PREPARE depois do COMMIT", setup: []string{"PREPARE", "COMMIT"}, operation: "PREPARE", wantDuplicate: true, wantState: TxCommitted},
+		{name: "PREPARE depois do ABORT", setup: []string{"ABORT"}, operation: "PREPARE", wantCode: schemas.TxErrAlreadyAborted, wantState: TxAborted},
+		{name: "PREPARE em curso", setup: []string{"INIT"}, operation: "PREPARE", wantCode: schemas.TxErrPrepareInProgress, wantRetryable: true, wantState: TxInit},
+		{name: "PREPARE sem worker online", offline: true, operation: "PREPARE", wantCode: schemas.TxErrWorkerUnavailable, wantRetryable: true},
+		{name: "PREPARE sem resposta do worker", reply: "sem resposta", operation: "PREPARE", wantCode: schemas.TxErrWorkerUnavailable, wantRetryable: true},
+		{name: "PREPARE recusado pelo worker", reply: "recusa", operation: "PREPARE", wantCode: schemas.TxErrNoCapacity},
+
+		{name: "COMMIT do preparado", setup: []string{"PREPARE"}, operation: "COMMIT", wantState: TxCommitted},
+		{name: "COMMIT repetido", setup: []string{"PREPARE", "COMMIT"}, operation: "COMMIT", wantDuplicate: true, wantState: TxCommitted},
+		{name: "COMMIT de transação desconhecida", operation: "COMMIT", wantCode: schemas.TxErrUnknownTransaction},
+		{name: "COMMIT depois do ABORT", setup: []string{"PREPARE", "ABORT"}, operation: "COMMIT", wantCode: schemas.TxErrAlreadyAborted, wantState: TxAborted},
+		{name: "COMMIT depois do timeout", setup: []string{"PREPARE", "TIMEOUT"}, operation: "COMMIT", wantCode: schemas.TxErrAlreadyAborted, wantState: TxAborted},
+		{name: "COMMIT com PREPARE em curso", setup: []string{"INIT"}, operation: "COMMIT", wantCode: schemas.TxErrPrepareInProgress, wantRetryable: true, wantState: TxInit},
+
+		{name: "ABORT do preparado", setup: []string{"PREPARE"}, operation: "ABORT", wantState: TxAborted},
+		{name: "ABORT repetido", setup: []string{"PREPARE", "ABORT"}, operation: "ABORT", wantDuplicate: true, wantState: TxAborted},
+		{name: "ABORT de transação desconhecida", operation: "ABORT", wantState: TxAborted},
+		{name: "ABORT depois do COMMIT", setup: []string{"PREPARE", "COMMIT"}, operation: "ABORT", wantCode: schemas.TxErrAlreadyCommitted, wantState: TxCommitted},
+		{name: "ABORT com PREPARE em curso", setup: []string{"INIT"}, operation: "ABORT", wantCode: schemas.TxErrPrepareInProgress, wantRetryable: true, wantState: TxInit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quietLogs(t)
+			worker := &scriptedWorker{reply: "aceita"}
+			m := newTestManager(worker, func() []string {
+				if tt.offline {
+					return nil
+				}
+				return []string{"w1"}
+			})
+			apply := func(operation string) (bool, error) {
+				switch operation {
+				case "PREPARE":
+					return m.PrepareReservation(tx, "car-1", "req-1", hours(12, 13), "http://coordenador:8080", nil)
+				case "COMMIT":
+					return m.CommitReservation(tx)
+				case "ABORT":
+					return m.AbortReservation(tx)
+				case "INIT":
+					m.cityDataMux.Lock()
+					m.setTxState(tx, TxInit)
+					m.cityDataMux.Unlock()
+				case "TIMEOUT":
+					m.expirePrepared(time.Now().UTC().Add(m.PrepareTimeout()))
+				}
+				return false, nil
+			}
+
+			for _, operation := range tt.setup {
+				if _, err := apply(operation); err != nil {
+					t.Fatalf("%s na preparação: %v", operation, err)
+				}
+			}
+			worker.reply = cmp.Or(tt.reply, "aceita")
+			duplicate, err := apply(tt.operation)
+
+			if duplicate != tt.wantDuplicate {
+				t.Fatalf("duplicate = %v, esperado %v", duplicate, tt.wantDuplicate)
+			}
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("erro inesperado: %v", err)
+				}
+			} else {
+				var txErr *TxError
+				if !errors.As(err, &txErr) {
+					t.Fatalf("erro = %v, esperado *TxError %s", err, tt.wantCode)
+				}
+				if txErr.Code != tt.wantCode || txErr.Retryable() != tt.wantRetryable {
+					t.Fatalf("código %s (repetível %v), esperado %s (repetível %v)", txErr.Code, txErr.Retryable(), tt.wantCode, tt.wantRetryable)
+				}
+			}
+			if state := m.TransactionState(tx); state != tt.wantState {
+				t.Fatalf("estado %q, esperado %q", state, tt.wantState)
+			}
+		})
+	}
+}
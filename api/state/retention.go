@@ -0,0 +1,72 @@
+package state
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// activeEntry é o que o índice de janelas guarda de cada reserva ativa.
+type activeEntry struct {
+	TransactionID string
+	WorkerID      string
+}
+
+// SetRetention define por quanto tempo uma reserva encerrada fica na memória e o arquivo
+// para onde ela vai depois. Sem arquivo, as reservas encerradas não são removidas.
+func (m *StateManager) SetRetention(retention time.Duration, archive *schedule.Archive) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.retention, m.archive = retention, archive
+}
+
+// Retention retorna por quanto tempo uma reserva encerrada fica na memória.
+func (m *StateManager) Retention() time.Duration {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.retention
+}
+
+// CollectReservations arquiva, a cada schedule.SweepInterval, as reservas encerradas há
+// mais que o prazo de retenção. Não retorna; deve ser chamada numa goroutine.
+func (m *StateManager) CollectReservations() {
+	ticker := time.NewTicker(schedule.SweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.ArchiveFinished(time.Now().UTC())
+	}
+}
+
+// ArchiveFinished grava no arquivo as reservas encerradas há mais que o prazo de retenção
+// e só então as tira do estado da cidade: se a gravação falhar, elas ficam para a próxima
+// varredura. A escrita acontece fora do lock. Retorna quantas reservas foram arquivadas.
+func (m *StateManager) ArchiveFinished(now time.Time) int {
+	m.cityDataMux.Lock()
+	archive, retention := m.archive, m.retention
+	m.forgetDecided(now, retention)
+	var expired []any
+	for _, res := range m.cityData.ActiveReservations {
+		if res.FinishedAt != nil && now.Sub(*res.FinishedAt) >= retention {
+			expired = append(expired, res)
+		}
+	}
+	m.cityDataMux.Unlock()
+	if archive == nil || len(expired) == 0 {
+		return 0
+	}
+
+	if err := archive.Append(expired...); err != nil {
+		log.Printf("[StateManager-%s] ERRO ao arquivar %d reserva(s) encerrada(s): %v", m.ownedCity, len(expired), err)
+		return 0
+	}
+	m.cityDataMux.Lock()
+	m.cityData.ActiveReservations = slices.DeleteFunc(m.cityData.ActiveReservations, func(res schemas.ActiveReservation) bool {
+		return res.FinishedAt != nil && now.Sub(*res.FinishedAt) >= retention
+	})
+	m.cityDataMux.Unlock()
+	log.Printf("[StateManager-%s] %d reserva(s) encerrada(s) movida(s) para '%s'.", m.ownedCity, len(expired), archive.Path())
+	return len(expired)
+}
@@ -0,0 +1,114 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+func TestArchiveFinished(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	finished := func(ago time.Duration) *time.Time {
+		at := now.Add(-ago)
+		return &at
+	}
+	reservations := []schemas.ActiveReservation{
+		{TransactionID: "antiga", Status: schemas.StatusReservationCharged, FinishedAt: finished(48 * time.Hour)},
+		{TransactionID: "no-prazo", Status: schemas.StatusReservationNoShow, FinishedAt: finished(24 * time.Hour)}, // Exatamente no prazo: sai
+		{TransactionID: "recente", Status: schemas.StatusReservationCharged, FinishedAt: finished(time.Hour)},
+		{TransactionID: "ativa", Status: "COMMITTED"},
+	}
+
+	tests := []struct {
+		name         string
+		archive      func(dir string) *schedule.Archive
+		wantArchived []string
+		wantKept     []string
+	}{
+		{
+			name:         "arquiva as encerradas há mais que a retenção",
+			archive:      func(dir string) *schedule.Archive { return schedule.NewArchive(filepath.Join(dir, "reservas.jsonl")) },
+			wantArchived: []string{"antiga", "no-prazo"},
+			wantKept:     []string{"recente", "ativa"},
+		},
+		{
+			name:     "sem arquivo nada é removido",
+			archive:  func(string) *schedule.Archive { return nil },
+			wantKept: []string{"antiga", "no-prazo", "recente", "ativa"},
+		},
+		{
+			name:     "falha na gravação mantém as reservas",
+			archive:  func(dir string) *schedule.Archive { return schedule.NewArchive(dir) }, // Diretório: não abre para escrita
+			wantKept: []string{"antiga", "no-prazo", "recente", "ativa"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quietLogs(t)
+			dir := t.TempDir()
+			archive := tt.archive(dir)
+			m := NewStateManager("Salvador", "http://solatlantico:8080")
+			m.SetRetention(24*time.Hour, archive)
+			m.cityData.ActiveReservations = slices.Clone(reservations)
+
+			if got := m.ArchiveFinished(now); got != len(tt.wantArchived) {
+				t.Fatalf("ArchiveFinished = %d, esperado %d", got, len(tt.wantArchived))
+			}
+			var kept []string
+			for _, res := range m.cityData.ActiveReservations {
+				kept = append(kept, res.TransactionID)
+			}
+			if !slices.Equal(kept, tt.wantKept) {
+				t.Fatalf("mantidas %v, esperadas %v", kept, tt.wantKept)
+			}
+
+			if len(tt.wantArchived) == 0 {
+				return
+			}
+			data, err := os.ReadFile(archive.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != len(tt.wantArchived) {
+				t.Fatalf("%d linha(s) no arquivo, esperadas %d", len(lines), len(tt.wantArchived))
+			}
+			for i, id := range tt.wantArchived {
+				if !strings.Contains(lines[i], `"transaction_id":"`+id+`"`) {
+					t.Fatalf("linha %d = %s, esperada a reserva %s", i, lines[i], id)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveFinishedForgetsDecidedTransactions(t *testing.T) {
+	quietLogs(t)
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	m := NewStateManager("Salvador", "http://solatlantico:8080")
+	m.SetRetention(time.Hour, nil)
+	m.cityData.ActiveReservations = []schemas.ActiveReservation{{TransactionID: "com-reserva", Status: "COMMITTED"}}
+	m.transactions = map[string]*participantTx{
+		"antiga":      {state: TxAborted, updatedAt: now.Add(-2 * time.Hour)},
+		"recente":     {state: TxCommitted, updatedAt: now.Add(-time.Minute)},
+		"com-reserva": {state: TxCommitted, updatedAt: now.Add(-2 * time.Hour)},
+		"preparada":   {state: TxPrepared, updatedAt: now.Add(-2 * time.Hour)},
+	}
+
+	m.ArchiveFinished(now)
+	var remaining []string
+	for id := range m.transactions {
+		remaining = append(remaining, id)
+	}
+	slices.Sort(remaining)
+	if want := []string{"com-reserva", "preparada", "recente"}; !slices.Equal(remaining, want) {
+		t.Fatalf("transações restantes %v, esperadas %v", remaining, want)
+	}
+}
@@ -0,0 +1,64 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// workerPrepareTimeout é o tempo máximo de espera pela resposta de um PREPARE.
+const workerPrepareTimeout = 5 * time.Second
+
+// WorkerTransport leva os comandos do 2PC aos charging point workers. O StateManager
+// nunca o chama com cityDataMux travado.
+type WorkerTransport interface {
+	// Prepare envia PREPARE_RESERVE_WINDOW e aguarda a resposta do worker.
+	Prepare(ctx context.Context, workerID string, command schemas.PrepareReserveWindowCommand) (schemas.PrepareResponse, error)
+	// Send envia COMMIT ou ABORT (schemas.WorkerCommand*), que não têm resposta, para a
+	// reserva da tentativa de PREPARE attemptID.
+	Send(workerID, command, transactionID, attemptID string) error
+}
+
+// mqttTransport é o WorkerTransport padrão: publica no tópico de comandos do worker.
+type mqttTransport struct {
+	enterpriseName string
+	version        func(workerID string) int // Versão de mensagem negociada com o worker
+}
+
+func (t mqttTransport) commandTopic(workerID string) string {
+	return fmt.Sprintf("enterprise/%s/cp/%s/command", t.enterpriseName, workerID)
+}
+
+func (t mqttTransport) Prepare(ctx context.Context, workerID string, command schemas.PrepareReserveWindowCommand) (schemas.PrepareResponse, error) {
+	version := t.version(workerID)
+	encode := func(request mqtt.RPCRequest) ([]byte, error) {
+		return schemas.EncodeMessage(schemas.MsgPrepareReserveWindow, t.enterpriseName, version, request)
+	}
+	return mqtt.Call[schemas.PrepareResponse](ctx, mqtt.DefaultRequester(), t.commandTopic(workerID), &command, encode)
+}
+
+func (t mqttTransport) Send(workerID, command, transactionID, attemptID string) error {
+	var msg any
+	switch command {
+	case schemas.WorkerCommandCommit:
+		msg = schemas.CommitCommand{TransactionID: transactionID, AttemptID: attemptID}
+	case schemas.WorkerCommandAbort:
+		msg = schemas.AbortCommand{TransactionID: transactionID, AttemptID: attemptID}
+	default:
+		return fmt.Errorf("comando desconhecido para worker: '%s'", command)
+	}
+	msgBytes, err := schemas.EncodeMessage(command, t.enterpriseName, t.version(workerID), msg)
+	if err != nil {
+		return fmt.Errorf("falha ao serializar comando '%s': %w", command, err)
+	}
+	mqtt.Publish(t.commandTopic(workerID), string(msgBytes))
+	return nil
+}
+
+// SetWorkerTransport troca o meio usado para falar com os workers (o padrão é o MQTT).
+func (m *StateManager) SetWorkerTransport(transport WorkerTransport) {
+	m.transport = transport
+}
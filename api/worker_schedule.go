@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Tempo máximo de espera pela resposta de um QUERY_SCHEDULE ou QUERY_WINDOW
+	workerQueryTimeout = 3 * time.Second
+	// Duração padrão de cada intervalo do calendário de vagas
+	defaultSlotDuration = time.Hour
+	minSlotDuration     = 5 * time.Minute
+)
+
+// workerSupportsQueries informa se o worker anunciou, no heartbeat, que atende
+// QUERY_SCHEDULE e QUERY_WINDOW.
+func workerSupportsQueries(workerID string) bool {
+	workersMux.RLock()
+	defer workersMux.RUnlock()
+	p, ok := workers[workerID]
+	return ok && p.capabilities != nil && p.capabilities.Queries
+}
+
+// queryWorkerSchedule pede ao worker a agenda dos conectores em [from, to). Se o worker não
+// atende consultas ou não responde a tempo, usa a última info publicada por ele; o erro só
+// é retornado se nem essa info existir.
+func queryWorkerSchedule(workerID string, from, to time.Time) (schemas.ScheduleResponse, error) {
+	if workerSupportsQueries(workerID) {
+		command := schemas.QueryScheduleCommand{From: from, To: to}
+		version := schemas.NegotiateVersion(workerProtocolVersion(workerID))
+		encode := func(request mqtt.RPCRequest) ([]byte, error) {
+			return schemas.EncodeMessage(schemas.MsgQuerySchedule, enterpriseName, version, request)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), workerQueryTimeout)
+		defer cancel()
+		resp, err := mqtt.Call[schemas.ScheduleResponse](ctx, mqtt.DefaultRequester(), workerCommandTopic(workerID), &command, encode)
+		if err == nil {
+			resp.Source = schemas.ScheduleFromWorker
+			return resp, nil
+		}
+		log.Printf("[%s] Sem resposta de QUERY_SCHEDULE do worker '%s': %v. Usando a agenda anunciada.", enterpriseName, workerID, err)
+	}
+	return announcedSchedule(workerID, from, to)
+}
+
+// announcedSchedule monta a agenda do worker a partir da última info publicada por ele.
+func announcedSchedule(workerID string, from, to time.Time) (schemas.ScheduleResponse, error) {
+	chargingPointsMux.RLock()
+	info, ok := chargingPoints[workerID]
+	receivedAt := chargingPointsAt[workerID]
+	chargingPointsMux.RUnlock()
+	if !ok || info.Connectors == nil {
+		return schemas.ScheduleResponse{}, fmt.Errorf("agenda do worker '%s' desconhecida", workerID)
+	}
+
+	resp := schemas.ScheduleResponse{WorkerID: workerID, From: from, To: to, GeneratedAt: receivedAt, Source: schemas.ScheduleFromAnnounced}
+	for _, c := range info.Connectors {
+		schedule := schemas.ConnectorSchedule{ConnectorID: c.ConnectorID, Type: c.Type, PowerKW: c.PowerKW, Status: c.Status, Reservations: []schemas.ScheduledWindow{}}
+		for _, window := range c.Reservations {
+			if window.EndTimeUTC.After(from) && window.StartTimeUTC.Before(to) {
+				schedule.Reservations = append(schedule.Reservations, schemas.ScheduledWindow{Window: window})
+			}
+		}
+		resp.Connectors = append(resp.Connectors, schedule)
+	}
+	return resp, nil
+}
+
+// queryWorkerWindow pergunta ao worker, sem reservar, se ele atende a janela.
+func queryWorkerWindow(workerID string, window schemas.ReservationWindow, vehicle *schemas.VehicleProfile) (schemas.WindowResponse, error) {
+	if !workerSupportsQueries(workerID) {
+		return schemas.WindowResponse{}, fmt.Errorf("worker '%s' não atende QUERY_WINDOW", workerID)
+	}
+	command := schemas.QueryWindowCommand{Window: window, Vehicle: vehicle}
+	version := schemas.NegotiateVersion(workerProtocolVersion(workerID))
+	encode := func(request mqtt.RPCRequest) ([]byte, error) {
+		return schemas.EncodeMessage(schemas.MsgQueryWindow, enterpriseName, version, request)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), workerQueryTimeout)
+	defer cancel()
+	return mqtt.Call[schemas.WindowResponse](ctx, mqtt.DefaultRequester(), workerCommandTopic(workerID), &command, encode)
+}
+
+func workerCommandTopic(workerID string) string {
+	return fmt.Sprintf("enterprise/%s/cp/%s/command", enterpriseName, workerID)
+}
+
+// parseScheduleDate lê o parâmetro 'date' (AAAA-MM-DD, em UTC); vazio é o dia de hoje.
+func parseScheduleDate(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour), nil
+	}
+	return time.Parse(time.DateOnly, raw)
+}
+
+// handleWorkerSchedule responde GET /workers/:id/schedule?date=AAAA-MM-DD com a agenda
+// dos conectores do worker no dia.
+func handleWorkerSchedule(c *gin.Context) {
+	workerID := c.Param("id")
+	workersMux.RLock()
+	_, known := workers[workerID]
+	workersMux.RUnlock()
+	if !known {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Worker não encontrado"})
+		return
+	}
+	day, err := parseScheduleDate(c.Query("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parâmetro 'date' inválido: use AAAA-MM-DD"})
+		return
+	}
+
+	schedule, err := queryWorkerSchedule(workerID, day, day.Add(24*time.Hour))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// querySchedules consulta ao mesmo tempo a agenda dos workers aptos a receber reservas.
+// Os workers sem agenda conhecida vêm em unreachable.
+func querySchedules(from, to time.Time) (schedules []schemas.ScheduleResponse, unreachable []string) {
+	ids := eligibleWorkers()
+	results := make([]*schemas.ScheduleResponse, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if schedule, err := queryWorkerSchedule(id, from, to); err == nil {
+				results[i] = &schedule
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, schedule := range results {
+		if schedule == nil {
+			unreachable = append(unreachable, ids[i])
+			continue
+		}
+		schedules = append(schedules, *schedule)
+	}
+	return schedules, unreachable
+}
+
+// connectorFree informa se o conector está livre durante todo o intervalo. Janelas que
+// apenas se tocam contam como sobrepostas, como no PREPARE.
+func connectorFree(c schemas.ConnectorSchedule, slot schemas.ReservationWindow) bool {
+	if c.Status == schemas.ConnectorFaulted {
+		return false
+	}
+	for _, reserved := range c.Reservations {
+		if schedule.Overlaps(slot, reserved.Window) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleFreeSlots responde GET /schedule/free-slots?date=AAAA-MM-DD&slot=60m&connector_type=CCS2
+// com o calendário de vagas da cidade: para cada intervalo do dia, quantos conectores
+// compatíveis ficam livres durante todo ele e em quais workers.
+func handleFreeSlots(c *gin.Context) {
+	day, err := parseScheduleDate(c.Query("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parâmetro 'date' inválido: use AAAA-MM-DD"})
+		return
+	}
+	slotDuration := defaultSlotDuration
+	if raw := c.Query("slot"); raw != "" {
+		slotDuration, err = time.ParseDuration(raw)
+		if err != nil || slotDuration < minSlotDuration || slotDuration > 24*time.Hour {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Parâmetro 'slot' inválido: use uma duração entre %v e 24h", minSlotDuration)})
+			return
+		}
+	}
+	connectorType := c.Query("connector_type")
+	switch connectorType {
+	case "", schemas.ConnectorCCS2, schemas.ConnectorType2, schemas.ConnectorCHAdeMO:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Tipo de conector desconhecido: '%s'", connectorType)})
+		return
+	}
+
+	end := day.Add(24 * time.Hour)
+	schedules, unreachable := querySchedules(day, end)
+	calendar := schemas.FreeSlotCalendar{
+		City:          ownedCity,
+		Date:          day.Format(time.DateOnly),
+		SlotMinutes:   int(slotDuration.Minutes()),
+		ConnectorType: connectorType,
+		Slots:         []schemas.FreeSlot{},
+		Unreachable:   unreachable,
+	}
+	for start := day; start.Before(end); start = start.Add(slotDuration) {
+		slot := schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(slotDuration)}
+		if slot.EndTimeUTC.After(end) {
+			slot.EndTimeUTC = end
+		}
+		free := schemas.FreeSlot{Start: slot.StartTimeUTC, End: slot.EndTimeUTC}
+		for _, schedule := range schedules {
+			count := 0
+			for _, connector := range schedule.Connectors {
+				if (connectorType == "" || connector.Type == connectorType) && connectorFree(connector, slot) {
+					count++
+				}
+			}
+			if count > 0 {
+				free.FreeConnectors += count
+				free.Workers = append(free.Workers, schedule.WorkerID)
+			}
+		}
+		calendar.Slots = append(calendar.Slots, free)
+	}
+	c.JSON(http.StatusOK, calendar)
+}
+
+// handleWindowAvailability responde GET /schedule/window?start=..&end=..&connector_type=..
+// consultando ao mesmo tempo, com QUERY_WINDOW, os workers aptos a receber reservas.
+func handleWindowAvailability(c *gin.Context) {
+	start, errStart := time.Parse(time.RFC3339, c.Query("start"))
+	end, errEnd := time.Parse(time.RFC3339, c.Query("end"))
+	if errStart != nil || errEnd != nil || !end.After(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parâmetros 'start' e 'end' são obrigatórios (RFC 3339) e 'end' deve ser posterior a 'start'"})
+		return
+	}
+	window := schemas.ReservationWindow{StartTimeUTC: start.UTC(), EndTimeUTC: end.UTC()}
+	var vehicle *schemas.VehicleProfile
+	if connectorType := c.Query("connector_type"); connectorType != "" {
+		vehicle = &schemas.VehicleProfile{ConnectorType: connectorType}
+	}
+
+	ids := eligibleWorkers()
+	results := make([]*schemas.WindowResponse, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := queryWorkerWindow(id, window, vehicle)
+			if err != nil {
+				log.Printf("[%s] QUERY_WINDOW sem resposta do worker '%s': %v", enterpriseName, id, err)
+				return
+			}
+			resp.WorkerID = id
+			results[i] = &resp
+		}()
+	}
+	wg.Wait()
+
+	availability := schemas.WindowAvailability{City: ownedCity, Window: window, Workers: []schemas.WindowResponse{}}
+	for i, resp := range results {
+		if resp == nil {
+			availability.Unreachable = append(availability.Unreachable, ids[i])
+			continue
+		}
+		availability.Workers = append(availability.Workers, *resp)
+		availability.Available = availability.Available || resp.Available
+	}
+	sort.Strings(availability.Unreachable)
+	c.JSON(http.StatusOK, availability)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Sem heartbeat por este número de intervalos, o worker é considerado offline
+	missedHeartbeatsLimit = 3
+	// Intervalo assumido até o primeiro heartbeat do worker
+	defaultHeartbeatInterval = 10 * time.Second
+)
+
+// workerPresence é o que a API sabe sobre um worker pelos tópicos de status e heartbeat.
+type workerPresence struct {
+	status        string    // Último status publicado (online/offline)
+	statusAt      time.Time // Quando o status foi recebido
+	lastHeartbeat time.Time
+	interval      time.Duration
+	capabilities  *schemas.WorkerCapabilities
+	telemetry     *schemas.WorkerTelemetry // Última telemetria
+	telemetryAt   time.Time
+}
+
+// online informa se o worker está no ar: o último status é "online" e o último sinal de
+// vida (heartbeat ou o próprio status) não passou de missedHeartbeatsLimit intervalos.
+func (p *workerPresence) online(now time.Time) bool {
+	if p.status != schemas.WorkerOnline {
+		return false
+	}
+	lastSeen := p.statusAt
+	if p.lastHeartbeat.After(lastSeen) {
+		lastSeen = p.lastHeartbeat
+	}
+	return now.Sub(lastSeen) <= missedHeartbeatsLimit*p.interval
+}
+
+// faulted informa se a telemetria recente do worker o dá como em falha ou indisponível.
+// Telemetria antiga (ou ausente, em workers que não a publicam) não conta.
+func (p *workerPresence) faulted(now time.Time) bool {
+	if p.telemetry == nil || now.Sub(p.telemetryAt) > missedHeartbeatsLimit*p.interval {
+		return false
+	}
+	return p.telemetry.Status == schemas.TelemetryFaulted || p.telemetry.Status == schemas.TelemetryUnavailable
+}
+
+// eligible informa se o worker pode receber PREPARE: online e sem falha.
+func (p *workerPresence) eligible(now time.Time) bool {
+	return p.online(now) && !p.faulted(now)
+}
+
+var (
+	// Registro dos charging point workers desta empresa, descobertos pelo MQTT
+	workers    = make(map[string]*workerPresence)
+	workersMux sync.RWMutex
+)
+
+// presence retorna o registro do worker, criando-o se preciso. Deve ser chamada com workersMux travado.
+func presence(workerID string) *workerPresence {
+	p, ok := workers[workerID]
+	if !ok {
+		p = &workerPresence{interval: defaultHeartbeatInterval}
+		workers[workerID] = p
+	}
+	return p
+}
+
+// setupWorkerRegistry escuta os tópicos de status (retidos), de heartbeat e de telemetria
+// dos workers. onFault é chamada quando a telemetria de um worker passa a Faulted ou
+// Unavailable, para que as suas reservas sejam transferidas.
+func setupWorkerRegistry(ctx context.Context, enterpriseName string, onFault func(workerID string)) {
+	statusTopic := fmt.Sprintf("enterprise/%s/cp/+/status", enterpriseName)
+	status, err := mqtt.Listen(ctx, statusTopic, mqtt.ListenOptions{BufferSize: 10, Overflow: mqtt.OverflowQueue})
+	if err != nil {
+		log.Fatalf("[%s] Falha ao assinar o status dos workers: %v", enterpriseName, err)
+	}
+	heartbeatTopic := fmt.Sprintf("enterprise/%s/cp/+/heartbeat", enterpriseName)
+	// Um heartbeat atrasado é substituído pelo próximo; os antigos podem ser descartados
+	heartbeats, err := mqtt.Listen(ctx, heartbeatTopic, mqtt.ListenOptions{BufferSize: 50, Overflow: mqtt.OverflowDropOldest})
+	if err != nil {
+		log.Fatalf("[%s] Falha ao assinar os heartbeats dos workers: %v", enterpriseName, err)
+	}
+	telemetryTopic := fmt.Sprintf("enterprise/%s/cp/+/telemetry", enterpriseName)
+	telemetry, err := mqtt.Listen(ctx, telemetryTopic, mqtt.ListenOptions{BufferSize: 50, Overflow: mqtt.OverflowQueue})
+	if err != nil {
+		log.Fatalf("[%s] Falha ao assinar a telemetria dos workers: %v", enterpriseName, err)
+	}
+
+	go func() {
+		for payload := range status.C {
+			var msg schemas.WorkerStatus
+			if _, err := schemas.DecodeMessage([]byte(payload), schemas.MsgWorkerStatus, &msg); err != nil {
+				log.Printf("[%s] Erro ao decodificar status do worker: %v. Mensagem: %s", enterpriseName, err, payload)
+				continue
+			}
+			workersMux.Lock()
+			p := presence(msg.WorkerID)
+			p.status, p.statusAt = msg.Status, time.Now()
+			workersMux.Unlock()
+			log.Printf("[%s] Worker '%s' está %s", enterpriseName, msg.WorkerID, msg.Status)
+		}
+	}()
+
+	go func() {
+		for payload := range heartbeats.C {
+			var msg schemas.WorkerHeartbeat
+			if _, err := schemas.DecodeMessage([]byte(payload), schemas.MsgWorkerHeartbeat, &msg); err != nil {
+				log.Printf("[%s] Erro ao decodificar heartbeat do worker: %v. Mensagem: %s", enterpriseName, err, payload)
+				continue
+			}
+			capabilities := msg.Capabilities
+			workersMux.Lock()
+			p := presence(msg.WorkerID)
+			p.lastHeartbeat = time.Now()
+			p.interval = time.Duration(msg.IntervalSeconds) * time.Second
+			p.capabilities = &capabilities
+			workersMux.Unlock()
+		}
+	}()
+
+	go func() {
+		for payload := range telemetry.C {
+			var msg schemas.WorkerTelemetry
+			if _, err := schemas.DecodeMessage([]byte(payload), schemas.MsgWorkerTelemetry, &msg); err != nil {
+				log.Printf("[%s] Erro ao decodificar telemetria do worker: %v. Mensagem: %s", enterpriseName, err, payload)
+				continue
+			}
+			now := time.Now()
+			workersMux.Lock()
+			p := presence(msg.WorkerID)
+			wasFaulted := p.faulted(now)
+			p.telemetry, p.telemetryAt = &msg, now
+			isFaulted := p.faulted(now)
+			workersMux.Unlock()
+
+			switch {
+			case isFaulted && !wasFaulted:
+				log.Printf("[%s] Worker '%s' está %s: fora da alocação. Transferindo as suas reservas.", enterpriseName, msg.WorkerID, msg.Status)
+				if onFault != nil {
+					go onFault(msg.WorkerID)
+				}
+			case wasFaulted && !isFaulted:
+				log.Printf("[%s] Worker '%s' voltou a %s.", enterpriseName, msg.WorkerID, msg.Status)
+			}
+		}
+	}()
+}
+
+// eligibleWorkers retorna os IDs dos workers que podem receber PREPARE (online e sem
+// falha), em ordem alfabética.
+func eligibleWorkers() []string {
+	workersMux.RLock()
+	defer workersMux.RUnlock()
+	now := time.Now()
+	var ids []string
+	for id, p := range workers {
+		if p.eligible(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// handleListWorkers responde GET /workers com o registro de workers, online ou não, e a
+// última telemetria de cada um.
+func handleListWorkers(c *gin.Context) {
+	workersMux.RLock()
+	now := time.Now()
+	entries := make([]schemas.WorkerEntry, 0, len(workers))
+	for id, p := range workers {
+		entry := schemas.WorkerEntry{WorkerID: id, Online: p.online(now), Eligible: p.eligible(now), Status: p.status, Capabilities: p.capabilities, Telemetry: p.telemetry}
+		if !p.statusAt.IsZero() {
+			statusAt := p.statusAt.UTC()
+			entry.LastSeen = &statusAt
+		}
+		if !p.lastHeartbeat.IsZero() {
+			lastHeartbeat := p.lastHeartbeat.UTC()
+			entry.LastHeartbeat = &lastHeartbeat
+			if entry.LastSeen == nil || lastHeartbeat.After(*entry.LastSeen) {
+				entry.LastSeen = &lastHeartbeat
+			}
+		}
+		entries = append(entries, entry)
+	}
+	workersMux.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].WorkerID < entries[j].WorkerID })
+	c.JSON(http.StatusOK, entries)
+}
+
+// loadAllocationConfig aplica ALLOCATION_STRATEGY (least-loaded, best-fit, round-robin ou
+// connector) e ALLOCATION_FANOUT (workers que recebem PREPARE ao mesmo tempo).
+func loadAllocationConfig(sm *state.StateManager) {
+	strategy, err := state.NewAllocationStrategy(os.Getenv("ALLOCATION_STRATEGY"))
+	if err != nil {
+		log.Printf("AVISO: %v. Usando '%s'.", err, state.StrategyLeastLoaded)
+		strategy, _ = state.NewAllocationStrategy(state.StrategyLeastLoaded)
+	}
+	fanout := state.DefaultPrepareFanout
+	if raw := os.Getenv("ALLOCATION_FANOUT"); raw != "" {
+		if value, err := strconv.Atoi(raw); err != nil || value < 1 {
+			log.Printf("AVISO: ALLOCATION_FANOUT inválido ('%s'). Usando %d.", raw, fanout)
+		} else {
+			fanout = value
+		}
+	}
+	sm.SetAllocation(strategy, fanout)
+	log.Printf("Alocação de workers: estratégia '%s', PREPARE para até %d worker(s) ao mesmo tempo.", strategy.Name(), fanout)
+}
+
+// loadRetentionConfig aplica RESERVATION_RETENTION (por quanto tempo uma reserva encerrada
+// fica na memória) e RESERVATION_ARCHIVE (arquivo para onde ela vai depois).
+func loadRetentionConfig(sm *state.StateManager) {
+	retention := schedule.DefaultRetention
+	if raw := os.Getenv("RESERVATION_RETENTION"); raw != "" {
+		if value, err := time.ParseDuration(raw); err != nil || value < 0 {
+			log.Printf("AVISO: RESERVATION_RETENTION inválido ('%s'). Usando %v.", raw, retention)
+		} else {
+			retention = value
+		}
+	}
+	path := os.Getenv("RESERVATION_ARCHIVE")
+	if path == "" {
+		path = fmt.Sprintf("archive/reservations-%s.jsonl", ownedCity)
+	}
+	sm.SetRetention(retention, schedule.NewArchive(path))
+	log.Printf("Reservas encerradas ficam %v na memória e depois vão para '%s'.", retention, path)
+}
+
+// loadPrepareTimeoutConfig aplica PREPARE_TIMEOUT: quanto tempo uma transação fica
+// PREPARED nesta API esperando o COMMIT ou o ABORT do coordenador.
+func loadPrepareTimeoutConfig(sm *state.StateManager) {
+	timeout := state.DefaultPrepareTimeout
+	if raw := os.Getenv("PREPARE_TIMEOUT"); raw != "" {
+		if value, err := time.ParseDuration(raw); err != nil || value < time.Second {
+			log.Printf("AVISO: PREPARE_TIMEOUT inválido ('%s'). Usando %v.", raw, timeout)
+		} else {
+			timeout = value
+		}
+	}
+	sm.SetPrepareTimeout(timeout)
+}
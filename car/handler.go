@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 
@@ -13,7 +12,7 @@ import (
 func messageHandler(client mqtt.Client, msg mqtt.Message) {
 	var enterprise schemas.Enterprises
 
-	err := json.Unmarshal(msg.Payload(), &enterprise)
+	_, err := schemas.DecodeMessage(msg.Payload(), schemas.MsgEnterpriseInfo, &enterprise)
 	if err != nil {
 		fmt.Printf("Error deserializing message: %v\n", err)
 		return
@@ -21,21 +20,31 @@ func messageHandler(client mqtt.Client, msg mqtt.Message) {
 	addEnterprise(enterprise)
 }
 
-// addEnterprise adds an enterprise name to the global list and prints the list
+// addEnterprise adds an enterprise to the global list, replacing any previous entry with the same name
 func addEnterprise(enterprise schemas.Enterprises) {
 	mu.Lock()
 	defer mu.Unlock()
+	for i, e := range enterprises {
+		if e.Name == enterprise.Name {
+			enterprises[i] = enterprise
+			return
+		}
+	}
 	enterprises = append(enterprises, enterprise)
 }
 
 func handleJourneyFinished(finishedChan chan struct{}) func(mqtt.Client, mqtt.Message) {
 	return func(client mqtt.Client, msg mqtt.Message) {
-		var payload map[string]string
-		json.Unmarshal(msg.Payload(), &payload)
+		var payload schemas.JourneyFinished
+		if _, err := schemas.DecodeMessage(msg.Payload(), schemas.MsgJourneyFinished, &payload); err != nil {
+			log.Printf("Error deserializing journey finished message: %v", err)
+		}
 
 		log.Println("=======================================================================")
 		log.Println("🎉🎉🎉 MENSAGEM DE FIM DE TRAJETO RECEBIDA! 🎉🎉🎉")
-		log.Printf("ID da Transação: %s", payload["transaction_id"])
+		log.Printf("ID da Transação: %s", payload.TransactionID)
+		log.Printf("Custo total: %.2f", payload.TotalCost)
+		log.Printf("Energia total: %.3f kWh", payload.TotalEnergy)
 		log.Println("=======================================================================")
 
 		// Envia o sinal para o canal para desbloquear o loop principal
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
 )
 
 // Generate Car ID in the format "CAR" followed by 4 random letters or numbers
@@ -30,3 +32,19 @@ func initializeDischargeRate() string {
 	dischargeRate := rand.Intn(21) + 10 // Random value between 10 and 30
 	return fmt.Sprintf("%d%%", dischargeRate)
 }
+
+// Connector types a car may have; CCS2 is the most common one
+var connectorTypes = []string{schemas.ConnectorCCS2, schemas.ConnectorCCS2, schemas.ConnectorType2, schemas.ConnectorCHAdeMO}
+
+// Initialize the vehicle profile sent with the chosen route, used by the charging points
+// to simulate the charging session
+func initializeVehicleProfile(batteryLevel int) schemas.VehicleProfile {
+	rand.Seed(time.Now().UnixNano())
+	return schemas.VehicleProfile{
+		BatteryCapacityKWh: float64(rand.Intn(61) + 40), // Random value between 40 and 100 kWh
+		StateOfChargePct:   float64(batteryLevel),
+		TargetSOCPct:       100,
+		MaxChargePowerKW:   float64(rand.Intn(11)*10 + 50), // Random value between 50 and 150 kW
+		ConnectorType:      connectorTypes[rand.Intn(len(connectorTypes))],
+	}
+}
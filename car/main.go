@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
@@ -33,7 +32,7 @@ func main() {
 	go func() {
 		subscribeToTopic(client, topic, func(c mqtt.Client, m mqtt.Message) {
 			var resp schemas.ReservationStatus
-			err := json.Unmarshal(m.Payload(), &resp)
+			_, err := schemas.DecodeMessage(m.Payload(), schemas.MsgReservationStatus, &resp)
 			if err != nil {
 				fmt.Printf("Error deserializing message: %v\n", err)
 				return
@@ -57,7 +56,7 @@ func main() {
 	go func() {
 		subscribeToTopic(client, CarID, func(c mqtt.Client, m mqtt.Message) {
 			var resp schemas.RouteReservationOptions
-			err := json.Unmarshal(m.Payload(), &resp)
+			_, err := schemas.DecodeMessage(m.Payload(), schemas.MsgRouteOptions, &resp)
 			if err != nil {
 				fmt.Printf("Error deserializing message: %v\n", err)
 				return
@@ -71,6 +70,8 @@ func main() {
 	dischargeRate := initializeDischargeRate()
 	fmt.Printf("Battery level: %d%%\n", batteryLevel)
 	fmt.Printf("Discharge rate: %s\n", dischargeRate)
+	vehicle := initializeVehicleProfile(batteryLevel)
+	fmt.Printf("Battery capacity: %.0f kWh, max charge power: %.0f kW\n", vehicle.BatteryCapacityKWh, vehicle.MaxChargePowerKW)
 
 	var selectedEnterprise *schemas.Enterprises
 	for {
@@ -96,7 +97,7 @@ func main() {
 		fmt.Printf("Origin: %s, Destination: %s\n", origin, destination)
 
 		// Publish the charging request
-		PublishChargingRequest(client, origin, destination, CarID, selectedEnterprise.Name)
+		PublishChargingRequest(client, origin, destination, CarID, selectedEnterprise.Name, schemas.NegotiateVersion(selectedEnterprise.ProtocolVersion))
 		fmt.Println("Waiting for response...")
 		// Wait for a response from the MQTT broker
 		// This is a blocking call, so it will wait until a message is received
@@ -135,9 +136,10 @@ func main() {
 			RequestID: response.RequestID,
 			VehicleID: CarID,
 			Route:     selectedRoute,
+			Vehicle:   &vehicle,
 		}
 
-		payload, err := json.Marshal(chosenRouteMsg)
+		payload, err := schemas.EncodeMessage(schemas.MsgChosenRoute, CarID, schemas.NegotiateVersion(selectedEnterprise.ProtocolVersion), chosenRouteMsg)
 		if err != nil {
 			fmt.Printf("Error serializing message: %v\n", err)
 			continue
@@ -162,6 +164,9 @@ func main() {
 		fmt.Println("\nWaiting for response...")
 		finalMsg := <-finalResponse
 		fmt.Printf("Response received: %v\n", finalMsg.Message)
+		if finalMsg.Status == schemas.StatusConfirmed {
+			go driveRoute(client, CarID, finalMsg)
+		}
 
 		<-journeyFinishedChan
 
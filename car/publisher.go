@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"github.com/4r7hur0/PBL-2/schemas"
@@ -9,14 +8,15 @@ import (
 )
 
 // PublishToEnterprise publishes a message to all enterprises in the list
-func PublishChargingRequest(client mqtt.Client, origin, destination, carID, topic string) {
+// The message version is negotiated with the version advertised by the enterprise.
+func PublishChargingRequest(client mqtt.Client, origin, destination, carID, topic string, version int) {
 	request := schemas.RouteRequest{
 		VehicleID:   carID,
 		Origin:      origin,
 		Destination: destination,
 	}
 
-	payload, err := json.Marshal(request)
+	payload, err := schemas.EncodeMessage(schemas.MsgRouteRequest, carID, version, request)
 	if err != nil {
 		fmt.Printf("Error serializing request: %v\n", err)
 		return
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Driver behaviour at each charging stop. Both rates default to 0: the car arrives
+// within the window and leaves when it ends.
+var (
+	noShowRate   = envRate("NO_SHOW_RATE", 0)  // Fraction of stops the car skips
+	overstayRate = envRate("OVERSTAY_RATE", 0) // Fraction of stops where the car stays past the window
+)
+
+const (
+	maxArrivalDelay      = 10 * time.Second // Below the workers' default NO_SHOW_GRACE
+	maxArrivalDelayRatio = 0.1              // The car arrives within 10% of the window
+	maxOverstayRatio     = 0.25             // Longest stay past the window, as a fraction of the window
+)
+
+// envRate reads a fraction between 0 and 1.
+func envRate(name string, fallback float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < 0 || value > 1 {
+		fmt.Printf("Invalid %s ('%s'). Using %.2f.\n", name, raw, fallback)
+		return fallback
+	}
+	return value
+}
+
+// driveRoute goes through the confirmed stops in order, telling the charging point when
+// the car arrives (CAR_ARRIVED) and when it unplugs and leaves (CAR_UNPLUGGED).
+func driveRoute(client mqtt.Client, carID string, status schemas.ReservationStatus) {
+	for _, segment := range status.ConfirmedRoute {
+		window := segment.ReservationWindow
+		length := window.EndTimeUTC.Sub(window.StartTimeUTC)
+		if rand.Float64() < noShowRate {
+			fmt.Printf("Skipping the stop in %s (no-show).\n", segment.City)
+			continue
+		}
+
+		maxDelay := min(maxArrivalDelay, time.Duration(float64(length)*maxArrivalDelayRatio))
+		time.Sleep(time.Until(window.StartTimeUTC.Add(time.Duration(rand.Int63n(int64(maxDelay) + 1)))))
+		publishVehicleSignal(client, carID, status.TransactionID, schemas.MsgCarArrived, window)
+
+		leaveAt := window.EndTimeUTC
+		if rand.Float64() < overstayRate {
+			leaveAt = leaveAt.Add(time.Duration(rand.Int63n(int64(float64(length)*maxOverstayRatio)) + 1))
+		}
+		time.Sleep(time.Until(leaveAt))
+		publishVehicleSignal(client, carID, status.TransactionID, schemas.MsgCarUnplugged, window)
+	}
+}
+
+func publishVehicleSignal(client mqtt.Client, carID, transactionID, msgType string, window schemas.ReservationWindow) {
+	signal := schemas.VehicleSignal{
+		TransactionID: transactionID,
+		VehicleID:     carID,
+		Window:        window,
+		Timestamp:     time.Now().UTC(),
+	}
+	payload, err := schemas.EncodeMessage(msgType, carID, schemas.ProtocolVersion, signal)
+	if err != nil {
+		fmt.Printf("Error serializing %s: %v\n", msgType, err)
+		return
+	}
+	token := client.Publish(fmt.Sprintf("car/session/%s", transactionID), 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("Error publishing %s: %v\n", msgType, token.Error())
+		return
+	}
+	fmt.Printf("%s published for the window %s - %s\n", msgType, window.StartTimeUTC.Format("15:04:05"), window.EndTimeUTC.Format("15:04:05"))
+}
@@ -32,6 +32,27 @@ type ChargingTransaction struct {
 	PaymantTimeStampUTC       string              `json:"paymentTimeStampUTC"`
 }
 
+// Desfechos de um segmento da rota na cidade de destino.
+const (
+	SegmentCharged            = "CHARGED"
+	SegmentChargedWithIdleFee = "CHARGED_WITH_IDLE_FEE"
+	SegmentNoShow             = "NO_SHOW"
+)
+
+// segmentObjectType é o prefixo da chave composta (segment, transactionID, city). Cada
+// segmento fica numa chave própria para não conflitar com a escrita da transação.
+const segmentObjectType = "segment"
+
+type SegmentOutcome struct {
+	TransactionID        string  `json:"transactionId"`
+	City                 string  `json:"city"`
+	Status               string  `json:"status"`
+	Cost                 float64 `json:"cost"`
+	EnergyConsumed       float64 `json:"energyConsumed"`
+	IdleFee              float64 `json:"idleFee"`
+	RecordedTimeStampUTC string  `json:"recordedTimeStampUTC"`
+}
+
 type HistoricState struct {
 	TxId      string               `json:"txId"`
 	Timestamp string               `json:"timestamp"`
@@ -118,6 +139,97 @@ func (s *smartContract) EndCharging(ctx contractapi.TransactionContextInterface,
 	return ctx.GetStub().PutState(transactionID, assetBytes)
 }
 
+// UpdateChargingSegment registra o desfecho do segmento de uma cidade: a recarga (com ou
+// sem taxa de ociosidade) ou o não comparecimento do veículo. A transação precisa existir.
+// O segmento é escrito numa chave própria; a chave da transação só é lida, e se o
+// EndCharging do coordenador a escrever no mesmo bloco, esta transação é invalidada
+// (MVCC_READ_CONFLICT) e a API a submete de novo.
+func (s *smartContract) UpdateChargingSegment(ctx contractapi.TransactionContextInterface, transactionID string, city string, status string, costStr string, energyConsumedStr string, idleFeeStr string) error {
+	if transactionID == "" || city == "" {
+		return fmt.Errorf("transactionID and city are required")
+	}
+
+	switch status {
+	case SegmentCharged, SegmentChargedWithIdleFee, SegmentNoShow:
+	default:
+		return fmt.Errorf("unknown segment status '%s'", status)
+	}
+
+	exists, err := s.transactionExists(ctx, transactionID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("transaction with ID %s does not exist", transactionID)
+	}
+
+	values := make([]float64, 3)
+	for i, raw := range []string{costStr, energyConsumedStr, idleFeeStr} {
+		values[i], err = strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse value '%s': %v", raw, err)
+		}
+		if values[i] < 0 {
+			return fmt.Errorf("value '%s' must not be negative", raw)
+		}
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(segmentObjectType, []string{transactionID, city})
+	if err != nil {
+		return fmt.Errorf("failed to create segment key: %v", err)
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("segment %s of transaction %s already recorded", city, transactionID)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	segment := SegmentOutcome{
+		TransactionID:        transactionID,
+		City:                 city,
+		Status:               status,
+		Cost:                 values[0],
+		EnergyConsumed:       values[1],
+		IdleFee:              values[2],
+		RecordedTimeStampUTC: txTimestamp.AsTime().Format(time.RFC3339),
+	}
+	segmentBytes, err := json.Marshal(segment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal segment: %v", err)
+	}
+	return ctx.GetStub().PutState(key, segmentBytes)
+}
+
+// QuerySegments retorna os desfechos já registrados dos segmentos da transação.
+func (s *smartContract) QuerySegments(ctx contractapi.TransactionContextInterface, transactionID string) ([]*SegmentOutcome, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(segmentObjectType, []string{transactionID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segments of transaction %s: %w", transactionID, err)
+	}
+	defer resultsIterator.Close()
+
+	segments := []*SegmentOutcome{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var segment SegmentOutcome
+		if err := json.Unmarshal(response.Value, &segment); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal segment: %v", err)
+		}
+		segments = append(segments, &segment)
+	}
+	return segments, nil
+}
+
 func (s *smartContract) RegisterPayment(ctx contractapi.TransactionContextInterface, transactionID string) error {
 	asset, err := s.getTransaction(ctx, transactionID)
 	if err != nil {
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Connector é um conector do ponto de recarga, com a sua própria agenda de reservas.
+type Connector struct {
+	ID           int
+	Type         string
+	PowerKW      float64
+	Reservations []*ReservationWindow
+	index        schedule.Tree[*ReservationWindow] // As mesmas reservas, indexadas pela janela
+
+	fault        string    // Código da falha em curso ("" sem falha)
+	faultUntil   time.Time // Fim previsto da falha
+	temperatureC float64
+}
+
+// loadConnectors lê CP_CONNECTORS no formato "CCS2:150,Type2:22,CHAdeMO:50" (os IDs
+// seguem a ordem da lista, a partir de 1). Sem a variável, o posto tem um conector CCS2
+// com a potência de CP_POWER_KW.
+func loadConnectors() ([]*Connector, error) {
+	raw := os.Getenv("CP_CONNECTORS")
+	if raw == "" {
+		return []*Connector{{ID: 1, Type: schemas.ConnectorCCS2, PowerKW: connectorPowerKW}}, nil
+	}
+
+	var connectors []*Connector
+	for i, spec := range strings.Split(raw, ",") {
+		connectorType, powerStr, ok := strings.Cut(strings.TrimSpace(spec), ":")
+		if !ok {
+			return nil, fmt.Errorf("conector '%s' inválido: use <tipo>:<kW>", spec)
+		}
+		switch connectorType {
+		case schemas.ConnectorCCS2, schemas.ConnectorType2, schemas.ConnectorCHAdeMO:
+		default:
+			return nil, fmt.Errorf("tipo de conector desconhecido: '%s'", connectorType)
+		}
+		power, err := strconv.ParseFloat(powerStr, 64)
+		if err != nil || power <= 0 {
+			return nil, fmt.Errorf("potência inválida no conector '%s'", spec)
+		}
+		connectors = append(connectors, &Connector{ID: i + 1, Type: connectorType, PowerKW: power})
+	}
+	return connectors, nil
+}
+
+// released informa se a reserva já não ocupa o conector.
+func (r *ReservationWindow) released() bool {
+	return r.Status == "aborted" || r.Status == "completed" || r.Status == schemas.StatusReservationNoShow
+}
+
+// finish libera a reserva com um estado final; ela fica na agenda até ser arquivada.
+func (r *ReservationWindow) finish(status string, at time.Time) {
+	r.Status, r.FinishedAt = status, at
+}
+
+func (r *ReservationWindow) window() schemas.ReservationWindow {
+	return schemas.ReservationWindow{StartTimeUTC: r.StartTimeUTC, EndTimeUTC: r.EndTimeUTC}
+}
+
+// add coloca a reserva na agenda do conector. Deve ser chamada com o lock do worker.
+func (c *Connector) add(r *ReservationWindow) {
+	c.Reservations = append(c.Reservations, r)
+	c.index.Insert(r.window(), r)
+}
+
+// remove tira a reserva da agenda do conector. Deve ser chamada com o lock do worker.
+func (c *Connector) remove(r *ReservationWindow) {
+	c.Reservations = slices.DeleteFunc(c.Reservations, func(other *ReservationWindow) bool { return other == r })
+	c.index.Delete(r.window(), r)
+}
+
+// isAvailable informa se a janela não se sobrepõe a nenhuma reserva ativa do conector.
+// Só as reservas que se sobrepõem à janela são examinadas, pelo índice.
+func (c *Connector) isAvailable(window schemas.ReservationWindow) bool {
+	for _, r := range c.index.Overlapping(window) {
+		if !r.released() {
+			return false
+		}
+	}
+	return true
+}
+
+// selectConnector escolhe, entre os conectores sem falha, do tipo pedido pelo veículo e
+// livres na janela, o de menor potência que ainda atende a potência máxima do veículo. Se nenhum
+// atender, fica com o mais potente. Assim os conectores rápidos ficam livres para quem
+// precisa deles. Um worker desligando não aceita reservas. Deve ser chamada com o lock do worker.
+func (cpw *ChargingPointWorker) selectConnector(window schemas.ReservationWindow, vehicle *schemas.VehicleProfile) *Connector {
+	if cpw.draining {
+		return nil
+	}
+	var connectorType string
+	var requestedKW float64
+	if vehicle != nil {
+		connectorType, requestedKW = vehicle.ConnectorType, vehicle.MaxChargePowerKW
+	}
+
+	var best *Connector
+	for _, c := range cpw.Connectors {
+		if (connectorType != "" && c.Type != connectorType) || c.fault != "" || !c.isAvailable(window) {
+			continue
+		}
+		if best == nil {
+			best = c
+			continue
+		}
+		bestFits, fits := best.PowerKW >= requestedKW, c.PowerKW >= requestedKW
+		switch {
+		case fits && !bestFits:
+			best = c
+		case fits && bestFits && c.PowerKW < best.PowerKW:
+			best = c
+		case !fits && !bestFits && c.PowerKW > best.PowerKW:
+			best = c
+		}
+	}
+	return best
+}
+
+// status descreve o conector e sua ocupação. Deve ser chamada com o lock do worker.
+func (c *Connector) status() schemas.ConnectorStatus {
+	status := schemas.ConnectorStatus{ConnectorID: c.ID, Type: c.Type, PowerKW: c.PowerKW, Status: schemas.ConnectorAvailable}
+	for _, r := range c.Reservations {
+		switch r.Status {
+		case "charging":
+			status.Status = schemas.ConnectorCharging
+		case "arrived", "charged":
+			if status.Status != schemas.ConnectorCharging {
+				status.Status = schemas.ConnectorOccupied
+			}
+		case "prepared", "committed":
+			if status.Status == schemas.ConnectorAvailable {
+				status.Status = schemas.ConnectorReserved
+			}
+		default:
+			continue
+		}
+		status.Reservations = append(status.Reservations, r.window())
+	}
+	if c.fault != "" {
+		status.Status = schemas.ConnectorFaulted
+	}
+	return status
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/4r7hur0/PBL-2/api/mqtt"
@@ -16,158 +18,431 @@ type ReservationWindow struct {
 	StartTimeUTC  time.Time
 	EndTimeUTC    time.Time
 	TransactionID string
-	Status        string // "prepared", "committed", "charged", "aborted"
+	AttemptID     string // Tentativa de PREPARE da API; COMMIT e ABORT de outra tentativa não a atingem
+	Status        string // "prepared", "committed", "arrived", "charging", "charged", "completed", "no_show", "aborted"
+	Version       int    // Versão de mensagem usada pela API no PREPARE; os eventos da reserva usam a mesma
+	Vehicle       *schemas.VehicleProfile
+	Visit         *Visit           // Passagem do veículo, informada pelo carro
+	Session       *ChargingSession // Sessão de recarga, criada quando o veículo é conectado
+	FinishedAt    time.Time        // Quando a reserva foi liberada (aborted, completed ou no_show)
 }
 
 type ChargingPointWorker struct {
-	ID           string
-	Reservations []ReservationWindow
-	mu           sync.Mutex // 2. Adicione o Mutex à struct
+	ID         string
+	Enterprise string
+	Location   *schemas.GeoPoint
+	Connectors []*Connector // Cada conector tem a sua agenda
+	draining   bool         // Desligando: não aceita reservas (telemetria Unavailable)
+	mu         sync.Mutex   // 2. Adicione o Mutex à struct
 }
 
-func (cpw *ChargingPointWorker) isAvailable(window schemas.ReservationWindow) bool {
-	// Esta função não precisa do lock aqui porque ela será chamada
-	// de dentro de um trecho de código que já está protegido pelo lock.
-	for _, r := range cpw.Reservations {
-		if r.Status != "aborted" && r.Status != "charged" &&
-			!(window.EndTimeUTC.Before(r.StartTimeUTC) || window.StartTimeUTC.After(r.EndTimeUTC)) {
-			return false
+// forEachReservation percorre as reservas de todos os conectores. Deve ser chamada com o lock.
+func (cpw *ChargingPointWorker) forEachReservation(fn func(c *Connector, r *ReservationWindow)) {
+	for _, c := range cpw.Connectors {
+		for _, r := range c.Reservations {
+			fn(c, r)
 		}
 	}
-	return true
 }
 
 func (cpw *ChargingPointWorker) handleMQTTMessage(payload string) {
-	var msg map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+	env, err := schemas.ParseMessage([]byte(payload))
+	if err != nil {
 		log.Printf("Erro ao decodificar mensagem MQTT: %v", err)
 		return
 	}
 
-	cmd, _ := msg["command"].(string)
-	switch cmd {
+	switch env.Type {
 	// REMOVIDO: O case "QUERY_AVAILABILITY" não é mais necessário.
 
-	case "PREPARE_RESERVE_WINDOW":
-		var window schemas.ReservationWindow
-		b, _ := json.Marshal(msg["window"])
-		json.Unmarshal(b, &window)
-		txID, _ := msg["transaction_id"].(string)
-
-		responseTopic, rt_ok := msg["response_topic"].(string)
-		if !rt_ok {
-			log.Printf("ERRO: Mensagem PREPARE_RESERVE_WINDOW sem response_topic. TX: %s", txID)
+	case schemas.MsgPrepareReserveWindow:
+		var cmd schemas.PrepareReserveWindowCommand
+		if err := env.DecodePayload(&cmd); err != nil {
+			log.Printf("ERRO: %v", err)
 			return
 		}
+		txID, window := cmd.TransactionID, cmd.Window
 
-		var success bool
+		var connectorID int
 		// *** Início da Seção Crítica Atômica ***
 		cpw.mu.Lock()
-		if cpw.isAvailable(window) {
-			cpw.Reservations = append(cpw.Reservations, ReservationWindow{
+		if connector := cpw.selectConnector(window, cmd.Vehicle); connector != nil {
+			connector.add(&ReservationWindow{
 				StartTimeUTC:  window.StartTimeUTC,
 				EndTimeUTC:    window.EndTimeUTC,
 				TransactionID: txID,
+				AttemptID:     cmd.AttemptID,
 				Status:        "prepared", // Marca como preparado
+				Version:       env.Version,
+				Vehicle:       cmd.Vehicle,
 			})
-			success = true
-			log.Printf("[%s] SUCESSO PREPARE para TX: %s. Janela: %v", cpw.ID, txID, window)
+			connectorID = connector.ID
+			log.Printf("[%s] SUCESSO PREPARE para TX: %s. Conector %d (%s, %.0f kW). Janela: %v", cpw.ID, txID, connector.ID, connector.Type, connector.PowerKW, window)
 		} else {
-			success = false
-			log.Printf("[%s] FALHA PREPARE para TX: %s. Conflito de janela.", cpw.ID, txID)
+			log.Printf("[%s] FALHA PREPARE para TX: %s. Nenhum conector compatível livre na janela.", cpw.ID, txID)
 		}
+		info := cpw.info()
 		cpw.mu.Unlock()
 		// *** Fim da Seção Crítica Atômica ***
+		success := connectorID != 0
+		if success {
+			cpw.publishInfo(info)
+		}
 
-		// Monta a resposta
-		resp := map[string]interface{}{
-			"command":        "PREPARE_RESPONSE",
-			"success":        success,
-			"transaction_id": txID,
-			"worker_id":      cpw.ID,
+		// Monta a resposta na mesma versão do pedido, devolvendo o ID de correlação
+		resp := schemas.PrepareResponse{
+			Success:       success,
+			TransactionID: txID,
+			WorkerID:      cpw.ID,
+			CorrelationID: cmd.CorrelationID,
+			ConnectorID:   connectorID,
+		}
+		respBytes, err := schemas.EncodeMessage(schemas.MsgPrepareResponse, cpw.ID, env.Version, resp)
+		if err != nil {
+			log.Printf("ERRO ao serializar resposta de PREPARE: %v", err)
+			return
 		}
-		respBytes, _ := json.Marshal(resp)
 
 		// Publica a resposta (sucesso ou falha) no tópico de resposta
-		mqtt.Publish(responseTopic, string(respBytes))
+		mqtt.Publish(cmd.ResponseTopic, string(respBytes))
 
-	case "COMMIT":
-		txID, _ := msg["transaction_id"].(string)
+	case schemas.MsgCommit:
+		var cmd schemas.CommitCommand
+		if err := env.DecodePayload(&cmd); err != nil {
+			log.Printf("ERRO: %v", err)
+			return
+		}
 		cpw.mu.Lock()
-		for i, r := range cpw.Reservations {
-			if r.TransactionID == txID && r.Status == "prepared" {
-				cpw.Reservations[i].Status = "committed"
-				log.Printf("[%s] SUCESSO COMMIT para TX: %s", cpw.ID, txID)
+		cpw.forEachReservation(func(c *Connector, r *ReservationWindow) {
+			if r.TransactionID == cmd.TransactionID && schemas.SameAttempt(r.AttemptID, cmd.AttemptID) && r.Status == "prepared" {
+				r.Status = "committed"
+				log.Printf("[%s] SUCESSO COMMIT para TX: %s (conector %d)", cpw.ID, cmd.TransactionID, c.ID)
 			}
-		}
+		})
 		cpw.mu.Unlock()
 
-	case "ABORT":
-		txID, _ := msg["transaction_id"].(string)
+	case schemas.MsgAbort:
+		var cmd schemas.AbortCommand
+		if err := env.DecodePayload(&cmd); err != nil {
+			log.Printf("ERRO: %v", err)
+			return
+		}
 		cpw.mu.Lock()
-		// Em vez de remover, marcamos como abortada para manter histórico se necessário.
-		// Para limpar a lista, você poderia usar a lógica de remoção.
-		for i, r := range cpw.Reservations {
-			if r.TransactionID == txID && r.Status == "prepared" {
-				cpw.Reservations[i].Status = "aborted"
-				log.Printf("[%s] SUCESSO ABORT para TX: %s", cpw.ID, txID)
+		// Em vez de remover, marcamos como abortada: a reserva vai para o arquivo depois do
+		// prazo de retenção (veja collectReservations).
+		// Uma reserva confirmada que ainda não começou também é liberada: a API a transfere
+		// para outro worker quando este entra em falha
+		aborted := false
+		cpw.forEachReservation(func(c *Connector, r *ReservationWindow) {
+			if r.TransactionID == cmd.TransactionID && schemas.SameAttempt(r.AttemptID, cmd.AttemptID) && (r.Status == "prepared" || r.Status == "committed") {
+				r.finish("aborted", time.Now().UTC())
+				aborted = true
+				log.Printf("[%s] SUCESSO ABORT para TX: %s (conector %d)", cpw.ID, cmd.TransactionID, c.ID)
 			}
-		}
+		})
+		info := cpw.info()
 		cpw.mu.Unlock()
+		if aborted {
+			cpw.publishInfo(info)
+		}
+
+	case schemas.MsgQuerySchedule:
+		cpw.answerScheduleQuery(env)
+
+	case schemas.MsgQueryWindow:
+		cpw.answerWindowQuery(env)
+
+	default:
+		log.Printf("[%s] Comando desconhecido ignorado: '%s'", cpw.ID, env.Type)
 	}
 }
 
-// Rotina para detectar passagem do tempo e cobrar
+// Rotina que acompanha a passagem dos veículos: chegada (ou não comparecimento), conexão,
+// leituras do medidor e, na desconexão, a cobrança da energia e da ociosidade
 func (cpw *ChargingPointWorker) monitorPassageAndCharge() {
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(meterInterval)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
 		now := time.Now().UTC()
 
 		cpw.mu.Lock() // Protege a leitura e modificação das reservas
-		for i, r := range cpw.Reservations {
-			if r.Status == "committed" && now.After(r.EndTimeUTC) {
-				// Gera custo fixo
-				cost := 20.0
-				cpw.Reservations[i].Status = "charged"
-				// Publica evento para API
-				event := map[string]interface{}{
-					"command":        "VEHICLE_PASSED_AND_CHARGED",
-					"transaction_id": r.TransactionID,
-					"cost":           cost,
-					"window": map[string]interface{}{
-						"start_time_utc": r.StartTimeUTC,
-						"end_time_utc":   r.EndTimeUTC,
-					},
-					"worker_id": cpw.ID,
-				}
-				eventBytes, _ := json.Marshal(event)
-				mqtt.Publish(fmt.Sprintf("enterprise/%s/cp/%s/event", os.Getenv("ENTERPRISE_NAME"), cpw.ID), string(eventBytes))
-				log.Printf("Reserva %s cobrada e notificada para API.", r.TransactionID)
+		changed := false
+		cpw.forEachReservation(func(c *Connector, r *ReservationWindow) {
+			if cpw.advance(c, r, now) {
+				changed = true
 			}
-		}
+		})
+		info := cpw.info()
 		cpw.mu.Unlock()
+		if changed {
+			cpw.publishInfo(info)
+		}
 	}
 }
 
+// advance leva a reserva adiante na passagem do veículo até o instante now:
+// committed -> arrived -> charging -> charged -> completed, ou committed -> no_show.
+// Retorna true se a ocupação do conector mudou. Deve ser chamada com o lock.
+func (cpw *ChargingPointWorker) advance(c *Connector, r *ReservationWindow, now time.Time) bool {
+	if r.Status != "committed" && r.Status != "arrived" && r.Status != "charging" && r.Status != "charged" {
+		return false
+	}
+	if now.Before(r.StartTimeUTC) {
+		return false
+	}
+	if r.Visit == nil {
+		r.Visit = &Visit{}
+	}
+	visit := r.Visit
+	changed := false
+
+	if r.Status == "committed" {
+		graceEnd := r.StartTimeUTC.Add(noShowGrace)
+		if visit.ArriveAt.IsZero() || visit.ArriveAt.After(graceEnd) {
+			// Sem o veículo até o fim da tolerância, a reserva é liberada
+			if !now.Before(graceEnd) {
+				r.finish(schemas.StatusReservationNoShow, graceEnd)
+				cpw.publishNoShow(c, r, graceEnd)
+				return true
+			}
+			return false
+		}
+		if now.Before(visit.ArriveAt) {
+			return false
+		}
+		visit.ArrivedAt = visit.ArriveAt
+		r.Status = "arrived"
+		changed = true
+		cpw.publishSessionEvent(schemas.MsgVehicleArrived, c, r, visit.ArrivedAt)
+		log.Printf("[%s] TX[%s]: Veículo chegou ao conector %d.", cpw.ID, r.TransactionID, c.ID)
+	}
+
+	if r.Status == "arrived" {
+		// O conector ficou em falha até o fim da janela ou o veículo saiu antes de ser conectado
+		leftEarly := !visit.LeaveAt.IsZero() && !now.Before(visit.LeaveAt)
+		if leftEarly || c.fault != "" && !now.Before(r.EndTimeUTC) {
+			end := r.EndTimeUTC
+			if leftEarly {
+				end = visit.LeaveAt
+			}
+			r.Session = newChargingSession(r.Vehicle, c.PowerKW, end)
+			r.Session.EndedAt = end
+			r.Status = "charged"
+			log.Printf("[%s] TX[%s]: Veículo saiu do conector %d sem recarregar.", cpw.ID, r.TransactionID, c.ID)
+			return true
+		}
+		if now.Before(visit.PlugInAt) || c.fault != "" {
+			return changed
+		}
+		r.Session = newChargingSession(r.Vehicle, c.PowerKW, visit.PlugInAt)
+		r.Status = "charging"
+		changed = true
+		cpw.publishSessionEvent(schemas.MsgVehiclePluggedIn, c, r, visit.PlugInAt)
+		log.Printf("[%s] TX[%s]: Veículo conectado no conector %d. Iniciando recarga (SOC %.0f%%, alvo %.0f%%).", cpw.ID, r.TransactionID, c.ID, r.Session.SOC, r.Session.Vehicle.TargetSOCPct)
+	}
+
+	if r.Status == "charging" {
+		// A sessão termina no fim da janela, quando a bateria atinge a carga alvo ou quando
+		// o carro informa a saída
+		until := now
+		if until.After(r.EndTimeUTC) {
+			until = r.EndTimeUTC
+		}
+		left := !visit.LeaveAt.IsZero() && !until.Before(visit.LeaveAt)
+		if left {
+			until = visit.LeaveAt
+		}
+		full := r.Session.Advance(until)
+		if r.Version > schemas.LegacyVersion { // APIs no formato legado não conhecem METER_VALUES
+			reading := r.Session.Reading(r.TransactionID, cpw.ID)
+			reading.ConnectorID = c.ID
+			cpw.publishEvent(schemas.MsgMeterValues, r.Version, reading)
+		}
+		// Uma falha no conector interrompe a sessão
+		interrupted := c.fault != ""
+		if !full && !interrupted && !left && now.Before(r.EndTimeUTC) {
+			return changed
+		}
+		if !full {
+			r.Session.EndedAt = until
+		}
+		r.Status = "charged"
+		changed = true
+		log.Printf("[%s] TX[%s]: Recarga encerrada no conector %d. Energia: %.3f kWh, SOC final: %.1f%%.", cpw.ID, r.TransactionID, c.ID, r.Session.EnergyKWh, r.Session.SOC)
+	}
+
+	if r.Status == "charged" {
+		visit.planUnplug(r, r.Session.EndedAt)
+		if now.Before(visit.UnplugAt) {
+			return changed
+		}
+		if visit.LeaveAt.IsZero() {
+			log.Printf("[%s] TX[%s]: Sem CAR_UNPLUGGED até o limite de permanência. Conector %d liberado.", cpw.ID, r.TransactionID, c.ID)
+		}
+		visit.UnpluggedAt = visit.UnplugAt
+		r.finish("completed", visit.UnpluggedAt)
+		changed = true
+		cpw.publishSessionEvent(schemas.MsgVehicleUnplugged, c, r, visit.UnpluggedAt)
+		cpw.publishCharge(c, r)
+	}
+	return changed
+}
+
+// publishSessionEvent publica uma etapa da passagem do veículo (APIs no formato legado não a conhecem).
+func (cpw *ChargingPointWorker) publishSessionEvent(msgType string, c *Connector, r *ReservationWindow, at time.Time) {
+	if r.Version == schemas.LegacyVersion {
+		return
+	}
+	cpw.publishEvent(msgType, r.Version, schemas.SessionEvent{TransactionID: r.TransactionID, WorkerID: cpw.ID, ConnectorID: c.ID, Timestamp: at})
+}
+
+// publishNoShow informa que o veículo não compareceu e a reserva foi liberada. APIs no
+// formato legado recebem uma cobrança sem custo, para que o trajeto seja encerrado.
+func (cpw *ChargingPointWorker) publishNoShow(c *Connector, r *ReservationWindow, releasedAt time.Time) {
+	window := r.window()
+	log.Printf("[%s] TX[%s]: Veículo não compareceu em %v. Conector %d liberado.", cpw.ID, r.TransactionID, noShowGrace, c.ID)
+	if r.Version == schemas.LegacyVersion {
+		cpw.publishEvent(schemas.MsgVehiclePassedAndCharged, r.Version, schemas.VehiclePassedAndChargedEvent{TransactionID: r.TransactionID, Window: window, WorkerID: cpw.ID})
+		return
+	}
+	cpw.publishEvent(schemas.MsgVehicleNoShow, r.Version, schemas.NoShowEvent{
+		TransactionID:      r.TransactionID,
+		WorkerID:           cpw.ID,
+		ConnectorID:        c.ID,
+		Window:             window,
+		GracePeriodSeconds: int(noShowGrace.Seconds()),
+		ReleasedAt:         releasedAt,
+	})
+}
+
+// publishCharge publica a cobrança da reserva depois que o veículo é desconectado: a
+// energia entregue e, se ele ficou além da janela, a taxa de ociosidade.
+func (cpw *ChargingPointWorker) publishCharge(c *Connector, r *ReservationWindow) {
+	session := r.Session
+	energy := roundKWh(session.EnergyKWh)
+	idleMinutes := r.Visit.idleMinutes(r)
+	idleFee := math.Round(idleMinutes*idleFeePerMinute*100) / 100
+	event := schemas.VehiclePassedAndChargedEvent{
+		TransactionID:  r.TransactionID,
+		Cost:           math.Round((energy*pricePerKWh+idleFee)*100) / 100,
+		Window:         r.window(),
+		WorkerID:       cpw.ID,
+		ConnectorID:    c.ID,
+		EnergyKWh:      energy,
+		PluggedInAt:    &session.PluggedInAt,
+		SessionEndedAt: &session.EndedAt,
+		FinalSOCPct:    math.Round(session.SOC*10) / 10,
+		UnpluggedAt:    &r.Visit.UnpluggedAt,
+		IdleMinutes:    idleMinutes,
+		IdleFee:        idleFee,
+	}
+	cpw.publishEvent(schemas.MsgVehiclePassedAndCharged, r.Version, event)
+	log.Printf("[%s] TX[%s]: Veículo desconectado. Energia: %.3f kWh, ociosidade: %.1f min (taxa %.2f). Cobrança notificada para API.", cpw.ID, r.TransactionID, energy, idleMinutes, idleFee)
+}
+
+func (cpw *ChargingPointWorker) publishEvent(msgType string, version int, event any) {
+	eventBytes, err := schemas.EncodeMessage(msgType, cpw.ID, version, event)
+	if err != nil {
+		log.Printf("ERRO ao serializar evento %s: %v", msgType, err)
+		return
+	}
+	mqtt.Publish(cpw.topic("event"), string(eventBytes))
+}
+
+// info monta a mensagem de info com a ocupação atual dos conectores. Deve ser chamada com o lock.
+func (cpw *ChargingPointWorker) info() schemas.ChargingPointInfo {
+	info := schemas.ChargingPointInfo{WorkerID: cpw.ID, Enterprise: cpw.Enterprise, Location: cpw.Location, ProtocolVersion: schemas.ProtocolVersion}
+	for _, c := range cpw.Connectors {
+		info.Connectors = append(info.Connectors, c.status())
+	}
+	return info
+}
+
+// publishInfo publica a info do posto como mensagem retida, lida pela API. Ela fica sem
+// envelope: é por ela que a API descobre a versão que o worker entende.
+func (cpw *ChargingPointWorker) publishInfo(info schemas.ChargingPointInfo) {
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("ERRO ao serializar info do worker: %v", err)
+		return
+	}
+	mqtt.PublishRetained(cpw.topic("info"), string(infoBytes))
+}
+
 func main() {
 	workerID := os.Getenv("WORKER_ID")
 	if workerID == "" {
 		workerID = "CP001"
 	}
+	loadSessionConfig()
+	loadHeartbeatConfig()
+	loadVisitConfig()
+	loadTelemetryConfig()
+	loadRetentionConfig(workerID)
+	connectors, err := loadConnectors()
+	if err != nil {
+		log.Fatalf("[%s] CP_CONNECTORS inválido: %v", workerID, err)
+	}
+	location, err := schemas.ParseGeoPoint(os.Getenv("WORKER_LATITUDE"), os.Getenv("WORKER_LONGITUDE"))
+	if err != nil {
+		log.Printf("AVISO: Coordenadas do worker ignoradas: %v", err)
+	}
 	// Inicializa o worker com o mutex
 	cpw := &ChargingPointWorker{
-		ID: workerID,
-		mu: sync.Mutex{},
+		ID:         workerID,
+		Enterprise: os.Getenv("ENTERPRISE_NAME"),
+		Location:   location,
+		Connectors: connectors,
+		mu:         sync.Mutex{},
+	}
+	// O status "online" é republicado a cada conexão; se a conexão cair, o broker publica "offline"
+	mqttConfig := mqtt.ConfigFromEnv("tcp://mosquitto:1883")
+	mqttConfig.Birth = cpw.statusMessage(schemas.WorkerOnline)
+	mqttConfig.Will = cpw.statusMessage(schemas.WorkerOffline)
+	if err := mqtt.Connect(mqttConfig); err != nil {
+		log.Fatalf("[%s] Falha ao configurar o cliente MQTT: %v", workerID, err)
 	}
-	mqtt.InitializeMQTT("tcp://mosquitto:1883")
-	commandTopic := fmt.Sprintf("enterprise/%s/cp/%s/command", os.Getenv("ENTERPRISE_NAME"), workerID)
+
+	// Desligamento limpo: encerra a conexão com o broker
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Printf("[%s] Desligando...", workerID)
+		cpw.mu.Lock()
+		cpw.draining = true
+		telemetry := cpw.telemetry(time.Now().UTC())
+		cpw.mu.Unlock()
+		cpw.publishTelemetry(telemetry)
+		offline := cpw.statusMessage(schemas.WorkerOffline) // Desconexões limpas não disparam o last will
+		mqtt.PublishRetained(offline.Topic, offline.Payload)
+		mqtt.Disconnect()
+		os.Exit(0)
+	}()
+
+	// Anuncia a localização e os conectores do posto
+	cpw.mu.Lock()
+	info := cpw.info()
+	cpw.mu.Unlock()
+	cpw.publishInfo(info)
+
+	commandTopic := cpw.topic("command")
 	msgChan := mqtt.StartListening(commandTopic, 10)
 	log.Printf("ChargingPointWorker %s iniciado. Escutando em %s", workerID, commandTopic)
 
+	// A chegada e a saída dos veículos vêm dos carros
+	go func() {
+		for msg := range mqtt.StartListening("car/session/+", 10) {
+			cpw.handleVehicleSignal(msg)
+		}
+	}()
+
 	// Inicia rotina de monitoramento de passagem e cobrança
 	go cpw.monitorPassageAndCharge()
+	go cpw.sendHeartbeats()
+	go cpw.monitorTelemetry()
+	go cpw.collectReservations()
 
 	for msg := range msgChan {
 		cpw.handleMQTTMessage(msg)
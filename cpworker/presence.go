@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// heartbeatInterval é o intervalo entre heartbeats (HEARTBEAT_INTERVAL).
+var heartbeatInterval = 10 * time.Second
+
+func loadHeartbeatConfig() {
+	if raw := os.Getenv("HEARTBEAT_INTERVAL"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval < time.Second {
+			log.Printf("AVISO: HEARTBEAT_INTERVAL inválido ('%s'). Usando %v.", raw, heartbeatInterval)
+		} else {
+			heartbeatInterval = interval
+		}
+	}
+}
+
+func (cpw *ChargingPointWorker) topic(kind string) string {
+	return fmt.Sprintf("enterprise/%s/cp/%s/%s", cpw.Enterprise, cpw.ID, kind)
+}
+
+// statusMessage monta a mensagem retida de status: a de nascimento ("online") e o last
+// will ("offline").
+func (cpw *ChargingPointWorker) statusMessage(status string) *mqtt.Message {
+	msg := schemas.WorkerStatus{WorkerID: cpw.ID, Enterprise: cpw.Enterprise, Status: status}
+	payload, err := schemas.EncodeMessage(schemas.MsgWorkerStatus, cpw.ID, schemas.ProtocolVersion, msg)
+	if err != nil {
+		log.Fatalf("[%s] Erro ao serializar status do worker: %v", cpw.ID, err)
+	}
+	return &mqtt.Message{Topic: cpw.topic("status"), Payload: string(payload), Retained: true}
+}
+
+// capabilities resume os conectores do posto. Tipo e potência dos conectores não mudam
+// depois da inicialização, então não é preciso o lock.
+func (cpw *ChargingPointWorker) capabilities() schemas.WorkerCapabilities {
+	caps := schemas.WorkerCapabilities{ProtocolVersion: schemas.ProtocolVersion, Connectors: len(cpw.Connectors), Queries: true}
+	for _, c := range cpw.Connectors {
+		if !slices.Contains(caps.ConnectorTypes, c.Type) {
+			caps.ConnectorTypes = append(caps.ConnectorTypes, c.Type)
+		}
+		caps.MaxPowerKW = max(caps.MaxPowerKW, c.PowerKW)
+	}
+	return caps
+}
+
+// sendHeartbeats publica um heartbeat a cada heartbeatInterval.
+func (cpw *ChargingPointWorker) sendHeartbeats() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		heartbeat := schemas.WorkerHeartbeat{
+			WorkerID:        cpw.ID,
+			Enterprise:      cpw.Enterprise,
+			Timestamp:       time.Now().UTC(),
+			IntervalSeconds: int(heartbeatInterval.Seconds()),
+			Capabilities:    cpw.capabilities(),
+		}
+		payload, err := schemas.EncodeMessage(schemas.MsgWorkerHeartbeat, cpw.ID, schemas.ProtocolVersion, heartbeat)
+		if err != nil {
+			log.Printf("ERRO ao serializar heartbeat: %v", err)
+			continue
+		}
+		mqtt.Publish(cpw.topic("heartbeat"), string(payload))
+	}
+}
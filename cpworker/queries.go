@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// answerScheduleQuery responde QUERY_SCHEDULE com as reservas que ocupam cada conector
+// no intervalo pedido.
+func (cpw *ChargingPointWorker) answerScheduleQuery(env schemas.Envelope) {
+	var cmd schemas.QueryScheduleCommand
+	if err := env.DecodePayload(&cmd); err != nil {
+		log.Printf("ERRO: %v", err)
+		return
+	}
+	query := schemas.ReservationWindow{StartTimeUTC: cmd.From, EndTimeUTC: cmd.To}
+	resp := schemas.ScheduleResponse{WorkerID: cpw.ID, CorrelationID: cmd.CorrelationID, From: cmd.From, To: cmd.To, GeneratedAt: time.Now().UTC()}
+
+	cpw.mu.Lock()
+	for _, c := range cpw.Connectors {
+		schedule := schemas.ConnectorSchedule{ConnectorID: c.ID, Type: c.Type, PowerKW: c.PowerKW, Status: c.status().Status, Reservations: []schemas.ScheduledWindow{}}
+		for _, r := range c.index.Overlapping(query) {
+			window := r.window()
+			if r.released() || !window.EndTimeUTC.After(query.StartTimeUTC) || !window.StartTimeUTC.Before(query.EndTimeUTC) {
+				continue
+			}
+			schedule.Reservations = append(schedule.Reservations, schemas.ScheduledWindow{Window: window, Status: r.Status})
+		}
+		resp.Connectors = append(resp.Connectors, schedule)
+	}
+	cpw.mu.Unlock()
+
+	cpw.reply(cmd.ResponseTopic, schemas.MsgScheduleResponse, env.Version, resp)
+}
+
+// answerWindowQuery responde QUERY_WINDOW com os conectores que atenderiam a janela, sem
+// reservá-la. Os critérios são os do PREPARE (veja selectConnector).
+func (cpw *ChargingPointWorker) answerWindowQuery(env schemas.Envelope) {
+	var cmd schemas.QueryWindowCommand
+	if err := env.DecodePayload(&cmd); err != nil {
+		log.Printf("ERRO: %v", err)
+		return
+	}
+	var connectorType string
+	if cmd.Vehicle != nil {
+		connectorType = cmd.Vehicle.ConnectorType
+	}
+	resp := schemas.WindowResponse{WorkerID: cpw.ID, CorrelationID: cmd.CorrelationID, Window: cmd.Window}
+
+	cpw.mu.Lock()
+	for _, c := range cpw.Connectors {
+		if cpw.draining || c.fault != "" || (connectorType != "" && c.Type != connectorType) || !c.isAvailable(cmd.Window) {
+			continue
+		}
+		resp.ConnectorIDs = append(resp.ConnectorIDs, c.ID)
+	}
+	cpw.mu.Unlock()
+	resp.Available = len(resp.ConnectorIDs) > 0
+
+	cpw.reply(cmd.ResponseTopic, schemas.MsgWindowResponse, env.Version, resp)
+}
+
+// reply publica a resposta de um pedido request/reply na versão do pedido.
+func (cpw *ChargingPointWorker) reply(topic, msgType string, version int, resp any) {
+	respBytes, err := schemas.EncodeMessage(msgType, cpw.ID, version, resp)
+	if err != nil {
+		log.Printf("ERRO ao serializar resposta %s: %v", msgType, err)
+		return
+	}
+	mqtt.Publish(topic, string(respBytes))
+}
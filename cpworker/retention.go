@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/schedule"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Retenção das reservas encerradas, lida em loadRetentionConfig.
+var (
+	reservationRetention = schedule.DefaultRetention // Tempo na memória depois de encerrada (RESERVATION_RETENTION)
+	reservationArchive   *schedule.Archive           // Arquivo das reservas encerradas (RESERVATION_ARCHIVE)
+)
+
+func loadRetentionConfig(workerID string) {
+	if raw := os.Getenv("RESERVATION_RETENTION"); raw != "" {
+		retention, err := time.ParseDuration(raw)
+		if err != nil || retention < 0 {
+			log.Printf("AVISO: RESERVATION_RETENTION inválido ('%s'). Usando %v.", raw, reservationRetention)
+		} else {
+			reservationRetention = retention
+		}
+	}
+	path := os.Getenv("RESERVATION_ARCHIVE")
+	if path == "" {
+		path = fmt.Sprintf("archive/reservations-%s.jsonl", workerID)
+	}
+	reservationArchive = schedule.NewArchive(path)
+}
+
+// archivedReservation é o registro de uma reserva encerrada no arquivo.
+type archivedReservation struct {
+	WorkerID      string                    `json:"worker_id"`
+	ConnectorID   int                       `json:"connector_id"`
+	TransactionID string                    `json:"transaction_id"`
+	Window        schemas.ReservationWindow `json:"window"`
+	Status        string                    `json:"status"`
+	FinishedAt    time.Time                 `json:"finished_at"`
+	EnergyKWh     float64                   `json:"energy_kwh,omitempty"`
+	IdleMinutes   float64                   `json:"idle_minutes,omitempty"`
+}
+
+// collectReservations move para o arquivo, a cada schedule.SweepInterval, as reservas
+// encerradas há mais de reservationRetention, para que a agenda dos conectores não cresça
+// indefinidamente.
+func (cpw *ChargingPointWorker) collectReservations() {
+	ticker := time.NewTicker(schedule.SweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cpw.archiveFinished(time.Now().UTC())
+	}
+}
+
+// archiveFinished grava as reservas expiradas no arquivo e só então as tira da agenda: se
+// a gravação falhar, elas ficam para a próxima varredura. A escrita acontece fora do lock.
+func (cpw *ChargingPointWorker) archiveFinished(now time.Time) {
+	type expiredReservation struct {
+		connector   *Connector
+		reservation *ReservationWindow
+	}
+	var (
+		expired []expiredReservation
+		records []any
+	)
+	cpw.mu.Lock()
+	cpw.forEachReservation(func(c *Connector, r *ReservationWindow) {
+		if !r.released() || now.Sub(r.FinishedAt) < reservationRetention {
+			return
+		}
+		record := archivedReservation{WorkerID: cpw.ID, ConnectorID: c.ID, TransactionID: r.TransactionID, Window: r.window(), Status: r.Status, FinishedAt: r.FinishedAt}
+		if r.Session != nil {
+			record.EnergyKWh = roundKWh(r.Session.EnergyKWh)
+		}
+		if r.Visit != nil {
+			record.IdleMinutes = r.Visit.idleMinutes(r)
+		}
+		expired = append(expired, expiredReservation{c, r})
+		records = append(records, record)
+	})
+	cpw.mu.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+
+	if err := reservationArchive.Append(records...); err != nil {
+		log.Printf("[%s] ERRO ao arquivar %d reserva(s) encerrada(s): %v", cpw.ID, len(expired), err)
+		return
+	}
+	cpw.mu.Lock()
+	for _, e := range expired {
+		e.connector.remove(e.reservation)
+	}
+	cpw.mu.Unlock()
+	log.Printf("[%s] %d reserva(s) encerrada(s) movida(s) para '%s'.", cpw.ID, len(expired), reservationArchive.Path())
+}
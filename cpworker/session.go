@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Configuração da simulação de recarga, lida de variáveis de ambiente em loadSessionConfig.
+var (
+	connectorPowerKW  = 50.0            // Potência do conector padrão, sem CP_CONNECTORS (CP_POWER_KW)
+	meterInterval     = 5 * time.Second // Intervalo entre leituras do medidor (METER_INTERVAL)
+	simulationSpeedup = 60.0            // Tempo simulado por tempo real: 60 = 1 minuto de recarga por segundo (SIMULATION_SPEEDUP)
+	pricePerKWh       = 1.0             // Tarifa do custo informado no evento; a API recalcula com o preço que anuncia (PRICE_PER_KWH)
+)
+
+// Perfil usado quando a API não informa os dados do veículo (carros e APIs antigas).
+var defaultVehicle = schemas.VehicleProfile{
+	BatteryCapacityKWh: 60,
+	StateOfChargePct:   20,
+	TargetSOCPct:       80,
+	MaxChargePowerKW:   100,
+}
+
+const (
+	taperStartSOC   = 80.0             // A partir daqui a potência cai (fase de tensão constante)
+	taperFloorRatio = 0.1              // Fração da potência máxima entregue com a bateria cheia
+	integrationStep = 10 * time.Second // Passo máximo de integração, em tempo simulado
+)
+
+func loadSessionConfig() {
+	connectorPowerKW = envFloat("CP_POWER_KW", connectorPowerKW)
+	simulationSpeedup = envFloat("SIMULATION_SPEEDUP", simulationSpeedup)
+	pricePerKWh = envFloat("PRICE_PER_KWH", pricePerKWh)
+	if raw := os.Getenv("METER_INTERVAL"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval <= 0 {
+			log.Printf("AVISO: METER_INTERVAL inválido ('%s'). Usando %v.", raw, meterInterval)
+		} else {
+			meterInterval = interval
+		}
+	}
+}
+
+func envFloat(name string, fallback float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value <= 0 {
+		log.Printf("AVISO: %s inválido ('%s'). Usando %.2f.", name, raw, fallback)
+		return fallback
+	}
+	return value
+}
+
+// envRate lê uma fração entre 0 e 1.
+func envRate(name string, fallback float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < 0 || value > 1 {
+		log.Printf("AVISO: %s inválido ('%s'). Usando %.2f.", name, raw, fallback)
+		return fallback
+	}
+	return value
+}
+
+// ChargingSession é a sessão de recarga em andamento numa reserva.
+type ChargingSession struct {
+	Vehicle     schemas.VehicleProfile
+	PowerKWMax  float64 // Potência nominal do conector
+	PluggedInAt time.Time
+	LastReading time.Time // Instante (real) até onde a energia já foi integrada
+	EndedAt     time.Time // Preenchido quando a sessão termina
+	EnergyKWh   float64
+	PowerKW     float64
+	SOC         float64
+}
+
+// newChargingSession conecta o veículo a um conector de connectorKW em pluggedInAt.
+func newChargingSession(vehicle *schemas.VehicleProfile, connectorKW float64, pluggedInAt time.Time) *ChargingSession {
+	profile := defaultVehicle
+	if vehicle != nil {
+		profile = *vehicle
+	}
+	if profile.TargetSOCPct == 0 {
+		profile.TargetSOCPct = 100
+	}
+	return &ChargingSession{
+		Vehicle:     profile,
+		PowerKWMax:  connectorKW,
+		PluggedInAt: pluggedInAt,
+		LastReading: pluggedInAt,
+		SOC:         profile.StateOfChargePct,
+	}
+}
+
+// chargingPowerKW é a potência entregue com a bateria em soc: o menor limite entre
+// conector e veículo até taperStartSOC, caindo linearmente até taperFloorRatio em 100%.
+func chargingPowerKW(maxPowerKW, soc float64) float64 {
+	if soc >= 100 {
+		return 0
+	}
+	if soc <= taperStartSOC {
+		return maxPowerKW
+	}
+	progress := (soc - taperStartSOC) / (100 - taperStartSOC)
+	return maxPowerKW * (1 - progress*(1-taperFloorRatio))
+}
+
+// Advance integra a energia entregue até o instante real until. Retorna true quando a
+// bateria atinge a carga alvo; nesse caso EndedAt recebe o instante em que isso ocorreu.
+func (s *ChargingSession) Advance(until time.Time) bool {
+	maxPower := math.Min(s.PowerKWMax, s.Vehicle.MaxChargePowerKW)
+	remaining := time.Duration(float64(until.Sub(s.LastReading)) * simulationSpeedup)
+	var elapsed time.Duration // Tempo simulado de recarga neste avanço
+	for remaining > 0 && s.SOC < s.Vehicle.TargetSOCPct {
+		step := min(remaining, integrationStep)
+		s.PowerKW = chargingPowerKW(maxPower, s.SOC)
+		energy := s.PowerKW * step.Hours()
+		if needed := (s.Vehicle.TargetSOCPct - s.SOC) / 100 * s.Vehicle.BatteryCapacityKWh; energy >= needed {
+			// A carga alvo é atingida no meio do passo: só o tempo para entregar o que falta conta
+			energy = needed
+			step = time.Duration(needed / s.PowerKW * float64(time.Hour))
+			s.SOC = s.Vehicle.TargetSOCPct
+		} else {
+			s.SOC += energy / s.Vehicle.BatteryCapacityKWh * 100
+		}
+		s.EnergyKWh += energy
+		elapsed += step
+		remaining -= step
+	}
+
+	if s.SOC >= s.Vehicle.TargetSOCPct {
+		s.EndedAt = s.LastReading.Add(time.Duration(float64(elapsed) / simulationSpeedup))
+		s.LastReading = s.EndedAt
+		s.PowerKW = 0
+		return true
+	}
+	if until.After(s.LastReading) {
+		s.LastReading = until
+	}
+	return false
+}
+
+// Reading retorna a leitura atual do medidor.
+func (s *ChargingSession) Reading(transactionID, workerID string) schemas.MeterValuesEvent {
+	return schemas.MeterValuesEvent{
+		TransactionID:    transactionID,
+		WorkerID:         workerID,
+		Timestamp:        s.LastReading,
+		EnergyKWh:        roundKWh(s.EnergyKWh),
+		PowerKW:          roundKWh(s.PowerKW),
+		StateOfChargePct: math.Round(s.SOC*10) / 10,
+	}
+}
+
+func roundKWh(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Configuração da telemetria e da simulação de falhas, lida em loadTelemetryConfig.
+var (
+	telemetryInterval = 5 * time.Second  // Intervalo entre publicações de telemetria (TELEMETRY_INTERVAL)
+	faultRate         = 0.0              // Chance de falha de um conector a cada intervalo (FAULT_RATE)
+	faultDuration     = 60 * time.Second // Quanto tempo o conector fica em falha (FAULT_DURATION)
+)
+
+const (
+	ambientTemperatureC = 25.0 // Temperatura do conector parado
+	fullLoadHeatingC    = 35.0 // Aquecimento acima do ambiente na potência nominal
+	thermalResponse     = 0.3  // Fração da diferença para a temperatura alvo vencida a cada intervalo
+	dcVoltageV          = 400.0
+	acVoltageV          = 230.0 // Tensão de fase dos conectores Type2 (trifásicos)
+)
+
+// faultCodes são os ChargePointErrorCode do OCPP sorteados nas falhas simuladas.
+var faultCodes = []string{"GroundFailure", "HighTemperature", "OverCurrentFailure", "PowerMeterFailure", "InternalError"}
+
+func loadTelemetryConfig() {
+	faultRate = envRate("FAULT_RATE", faultRate)
+	for name, target := range map[string]*time.Duration{"TELEMETRY_INTERVAL": &telemetryInterval, "FAULT_DURATION": &faultDuration} {
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		value, err := time.ParseDuration(raw)
+		if err != nil || value < time.Second {
+			log.Printf("AVISO: %s inválido ('%s'). Usando %v.", name, raw, *target)
+			continue
+		}
+		*target = value
+	}
+}
+
+// monitorTelemetry sorteia falhas e recuperações dos conectores e publica a telemetria a
+// cada telemetryInterval.
+func (cpw *ChargingPointWorker) monitorTelemetry() {
+	ticker := time.NewTicker(telemetryInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		now := time.Now().UTC()
+		cpw.mu.Lock()
+		changed := cpw.updateFaults(now)
+		telemetry := cpw.telemetry(now)
+		info := cpw.info()
+		cpw.mu.Unlock()
+		cpw.publishTelemetry(telemetry)
+		if changed {
+			cpw.publishInfo(info)
+		}
+	}
+}
+
+// updateFaults encerra as falhas vencidas e sorteia novas. As reservas confirmadas de um
+// conector que entra em falha passam, quando possível, para outro conector livre do
+// posto; as demais ficam com a API, que as transfere se o posto inteiro falhar.
+// Retorna true se algum conector mudou de estado. Deve ser chamada com o lock.
+func (cpw *ChargingPointWorker) updateFaults(now time.Time) bool {
+	changed := false
+	for _, c := range cpw.Connectors {
+		switch {
+		case c.fault != "" && !now.Before(c.faultUntil):
+			log.Printf("[%s] Conector %d recuperado da falha '%s'.", cpw.ID, c.ID, c.fault)
+			c.fault = ""
+			changed = true
+		case c.fault == "" && rand.Float64() < faultRate:
+			c.fault = faultCodes[rand.Intn(len(faultCodes))]
+			c.faultUntil = now.Add(faultDuration)
+			changed = true
+			log.Printf("[%s] Conector %d em falha: %s (até %s).", cpw.ID, c.ID, c.fault, c.faultUntil.Format(time.TimeOnly))
+			cpw.relocateReservations(c)
+		}
+	}
+	return changed
+}
+
+// relocateReservations passa as reservas confirmadas que ainda não começaram do conector
+// em falha para outro conector do posto. Deve ser chamada com o lock.
+func (cpw *ChargingPointWorker) relocateReservations(faulted *Connector) {
+	for _, r := range slices.Clone(faulted.Reservations) {
+		if r.Status != "committed" {
+			continue
+		}
+		target := cpw.selectConnector(r.window(), r.Vehicle)
+		if target == nil {
+			continue
+		}
+		faulted.remove(r)
+		target.add(r)
+		log.Printf("[%s] TX[%s]: Reserva transferida do conector %d para o %d.", cpw.ID, r.TransactionID, faulted.ID, target.ID)
+	}
+}
+
+// telemetry monta a telemetria do posto. Deve ser chamada com o lock.
+func (cpw *ChargingPointWorker) telemetry(now time.Time) schemas.WorkerTelemetry {
+	telemetry := schemas.WorkerTelemetry{WorkerID: cpw.ID, Enterprise: cpw.Enterprise, Timestamp: now}
+	faulted, available := 0, 0
+	for _, c := range cpw.Connectors {
+		connector := c.telemetry(cpw.draining)
+		switch connector.Status {
+		case schemas.TelemetryFaulted:
+			faulted++
+		case schemas.TelemetryAvailable:
+			available++
+		}
+		telemetry.Connectors = append(telemetry.Connectors, connector)
+	}
+	switch {
+	case cpw.draining:
+		telemetry.Status = schemas.TelemetryUnavailable
+	case faulted == len(cpw.Connectors):
+		telemetry.Status = schemas.TelemetryFaulted
+	case available == 0:
+		telemetry.Status = schemas.TelemetryOccupied
+	default:
+		telemetry.Status = schemas.TelemetryAvailable
+	}
+	return telemetry
+}
+
+// telemetry mede o conector. A temperatura segue a potência entregue com algum atraso.
+// Deve ser chamada com o lock do worker.
+func (c *Connector) telemetry(draining bool) schemas.ConnectorTelemetry {
+	telemetry := schemas.ConnectorTelemetry{ConnectorID: c.ID, Status: schemas.TelemetryAvailable}
+	for _, r := range c.Reservations {
+		switch r.Status {
+		case "charging":
+			telemetry.PowerKW += r.Session.PowerKW
+			telemetry.Status = schemas.TelemetryOccupied
+		case "arrived", "charged":
+			telemetry.Status = schemas.TelemetryOccupied
+		}
+	}
+	if c.temperatureC == 0 {
+		c.temperatureC = ambientTemperatureC
+	}
+	target := ambientTemperatureC + fullLoadHeatingC*telemetry.PowerKW/c.PowerKW
+	c.temperatureC += (target - c.temperatureC) * thermalResponse
+	telemetry.TemperatureC = math.Round(c.temperatureC*10) / 10
+
+	switch {
+	case c.fault != "":
+		telemetry.Status, telemetry.ErrorCode = schemas.TelemetryFaulted, c.fault
+		telemetry.PowerKW = 0
+		return telemetry // Sem tensão no conector em falha
+	case draining && telemetry.Status == schemas.TelemetryAvailable:
+		telemetry.Status = schemas.TelemetryUnavailable
+	}
+
+	// Tensão nominal com uma pequena variação; nos conectores AC a corrente é por fase
+	voltage, phases := dcVoltageV, 1.0
+	if c.Type == schemas.ConnectorType2 {
+		voltage, phases = acVoltageV, 3
+	}
+	voltage *= 1 + (rand.Float64()-0.5)*0.02
+	telemetry.VoltageV = math.Round(voltage*10) / 10
+	telemetry.CurrentA = math.Round(telemetry.PowerKW*1000/(voltage*phases)*10) / 10
+	telemetry.PowerKW = roundKWh(telemetry.PowerKW)
+	return telemetry
+}
+
+func (cpw *ChargingPointWorker) publishTelemetry(telemetry schemas.WorkerTelemetry) {
+	payload, err := schemas.EncodeMessage(schemas.MsgWorkerTelemetry, cpw.ID, schemas.ProtocolVersion, telemetry)
+	if err != nil {
+		log.Printf("ERRO ao serializar telemetria: %v", err)
+		return
+	}
+	mqtt.Publish(cpw.topic("telemetry"), string(payload))
+}
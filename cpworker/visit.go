@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Configuração da passagem dos veículos, lida em loadVisitConfig. A chegada e a saída
+// vêm do carro (CAR_ARRIVED e CAR_UNPLUGGED, veja handleVehicleSignal).
+var (
+	noShowGrace      = 15 * time.Second // Tolerância para a chegada após o início da janela (NO_SHOW_GRACE)
+	idleFeePerMinute = 0.5              // Taxa por minuto simulado além da janela (IDLE_FEE_PER_MINUTE)
+)
+
+const (
+	plugInDelayRatio = 0.05 // Fração da janela entre a chegada e a conexão ao conector
+	maxOverstayRatio = 0.5  // Sem CAR_UNPLUGGED, o veículo é desconectado após essa fração da janela além do fim
+)
+
+func loadVisitConfig() {
+	idleFeePerMinute = envFloat("IDLE_FEE_PER_MINUTE", idleFeePerMinute)
+	if raw := os.Getenv("NO_SHOW_GRACE"); raw != "" {
+		grace, err := time.ParseDuration(raw)
+		if err != nil || grace <= 0 {
+			log.Printf("AVISO: NO_SHOW_GRACE inválido ('%s'). Usando %v.", raw, noShowGrace)
+		} else {
+			noShowGrace = grace
+		}
+	}
+}
+
+// Visit é a passagem do veículo pelo posto. A chegada e a saída são informadas pelo carro.
+type Visit struct {
+	ArriveAt    time.Time // CAR_ARRIVED; zero até o sinal chegar
+	LeaveAt     time.Time // CAR_UNPLUGGED; zero até o sinal chegar
+	PlugInAt    time.Time
+	ArrivedAt   time.Time // Preenchidos conforme a passagem acontece
+	UnplugAt    time.Time // Definido quando o veículo sai (ou no limite de permanência)
+	UnpluggedAt time.Time
+}
+
+// arrive registra a chegada informada pelo carro. Um veículo adiantado é conectado a partir
+// do início da janela.
+func (v *Visit) arrive(r *ReservationWindow, at time.Time) {
+	if at.Before(r.StartTimeUTC) {
+		at = r.StartTimeUTC
+	}
+	window := r.EndTimeUTC.Sub(r.StartTimeUTC)
+	v.ArriveAt = at
+	v.PlugInAt = at.Add(time.Duration(float64(window) * plugInDelayRatio))
+}
+
+// planUnplug define quando o veículo sai, depois do fim da sessão de recarga: na saída
+// informada pelo carro ou, sem ela, no limite de permanência além da janela.
+func (v *Visit) planUnplug(r *ReservationWindow, sessionEnd time.Time) {
+	if v.LeaveAt.IsZero() {
+		window := r.EndTimeUTC.Sub(r.StartTimeUTC)
+		v.UnplugAt = r.EndTimeUTC.Add(time.Duration(float64(window) * maxOverstayRatio))
+		return
+	}
+	v.UnplugAt = v.LeaveAt
+	if v.UnplugAt.Before(sessionEnd) {
+		v.UnplugAt = sessionEnd
+	}
+}
+
+// handleVehicleSignal registra a chegada ou a saída informada pelo carro na reserva da
+// transação com a mesma janela. Sinais de trechos reservados em outros workers não casam
+// com nenhuma reserva e são ignorados.
+func (cpw *ChargingPointWorker) handleVehicleSignal(payload string) {
+	env, err := schemas.ParseMessage([]byte(payload))
+	if err != nil {
+		log.Printf("Erro ao decodificar sinal do carro: %v", err)
+		return
+	}
+	var signal schemas.VehicleSignal
+	if err := env.DecodePayload(&signal); err != nil {
+		log.Printf("ERRO: %v", err)
+		return
+	}
+
+	cpw.mu.Lock()
+	defer cpw.mu.Unlock()
+	cpw.forEachReservation(func(c *Connector, r *ReservationWindow) {
+		if r.TransactionID != signal.TransactionID || !r.StartTimeUTC.Equal(signal.Window.StartTimeUTC) || !r.EndTimeUTC.Equal(signal.Window.EndTimeUTC) {
+			return
+		}
+		if r.Status != "committed" && r.Status != "arrived" && r.Status != "charging" && r.Status != "charged" {
+			return
+		}
+		if r.Visit == nil {
+			r.Visit = &Visit{}
+		}
+		switch env.Type {
+		case schemas.MsgCarArrived:
+			if r.Visit.ArriveAt.IsZero() {
+				r.Visit.arrive(r, signal.Timestamp)
+			}
+		case schemas.MsgCarUnplugged:
+			if r.Visit.LeaveAt.IsZero() {
+				r.Visit.LeaveAt = signal.Timestamp
+			}
+		default:
+			return
+		}
+		log.Printf("[%s] TX[%s]: %s do veículo %s no conector %d.", cpw.ID, r.TransactionID, env.Type, signal.VehicleID, c.ID)
+	})
+}
+
+// idleMinutes é a permanência além da janela, em minutos simulados.
+func (v *Visit) idleMinutes(r *ReservationWindow) float64 {
+	if !v.UnpluggedAt.After(r.EndTimeUTC) {
+		return 0
+	}
+	return math.Round(v.UnpluggedAt.Sub(r.EndTimeUTC).Minutes()*simulationSpeedup*10) / 10
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	rc "github.com/4r7hur0/PBL-2/registry/registry_client"
 	"github.com/4r7hur0/PBL-2/schemas"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -18,19 +19,46 @@ func main() {
 	}
 	client := initializeMQTTClient(broker)
 
-	// Enterprises to publish
-	enterprises := []schemas.Enterprises{
-		{Name: "SolAtlantico", City: "Salvador"},
-		{Name: "SertaoCarga", City: "Feira de Santana"},
-		{Name: "CacauPower", City: "Ilheus"},
-	}
+	// Enterprises are discovered from the registry instead of being hard-coded
+	registryClient := rc.NewRegistryClient(os.Getenv("REGISTRY_URL"))
 
 	topic := "car/enterprises"
 	for {
-		// Publish enterprises to the topic
-		publishEnterprises(client, topic, enterprises)
-		time.Sleep(10 * time.Second) // Sleep for 10 seconds before publishing againsss
+		enterprises, err := fetchEnterprises(registryClient)
+		if err != nil {
+			fmt.Printf("Error fetching enterprises from registry: %v\n", err)
+		} else {
+			// Publish enterprises to the topic
+			publishEnterprises(client, topic, enterprises)
+		}
+		time.Sleep(10 * time.Second) // Sleep for 10 seconds before publishing again
+	}
+}
+
+// fetchEnterprises builds the enterprise list from the services in the registry
+func fetchEnterprises(registryClient *rc.RegistryClient) ([]schemas.Enterprises, error) {
+	services, err := registryClient.ListServices()
+	if err != nil {
+		return nil, err
+	}
+
+	// Several instances of the same enterprise may serve a city; publish it only once
+	seen := make(map[string]bool)
+	enterprises := make([]schemas.Enterprises, 0, len(services))
+	for _, service := range services {
+		key := service.EnterpriseName + "|" + service.CityManaged
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		enterprises = append(enterprises, schemas.Enterprises{
+			Name:            service.EnterpriseName,
+			City:            service.CityManaged,
+			Location:        service.Location,
+			ProtocolVersion: service.ProtocolVersion,
+		})
 	}
+	return enterprises, nil
 }
 
 // initializeMQTTClient initializes and connects an MQTT client
@@ -54,7 +82,7 @@ func initializeMQTTClient(broker string) mqtt.Client {
 // publishEnterprises publishes a list of enterprises to a given topic
 func publishEnterprises(client mqtt.Client, topic string, enterprises []schemas.Enterprises) {
 	for _, en := range enterprises {
-		// Serialize the struct to JSON
+		// Broadcast to cars of any version, so it stays in the legacy format
 		payload, err := json.Marshal(en)
 		if err != nil {
 			fmt.Printf("Error serializing enterprise: %v\n", err.Error())
@@ -66,7 +94,7 @@ func publishEnterprises(client mqtt.Client, topic string, enterprises []schemas.
 		if token.Error() != nil {
 			fmt.Printf("Error publishing message: %v\n", token.Error())
 		} else {
-			fmt.Printf("Published message: %s to topic: %s\n", en, topic)
+			fmt.Printf("Published message: %+v to topic: %s\n", en, topic)
 		}
 	}
 }
@@ -0,0 +1,138 @@
+// Package msp verifica, fora da Fabric, identidades emitidas pelas CAs dos MSPs.
+// É usado pelo Registry e pelas APIs para autenticar as empresas umas perante as outras.
+package msp
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TrustedRoots associa cada MSP ID às CAs que emitem seus certificados.
+type TrustedRoots map[string]*x509.CertPool
+
+// LoadTrustedRoots lê uma lista no formato "Org1MSP=/caminho,Org2MSP=/caminho".
+// Cada caminho pode ser um arquivo PEM ou um diretório (ex: msp/cacerts).
+func LoadTrustedRoots(spec string) (TrustedRoots, error) {
+	roots := make(TrustedRoots)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		mspID, caPath, found := strings.Cut(entry, "=")
+		if !found || mspID == "" || caPath == "" {
+			return nil, fmt.Errorf("entrada inválida: '%s' (esperado MSPID=caminho)", entry)
+		}
+		pool, ok := roots[mspID]
+		if !ok {
+			pool = x509.NewCertPool()
+			roots[mspID] = pool
+		}
+		if err := AppendCertsFromPath(pool, caPath); err != nil {
+			return nil, fmt.Errorf("falha ao carregar CAs de %s: %w", mspID, err)
+		}
+	}
+	return roots, nil
+}
+
+// MSPIDs retorna os MSPs configurados.
+func (r TrustedRoots) MSPIDs() []string {
+	ids := make([]string, 0, len(r))
+	for id := range r {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// AppendCertsFromPath adiciona ao pool os certificados de um arquivo PEM ou de todos os arquivos de um diretório.
+func AppendCertsFromPath(pool *x509.CertPool, caPath string) error {
+	info, err := os.Stat(caPath)
+	if err != nil {
+		return err
+	}
+	files := []string{caPath}
+	if info.IsDir() {
+		entries, err := os.ReadDir(caPath)
+		if err != nil {
+			return err
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(caPath, e.Name()))
+			}
+		}
+	}
+	loaded := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if pool.AppendCertsFromPEM(data) {
+			loaded++
+		}
+	}
+	if loaded == 0 {
+		return fmt.Errorf("nenhum certificado PEM encontrado em %s", caPath)
+	}
+	return nil
+}
+
+// VerifyCertificate confere se o certificado PEM foi emitido por uma CA confiável do MSP informado.
+func (r TrustedRoots) VerifyCertificate(mspID, certPEM string, now time.Time) (*x509.Certificate, error) {
+	pool, ok := r[mspID]
+	if !ok {
+		return nil, fmt.Errorf("MSP '%s' não é confiável", mspID)
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("certificado PEM inválido")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler certificado: %w", err)
+	}
+	if err := VerifyChain(cert, pool, now); err != nil {
+		return nil, fmt.Errorf("certificado não emitido por uma CA confiável de %s: %w", mspID, err)
+	}
+	return cert, nil
+}
+
+// VerifyChain confere a cadeia do certificado contra o pool. O uso da chave não é
+// exigido: certificados de usuário da Fabric nem sempre trazem ExtKeyUsage.
+func VerifyChain(cert *x509.Certificate, pool *x509.CertPool, now time.Time) error {
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:       pool,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// VerifySignature confere uma assinatura ECDSA (ASN.1) sobre o SHA-256 da mensagem,
+// no formato produzido por identity.Sign da Fabric.
+func VerifySignature(cert *x509.Certificate, message, signature []byte) error {
+	publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("apenas chaves ECDSA são suportadas")
+	}
+	digest := sha256.Sum256(message)
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return errors.New("assinatura inválida")
+	}
+	return nil
+}
+
+// Identity é o nome estável de uma identidade: "MSPID/CN".
+func Identity(mspID string, cert *x509.Certificate) string {
+	return mspID + "/" + cert.Subject.CommonName
+}
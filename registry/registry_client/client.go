@@ -3,105 +3,325 @@ package registry
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"time"
-	"io"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/4r7hur0/PBL-2/schemas" // Ajuste o caminho do import!
 )
 
+// ErrLeaseNotFound indica que o Registry não conhece mais o lease (expirou ou o Registry reiniciou).
+var ErrLeaseNotFound = errors.New("lease desconhecido ou expirado no Registry")
+
 type RegistryClient struct {
-	RegistryBaseURL string
+	RegistryBaseURL string   // Instância do Registry que respondeu por último
+	RegistryURLs    []string // Todas as instâncias conhecidas, tentadas em ordem se uma falhar
 	HttpClient      *http.Client
+
+	// Estado do registro atual, usado pelo heartbeat em background
+	leaseMu      sync.Mutex
+	registration *schemas.RegisterRequest
+	leaseID      string
+	leaseTTL     time.Duration
+
+	cache    *serviceCache // Visão local mantida por StartWatch
+	watching bool
+
+	credentials *Credentials // Nil: registros enviados sem assinatura
+}
+
+// Credentials identifica a empresa perante o Registry com a sua identidade MSP da Fabric.
+type Credentials struct {
+	MSPID          string
+	CertificatePEM []byte
+	Sign           func(digest []byte) ([]byte, error) // Assina o SHA-256 da mensagem (ex: identity.Sign da Fabric)
 }
 
+// SetCredentials faz com que os próximos registros sejam assinados com a identidade informada.
+func (rc *RegistryClient) SetCredentials(credentials Credentials) {
+	rc.leaseMu.Lock()
+	defer rc.leaseMu.Unlock()
+	rc.credentials = &credentials
+}
+
+// NewRegistryClient cria o cliente. registryURL pode conter várias instâncias
+// replicadas do Registry separadas por vírgula (ex: "http://registry:9000,http://registry2:9000").
 func NewRegistryClient(registryURL string) *RegistryClient {
 	if registryURL == "" {
 		log.Println("[RegistryClient] AVISO: URL do Registry não fornecida. Usando padrão http://localhost:9000")
 		registryURL = "http://localhost:9000"
 	}
+	var urls []string
+	for _, u := range strings.Split(registryURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, strings.TrimRight(u, "/"))
+		}
+	}
 	return &RegistryClient{
-		RegistryBaseURL: registryURL,
+		RegistryBaseURL: urls[0],
+		RegistryURLs:    urls,
 		HttpClient:      &http.Client{Timeout: 5 * time.Second},
+		cache:           &serviceCache{services: make(map[string]schemas.ServiceInfo)},
 	}
 }
 
-func (rc *RegistryClient) RegisterService(enterpriseName, cityManaged, apiURL string) error {
-	payload := schemas.RegisterRequest{
-		EnterpriseName: enterpriseName,
-		CityManaged:    cityManaged,
-		ApiURL:         apiURL,
+// doWithFailover envia a requisição à instância preferida do Registry e, se ela não
+// responder, às demais. A instância que responder passa a ser a preferida.
+func (rc *RegistryClient) doWithFailover(method, path string, body []byte) (*http.Response, error) {
+	return rc.doWithFailoverUsing(rc.HttpClient, method, path, body)
+}
+
+func (rc *RegistryClient) doWithFailoverUsing(httpClient *http.Client, method, path string, body []byte) (*http.Response, error) {
+	rc.leaseMu.Lock()
+	preferred := rc.RegistryBaseURL
+	rc.leaseMu.Unlock()
+
+	ordered := []string{preferred}
+	for _, u := range rc.RegistryURLs {
+		if u != preferred {
+			ordered = append(ordered, u)
+		}
+	}
+
+	var lastErr error
+	for _, baseURL := range ordered {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, baseURL+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("falha ao enviar requisição para %s: %w", baseURL+path, err)
+			continue
+		}
+		if baseURL != preferred {
+			log.Printf("[RegistryClient] Registry %s indisponível. Usando %s.", preferred, baseURL)
+			rc.leaseMu.Lock()
+			rc.RegistryBaseURL = baseURL
+			rc.leaseMu.Unlock()
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// RegisterService registra a API no Registry e retorna o ID do lease e seu TTL.
+// O lease precisa ser renovado antes de expirar; veja StartHeartbeat.
+func (rc *RegistryClient) RegisterService(payload schemas.RegisterRequest) (string, time.Duration, error) {
+	return rc.register(payload)
+}
+
+// UpdateMetadata altera os metadados (preço, postos livres) enviados na próxima renovação do lease.
+func (rc *RegistryClient) UpdateMetadata(metadata schemas.ServiceMetadata) {
+	rc.leaseMu.Lock()
+	defer rc.leaseMu.Unlock()
+	if rc.registration != nil {
+		rc.registration.Metadata = metadata
+	}
+}
+
+func (rc *RegistryClient) register(payload schemas.RegisterRequest) (string, time.Duration, error) {
+	payload.Auth = nil // Cada envio é assinado de novo, com timestamp atual
+	signed, err := rc.sign(payload)
+	if err != nil {
+		return "", 0, fmt.Errorf("falha ao assinar registro: %w", err)
+	}
+
+	var regResp schemas.RegisterResponse
+	if err := rc.postJSON("/register", signed, &regResp); err != nil {
+		return "", 0, fmt.Errorf("falha ao registrar serviço: %w", err)
+	}
+	ttl := time.Duration(regResp.TTLSeconds) * time.Second
+
+	rc.leaseMu.Lock()
+	rc.registration = &payload
+	rc.leaseID = regResp.LeaseID
+	rc.leaseTTL = ttl
+	rc.leaseMu.Unlock()
+
+	log.Printf("[RegistryClient] Serviço '%s' para cidade '%s' em '%s' registrado com sucesso (lease %s, TTL %s).", payload.EnterpriseName, payload.CityManaged, payload.ApiURL, regResp.LeaseID, ttl)
+	return regResp.LeaseID, ttl, nil
+}
+
+// sign anexa ao registro a prova de identidade, se houver credenciais configuradas.
+func (rc *RegistryClient) sign(payload schemas.RegisterRequest) (schemas.RegisterRequest, error) {
+	rc.leaseMu.Lock()
+	credentials := rc.credentials
+	rc.leaseMu.Unlock()
+	if credentials == nil {
+		return payload, nil
+	}
+
+	timestamp := time.Now().UTC()
+	digest := sha256.Sum256(payload.SigningBytes(credentials.MSPID, timestamp))
+	signature, err := credentials.Sign(digest[:])
+	if err != nil {
+		return payload, err
 	}
+	payload.Auth = &schemas.RegistrationAuth{
+		MSPID:          credentials.MSPID,
+		CertificatePEM: string(credentials.CertificatePEM),
+		Timestamp:      timestamp,
+		Signature:      signature,
+	}
+	return payload, nil
+}
+
+// RenewLease renova o lease e retorna o novo TTL. Retorna ErrLeaseNotFound se o
+// Registry não conhecer mais o lease. Metadados não nulos substituem os anteriores.
+func (rc *RegistryClient) RenewLease(leaseID string, metadata *schemas.ServiceMetadata) (time.Duration, error) {
+	var regResp schemas.RegisterResponse
+	if err := rc.postJSON("/renew", schemas.LeaseRequest{LeaseID: leaseID, Metadata: metadata}, &regResp); err != nil {
+		return 0, err
+	}
+	return time.Duration(regResp.TTLSeconds) * time.Second, nil
+}
+
+// Deregister remove o serviço do Registry (usado no desligamento da API).
+func (rc *RegistryClient) Deregister(leaseID string) error {
+	return rc.postJSON("/deregister", schemas.LeaseRequest{LeaseID: leaseID}, nil)
+}
+
+// StartHeartbeat renova em background o lease obtido no último RegisterService.
+// Se o Registry esquecer o lease (expiração ou reinício), o serviço é registrado de novo.
+// Ao fechar stop, o serviço é removido do Registry e o canal retornado é fechado.
+func (rc *RegistryClient) StartHeartbeat(stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			rc.leaseMu.Lock()
+			leaseID, ttl, registered := rc.leaseID, rc.leaseTTL, rc.registration != nil
+			rc.leaseMu.Unlock()
+
+			if !registered {
+				log.Println("[RegistryClient] AVISO: StartHeartbeat chamado antes de RegisterService.")
+				return
+			}
+
+			interval := ttl / 3
+			if interval <= 0 {
+				interval = time.Second
+			}
+			select {
+			case <-stop:
+				if err := rc.Deregister(leaseID); err != nil {
+					log.Printf("[RegistryClient] Falha ao remover registro do Registry: %v", err)
+				} else {
+					log.Printf("[RegistryClient] Registro removido do Registry (lease %s).", leaseID)
+				}
+				return
+			case <-time.After(interval):
+			}
+
+			// Cópia tirada após a espera para enviar os metadados mais recentes
+			rc.leaseMu.Lock()
+			registration := *rc.registration
+			rc.leaseMu.Unlock()
+
+			newTTL, err := rc.RenewLease(leaseID, &registration.Metadata)
+			switch {
+			case err == nil:
+				rc.leaseMu.Lock()
+				rc.leaseTTL = newTTL
+				rc.leaseMu.Unlock()
+			case errors.Is(err, ErrLeaseNotFound):
+				log.Printf("[RegistryClient] Lease %s não existe mais no Registry. Registrando novamente...", leaseID)
+				if _, _, err := rc.register(registration); err != nil {
+					log.Printf("[RegistryClient] Falha ao registrar novamente: %v", err)
+				}
+			default:
+				log.Printf("[RegistryClient] Falha ao renovar lease %s: %v", leaseID, err)
+			}
+		}
+	}()
+	return done
+}
+
+// postJSON envia payload em JSON para o caminho do Registry e decodifica a resposta em out (se não for nil).
+func (rc *RegistryClient) postJSON(path string, payload interface{}, out interface{}) error {
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("falha ao serializar payload de registro: %w", err)
+		return fmt.Errorf("falha ao serializar payload: %w", err)
 	}
 
-	reqURL := fmt.Sprintf("%s/register", rc.RegistryBaseURL)
-	resp, err := rc.HttpClient.Post(reqURL, "application/json", bytes.NewBuffer(payloadBytes))
+	resp, err := rc.doWithFailover(http.MethodPost, path, payloadBytes)
 	if err != nil {
-		return fmt.Errorf("falha ao enviar requisição de registro para %s: %w", reqURL, err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound && path != "/register" {
+		return ErrLeaseNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
 		// Tentar ler o corpo do erro
 		var errorBody map[string]interface{}
 		json.NewDecoder(resp.Body).Decode(&errorBody)
-		return fmt.Errorf("falha ao registrar serviço. Status: %s, Corpo: %v", resp.Status, errorBody)
+		return fmt.Errorf("status: %s, corpo: %v", resp.Status, errorBody)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("falha ao decodificar resposta de %s: %w", path, err)
 	}
-
-	log.Printf("[RegistryClient] Serviço '%s' para cidade '%s' em '%s' registrado com sucesso.", enterpriseName, cityManaged, apiURL)
 	return nil
 }
 
+// DiscoverService consulta o Registry diretamente. Quem chamou StartWatch deve
+// preferir Candidates, que responde a partir da visão local.
 func (rc *RegistryClient) DiscoverService(cityName string) (schemas.DiscoverResponse, error) {
-    var discoverResp schemas.DiscoverResponse
-		encodedCityName := url.QueryEscape(cityName)
-    reqURL := fmt.Sprintf("%s/discover?city=%s", rc.RegistryBaseURL, encodedCityName)
-
-		log.Printf("[RegistryClient] Enviando GET para: %s (Nome original da cidade: '%s')", reqURL, cityName)
-    log.Printf("[RegistryClient] Enviando requisição de descoberta para: %s", reqURL) 
-    resp, err := rc.HttpClient.Get(reqURL)
-    if err != nil {
-        return discoverResp, fmt.Errorf("falha ao enviar requisição de descoberta para %s: %w", reqURL, err)
-    }
-    defer resp.Body.Close()
-
-    // Ler e logar o corpo da resposta ANTES de decodificar
-    bodyBytes, readErr := io.ReadAll(resp.Body)
-    if readErr != nil {
-        log.Printf("[RegistryClient] Erro ao ler o corpo da resposta para %s: %v", cityName, readErr)
-        // Recriar o resp.Body para a tentativa de Decode, embora possa não ser útil se a leitura falhou
-         resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes)) // Tenta repopular, mas pode já estar comprometido
-        return discoverResp, fmt.Errorf("falha ao ler corpo da resposta de descoberta: %w", readErr)
-    }
-    // Importante: Depois de ler com io.ReadAll, resp.Body está "gasto".
-    // Precisamos substituí-lo por um novo reader com o mesmo conteúdo para o json.Decoder.
-    resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-
-    log.Printf("[RegistryClient] Resposta recebida de %s. Status: %s, Corpo Bruto: '%s'", reqURL, resp.Status, string(bodyBytes))
-
-    // Tentar decodificar
-    if err := json.NewDecoder(resp.Body).Decode(&discoverResp); err != nil {
-        // O erro que você está vendo acontece aqui. O log acima do corpo bruto é crucial.
-        log.Printf("[RegistryClient] Erro ao decodificar JSON para %s. Erro: %v", cityName, err)
-        // Retornar o erro original de decodificação, a discoverResp estará no seu valor zero (Found: false).
-        return discoverResp, fmt.Errorf("falha ao decodificar resposta de descoberta (%s): %w. Corpo: %s", resp.Status, err, string(bodyBytes))
-    }
-
-    // Se a decodificação foi bem-sucedida, discoverResp está preenchida.
-    // A lógica abaixo para verificar resp.StatusCode e discoverResp.Found ainda é válida.
-    if resp.StatusCode != http.StatusOK || !discoverResp.Found {
-        log.Printf("[RegistryClient] Serviço para cidade '%s' não encontrado (Status HTTP: %s, Payload Found: %v)", cityName, resp.Status, discoverResp.Found)
-        // Retorna a resposta (que pode ter Found: false) e nenhum erro de *comunicação*
-        return discoverResp, nil
-    }
-
-    log.Printf("[RegistryClient] Serviço para cidade '%s' descoberto: %+v", cityName, discoverResp)
-    return discoverResp, nil
-}
\ No newline at end of file
+	var discoverResp schemas.DiscoverResponse
+	reqURL := fmt.Sprintf("/discover?city=%s", url.QueryEscape(cityName))
+
+	resp, err := rc.doWithFailover(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return discoverResp, fmt.Errorf("falha ao enviar requisição de descoberta: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&discoverResp); err != nil {
+		return discoverResp, fmt.Errorf("falha ao decodificar resposta de descoberta (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || !discoverResp.Found {
+		// Resposta válida com Found: false, sem erro de comunicação
+		log.Printf("[RegistryClient] Serviço para cidade '%s' não encontrado (Status HTTP: %s)", cityName, resp.Status)
+		return discoverResp, nil
+	}
+	return discoverResp, nil
+}
+
+// ListServices retorna todas as APIs atualmente registradas no Registry.
+func (rc *RegistryClient) ListServices() ([]schemas.ServiceInfo, error) {
+	resp, err := rc.doWithFailover(http.MethodGet, "/services", nil)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao enviar requisição de listagem: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("falha ao listar serviços. Status: %s", resp.Status)
+	}
+
+	var services []schemas.ServiceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		return nil, fmt.Errorf("falha ao decodificar lista de serviços: %w", err)
+	}
+	return services, nil
+}
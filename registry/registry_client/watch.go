@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// watchTimeoutSeconds é quanto o Registry segura cada requisição de /watch sem eventos.
+const watchTimeoutSeconds = 25
+
+// serviceCache é a visão local dos serviços do Registry, mantida por StartWatch.
+type serviceCache struct {
+	mu       sync.RWMutex
+	services map[string]schemas.ServiceInfo // Chave: empresa|cidade|instância
+	synced   bool                           // Já recebeu o estado completo ao menos uma vez
+	epoch    string
+	revision int64
+}
+
+func serviceKey(s schemas.ServiceInfo) string {
+	return s.EnterpriseName + "|" + s.CityManaged + "|" + s.InstanceID
+}
+
+// StartWatch mantém em background uma cópia local dos serviços do Registry, atualizada
+// por long-polling em /watch. Enquanto a cópia não estiver pronta (ou se o Registry
+// estiver fora do ar desde o início), CachedServices e Candidates retornam ok=false.
+func (rc *RegistryClient) StartWatch() {
+	rc.leaseMu.Lock()
+	alreadyWatching := rc.watching
+	rc.watching = true
+	rc.leaseMu.Unlock()
+	if alreadyWatching {
+		return
+	}
+
+	// Cliente próprio: as requisições de /watch ficam abertas por até watchTimeoutSeconds
+	watchClient := &http.Client{Timeout: (watchTimeoutSeconds + 10) * time.Second}
+	go func() {
+		for {
+			if err := rc.pollWatch(watchClient); err != nil {
+				log.Printf("[RegistryClient] Falha ao acompanhar alterações do Registry: %v. Tentando novamente em 2s.", err)
+				time.Sleep(2 * time.Second)
+			}
+		}
+	}()
+}
+
+// pollWatch faz uma requisição de /watch e aplica a resposta ao cache.
+func (rc *RegistryClient) pollWatch(watchClient *http.Client) error {
+	cache := rc.cache
+	cache.mu.RLock()
+	query := url.Values{}
+	query.Set("since", fmt.Sprint(cache.revision))
+	query.Set("epoch", cache.epoch)
+	query.Set("timeout", fmt.Sprint(watchTimeoutSeconds))
+	cache.mu.RUnlock()
+
+	// Percorre as instâncias como doWithFailover, mas com o cliente de timeout longo.
+	// Ao trocar de instância o epoch muda e o Registry responde com o estado completo.
+	resp, err := rc.doWithFailoverUsing(watchClient, http.MethodGet, "/watch?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	var watchResp schemas.WatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&watchResp); err != nil {
+		return fmt.Errorf("falha ao decodificar resposta de /watch: %w", err)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if watchResp.Reset {
+		cache.services = make(map[string]schemas.ServiceInfo, len(watchResp.Services))
+		for _, service := range watchResp.Services {
+			cache.services[serviceKey(service)] = service
+		}
+		log.Printf("[RegistryClient] Visão local do Registry sincronizada: %d serviço(s) (revisão %d).", len(cache.services), watchResp.Revision)
+	}
+	for _, event := range watchResp.Events {
+		switch event.Type {
+		case schemas.RegistryEventRegistered, schemas.RegistryEventUpdated:
+			cache.services[serviceKey(event.Service)] = event.Service
+		case schemas.RegistryEventDeregistered, schemas.RegistryEventExpired:
+			delete(cache.services, serviceKey(event.Service))
+		}
+		if event.Type != schemas.RegistryEventUpdated {
+			log.Printf("[RegistryClient] Registry: %s '%s' (instância '%s') para cidade '%s'.", event.Type, event.Service.EnterpriseName, event.Service.InstanceID, event.Service.CityManaged)
+		}
+	}
+	cache.epoch = watchResp.Epoch
+	cache.revision = watchResp.Revision
+	cache.synced = true
+	return nil
+}
+
+// CachedServices retorna os serviços da visão local. ok é false se StartWatch não foi
+// chamado ou se a primeira sincronização ainda não terminou.
+func (rc *RegistryClient) CachedServices() (services []schemas.ServiceInfo, ok bool) {
+	cache := rc.cache
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	if !cache.synced {
+		return nil, false
+	}
+	services = make([]schemas.ServiceInfo, 0, len(cache.services))
+	for _, service := range cache.services {
+		services = append(services, service)
+	}
+	sortServices(services)
+	return services, true
+}
+
+// Candidates retorna, a partir da visão local, os serviços que atendem a cidade,
+// na mesma ordem usada por /discover.
+func (rc *RegistryClient) Candidates(cityName string) (candidates []schemas.ServiceInfo, ok bool) {
+	services, ok := rc.CachedServices()
+	if !ok {
+		return nil, false
+	}
+	for _, service := range services {
+		if service.CityManaged == cityName {
+			candidates = append(candidates, service)
+		}
+	}
+	return candidates, true
+}
+
+// sortServices ordena por empresa e depois por instância, como o Registry.
+func sortServices(services []schemas.ServiceInfo) {
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].EnterpriseName != services[j].EnterpriseName {
+			return services[i].EnterpriseName < services[j].EnterpriseName
+		}
+		if services[i].CityManaged != services[j].CityManaged {
+			return services[i].CityManaged < services[j].CityManaged
+		}
+		return services[i].InstanceID < services[j].InstanceID
+	})
+}
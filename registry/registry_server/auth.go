@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/msp"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Autenticação dos registros. Cada empresa assina o registro com a chave da sua identidade
+// MSP da Fabric; o certificado precisa ter sido emitido por uma CA confiável do mesmo MSP.
+
+// maxSignatureAge limita por quanto tempo uma assinatura de registro pode ser reaproveitada.
+const maxSignatureAge = 5 * time.Minute
+
+var (
+	trustedRoots     msp.TrustedRoots
+	insecureRegister bool // REGISTRY_INSECURE=true aceita registros sem assinatura (apenas desenvolvimento)
+)
+
+// loadTrustedRoots lê REGISTRY_TRUSTED_CA_PATHS, no formato "Org1MSP=/caminho,Org2MSP=/caminho".
+// Cada caminho pode ser um arquivo PEM ou um diretório (ex: msp/cacerts).
+func loadTrustedRoots() error {
+	insecureRegister = os.Getenv("REGISTRY_INSECURE") == "true"
+	roots, err := msp.LoadTrustedRoots(os.Getenv("REGISTRY_TRUSTED_CA_PATHS"))
+	if err != nil {
+		return fmt.Errorf("REGISTRY_TRUSTED_CA_PATHS: %w", err)
+	}
+	trustedRoots = roots
+
+	switch {
+	case len(trustedRoots) > 0:
+		log.Printf("[Registry] Registros assinados exigidos. MSPs confiáveis: %v", trustedRoots.MSPIDs())
+	case insecureRegister:
+		log.Println("[Registry] AVISO: REGISTRY_INSECURE=true. Registros sem assinatura serão aceitos.")
+	default:
+		return errors.New("nenhuma CA confiável configurada (REGISTRY_TRUSTED_CA_PATHS); use REGISTRY_INSECURE=true apenas em desenvolvimento")
+	}
+	return nil
+}
+
+// authenticateRegistration verifica a assinatura do registro e retorna a identidade do
+// dono ("MSPID/CN"), que passa a ser a única autorizada a substituir o registro.
+func authenticateRegistration(req schemas.RegisterRequest, now time.Time) (string, error) {
+	if req.Auth == nil {
+		if insecureRegister && len(trustedRoots) == 0 {
+			return "", nil
+		}
+		return "", errors.New("registro sem assinatura")
+	}
+	auth := req.Auth
+
+	if age := now.Sub(auth.Timestamp); age > maxSignatureAge || age < -maxSignatureAge {
+		return "", fmt.Errorf("timestamp da assinatura fora da janela permitida (%s)", maxSignatureAge)
+	}
+	cert, err := trustedRoots.VerifyCertificate(auth.MSPID, auth.CertificatePEM, now)
+	if err != nil {
+		return "", err
+	}
+	if err := msp.VerifySignature(cert, req.SigningBytes(auth.MSPID, auth.Timestamp), auth.Signature); err != nil {
+		return "", err
+	}
+	return msp.Identity(auth.MSPID, cert), nil
+}
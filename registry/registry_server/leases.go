@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// leaseTTL é o tempo que um registro permanece válido sem renovação.
+var leaseTTL = 15 * time.Second
+
+// readLeaseTTL lê REGISTRY_LEASE_TTL (ex: "15s"), com padrão de 15 segundos.
+func readLeaseTTL() time.Duration {
+	raw := os.Getenv("REGISTRY_LEASE_TTL")
+	if raw == "" {
+		return 15 * time.Second
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl < time.Second {
+		log.Printf("[Registry] AVISO: REGISTRY_LEASE_TTL inválido ('%s'). Usando 15s.", raw)
+		return 15 * time.Second
+	}
+	return ttl
+}
+
+func (s ServiceInfo) expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
+
+func handleRenew(c *gin.Context) {
+	var req schemas.LeaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.LeaseID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Campo 'lease_id' é obrigatório."})
+		return
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	now := time.Now().UTC()
+	service, found := registry[req.LeaseID]
+	if !found || service.expired(now) {
+		// O cliente deve se registrar novamente
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lease desconhecido ou expirado", "lease_id": req.LeaseID})
+		return
+	}
+
+	service.LastHeartbeat = now
+	service.ExpiresAt = now.Add(leaseTTL)
+	eventType := "" // Renovação simples não gera evento para /watch
+	if req.Metadata != nil && *req.Metadata != service.Metadata {
+		service.Metadata = *req.Metadata
+		eventType = schemas.RegistryEventUpdated
+	}
+	putService(service, eventType)
+
+	c.JSON(http.StatusOK, schemas.RegisterResponse{
+		Message:    "Lease renovado",
+		LeaseID:    service.LeaseID,
+		TTLSeconds: int(leaseTTL.Seconds()),
+	})
+}
+
+func handleDeregister(c *gin.Context) {
+	var req schemas.LeaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.LeaseID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Campo 'lease_id' é obrigatório."})
+		return
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	service, found := registry[req.LeaseID]
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lease desconhecido", "lease_id": req.LeaseID})
+		return
+	}
+	removeService(req.LeaseID)
+
+	log.Printf("[Registry] Serviço removido: Empresa '%s' (instância '%s') para cidade '%s' (%s)", service.EnterpriseName, service.InstanceID, service.CityManaged, service.ApiURL)
+	c.JSON(http.StatusOK, gin.H{"message": "Serviço removido com sucesso"})
+}
+
+// evictExpiredLoop remove periodicamente os registros cujo lease expirou.
+func evictExpiredLoop() {
+	ticker := time.NewTicker(leaseTTL / 3)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		registryMutex.Lock()
+		unacked := purgeTombstones(now)
+		for _, service := range registry {
+			if service.expired(now) {
+				// O tombstone é replicado: sem ele, um par que ainda tem o lease o enviaria de volta
+				expireService(service)
+				log.Printf("[Registry] Lease expirado: Empresa '%s' (instância '%s') para cidade '%s' (%s) removida. Último heartbeat: %s", service.EnterpriseName, service.InstanceID, service.CityManaged, service.ApiURL, service.LastHeartbeat.Format(time.RFC3339))
+			}
+		}
+		registryMutex.Unlock()
+		pushToPeers(unacked)
+	}
+}
@@ -4,23 +4,50 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	// Importe o novo schemas se o criou
 	"github.com/4r7hur0/PBL-2/schemas" // Ajuste o caminho do import!
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type ServiceInfo struct {
-	CityManaged    string
-	ApiURL         string
-	EnterpriseName string
-	// Poderia adicionar um timestamp de último heartbeat aqui para remoção de inativos
+	CityManaged     string                  `json:"city_managed"`
+	ApiURL          string                  `json:"api_url"`
+	EnterpriseName  string                  `json:"enterprise_name"`
+	InstanceID      string                  `json:"instance_id"`
+	Location        *schemas.GeoPoint       `json:"location,omitempty"`
+	Metadata        schemas.ServiceMetadata `json:"metadata"`
+	Owner           string                  `json:"owner,omitempty"` // Identidade MSP que registrou o serviço ("MSPID/CN")
+	ProtocolVersion int                     `json:"protocol_version,omitempty"`
+	LeaseID         string                  `json:"-"` // Não exposto: quem conhece o lease pode renová-lo ou removê-lo
+	LastHeartbeat   time.Time               `json:"last_heartbeat"`
+	ExpiresAt       time.Time               `json:"expires_at"`
+	UpdatedAt       time.Time               `json:"-"` // Versão usada para resolver conflitos na replicação
+}
+
+// toSchema converte o registro interno para o formato público de descoberta.
+func (s ServiceInfo) toSchema() schemas.ServiceInfo {
+	return schemas.ServiceInfo{
+		CityManaged:     s.CityManaged,
+		ApiURL:          s.ApiURL,
+		EnterpriseName:  s.EnterpriseName,
+		InstanceID:      s.InstanceID,
+		Location:        s.Location,
+		Metadata:        s.Metadata,
+		ProtocolVersion: s.ProtocolVersion,
+		Owner:           s.Owner,
+	}
 }
 
 var (
 	// Protege o acesso concorrente ao mapa de registros
-	registry      map[string]ServiceInfo // Chave: Nome da Cidade
+	// Várias empresas, e várias instâncias da mesma empresa, podem atender a mesma cidade.
+	registry      map[string]ServiceInfo // Chave: ID do lease
 	registryMutex = &sync.RWMutex{}
 )
 
@@ -30,14 +57,43 @@ func main() {
 	if registryPort == "" {
 		registryPort = "9000" // Porta padrão para o serviço de registro
 	}
+	leaseTTL = readLeaseTTL()
+
+	dataDir := os.Getenv("REGISTRY_DATA_DIR")
+	if dataDir == "" {
+		dataDir = "./data" // Diretório padrão para o arquivo de dados
+	}
+	dataFile = filepath.Join(dataDir, "registry.json")
+	if err := loadSnapshot(); err != nil {
+		log.Fatalf("Falha ao carregar dados do Registry: %v", err)
+	}
+	if err := loadPeers(); err != nil {
+		log.Fatalf("Falha ao configurar a replicação: %v", err)
+	}
+	if err := loadTrustedRoots(); err != nil {
+		log.Fatalf("Falha ao carregar CAs confiáveis: %v", err)
+	}
 
-	log.Printf("Servidor de Registry iniciando na porta %s", registryPort)
+	log.Printf("Servidor de Registry iniciando na porta %s (TTL dos leases: %s, dados em %s)", registryPort, leaseTTL, dataFile)
+	go evictExpiredLoop()
+	go syncLoop()
+	go pullFromPeersLoop(leaseTTL / 3)
 
 	r := gin.Default()
 
 	r.POST("/register", handleRegister)
-	r.GET("/discover", handleDiscover) // Ex: /discover?city=Salvador
-	r.GET("/services", handleListServices) // Endpoint para listar todos os serviços registrados
+	r.POST("/renew", handleRenew)           // Renova o lease recebido no registro
+	r.POST("/deregister", handleDeregister) // Remove o serviço (desligamento limpo)
+	r.GET("/discover", handleDiscover)      // Ex: /discover?city=Salvador
+	r.GET("/services", handleListServices)  // Endpoint para listar todos os serviços registrados
+	r.GET("/watch", handleWatch)            // Long-polling: ex. /watch?since=42&epoch=...
+
+	// Endpoints internos usados entre instâncias do Registry
+	replication := r.Group("/replication", requirePeerToken)
+	{
+		replication.GET("/snapshot", handleReplicationSnapshot)
+		replication.POST("/push", handleReplicationPush)
+	}
 
 	if err := r.Run(":" + registryPort); err != nil {
 		log.Fatalf("Falha ao iniciar o servidor de Registry: %v", err)
@@ -58,17 +114,60 @@ func handleRegister(c *gin.Context) {
 		return
 	}
 
+	// A assinatura cobre o registro exatamente como foi enviado: os padrões vêm depois
+	now := time.Now().UTC()
+	owner, err := authenticateRegistration(req, now)
+	if err != nil {
+		log.Printf("[Registry] Registro REJEITADO para empresa '%s' na cidade '%s' (%s): %v", req.EnterpriseName, req.CityManaged, req.ApiURL, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Falha na autenticação do registro", "details": err.Error()})
+		return
+	}
+
+	if req.InstanceID == "" {
+		req.InstanceID = req.ApiURL
+	}
+
 	registryMutex.Lock()
 	defer registryMutex.Unlock()
 
-	registry[req.CityManaged] = ServiceInfo{
-		CityManaged:    req.CityManaged,
-		ApiURL:         req.ApiURL,
-		EnterpriseName: req.EnterpriseName,
+	// Uma empresa pertence à identidade que a registrou; outra identidade não pode
+	// registrar instâncias em seu nome nem substituir as existentes.
+	for _, existing := range registry {
+		if existing.EnterpriseName == req.EnterpriseName && existing.Owner != owner && !existing.expired(now) {
+			log.Printf("[Registry] Registro REJEITADO: empresa '%s' pertence a '%s', não a '%s'", req.EnterpriseName, existing.Owner, owner)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Empresa já registrada por outra identidade"})
+			return
+		}
+	}
+
+	// Um novo registro da mesma instância (ex: após reinício) substitui o anterior
+	for leaseID, existing := range registry {
+		if existing.CityManaged == req.CityManaged && existing.EnterpriseName == req.EnterpriseName && existing.InstanceID == req.InstanceID {
+			removeService(leaseID)
+		}
+	}
+
+	service := ServiceInfo{
+		CityManaged:     req.CityManaged,
+		ApiURL:          req.ApiURL,
+		EnterpriseName:  req.EnterpriseName,
+		InstanceID:      req.InstanceID,
+		Location:        req.Location,
+		Metadata:        req.Metadata,
+		Owner:           owner,
+		ProtocolVersion: req.ProtocolVersion,
+		LeaseID:         uuid.New().String(),
+		LastHeartbeat:   now,
+		ExpiresAt:       now.Add(leaseTTL),
 	}
+	putService(service, schemas.RegistryEventRegistered)
 
-	log.Printf("[Registry] Serviço Registrado: Empresa '%s' para cidade '%s' em %s", req.EnterpriseName, req.CityManaged, req.ApiURL)
-	c.JSON(http.StatusOK, gin.H{"message": "Serviço registrado com sucesso", "city": req.CityManaged, "url": req.ApiURL})
+	log.Printf("[Registry] Serviço Registrado: Empresa '%s' (instância '%s', identidade '%s') para cidade '%s' em %s (lease %s)", req.EnterpriseName, req.InstanceID, owner, req.CityManaged, req.ApiURL, service.LeaseID)
+	c.JSON(http.StatusOK, schemas.RegisterResponse{
+		Message:    "Serviço registrado com sucesso",
+		LeaseID:    service.LeaseID,
+		TTLSeconds: int(leaseTTL.Seconds()),
+	})
 }
 
 func handleDiscover(c *gin.Context) {
@@ -81,19 +180,36 @@ func handleDiscover(c *gin.Context) {
 	registryMutex.RLock()
 	defer registryMutex.RUnlock()
 
-	service, found := registry[cityName]
-	if !found {
+	now := time.Now()
+	var candidates []schemas.ServiceInfo
+	for _, service := range registry {
+		if service.CityManaged == cityName && !service.expired(now) {
+			candidates = append(candidates, service.toSchema())
+		}
+	}
+	if len(candidates) == 0 {
 		log.Printf("[Registry] Descoberta FALHOU para cidade '%s'", cityName)
 		c.JSON(http.StatusNotFound, schemas.DiscoverResponse{Found: false, CityName: cityName, ApiURL: ""})
 		return
 	}
 
-	log.Printf("[Registry] Descoberta SUCESSO para cidade '%s': %s (%s)", cityName, service.ApiURL, service.EnterpriseName)
+	// Ordem estável: por empresa e depois por instância
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].EnterpriseName != candidates[j].EnterpriseName {
+			return candidates[i].EnterpriseName < candidates[j].EnterpriseName
+		}
+		return candidates[i].InstanceID < candidates[j].InstanceID
+	})
+
+	first := candidates[0]
+	log.Printf("[Registry] Descoberta SUCESSO para cidade '%s': %d candidato(s)", cityName, len(candidates))
 	c.JSON(http.StatusOK, schemas.DiscoverResponse{
 		Found:          true,
-		CityName:       service.CityManaged,
-		ApiURL:         service.ApiURL,
-		EnterpriseName: service.EnterpriseName,
+		CityName:       first.CityManaged,
+		ApiURL:         first.ApiURL,
+		EnterpriseName: first.EnterpriseName,
+		Location:       first.Location,
+		Candidates:     candidates,
 	})
 }
 
@@ -102,9 +218,13 @@ func handleListServices(c *gin.Context) {
 	defer registryMutex.RUnlock()
 
 	// Para evitar expor a estrutura interna do mapa diretamente e para ter uma lista
-	var servicesList []ServiceInfo
+	now := time.Now()
+	servicesList := make([]ServiceInfo, 0, len(registry))
 	for _, service := range registry {
+		if service.expired(now) {
+			continue // Ainda não removido pela rotina de expiração
+		}
 		servicesList = append(servicesList, service)
 	}
 	c.JSON(http.StatusOK, servicesList)
-}
\ No newline at end of file
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// Replicação entre instâncias do Registry (REGISTRY_PEERS). Cada instância aceita
+// escritas e as envia aos pares; periodicamente também busca o estado completo de
+// cada par (anti-entropia). Em caso de conflito vence o registro mais recente.
+
+const peerTokenHeader = "X-Registry-Peer-Token"
+
+var (
+	peers      []string
+	peerToken  string // Segredo compartilhado entre os pares (REGISTRY_PEER_TOKEN)
+	peerClient = &http.Client{Timeout: 3 * time.Second}
+)
+
+// loadPeers lê REGISTRY_PEERS, uma lista de URLs separadas por vírgula, e o segredo
+// REGISTRY_PEER_TOKEN, obrigatório quando há pares.
+func loadPeers() error {
+	for _, peer := range strings.Split(os.Getenv("REGISTRY_PEERS"), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, strings.TrimRight(peer, "/"))
+		}
+	}
+	peerToken = os.Getenv("REGISTRY_PEER_TOKEN")
+	if len(peers) == 0 {
+		return nil
+	}
+	if peerToken == "" {
+		return errors.New("REGISTRY_PEERS definido sem REGISTRY_PEER_TOKEN: a replicação exige um segredo compartilhado entre os pares")
+	}
+	log.Printf("[Registry] Replicação ativa com os pares: %v", peers)
+	return nil
+}
+
+// requirePeerToken protege os endpoints de replicação, que expõem os IDs dos leases e
+// aceitam escritas. Sem REGISTRY_PEER_TOKEN a replicação fica desativada e todo pedido é recusado.
+func requirePeerToken(c *gin.Context) {
+	if peerToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Replicação desativada nesta instância"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader(peerTokenHeader)), []byte(peerToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token de par inválido"})
+		return
+	}
+	c.Next()
+}
+
+func handleReplicationSnapshot(c *gin.Context) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	c.JSON(http.StatusOK, registrySnapshot{Records: snapshotRecords()})
+}
+
+func handleReplicationPush(c *gin.Context) {
+	var snapshot registrySnapshot
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido", "details": err.Error()})
+		return
+	}
+	applied := mergeRecords(snapshot.Records)
+	c.JSON(http.StatusOK, gin.H{"applied": applied})
+}
+
+// mergeRecords aplica registros vindos de um par e retorna quantos alteraram o estado local.
+// As alterações aplicadas são gravadas em disco, mas não reenviadas (cada par envia as suas).
+func mergeRecords(records []serviceRecord) int {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	now := time.Now().UTC()
+	applied := 0
+	for _, record := range records {
+		local, exists := registry[record.LeaseID]
+		deletedAt, isTombstone := tombstones[record.LeaseID]
+
+		if record.Deleted {
+			if exists && local.UpdatedAt.After(record.UpdatedAt) {
+				continue // Temos uma renovação mais nova que a remoção
+			}
+			if !exists && isTombstone {
+				continue
+			}
+			delete(registry, record.LeaseID)
+			tombstones[record.LeaseID] = record.UpdatedAt
+			if exists {
+				// Uma remoção datada da expiração do lease é o par expirando-o antes de nós
+				eventType := schemas.RegistryEventDeregistered
+				if !record.UpdatedAt.Before(local.ExpiresAt) {
+					eventType = schemas.RegistryEventExpired
+				}
+				emitEvent(eventType, local)
+			}
+			applied++
+			continue
+		}
+
+		if isTombstone && !deletedAt.Before(record.UpdatedAt) {
+			continue // Já removido depois desta versão
+		}
+		if exists && !local.UpdatedAt.Before(record.UpdatedAt) {
+			continue // Versão local é igual ou mais nova
+		}
+		service := record.Service
+		service.LeaseID = record.LeaseID
+		service.UpdatedAt = record.UpdatedAt
+		if service.expired(now) {
+			// Lease já vencido no par: fica só o tombstone, sem REGISTERED para quem observa
+			delete(registry, record.LeaseID)
+			tombstones[record.LeaseID] = service.ExpiresAt
+			if exists {
+				emitEvent(schemas.RegistryEventExpired, local)
+			}
+			applied++
+			continue
+		}
+		registry[record.LeaseID] = service
+		delete(tombstones, record.LeaseID)
+		if !exists {
+			emitEvent(schemas.RegistryEventRegistered, service)
+		} else if local.Metadata != service.Metadata || local.ApiURL != service.ApiURL {
+			emitEvent(schemas.RegistryEventUpdated, service)
+		}
+		applied++
+	}
+
+	if applied > 0 {
+		markDirty()
+	}
+	return applied
+}
+
+// pushToPeers envia as alterações locais a todos os pares, sem bloquear em caso de falha.
+func pushToPeers(changes []serviceRecord) {
+	if len(peers) == 0 || len(changes) == 0 {
+		return
+	}
+	body, err := json.Marshal(registrySnapshot{Records: changes})
+	if err != nil {
+		log.Printf("[Registry] Falha ao serializar alterações para replicação: %v", err)
+		return
+	}
+	for _, peer := range peers {
+		go func(peer string) {
+			req, _ := http.NewRequest(http.MethodPost, peer+"/replication/push", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(peerTokenHeader, peerToken)
+			resp, err := peerClient.Do(req)
+			if err != nil {
+				log.Printf("[Registry] Par %s inacessível ao replicar: %v", peer, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("[Registry] Par %s recusou a replicação: status %s", peer, resp.Status)
+				return
+			}
+			ackTombstones(peer, changes)
+		}(peer)
+	}
+}
+
+// pullFromPeersLoop busca periodicamente o estado completo dos pares, cobrindo
+// alterações perdidas enquanto algum nó estava fora do ar.
+func pullFromPeersLoop(interval time.Duration) {
+	if len(peers) == 0 {
+		return
+	}
+	for {
+		for _, peer := range peers {
+			records, err := fetchPeerSnapshot(peer)
+			if err != nil {
+				log.Printf("[Registry] Falha ao sincronizar com o par %s: %v", peer, err)
+				continue
+			}
+			if applied := mergeRecords(records); applied > 0 {
+				log.Printf("[Registry] %d registro(s) sincronizado(s) a partir do par %s.", applied, peer)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func fetchPeerSnapshot(peer string) ([]serviceRecord, error) {
+	req, _ := http.NewRequest(http.MethodGet, peer+"/replication/snapshot", nil)
+	req.Header.Set(peerTokenHeader, peerToken)
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var snapshot registrySnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot.Records, nil
+}
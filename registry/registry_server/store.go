@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// serviceRecord é o formato usado no disco e na replicação entre instâncias do Registry.
+// Diferente do JSON de /services, inclui o lease e as remoções (tombstones).
+type serviceRecord struct {
+	LeaseID   string      `json:"lease_id"`
+	Service   ServiceInfo `json:"service"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Deleted   bool        `json:"deleted,omitempty"`
+}
+
+// registrySnapshot é o conteúdo do arquivo de dados do Registry.
+type registrySnapshot struct {
+	Records []serviceRecord `json:"records"`
+}
+
+var (
+	// Remoções recentes, mantidas para que a replicação não ressuscite serviços removidos.
+	tombstones = make(map[string]time.Time) // Chave: ID do lease
+	// Pares que já receberam cada tombstone; ele só é descartado depois que todos receberam.
+	tombstoneAcks = make(map[string]map[string]bool) // Chave: ID do lease -> par
+
+	// Alterações ainda não gravadas em disco nem enviadas aos pares
+	pendingChanges []serviceRecord
+	changeSignal   = make(chan struct{}, 1)
+
+	dataFile string // Vazio: persistência desativada
+)
+
+// putService grava ou atualiza um serviço e, se eventType não for vazio, notifica os
+// clientes de /watch. Deve ser chamada com registryMutex travado.
+func putService(service ServiceInfo, eventType string) {
+	service.UpdatedAt = time.Now().UTC()
+	registry[service.LeaseID] = service
+	delete(tombstones, service.LeaseID)
+	markChanged(serviceRecord{LeaseID: service.LeaseID, Service: service, UpdatedAt: service.UpdatedAt})
+	if eventType != "" {
+		emitEvent(eventType, service)
+	}
+}
+
+// removeService remove um serviço e registra o tombstone. Deve ser chamada com registryMutex travado.
+func removeService(leaseID string) {
+	now := time.Now().UTC()
+	if service, found := registry[leaseID]; found {
+		emitEvent(schemas.RegistryEventDeregistered, service)
+	}
+	delete(registry, leaseID)
+	tombstones[leaseID] = now
+	markChanged(serviceRecord{LeaseID: leaseID, UpdatedAt: now, Deleted: true})
+}
+
+// expireService remove um serviço cujo lease expirou. O tombstone leva a data de
+// expiração: uma cópia do lease vinda de um par, sem renovação posterior, não volta.
+// Deve ser chamada com registryMutex travado.
+func expireService(service ServiceInfo) {
+	delete(registry, service.LeaseID)
+	tombstones[service.LeaseID] = service.ExpiresAt
+	markChanged(serviceRecord{LeaseID: service.LeaseID, UpdatedAt: service.ExpiresAt, Deleted: true})
+	emitEvent(schemas.RegistryEventExpired, service)
+}
+
+// ackTombstones registra que o par recebeu as remoções enviadas.
+func ackTombstones(peer string, records []serviceRecord) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	for _, record := range records {
+		if !record.Deleted {
+			continue
+		}
+		if _, ok := tombstones[record.LeaseID]; !ok {
+			continue
+		}
+		if tombstoneAcks[record.LeaseID] == nil {
+			tombstoneAcks[record.LeaseID] = make(map[string]bool)
+		}
+		tombstoneAcks[record.LeaseID][peer] = true
+	}
+}
+
+func markChanged(record serviceRecord) {
+	pendingChanges = append(pendingChanges, record)
+	select {
+	case changeSignal <- struct{}{}:
+	default: // Já existe uma sincronização pendente
+	}
+}
+
+// markDirty agenda a gravação em disco sem replicar nada (ex: expiração, dados vindos de um par).
+// Deve ser chamada com registryMutex travado.
+func markDirty() {
+	select {
+	case changeSignal <- struct{}{}:
+	default:
+	}
+}
+
+// snapshotRecords retorna todos os serviços e tombstones. Deve ser chamada com registryMutex travado (leitura).
+func snapshotRecords() []serviceRecord {
+	records := make([]serviceRecord, 0, len(registry)+len(tombstones))
+	for leaseID, service := range registry {
+		records = append(records, serviceRecord{LeaseID: leaseID, Service: service, UpdatedAt: service.UpdatedAt})
+	}
+	for leaseID, deletedAt := range tombstones {
+		records = append(records, serviceRecord{LeaseID: leaseID, UpdatedAt: deletedAt, Deleted: true})
+	}
+	return records
+}
+
+// syncLoop grava o estado em disco e replica as alterações sempre que algo muda.
+func syncLoop() {
+	for range changeSignal {
+		registryMutex.Lock()
+		changes := pendingChanges
+		pendingChanges = nil
+		snapshot := registrySnapshot{Records: snapshotRecords()}
+		registryMutex.Unlock()
+
+		if err := saveSnapshot(snapshot); err != nil {
+			log.Printf("[Registry] ERRO ao gravar dados em disco: %v", err)
+		}
+		pushToPeers(changes)
+	}
+}
+
+// loadSnapshot restaura o Registry a partir do disco. Leases carregados recebem um TTL
+// novo, para que as APIs possam renová-los sem precisar se registrar de novo.
+func loadSnapshot() error {
+	if dataFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(dataFile)
+	if os.IsNotExist(err) {
+		log.Printf("[Registry] Nenhum arquivo de dados em %s. Iniciando vazio.", dataFile)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("falha ao ler %s: %w", dataFile, err)
+	}
+
+	var snapshot registrySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("falha ao decodificar %s: %w", dataFile, err)
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	minExpiry := time.Now().UTC().Add(leaseTTL)
+	for _, record := range snapshot.Records {
+		if record.Deleted {
+			tombstones[record.LeaseID] = record.UpdatedAt
+			continue
+		}
+		service := record.Service
+		service.LeaseID = record.LeaseID
+		service.UpdatedAt = record.UpdatedAt
+		if service.ExpiresAt.Before(minExpiry) {
+			service.ExpiresAt = minExpiry
+		}
+		registry[record.LeaseID] = service
+	}
+	log.Printf("[Registry] %d serviço(s) restaurado(s) de %s.", len(registry), dataFile)
+	return nil
+}
+
+// saveSnapshot grava o estado de forma atômica (arquivo temporário + rename).
+func saveSnapshot(snapshot registrySnapshot) error {
+	if dataFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dataFile), 0o755); err != nil {
+		return err
+	}
+	tmpFile := dataFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, dataFile)
+}
+
+// purgeTombstones descarta as remoções antigas que todos os pares já receberam e retorna
+// as antigas que algum par ainda não confirmou, para serem reenviadas.
+// Deve ser chamada com registryMutex travado.
+func purgeTombstones(now time.Time) (unacked []serviceRecord) {
+	for leaseID, deletedAt := range tombstones {
+		if now.Sub(deletedAt) <= 10*leaseTTL {
+			continue
+		}
+		if seenByAllPeers(leaseID) {
+			delete(tombstones, leaseID)
+			delete(tombstoneAcks, leaseID)
+			continue
+		}
+		unacked = append(unacked, serviceRecord{LeaseID: leaseID, UpdatedAt: deletedAt, Deleted: true})
+	}
+	return unacked
+}
+
+func seenByAllPeers(leaseID string) bool {
+	for _, peer := range peers {
+		if !tombstoneAcks[leaseID][peer] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Registro de eventos para /watch. Os clientes fazem long-polling informando a última
+// revisão vista e recebem apenas os eventos posteriores.
+
+const maxRetainedEvents = 1000
+
+var (
+	watchMu     sync.Mutex
+	watchEpoch  = uuid.New().String()
+	revision    int64
+	events      []schemas.RegistryEvent // Últimos eventos, em ordem de revisão
+	eventNotify = make(chan struct{})   // Fechado (e substituído) a cada novo evento
+)
+
+// emitEvent registra um evento e acorda os clientes em espera.
+// Deve ser chamada com registryMutex travado, para manter a ordem dos eventos.
+func emitEvent(eventType string, service ServiceInfo) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	revision++
+	events = append(events, schemas.RegistryEvent{Revision: revision, Type: eventType, Service: service.toSchema()})
+	if len(events) > maxRetainedEvents {
+		events = events[len(events)-maxRetainedEvents:]
+	}
+	close(eventNotify)
+	eventNotify = make(chan struct{})
+}
+
+// eventsSince retorna os eventos após a revisão informada. needsReset indica que o
+// cliente está atrasado demais (ou veio de outro epoch) e precisa do estado completo.
+// Deve ser chamada com watchMu travado.
+func eventsSince(epoch string, since int64) (result []schemas.RegistryEvent, needsReset bool) {
+	if epoch != watchEpoch || since > revision {
+		return nil, true
+	}
+	if len(events) > 0 && since < events[0].Revision-1 {
+		return nil, true
+	}
+	for _, event := range events {
+		if event.Revision > since {
+			result = append(result, event)
+		}
+	}
+	return result, false
+}
+
+// handleWatch responde GET /watch?since=<revisão>&epoch=<epoch>&timeout=<segundos>.
+// Segura a requisição até haver eventos novos ou o timeout expirar.
+func handleWatch(c *gin.Context) {
+	since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+	epoch := c.Query("epoch")
+	timeout := 25 * time.Second
+	if seconds, err := strconv.Atoi(c.Query("timeout")); err == nil && seconds > 0 && seconds <= 60 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	deadline := time.After(timeout)
+	for {
+		// Mesma ordem de travas usada por quem emite eventos: registryMutex e depois watchMu
+		registryMutex.RLock()
+		watchMu.Lock()
+		pending, needsReset := eventsSince(epoch, since)
+		currentEpoch, currentRevision, notify := watchEpoch, revision, eventNotify
+		var services []schemas.ServiceInfo
+		if needsReset {
+			now := time.Now()
+			services = make([]schemas.ServiceInfo, 0, len(registry))
+			for _, service := range registry {
+				if !service.expired(now) {
+					services = append(services, service.toSchema())
+				}
+			}
+		}
+		watchMu.Unlock()
+		registryMutex.RUnlock()
+
+		if needsReset {
+			c.JSON(http.StatusOK, schemas.WatchResponse{Epoch: currentEpoch, Revision: currentRevision, Reset: true, Events: []schemas.RegistryEvent{}, Services: services})
+			return
+		}
+		if len(pending) > 0 {
+			c.JSON(http.StatusOK, schemas.WatchResponse{Epoch: currentEpoch, Revision: currentRevision, Events: pending})
+			return
+		}
+
+		select {
+		case <-notify:
+			continue // Novos eventos; monta a resposta de novo
+		case <-deadline:
+			c.JSON(http.StatusOK, schemas.WatchResponse{Epoch: currentEpoch, Revision: currentRevision, Events: []schemas.RegistryEvent{}})
+			return
+		case <-c.Request.Context().Done():
+			return // Cliente desistiu
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package schemas
+
+//go:generate go run ./cmd/schemagen -src . -out generated
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// --- CATÁLOGO DE TIPOS, MENSAGENS E TÓPICOS ---
+//
+// Fonte do contrato publicado por schemas/cmd/schemagen (JSON Schema + AsyncAPI).
+// Um tipo, mensagem ou tópico novo deve ser acrescentado aqui; o gerador falha se
+// alguma struct exportada do pacote ficar de fora.
+
+// AllTypes retorna todas as structs exportadas do pacote.
+func AllTypes() []reflect.Type {
+	values := []any{
+		// Carro <-> API
+		RouteRequest{}, RouteReservationOptions{}, ChosenRouteMsg{}, ReservationStatus{},
+		JourneyFinished{}, ReservationEndMessage{}, Enterprises{}, RouteSegment{},
+		ReservationWindow{}, GeoPoint{}, VehicleProfile{},
+		// Carro -> Worker
+		VehicleSignal{},
+		// API <-> API
+		RemotePrepareRequest{}, RemotePrepareResponse{}, RemoteCommitAbortRequest{},
+		RemoteResult{}, CostUpdatePayload{}, ErrorResponse{},
+		// API <-> Registry
+		RegisterRequest{}, RegistrationAuth{}, ServiceMetadata{}, RegisterResponse{},
+		LeaseRequest{}, ServiceInfo{}, DiscoverResponse{}, RegistryEvent{}, WatchResponse{},
+		// API <-> Worker
+		PrepareReserveWindowCommand{}, CommitCommand{}, AbortCommand{}, PrepareResponse{},
+		VehiclePassedAndChargedEvent{}, MeterValuesEvent{}, SessionEvent{}, NoShowEvent{},
+		ChargingPointInfo{}, ConnectorStatus{},
+		WorkerStatus{}, WorkerCapabilities{}, WorkerHeartbeat{}, WorkerTelemetry{}, ConnectorTelemetry{},
+		QueryScheduleCommand{}, ScheduleResponse{}, ConnectorSchedule{}, ScheduledWindow{},
+		QueryWindowCommand{}, WindowResponse{},
+		// Consultas HTTP
+		NearestChargingPointResponse{}, ActiveReservation{}, TransactionState{}, SegmentOutcome{}, WorkerEntry{},
+		FreeSlotCalendar{}, FreeSlot{}, WindowAvailability{},
+		// Envelope
+		Envelope{},
+	}
+	types := make([]reflect.Type, len(values))
+	for i, v := range values {
+		types[i] = reflect.TypeOf(v)
+	}
+	return types
+}
+
+// messagePayloads associa cada tipo de mensagem ao seu payload.
+var messagePayloads = map[string]any{
+	MsgRouteRequest:            RouteRequest{},
+	MsgRouteOptions:            RouteReservationOptions{},
+	MsgChosenRoute:             ChosenRouteMsg{},
+	MsgReservationStatus:       ReservationStatus{},
+	MsgJourneyFinished:         JourneyFinished{},
+	MsgEnterpriseInfo:          Enterprises{},
+	MsgCarArrived:              VehicleSignal{},
+	MsgCarUnplugged:            VehicleSignal{},
+	MsgPrepareReserveWindow:    PrepareReserveWindowCommand{},
+	MsgCommit:                  CommitCommand{},
+	MsgAbort:                   AbortCommand{},
+	MsgPrepareResponse:         PrepareResponse{},
+	MsgVehiclePassedAndCharged: VehiclePassedAndChargedEvent{},
+	MsgMeterValues:             MeterValuesEvent{},
+	MsgVehicleArrived:          SessionEvent{},
+	MsgVehiclePluggedIn:        SessionEvent{},
+	MsgVehicleUnplugged:        SessionEvent{},
+	MsgVehicleNoShow:           NoShowEvent{},
+	MsgChargingPointInfo:       ChargingPointInfo{},
+	MsgWorkerStatus:            WorkerStatus{},
+	MsgWorkerHeartbeat:         WorkerHeartbeat{},
+	MsgWorkerTelemetry:         WorkerTelemetry{},
+	MsgQuerySchedule:           QueryScheduleCommand{},
+	MsgQueryWindow:             QueryWindowCommand{},
+	MsgScheduleResponse:        ScheduleResponse{},
+	MsgWindowResponse:          WindowResponse{},
+	MsgRemotePrepare:           RemotePrepareRequest{},
+	MsgRemotePrepareResponse:   RemotePrepareResponse{},
+	MsgRemoteCommit:            RemoteCommitAbortRequest{},
+	MsgRemoteAbort:             RemoteCommitAbortRequest{},
+	MsgRemoteResult:            RemoteResult{},
+	MsgSegmentCompletion:       CostUpdatePayload{},
+}
+
+// MessageTypes retorna os tipos de mensagem conhecidos, em ordem alfabética.
+func MessageTypes() []string {
+	types := make([]string, 0, len(messagePayloads))
+	for msgType := range messagePayloads {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// PayloadType retorna o tipo Go do payload de msgType.
+func PayloadType(msgType string) (reflect.Type, bool) {
+	payload, ok := messagePayloads[msgType]
+	if !ok {
+		return nil, false
+	}
+	return reflect.TypeOf(payload), true
+}
+
+var (
+	payloadSchemas   = make(map[string]*JSONSchema)
+	payloadSchemasMu sync.Mutex
+	envelopeSchema   = sync.OnceValue(func() *JSONSchema { return SchemaFor(Envelope{}) })
+)
+
+// PayloadSchema retorna o JSON Schema do payload de msgType (gerado uma vez e reaproveitado).
+func PayloadSchema(msgType string) (*JSONSchema, bool) {
+	payloadSchemasMu.Lock()
+	defer payloadSchemasMu.Unlock()
+	if schema, ok := payloadSchemas[msgType]; ok {
+		return schema, true
+	}
+	payload, ok := messagePayloads[msgType]
+	if !ok {
+		return nil, false
+	}
+	schema := SchemaFor(payload)
+	payloadSchemas[msgType] = schema
+	return schema, true
+}
+
+// Channel descreve um tópico MQTT: quem publica, quem assina e quais mensagens trafegam.
+type Channel struct {
+	Name        string            // Identificador do canal no documento AsyncAPI
+	Address     string            // Tópico, com parâmetros entre chaves
+	Description string            // Finalidade do tópico
+	Parameters  map[string]string // Parâmetro -> descrição
+	Publisher   string            // Componente que publica
+	Subscriber  string            // Componente que assina
+	Messages    []string          // Tipos de mensagem
+	Retained    bool              // Mensagens publicadas como retidas
+	LegacyOnly  bool              // Sempre no formato legado (sem envelope)
+}
+
+var (
+	paramEnterprise = map[string]string{"enterprise": "Nome da empresa (ENTERPRISE_NAME da API)"}
+	paramVehicle    = map[string]string{"vehicleId": "ID do veículo"}
+	paramTx         = map[string]string{"transactionId": "ID da transação da reserva"}
+	paramWorker     = map[string]string{
+		"enterprise": "Nome da empresa dona do ponto de recarga",
+		"workerId":   "ID do charging point worker",
+	}
+)
+
+// Channels lista todos os tópicos MQTT do sistema.
+var Channels = []Channel{
+	{
+		Name: "enterpriseList", Address: "car/enterprises",
+		Description: "Lista de empresas e cidades atendidas, republicada periodicamente a partir do Registry.",
+		Publisher:   "listEnterprises", Subscriber: "car",
+		Messages: []string{MsgEnterpriseInfo}, LegacyOnly: true,
+	},
+	{
+		Name: "routeRequest", Address: "{enterprise}", Parameters: paramEnterprise,
+		Description: "Pedido de rotas possíveis entre origem e destino.",
+		Publisher:   "car", Subscriber: "api",
+		Messages: []string{MsgRouteRequest},
+	},
+	{
+		Name: "routeOptions", Address: "{vehicleId}", Parameters: paramVehicle,
+		Description: "Rotas possíveis para o pedido do veículo.",
+		Publisher:   "api", Subscriber: "car",
+		Messages: []string{MsgRouteOptions},
+	},
+	{
+		Name: "chosenRoute", Address: "car/route/{enterprise}", Parameters: paramEnterprise,
+		Description: "Rota escolhida pelo veículo; inicia o 2PC de reserva.",
+		Publisher:   "car", Subscriber: "api",
+		Messages: []string{MsgChosenRoute},
+	},
+	{
+		Name: "reservationStatus", Address: "car/reservation/status/{vehicleId}", Parameters: paramVehicle,
+		Description: "Resultado do 2PC de reserva (CONFIRMED ou REJECTED).",
+		Publisher:   "api", Subscriber: "car",
+		Messages: []string{MsgReservationStatus},
+	},
+	{
+		Name: "journeyFinished", Address: "car/journey/finished/{vehicleId}", Parameters: paramVehicle,
+		Description: "Fim do trajeto, com o custo total das recargas.",
+		Publisher:   "api", Subscriber: "car",
+		Messages: []string{MsgJourneyFinished},
+	},
+	{
+		Name: "carSession", Address: "car/session/{transactionId}", Parameters: paramTx,
+		Description: "Chegada e saída do veículo em cada trecho confirmado. O worker da reserva conecta o veículo após a chegada e o desconecta na saída.",
+		Publisher:   "car", Subscriber: "cpworker",
+		Messages: []string{MsgCarArrived, MsgCarUnplugged},
+	},
+	{
+		Name: "workerCommand", Address: "enterprise/{enterprise}/cp/{workerId}/command", Parameters: paramWorker,
+		Description: "Comandos do 2PC local enviados ao ponto de recarga e consultas à sua agenda (request/reply).",
+		Publisher:   "api", Subscriber: "cpworker",
+		Messages: []string{MsgPrepareReserveWindow, MsgCommit, MsgAbort, MsgQuerySchedule, MsgQueryWindow},
+	},
+	{
+		Name: "workerReply", Address: "replies/{requesterId}",
+		Parameters:  map[string]string{"requesterId": "ID da instância da API que fez o pedido (response_topic do comando)"},
+		Description: "Respostas request/reply dos workers, associadas ao pedido pelo correlation_id.",
+		Publisher:   "cpworker", Subscriber: "api",
+		Messages: []string{MsgPrepareResponse, MsgScheduleResponse, MsgWindowResponse},
+	},
+	{
+		Name: "workerEvent", Address: "enterprise/{enterprise}/cp/{workerId}/event", Parameters: paramWorker,
+		Description: "Eventos do ponto de recarga: chegada, conexão e desconexão do veículo, leituras do medidor, a cobrança ao final e o não comparecimento.",
+		Publisher:   "cpworker", Subscriber: "api",
+		Messages: []string{MsgVehicleArrived, MsgVehiclePluggedIn, MsgMeterValues, MsgVehicleUnplugged, MsgVehiclePassedAndCharged, MsgVehicleNoShow},
+	},
+	{
+		Name: "workerInfo", Address: "enterprise/{enterprise}/cp/{workerId}/info", Parameters: paramWorker,
+		Description: "Dados do ponto de recarga, incluindo a versão de mensagem que ele entende e a ocupação de cada conector. Republicada a cada mudança.",
+		Publisher:   "cpworker", Subscriber: "api",
+		Messages: []string{MsgChargingPointInfo}, Retained: true, LegacyOnly: true,
+	},
+	{
+		Name: "workerStatus", Address: "enterprise/{enterprise}/cp/{workerId}/status", Parameters: paramWorker,
+		Description: "Presença do ponto de recarga: \"online\" a cada conexão (birth) e \"offline\" pelo last will ou ao desligar.",
+		Publisher:   "cpworker", Subscriber: "api",
+		Messages: []string{MsgWorkerStatus}, Retained: true,
+	},
+	{
+		Name: "workerHeartbeat", Address: "enterprise/{enterprise}/cp/{workerId}/heartbeat", Parameters: paramWorker,
+		Description: "Heartbeat periódico com as capacidades do ponto de recarga. Sem heartbeat por três intervalos, a API o considera offline.",
+		Publisher:   "cpworker", Subscriber: "api",
+		Messages: []string{MsgWorkerHeartbeat},
+	},
+	{
+		Name: "workerTelemetry", Address: "enterprise/{enterprise}/cp/{workerId}/telemetry", Parameters: paramWorker,
+		Description: "Estado (Available, Occupied, Faulted, Unavailable) e medições (tensão, corrente, potência, temperatura) de cada conector. A API não manda PREPARE a pontos de recarga em falha e transfere as suas reservas.",
+		Publisher:   "cpworker", Subscriber: "api",
+		Messages: []string{MsgWorkerTelemetry},
+	},
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+const componentsPrefix = "#/components/schemas/"
+
+// buildAsyncAPI descreve todos os tópicos de schemas.Channels em AsyncAPI 3.0. Cada canal
+// tem uma operação "send" do componente que publica e uma "receive" do que assina.
+func buildAsyncAPI(docs typeDocs) map[string]any {
+	builder := schemas.NewSchemaBuilder(componentsPrefix)
+	for _, t := range schemas.AllTypes() {
+		builder.SchemaOf(t)
+	}
+	for name, def := range builder.Defs {
+		docs.annotate(name, def)
+	}
+
+	// Mensagens que só trafegam sem envelope
+	legacyOnly := make(map[string]bool)
+	enveloped := make(map[string]bool)
+	for _, channel := range schemas.Channels {
+		for _, msgType := range channel.Messages {
+			if channel.LegacyOnly {
+				legacyOnly[msgType] = true
+			} else {
+				enveloped[msgType] = true
+			}
+		}
+	}
+
+	messages := make(map[string]any)
+	for _, msgType := range schemas.MessageTypes() {
+		payloadType, _ := schemas.PayloadType(msgType)
+		payloadRef := &schemas.JSONSchema{Ref: componentsPrefix + payloadType.Name()}
+		message := map[string]any{
+			"name":        msgType,
+			"title":       msgType,
+			"contentType": "application/json",
+		}
+		if legacyOnly[msgType] && !enveloped[msgType] {
+			message["summary"] = "Publicada sem envelope (formato legado)."
+			message["payload"] = payloadRef
+		} else {
+			message["summary"] = fmt.Sprintf("Envelope versão %d com payload %s. Versão 0: apenas o payload.", schemas.ProtocolVersion, payloadType.Name())
+			message["payload"] = envelopeFor(builder.Defs["Envelope"], msgType, payloadRef)
+			message["x-legacy-payload"] = payloadRef
+		}
+		messages[msgType] = message
+	}
+
+	channels := make(map[string]any)
+	operations := make(map[string]any)
+	for _, channel := range schemas.Channels {
+		channelMessages := make(map[string]any)
+		var operationMessages []any
+		for _, msgType := range channel.Messages {
+			channelMessages[msgType] = map[string]string{"$ref": "#/components/messages/" + msgType}
+			operationMessages = append(operationMessages, map[string]string{"$ref": "#/channels/" + channel.Name + "/messages/" + msgType})
+		}
+
+		entry := map[string]any{
+			"address":     channel.Address,
+			"description": channel.Description,
+			"messages":    channelMessages,
+		}
+		if len(channel.Parameters) > 0 {
+			parameters := make(map[string]any)
+			for name, description := range channel.Parameters {
+				parameters[name] = map[string]string{"description": description}
+			}
+			entry["parameters"] = parameters
+		}
+		channels[channel.Name] = entry
+
+		// O QoS vem da mesma tabela usada pelo cliente MQTT (api/mqtt.DefaultTopicQoS)
+		bindings := map[string]any{"qos": mqtt.QoSFor(channel.Address), "retain": channel.Retained}
+
+		channelRef := map[string]string{"$ref": "#/channels/" + channel.Name}
+		operations[channel.Publisher+"Send"+capitalize(channel.Name)] = map[string]any{
+			"action":   "send",
+			"channel":  channelRef,
+			"messages": operationMessages,
+			"summary":  fmt.Sprintf("%s publica em %s", channel.Publisher, channel.Address),
+			"tags":     []map[string]string{{"name": channel.Publisher}},
+			"bindings": map[string]any{"mqtt": bindings},
+		}
+		operations[channel.Subscriber+"Receive"+capitalize(channel.Name)] = map[string]any{
+			"action":   "receive",
+			"channel":  channelRef,
+			"messages": operationMessages,
+			"summary":  fmt.Sprintf("%s assina %s", channel.Subscriber, channel.Address),
+			"tags":     []map[string]string{{"name": channel.Subscriber}},
+		}
+	}
+
+	return map[string]any{
+		"asyncapi": "3.0.0",
+		"info": map[string]any{
+			"title":   "PBL-2 - Mensagens MQTT",
+			"version": fmt.Sprintf("%d", schemas.ProtocolVersion),
+			"description": "Tópicos MQTT entre carros, APIs das empresas e charging point workers. " +
+				"Gerado por schemas/cmd/schemagen a partir do pacote schemas; não edite à mão.",
+		},
+		"defaultContentType": "application/json",
+		"channels":           channels,
+		"operations":         operations,
+		"components": map[string]any{
+			"messages": messages,
+			"schemas":  builder.Defs,
+		},
+	}
+}
+
+// envelopeFor especializa o schema do envelope para um tipo de mensagem.
+func envelopeFor(envelope *schemas.JSONSchema, msgType string, payload *schemas.JSONSchema) *schemas.JSONSchema {
+	properties := make(map[string]*schemas.JSONSchema, len(envelope.Properties))
+	for name, prop := range envelope.Properties {
+		properties[name] = prop
+	}
+	properties["type"] = &schemas.JSONSchema{Type: "string", Const: msgType}
+	properties["version"] = &schemas.JSONSchema{Type: "integer", Const: schemas.ProtocolVersion}
+	properties["payload"] = payload
+	return &schemas.JSONSchema{
+		Type:                 "object",
+		Description:          envelope.Description,
+		Properties:           properties,
+		Required:             envelope.Required,
+		AdditionalProperties: false,
+	}
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
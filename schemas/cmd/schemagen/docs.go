@@ -0,0 +1,100 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// typeDoc é a documentação de uma struct extraída do código-fonte.
+type typeDoc struct {
+	doc    string
+	fields map[string]string // Nome JSON do campo -> comentário
+}
+
+// typeDocs indexa a documentação por nome da struct.
+type typeDocs map[string]typeDoc
+
+// parseTypeDocs lê as structs exportadas do pacote em dir, com seus comentários.
+func parseTypeDocs(dir string) (typeDocs, error) {
+	fset := token.NewFileSet()
+	notTest := func(info os.FileInfo) bool { return !strings.HasSuffix(info.Name(), "_test.go") }
+	pkgs, err := parser.ParseDir(fset, dir, notTest, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make(typeDocs)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					typeSpec := spec.(*ast.TypeSpec)
+					structType, ok := typeSpec.Type.(*ast.StructType)
+					if !ok || !typeSpec.Name.IsExported() {
+						continue
+					}
+					doc := typeSpec.Doc
+					if doc == nil {
+						doc = gen.Doc
+					}
+					docs[typeSpec.Name.Name] = typeDoc{doc: cleanDoc(doc), fields: fieldDocs(structType)}
+				}
+			}
+		}
+	}
+	return docs, nil
+}
+
+func fieldDocs(structType *ast.StructType) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range structType.Fields.List {
+		comment := cleanDoc(field.Comment)
+		if comment == "" {
+			comment = cleanDoc(field.Doc)
+		}
+		if comment == "" || len(field.Names) == 0 {
+			continue
+		}
+		jsonName := field.Names[0].Name
+		if field.Tag != nil {
+			tag, _ := strconv.Unquote(field.Tag.Value)
+			if name := strings.Split(reflect.StructTag(tag).Get("json"), ",")[0]; name != "" {
+				jsonName = name
+			}
+		}
+		fields[jsonName] = comment
+	}
+	return fields
+}
+
+func cleanDoc(group *ast.CommentGroup) string {
+	if group == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(group.Text()), " ")
+}
+
+// annotate preenche as descrições do schema da struct name e de suas propriedades.
+func (d typeDocs) annotate(name string, schema *schemas.JSONSchema) {
+	doc, ok := d[name]
+	if !ok {
+		return
+	}
+	schema.Description = doc.doc
+	for prop, propSchema := range schema.Properties {
+		if comment, ok := doc.fields[prop]; ok && propSchema.Ref == "" {
+			propSchema.Description = comment
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Comando schemagen gera o contrato das interfaces de mensagens a partir do pacote schemas:
+// um JSON Schema por struct (json/<Tipo>.schema.json) e um documento AsyncAPI com todos
+// os tópicos MQTT (asyncapi.json).
+//
+// Uso (a partir de schemas/): go generate ./...  ou  go run ./cmd/schemagen -check
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+func main() {
+	srcDir := flag.String("src", ".", "diretório com o código-fonte do pacote schemas")
+	outDir := flag.String("out", "generated", "diretório de saída")
+	check := flag.Bool("check", false, "apenas confere se os arquivos gerados estão atualizados")
+	flag.Parse()
+
+	docs, err := parseTypeDocs(*srcDir)
+	if err != nil {
+		log.Fatalf("schemagen: %v", err)
+	}
+	if err := checkCatalog(docs); err != nil {
+		log.Fatalf("schemagen: %v", err)
+	}
+
+	files := make(map[string][]byte)
+	for _, t := range schemas.AllTypes() {
+		schema := schemas.SchemaForType(t)
+		schema.ID = t.Name() + ".schema.json"
+		docs.annotate(t.Name(), schema)
+		for name, def := range schema.Defs {
+			docs.annotate(name, def)
+		}
+		files[filepath.Join("json", schema.ID)] = mustMarshal(schema)
+	}
+	files["asyncapi.json"] = mustMarshal(buildAsyncAPI(docs))
+
+	if *check {
+		if stale := staleFiles(*outDir, files); len(stale) > 0 {
+			log.Fatalf("schemagen: arquivos desatualizados (rode go generate em schemas/): %v", stale)
+		}
+		log.Printf("schemagen: %d arquivos atualizados.", len(files))
+		return
+	}
+	if err := writeFiles(*outDir, files); err != nil {
+		log.Fatalf("schemagen: %v", err)
+	}
+	log.Printf("schemagen: %d arquivos gerados em %s.", len(files), *outDir)
+}
+
+// contractTypes são as structs que descrevem o próprio contrato, não mensagens.
+var contractTypes = map[string]bool{"JSONSchema": true, "SchemaBuilder": true, "SchemaError": true, "Channel": true}
+
+// checkCatalog garante que toda struct exportada do pacote está em schemas.AllTypes.
+func checkCatalog(docs typeDocs) error {
+	cataloged := make(map[string]bool)
+	for _, t := range schemas.AllTypes() {
+		cataloged[t.Name()] = true
+	}
+	var missing []string
+	for name := range docs {
+		if !cataloged[name] && !contractTypes[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("structs fora de schemas.AllTypes: %v", missing)
+	}
+	return nil
+}
+
+func mustMarshal(v any) []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatalf("schemagen: falha ao serializar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func staleFiles(outDir string, files map[string][]byte) []string {
+	var stale []string
+	for name, content := range files {
+		current, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil || !bytes.Equal(current, content) {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func writeFiles(outDir string, files map[string][]byte) error {
+	// Recria o diretório json/ para não deixar schemas de tipos removidos
+	if err := os.RemoveAll(filepath.Join(outDir, "json")); err != nil {
+		return err
+	}
+	for name, content := range files {
+		path := filepath.Join(outDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			return fmt.Errorf("falha ao escrever %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package schemas
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,9 +25,20 @@ type RouteReservationOptions struct {
 
 // ChosenRouteMsg é a mensagem que o carro envia de volta com a rota escolhida.
 type ChosenRouteMsg struct {
-	RequestID string         `json:"request_id"`
-	VehicleID string         `json:"vehicle_id"`
-	Route     []RouteSegment `json:"route"`
+	RequestID string          `json:"request_id"`
+	VehicleID string          `json:"vehicle_id"`
+	Route     []RouteSegment  `json:"route"`
+	Vehicle   *VehicleProfile `json:"vehicle,omitempty"` // Dados da bateria, usados na simulação da recarga
+}
+
+// VehicleProfile descreve a bateria do veículo. O ponto de recarga usa esses dados para
+// calcular a curva de potência e a energia entregue durante a sessão.
+type VehicleProfile struct {
+	BatteryCapacityKWh float64 `json:"battery_capacity_kwh"`     // Capacidade útil da bateria
+	StateOfChargePct   float64 `json:"state_of_charge_pct"`      // Carga ao chegar no posto (0-100)
+	TargetSOCPct       float64 `json:"target_soc_pct,omitempty"` // Carga em que a sessão é encerrada (padrão: 100)
+	MaxChargePowerKW   float64 `json:"max_charge_power_kw"`      // Potência máxima aceita pelo veículo
+	ConnectorType      string  `json:"connector_type,omitempty"` // CCS2, Type2 ou CHAdeMO; vazio aceita qualquer conector
 }
 
 // ReservationStatus é a mensagem final da API para o carro, confirmando ou negando a reserva.
@@ -37,6 +51,15 @@ type ReservationStatus struct {
 	ConfirmedRoute []RouteSegment `json:"confirmed_route,omitempty"` // Rota confirmada, se aplicável
 }
 
+// JourneyFinished é enviada ao carro quando todos os trechos da viagem foram concluídos.
+type JourneyFinished struct {
+	Status        string  `json:"status"` // "completed"
+	TransactionID string  `json:"transaction_id"`
+	Message       string  `json:"message"`
+	TotalCost     float64 `json:"total_cost,omitempty"`
+	TotalEnergy   float64 `json:"total_energy_kwh,omitempty"` // Energia entregue em todos os trechos
+}
+
 // ReservationEndMessage é enviada quando uma janela de reserva expira.
 type ReservationEndMessage struct {
 	VehicleID     string    `json:"vehicle_id"`
@@ -55,6 +78,7 @@ type RemotePrepareRequest struct {
 	City              string            `json:"city"`
 	ReservationWindow ReservationWindow `json:"reservation_window"`
 	CoordinatorURL    string            `json:"coordinator_url"` // Campo adicionado
+	Vehicle           *VehicleProfile   `json:"vehicle,omitempty"`
 }
 
 // RemotePrepareResponse é a resposta para a chamada /2pc_remote/prepare.
@@ -62,6 +86,9 @@ type RemotePrepareResponse struct {
 	Status        string `json:"status"` // "PREPARED" ou "REJECTED"
 	TransactionID string `json:"transaction_id"`
 	Reason        string `json:"reason,omitempty"`
+	Code          string `json:"code,omitempty"`      // Motivo da rejeição (TxErr*)
+	Retryable     bool   `json:"retryable,omitempty"` // A mesma requisição pode ser repetida mais tarde
+	Duplicate     bool   `json:"duplicate,omitempty"` // A transação já estava preparada
 }
 
 // RemoteCommitAbortRequest é o payload para as chamadas /2pc_remote/commit e /2pc_remote/abort.
@@ -69,42 +96,216 @@ type RemoteCommitAbortRequest struct {
 	TransactionID string `json:"transaction_id"`
 }
 
-// CostUpdatePayload é o payload para a chamada /cost-update.
+// RemoteResult é a resposta de /2pc_remote/commit e /2pc_remote/abort.
+type RemoteResult struct {
+	Status        string `json:"status"` // Estado da transação no participante, ou REJECTED
+	TransactionID string `json:"transaction_id"`
+	Reason        string `json:"reason,omitempty"`
+	Code          string `json:"code,omitempty"`      // Motivo da rejeição (TxErr*)
+	Retryable     bool   `json:"retryable,omitempty"` // A mesma requisição pode ser repetida mais tarde
+	Duplicate     bool   `json:"duplicate,omitempty"` // A transação já estava no estado pedido
+}
+
+// Códigos de rejeição das rotas /2pc_remote/*. Só TxErrPrepareInProgress e
+// TxErrWorkerUnavailable são temporários: os demais não mudam se a mesma requisição for repetida.
+const (
+	TxErrInvalidPayload     = "INVALID_PAYLOAD"
+	TxErrWrongCity          = "WRONG_CITY"          // A API não gerencia a cidade pedida
+	TxErrNoCapacity         = "NO_CAPACITY"         // Nenhum posto atende a janela
+	TxErrUnknownTransaction = "UNKNOWN_TRANSACTION" // COMMIT de uma transação não preparada aqui
+	TxErrAlreadyAborted     = "ALREADY_ABORTED"     // Inclusive por timeout do PREPARE
+	TxErrAlreadyCommitted   = "ALREADY_COMMITTED"
+	TxErrPrepareInProgress  = "PREPARE_IN_PROGRESS" // O PREPARE da transação ainda está em curso
+	TxErrWorkerUnavailable  = "WORKER_UNAVAILABLE"  // Nenhum worker online ou sem resposta ao PREPARE
+	TxErrForbidden          = "FORBIDDEN"           // A empresa autenticada não é o coordenador (ou o participante) da transação
+)
+
+// CostUpdatePayload é o custo de um trecho concluído, enviado ao coordenador em
+// /report-segment-completion.
 type CostUpdatePayload struct {
 	TransactionID string  `json:"transaction_id"`
 	SegmentCity   string  `json:"segment_city"`
-	Cost          float64 `json:"cost"`
+	Cost          float64 `json:"cost"`                 // Custo total do trecho, taxa de ociosidade inclusa
+	EnergyKWh     float64 `json:"energy_kwh,omitempty"` // Energia medida pelo ponto de recarga no trecho
+	Status        string  `json:"status,omitempty"`     // Desfecho do trecho (SegmentCharged se vazio)
+	IdleFee       float64 `json:"idle_fee,omitempty"`   // Taxa de ociosidade cobrada no trecho
 }
 
+// Desfechos de um trecho, gravados no ledger com UpdateChargingSegment.
+const (
+	SegmentCharged            = "CHARGED"
+	SegmentChargedWithIdleFee = "CHARGED_WITH_IDLE_FEE"
+	SegmentNoShow             = "NO_SHOW"
+)
+
 // --- ESTRUTURAS DO REGISTRY DE SERVIÇOS ---
 
 // RegisterRequest é o payload para registrar uma API no serviço de Registry.
 type RegisterRequest struct {
-	CityManaged    string `json:"city_managed"`    // A cidade que esta API gerencia
-	ApiURL         string `json:"api_url"`         // A URL base da API (ex: http://solatlantico:8080)
-	EnterpriseName string `json:"enterprise_name"` // Nome da empresa/API
+	CityManaged    string    `json:"city_managed"`       // A cidade que esta API gerencia
+	ApiURL         string    `json:"api_url"`            // A URL base da API (ex: http://solatlantico:8080)
+	EnterpriseName string    `json:"enterprise_name"`    // Nome da empresa/API
+	Location       *GeoPoint `json:"location,omitempty"` // Coordenadas da cidade gerenciada
+	// Identifica a réplica da API; várias instâncias da mesma empresa podem atender a mesma cidade.
+	// Se vazio, o Registry usa a ApiURL.
+	InstanceID      string          `json:"instance_id,omitempty"`
+	Metadata        ServiceMetadata `json:"metadata"`
+	ProtocolVersion int             `json:"protocol_version,omitempty"` // Maior versão de mensagem entendida pela API
+	// Prova de identidade da empresa, assinada com a chave da sua identidade MSP na Fabric
+	Auth *RegistrationAuth `json:"auth,omitempty"`
+}
+
+// RegistrationAuth carrega o certificado MSP da empresa e a assinatura do registro.
+type RegistrationAuth struct {
+	MSPID          string    `json:"msp_id"`
+	CertificatePEM string    `json:"certificate_pem"`
+	Timestamp      time.Time `json:"timestamp"` // Limita a janela em que uma assinatura capturada pode ser reenviada
+	Signature      []byte    `json:"signature"` // ECDSA (ASN.1) sobre o SHA-256 de SigningBytes
+}
+
+// SigningBytes retorna a forma canônica dos campos protegidos pela assinatura do registro.
+// Metadados ficam de fora: mudam a cada renovação e não decidem para onde o tráfego vai.
+func (r RegisterRequest) SigningBytes(mspID string, timestamp time.Time) []byte {
+	location := ""
+	if r.Location != nil {
+		location = strconv.FormatFloat(r.Location.Latitude, 'f', -1, 64) + "," + strconv.FormatFloat(r.Location.Longitude, 'f', -1, 64)
+	}
+	return []byte(strings.Join([]string{
+		"pbl-registry-register-v1",
+		r.CityManaged,
+		r.ApiURL,
+		r.EnterpriseName,
+		r.InstanceID,
+		location,
+		mspID,
+		timestamp.UTC().Format(time.RFC3339Nano),
+	}, "\n"))
+}
+
+// ServiceMetadata traz as informações usadas pelo coordenador para escolher entre operadores concorrentes.
+type ServiceMetadata struct {
+	PricePerKWh    float64 `json:"price_per_kwh"`
+	AvailablePosts int     `json:"available_posts"`
+}
+
+// RegisterResponse é a resposta do Registry a um registro ou renovação bem-sucedidos.
+// A API deve renovar o lease (POST /renew) antes de TTLSeconds, senão é removida.
+type RegisterResponse struct {
+	Message    string `json:"message"`
+	LeaseID    string `json:"lease_id"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+// LeaseRequest é o payload de /renew e /deregister.
+type LeaseRequest struct {
+	LeaseID  string           `json:"lease_id"`
+	Metadata *ServiceMetadata `json:"metadata,omitempty"` // Atualiza os metadados na renovação
+}
+
+// ServiceInfo descreve uma API registrada no Registry (retornada por /services).
+type ServiceInfo struct {
+	CityManaged     string          `json:"city_managed"`
+	ApiURL          string          `json:"api_url"`
+	EnterpriseName  string          `json:"enterprise_name"`
+	InstanceID      string          `json:"instance_id"`
+	Location        *GeoPoint       `json:"location,omitempty"`
+	Metadata        ServiceMetadata `json:"metadata"`
+	ProtocolVersion int             `json:"protocol_version,omitempty"`
+	Owner           string          `json:"owner,omitempty"` // Identidade MSP que registrou o serviço ("MSPID/CN")
 }
 
 // DiscoverResponse é a resposta do serviço de Registry para uma consulta.
+// Os campos de primeiro nível descrevem o primeiro candidato; Candidates traz
+// todos os operadores e instâncias ativos para a cidade.
 type DiscoverResponse struct {
-	CityName       string `json:"city_name"`
-	ApiURL         string `json:"api_url"`
-	EnterpriseName string `json:"enterprise_name,omitempty"`
-	Found          bool   `json:"found"`
+	CityName       string        `json:"city_name"`
+	ApiURL         string        `json:"api_url"`
+	EnterpriseName string        `json:"enterprise_name,omitempty"`
+	Location       *GeoPoint     `json:"location,omitempty"`
+	Found          bool          `json:"found"`
+	Candidates     []ServiceInfo `json:"candidates,omitempty"`
+}
+
+// Tipos de evento emitidos por /watch no Registry.
+const (
+	RegistryEventRegistered   = "REGISTERED"
+	RegistryEventUpdated      = "UPDATED"
+	RegistryEventDeregistered = "DEREGISTERED"
+	RegistryEventExpired      = "EXPIRED"
+)
+
+// RegistryEvent é uma alteração no conjunto de serviços do Registry.
+type RegistryEvent struct {
+	Revision int64       `json:"revision"`
+	Type     string      `json:"type"`
+	Service  ServiceInfo `json:"service"`
+}
+
+// WatchResponse é a resposta de /watch (long-polling). Quando Reset é true, o cliente
+// deve descartar sua visão local e usar Services como estado completo.
+type WatchResponse struct {
+	Epoch    string          `json:"epoch"` // Muda quando o Registry reinicia; revisões de epochs diferentes não se comparam
+	Revision int64           `json:"revision"`
+	Reset    bool            `json:"reset"`
+	Events   []RegistryEvent `json:"events"`
+	Services []ServiceInfo   `json:"services,omitempty"`
 }
 
 // --- ESTRUTURAS E COMPONENTES COMUNS ---
 
+// GeoPoint é uma coordenada geográfica em graus decimais (WGS84).
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// ParseGeoPoint converte latitude e longitude em texto (ex: variáveis de ambiente) em um GeoPoint.
+// Retorna nil sem erro se ambos estiverem vazios.
+func ParseGeoPoint(latitude, longitude string) (*GeoPoint, error) {
+	if latitude == "" && longitude == "" {
+		return nil, nil
+	}
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("latitude inválida: '%s'", latitude)
+	}
+	lon, err := strconv.ParseFloat(longitude, 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, fmt.Errorf("longitude inválida: '%s'", longitude)
+	}
+	return &GeoPoint{Latitude: lat, Longitude: lon}, nil
+}
+
 // Enterprises representa uma empresa disponível no sistema.
 type Enterprises struct {
-	Name string `json:"name"`
-	City string `json:"city"`
+	Name            string    `json:"name"`
+	City            string    `json:"city"`
+	Location        *GeoPoint `json:"location,omitempty"`
+	ProtocolVersion int       `json:"protocol_version,omitempty"` // Maior versão de mensagem entendida pela API da empresa
 }
 
 // RouteSegment define um trecho da rota a ser reservado.
 type RouteSegment struct {
 	City              string            `json:"city"`
 	ReservationWindow ReservationWindow `json:"reservation_window"`
+	Location          *GeoPoint         `json:"location,omitempty"`    // Coordenadas da cidade do trecho
+	DistanceKm        float64           `json:"distance_km,omitempty"` // Distância desde o trecho anterior
+}
+
+// ChargingPointInfo é publicada (retida) por cada worker para anunciar sua localização.
+type ChargingPointInfo struct {
+	WorkerID        string            `json:"worker_id"`
+	Enterprise      string            `json:"enterprise"`
+	Location        *GeoPoint         `json:"location,omitempty"`
+	ProtocolVersion int               `json:"protocol_version,omitempty"` // Maior versão de mensagem entendida pelo worker (0: legado)
+	Connectors      []ConnectorStatus `json:"connectors,omitempty"`       // Conectores e sua ocupação
+}
+
+// NearestChargingPointResponse é a resposta de /charging-points/nearest.
+type NearestChargingPointResponse struct {
+	ChargingPoint ChargingPointInfo `json:"charging_point"`
+	City          string            `json:"city"`
+	DistanceKm    float64           `json:"distance_km"`
 }
 
 // ReservationWindow define o início e o fim de uma reserva.
@@ -120,9 +321,14 @@ type ActiveReservation struct {
 	RequestID         string            `json:"request_id"`
 	City              string            `json:"city"`
 	ReservationWindow ReservationWindow `json:"reservation_window"`
-	Status            string            `json:"status"`    // Ex: "PREPARED", "COMMITTED"
-	CoordinatorURL    string            `json:"-"`         // URL do coordenador, não precisa ser exposto no JSON de status.
-	WorkerID          string            `json:"worker_id"` // ID do worker que processou a reserva
+	Status            string            `json:"status"`                  // Ex: "PREPARED", "COMMITTED"; encerrada: StatusReservationCharged ou StatusReservationNoShow
+	CoordinatorURL    string            `json:"-"`                       // URL do coordenador, não precisa ser exposto no JSON de status.
+	WorkerID          string            `json:"worker_id"`               // ID do worker que processou a reserva
+	ConnectorID       int               `json:"connector_id,omitempty"`  // Conector reservado no worker
+	AttemptID         string            `json:"attempt_id,omitempty"`    // Tentativa de PREPARE que reservou o worker atual
+	Vehicle           *VehicleProfile   `json:"vehicle,omitempty"`       // Repassado ao worker no PREPARE
+	MigratedFrom      string            `json:"migrated_from,omitempty"` // Worker em falha de onde a reserva foi transferida
+	FinishedAt        *time.Time        `json:"finished_at,omitempty"`   // Quando a reserva chegou a um estado final
 }
 
 // TransactionState representa o estado de uma transação na Blockchain.
@@ -132,6 +338,45 @@ type TransactionState struct {
 	Timestamp time.Time      `json:"timestamp"`
 }
 
+// FreeSlot é um intervalo do calendário de vagas da cidade.
+type FreeSlot struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	FreeConnectors int       `json:"free_connectors"`   // Conectores compatíveis livres durante todo o intervalo
+	Workers        []string  `json:"workers,omitempty"` // Workers com ao menos um desses conectores
+}
+
+// FreeSlotCalendar é a resposta de GET /schedule/free-slots: as vagas da cidade num dia.
+type FreeSlotCalendar struct {
+	City          string     `json:"city"`
+	Date          string     `json:"date"` // AAAA-MM-DD, em UTC
+	SlotMinutes   int        `json:"slot_minutes"`
+	ConnectorType string     `json:"connector_type,omitempty"`
+	Slots         []FreeSlot `json:"slots"`
+	Unreachable   []string   `json:"unreachable,omitempty"` // Workers sem agenda conhecida, fora da contagem
+}
+
+// WindowAvailability é a resposta de GET /schedule/window: quais workers da cidade
+// atendem a janela.
+type WindowAvailability struct {
+	City        string            `json:"city"`
+	Window      ReservationWindow `json:"window"`
+	Available   bool              `json:"available"`
+	Workers     []WindowResponse  `json:"workers"`
+	Unreachable []string          `json:"unreachable,omitempty"` // Workers que não responderam
+}
+
+// SegmentOutcome é o desfecho de um trecho registrado na Blockchain (UpdateChargingSegment).
+type SegmentOutcome struct {
+	TransactionID        string  `json:"transactionId"`
+	City                 string  `json:"city"`
+	Status               string  `json:"status"` // CHARGED, CHARGED_WITH_IDLE_FEE, NO_SHOW
+	Cost                 float64 `json:"cost"`
+	EnergyConsumed       float64 `json:"energyConsumed"`
+	IdleFee              float64 `json:"idleFee"`
+	RecordedTimeStampUTC string  `json:"recordedTimeStampUTC"`
+}
+
 // ErrorResponse é uma resposta de erro genérica.
 type ErrorResponse struct {
 	Status        string `json:"status"`
@@ -148,6 +393,10 @@ const (
 	StatusAborted              = "ABORTED"
 	StatusRejected             = "REJECTED"
 
+	// Estados finais de uma reserva encerrada (StateManager, workers e central OCPP)
+	StatusReservationCharged = "charged"
+	StatusReservationNoShow  = "no_show"
+
 	// Status para o Carro
 	StatusConfirmed = "CONFIRMED"
 
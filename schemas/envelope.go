@@ -0,0 +1,331 @@
+package schemas
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- ENVELOPE VERSIONADO ---
+//
+// Todas as mensagens entre carro, API e worker (MQTT) e entre APIs (HTTP) seguem o
+// formato Envelope. A versão 0 representa o formato legado, sem envelope: o payload é
+// o próprio JSON da mensagem e, nas mensagens de worker, o tipo vem no campo "command".
+//
+// Negociação: cada lado anuncia a maior versão que entende (ProtocolVersion), e quem
+// envia usa NegotiateVersion com a versão anunciada pelo destino. Respostas usam a
+// mesma versão do pedido. Assim, componentes antigos e novos convivem na mesma rede.
+
+// ProtocolVersion é a maior versão do envelope entendida por este código.
+const ProtocolVersion = 1
+
+// LegacyVersion identifica mensagens sem envelope.
+const LegacyVersion = 0
+
+// Tipos de mensagem.
+const (
+	// Carro <-> API (MQTT)
+	MsgRouteRequest      = "ROUTE_REQUEST"
+	MsgRouteOptions      = "ROUTE_OPTIONS"
+	MsgChosenRoute       = "CHOSEN_ROUTE"
+	MsgReservationStatus = "RESERVATION_STATUS"
+	MsgJourneyFinished   = "JOURNEY_FINISHED"
+	MsgEnterpriseInfo    = "ENTERPRISE_INFO"
+
+	// Carro -> Worker (MQTT)
+	MsgCarArrived   = "CAR_ARRIVED"
+	MsgCarUnplugged = "CAR_UNPLUGGED"
+
+	// API <-> Worker (MQTT)
+	MsgPrepareReserveWindow    = WorkerCommandPrepare
+	MsgCommit                  = WorkerCommandCommit
+	MsgAbort                   = WorkerCommandAbort
+	MsgPrepareResponse         = "PREPARE_RESPONSE"
+	MsgVehiclePassedAndCharged = "VEHICLE_PASSED_AND_CHARGED"
+	MsgMeterValues             = "METER_VALUES"
+	MsgVehicleArrived          = "VEHICLE_ARRIVED"
+	MsgVehiclePluggedIn        = "VEHICLE_PLUGGED_IN"
+	MsgVehicleUnplugged        = "VEHICLE_UNPLUGGED"
+	MsgVehicleNoShow           = "VEHICLE_NO_SHOW"
+	MsgChargingPointInfo       = "CHARGING_POINT_INFO"
+	MsgWorkerStatus            = "WORKER_STATUS"
+	MsgWorkerHeartbeat         = "WORKER_HEARTBEAT"
+	MsgWorkerTelemetry         = "WORKER_TELEMETRY"
+	MsgQuerySchedule           = "QUERY_SCHEDULE"
+	MsgQueryWindow             = "QUERY_WINDOW"
+	MsgScheduleResponse        = "SCHEDULE_RESPONSE"
+	MsgWindowResponse          = "WINDOW_RESPONSE"
+
+	// API <-> API (HTTP)
+	MsgRemotePrepare         = "REMOTE_PREPARE"
+	MsgRemotePrepareResponse = "REMOTE_PREPARE_RESPONSE"
+	MsgRemoteCommit          = "REMOTE_COMMIT"
+	MsgRemoteAbort           = "REMOTE_ABORT"
+	MsgRemoteResult          = "REMOTE_RESULT"
+	MsgSegmentCompletion     = "SEGMENT_COMPLETION"
+)
+
+// legacyCommandTypes são os tipos que, no formato legado, levavam o tipo no campo "command".
+var legacyCommandTypes = map[string]bool{
+	MsgPrepareReserveWindow:    true,
+	MsgCommit:                  true,
+	MsgAbort:                   true,
+	MsgPrepareResponse:         true,
+	MsgVehiclePassedAndCharged: true,
+}
+
+// ErrUnsupportedVersion indica uma mensagem em versão mais nova que ProtocolVersion.
+var ErrUnsupportedVersion = errors.New("versão de mensagem não suportada")
+
+// Envelope é o formato comum de todas as mensagens a partir da versão 1.
+type Envelope struct {
+	Type      string          `json:"type"`
+	Version   int             `json:"version"`
+	MessageID string          `json:"message_id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Sender    string          `json:"sender"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Validator é implementada pelos payloads que conferem seus campos obrigatórios.
+type Validator interface {
+	Validate() error
+}
+
+// NegotiateVersion retorna a versão a usar com um destino que anunciou peerVersion.
+func NegotiateVersion(peerVersion int) int {
+	if peerVersion <= LegacyVersion {
+		return LegacyVersion
+	}
+	if peerVersion > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return peerVersion
+}
+
+// EncodeMessage serializa o payload na versão informada (0 = formato legado).
+func EncodeMessage(msgType, sender string, version int, payload any) ([]byte, error) {
+	if version <= LegacyVersion {
+		return encodeLegacy(msgType, payload)
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao serializar payload de %s: %w", msgType, err)
+	}
+	return json.Marshal(Envelope{
+		Type:      msgType,
+		Version:   version,
+		MessageID: uuid.New().String(),
+		Timestamp: time.Now().UTC(),
+		Sender:    sender,
+		Payload:   raw,
+	})
+}
+
+func encodeLegacy(msgType string, payload any) ([]byte, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao serializar payload de %s: %w", msgType, err)
+	}
+	if !legacyCommandTypes[msgType] {
+		return raw, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	fields["command"], _ = json.Marshal(msgType)
+	return json.Marshal(fields)
+}
+
+// ParseMessage lê o envelope de uma mensagem. Mensagens sem envelope são aceitas como
+// versão legada: o payload é a mensagem inteira e o tipo vem do campo "command", se houver.
+func ParseMessage(data []byte) (Envelope, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return Envelope{}, fmt.Errorf("mensagem não é um objeto JSON: %w", err)
+	}
+	_, hasVersion := probe["version"]
+	_, hasPayload := probe["payload"]
+	if !hasVersion || !hasPayload {
+		env := Envelope{Version: LegacyVersion, Payload: json.RawMessage(data)}
+		if command, ok := probe["command"]; ok {
+			json.Unmarshal(command, &env.Type)
+		}
+		return env, nil
+	}
+
+	if err := envelopeSchema().ValidateJSON(data, false); err != nil {
+		return Envelope{}, fmt.Errorf("envelope inválido: %w", err)
+	}
+	var env Envelope
+	if err := strictUnmarshal(data, &env); err != nil {
+		return Envelope{}, fmt.Errorf("envelope inválido: %w", err)
+	}
+	if err := env.Validate(); err != nil {
+		return Envelope{}, err
+	}
+	return env, nil
+}
+
+// Validate confere os campos obrigatórios do envelope.
+func (e Envelope) Validate() error {
+	switch {
+	case e.Version > ProtocolVersion:
+		return fmt.Errorf("%w: %d (máxima: %d)", ErrUnsupportedVersion, e.Version, ProtocolVersion)
+	case e.Version < 1:
+		return fmt.Errorf("versão de envelope inválida: %d", e.Version)
+	case e.Type == "":
+		return errors.New("envelope sem 'type'")
+	case e.MessageID == "":
+		return errors.New("envelope sem 'message_id'")
+	case e.Timestamp.IsZero():
+		return errors.New("envelope sem 'timestamp'")
+	case e.Sender == "":
+		return errors.New("envelope sem 'sender'")
+	case len(e.Payload) == 0 || string(e.Payload) == "null":
+		return errors.New("envelope sem 'payload'")
+	}
+	return nil
+}
+
+// DecodePayload confere o payload contra o JSON Schema do tipo da mensagem, o decodifica
+// em v e, se v implementar Validator, o valida. Envelopes versionados exigem os campos
+// obrigatórios e rejeitam campos desconhecidos; mensagens legadas não, pois podem vir de
+// versões anteriores das structs e carregam campos extras como "command".
+func (e Envelope) DecodePayload(v any) error {
+	if schema, ok := PayloadSchema(e.Type); ok {
+		if err := schema.ValidateJSON(e.Payload, e.Version == LegacyVersion); err != nil {
+			return fmt.Errorf("payload de %s não segue o schema: %w", e.describe(), err)
+		}
+	}
+	var err error
+	if e.Version == LegacyVersion {
+		err = json.Unmarshal(e.Payload, v)
+	} else {
+		err = strictUnmarshal(e.Payload, v)
+	}
+	if err != nil {
+		return fmt.Errorf("payload de %s inválido: %w", e.describe(), err)
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("payload de %s inválido: %w", e.describe(), err)
+		}
+	}
+	return nil
+}
+
+func (e Envelope) describe() string {
+	switch {
+	case e.Version != LegacyVersion:
+		return e.Type
+	case e.Type == "":
+		return "mensagem legada"
+	}
+	return e.Type + " (legada)"
+}
+
+// DecodeMessage lê a mensagem e decodifica o payload em v, conferindo o tipo quando a
+// mensagem o informa; mensagens legadas sem tipo assumem expectedType. Retorna o
+// envelope para que a resposta use a mesma versão.
+func DecodeMessage(data []byte, expectedType string, v any) (Envelope, error) {
+	env, err := ParseMessage(data)
+	if err != nil {
+		return env, err
+	}
+	if env.Type == "" {
+		env.Type = expectedType
+	}
+	if expectedType != "" && env.Type != expectedType {
+		return env, fmt.Errorf("tipo de mensagem inesperado: '%s' (esperado '%s')", env.Type, expectedType)
+	}
+	return env, env.DecodePayload(v)
+}
+
+func strictUnmarshal(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("dados extras após o objeto JSON")
+	}
+	return nil
+}
+
+// --- VALIDAÇÃO DOS PAYLOADS ---
+
+func (r RouteRequest) Validate() error {
+	if r.VehicleID == "" {
+		return errors.New("'vehicle_id' é obrigatório")
+	}
+	return nil
+}
+
+func (c ChosenRouteMsg) Validate() error {
+	if c.VehicleID == "" || c.RequestID == "" {
+		return errors.New("'vehicle_id' e 'request_id' são obrigatórios")
+	}
+	if c.Vehicle != nil {
+		return c.Vehicle.Validate()
+	}
+	return nil
+}
+
+func (v VehicleProfile) Validate() error {
+	if v.BatteryCapacityKWh <= 0 || v.MaxChargePowerKW <= 0 {
+		return errors.New("'battery_capacity_kwh' e 'max_charge_power_kw' devem ser positivos")
+	}
+	if v.StateOfChargePct < 0 || v.StateOfChargePct > 100 || v.TargetSOCPct < 0 || v.TargetSOCPct > 100 {
+		return errors.New("percentuais de carga devem estar entre 0 e 100")
+	}
+	switch v.ConnectorType {
+	case "", ConnectorCCS2, ConnectorType2, ConnectorCHAdeMO:
+	default:
+		return fmt.Errorf("tipo de conector desconhecido: '%s'", v.ConnectorType)
+	}
+	return nil
+}
+
+func (r RemotePrepareRequest) Validate() error {
+	if r.TransactionID == "" || r.City == "" {
+		return errors.New("'transaction_id' e 'city' são obrigatórios")
+	}
+	if !r.ReservationWindow.EndTimeUTC.After(r.ReservationWindow.StartTimeUTC) {
+		return errors.New("janela de reserva inválida")
+	}
+	if r.Vehicle != nil {
+		return r.Vehicle.Validate()
+	}
+	return nil
+}
+
+func (r RemoteCommitAbortRequest) Validate() error {
+	if r.TransactionID == "" {
+		return errors.New("'transaction_id' é obrigatório")
+	}
+	return nil
+}
+
+func (p CostUpdatePayload) Validate() error {
+	if p.TransactionID == "" || p.SegmentCity == "" {
+		return errors.New("'transaction_id' e 'segment_city' são obrigatórios")
+	}
+	if p.Cost < 0 || p.EnergyKWh < 0 || p.IdleFee < 0 {
+		return errors.New("'cost', 'energy_kwh' e 'idle_fee' não podem ser negativos")
+	}
+	switch p.Status {
+	case "", SegmentCharged, SegmentChargedWithIdleFee, SegmentNoShow:
+		return nil
+	}
+	return fmt.Errorf("desfecho de trecho desconhecido: '%s'", p.Status)
+}
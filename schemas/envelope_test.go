@@ -0,0 +1,232 @@
+package schemas
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		peer int
+		want int
+	}{
+		{peer: -1, want: LegacyVersion},
+		{peer: LegacyVersion, want: LegacyVersion},
+		{peer: 1, want: 1},
+		{peer: ProtocolVersion, want: ProtocolVersion},
+		{peer: ProtocolVersion + 1, want: ProtocolVersion},
+	}
+	for _, tt := range tests {
+		if got := NegotiateVersion(tt.peer); got != tt.want {
+			t.Errorf("NegotiateVersion(%d) = %d, esperado %d", tt.peer, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeDecodeAcrossVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     int
+		msgType     string
+		wantVersion int
+		wantType    string // Tipo lido por ParseMessage, antes de DecodeMessage completar
+		wantCommand bool   // Formato legado com o tipo no campo "command"
+	}{
+		{name: "comando legado", version: LegacyVersion, msgType: MsgCommit, wantVersion: LegacyVersion, wantType: MsgCommit, wantCommand: true},
+		{name: "legado sem command", version: LegacyVersion, msgType: MsgRouteRequest, wantVersion: LegacyVersion, wantType: ""},
+		{name: "versão negativa vira legado", version: -1, msgType: MsgCommit, wantVersion: LegacyVersion, wantType: MsgCommit, wantCommand: true},
+		{name: "envelope v1", version: 1, msgType: MsgCommit, wantVersion: 1, wantType: MsgCommit},
+		{name: "versão futura limitada à atual", version: ProtocolVersion + 1, msgType: MsgRouteRequest, wantVersion: ProtocolVersion, wantType: MsgRouteRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload any = CommitCommand{TransactionID: "tx-1"}
+			if tt.msgType == MsgRouteRequest {
+				payload = RouteRequest{VehicleID: "car-1", Origin: "A", Destination: "B"}
+			}
+			data, err := EncodeMessage(tt.msgType, "empresa-a", tt.version, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(data), `"command"`); got != tt.wantCommand {
+				t.Fatalf("campo command presente = %v em %s", got, data)
+			}
+
+			env, err := ParseMessage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Version != tt.wantVersion || env.Type != tt.wantType {
+				t.Fatalf("envelope v%d %q, esperado v%d %q", env.Version, env.Type, tt.wantVersion, tt.wantType)
+			}
+
+			switch p := payload.(type) {
+			case CommitCommand:
+				var got CommitCommand
+				if _, err := DecodeMessage(data, MsgCommit, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != p {
+					t.Fatalf("payload %+v, esperado %+v", got, p)
+				}
+			case RouteRequest:
+				var got RouteRequest
+				if _, err := DecodeMessage(data, MsgRouteRequest, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != p {
+					t.Fatalf("payload %+v, esperado %+v", got, p)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeMessageLegacyFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+		wantType string
+		wantErr  string
+	}{
+		{
+			name:     "legado sem tipo assume o esperado",
+			data:     `{"transaction_id":"tx-1"}`,
+			expected: MsgAbort,
+			wantType: MsgAbort,
+		},
+		{
+			name:     "legado aceita campos extras",
+			data:     `{"command":"ABORT","transaction_id":"tx-1","campo_antigo":true}`,
+			expected: MsgAbort,
+			wantType: MsgAbort,
+		},
+		{
+			name:     "legado com command de outro tipo",
+			data:     `{"command":"COMMIT","transaction_id":"tx-1"}`,
+			expected: MsgAbort,
+			wantErr:  "tipo de mensagem inesperado",
+		},
+		{
+			name:     "objeto com version mas sem payload é legado",
+			data:     `{"version":1,"transaction_id":"tx-1"}`,
+			expected: MsgAbort,
+			wantType: MsgAbort,
+		},
+		{
+			name:     "não é objeto JSON",
+			data:     `["ABORT"]`,
+			expected: MsgAbort,
+			wantErr:  "não é um objeto JSON",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got AbortCommand
+			env, err := DecodeMessage([]byte(tt.data), tt.expected, &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("erro = %v, esperado %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Version != LegacyVersion || env.Type != tt.wantType || got.TransactionID != "tx-1" {
+				t.Fatalf("envelope v%d %q, payload %+v", env.Version, env.Type, got)
+			}
+		})
+	}
+}
+
+func TestParseMessageRejectsNewerVersion(t *testing.T) {
+	data := `{"type":"ABORT","version":99,"message_id":"m1","timestamp":"2026-01-01T00:00:00Z","sender":"e","payload":{"transaction_id":"tx-1"}}`
+	if _, err := ParseMessage([]byte(data)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("erro = %v, esperado ErrUnsupportedVersion", err)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	const header = `"type":"PREPARE_RESERVE_WINDOW","version":1,"message_id":"m1","timestamp":"2026-01-01T00:00:00Z","sender":"e"`
+	const window = `"window":{"start_time_utc":"2026-01-01T10:00:00Z","end_time_utc":"2026-01-01T11:00:00Z"}`
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string // Vazio: mensagem aceita
+	}{
+		{
+			name: "envelope v1 válido",
+			data: `{` + header + `,"payload":{"transaction_id":"tx-1","response_topic":"r/1",` + window + `}}`,
+		},
+		{
+			name:    "envelope sem campo obrigatório",
+			data:    `{"type":"PREPARE_RESERVE_WINDOW","version":1,"timestamp":"2026-01-01T00:00:00Z","sender":"e","payload":{}}`,
+			wantErr: "campo obrigatório 'message_id' ausente",
+		},
+		{
+			name:    "envelope com campo desconhecido",
+			data:    `{` + header + `,"extra":1,"payload":{"transaction_id":"tx-1","response_topic":"r/1",` + window + `}}`,
+			wantErr: "extra: campo desconhecido",
+		},
+		{
+			name:    "timestamp fora do RFC 3339",
+			data:    `{"type":"PREPARE_RESERVE_WINDOW","version":1,"message_id":"m1","timestamp":"01/01/2026","sender":"e","payload":{}}`,
+			wantErr: "timestamp: data/hora inválida",
+		},
+		{
+			name:    "payload v1 sem campo obrigatório",
+			data:    `{` + header + `,"payload":{"transaction_id":"tx-1",` + window + `}}`,
+			wantErr: "campo obrigatório 'response_topic' ausente",
+		},
+		{
+			name:    "payload v1 com campo desconhecido",
+			data:    `{` + header + `,"payload":{"transaction_id":"tx-1","response_topic":"r/1","command":"PREPARE_RESERVE_WINDOW",` + window + `}}`,
+			wantErr: "command: campo desconhecido",
+		},
+		{
+			name:    "payload v1 com tipo errado",
+			data:    `{` + header + `,"payload":{"transaction_id":7,"response_topic":"r/1",` + window + `}}`,
+			wantErr: "transaction_id: esperado string",
+		},
+		{
+			name:    "data inválida em objeto aninhado",
+			data:    `{` + header + `,"payload":{"transaction_id":"tx-1","response_topic":"r/1","window":{"start_time_utc":"ontem","end_time_utc":"2026-01-01T11:00:00Z"}}}`,
+			wantErr: "window.start_time_utc: data/hora inválida",
+		},
+		{
+			name: "legado tolera campos extras",
+			data: `{"command":"PREPARE_RESERVE_WINDOW","transaction_id":"tx-1","response_topic":"r/1","antigo":true,` + window + `}`,
+		},
+		{
+			name:    "legado continua conferindo tipos",
+			data:    `{"command":"PREPARE_RESERVE_WINDOW","transaction_id":"tx-1","response_topic":["r/1"],` + window + `}`,
+			wantErr: "response_topic: esperado string",
+		},
+		{
+			name:    "legado sem campo obrigatório cai no Validate",
+			data:    `{"command":"PREPARE_RESERVE_WINDOW","transaction_id":"tx-1",` + window + `}`,
+			wantErr: "'transaction_id' e 'response_topic' são obrigatórios",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got PrepareReserveWindowCommand
+			_, err := DecodeMessage([]byte(tt.data), MsgPrepareReserveWindow, &got)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("erro inesperado: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("erro = %v, esperado %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package schemas
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- JSON SCHEMA ---
+//
+// Os schemas são gerados por reflexão a partir das structs deste pacote, usando as
+// tags json: campos sem omitempty são obrigatórios, ponteiros, slices e mapas aceitam
+// null e structs não aceitam campos desconhecidos. O mesmo schema publicado por
+// schemas/cmd/schemagen é usado em tempo de execução para validar as mensagens recebidas.
+
+// JSONSchemaDraft é o dialeto dos schemas gerados.
+const JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// JSONSchema é o subconjunto de JSON Schema usado pelos tipos deste pacote.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	ID                   string                 `json:"$id,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 any                    `json:"type,omitempty"` // string ou []string
+	Format               string                 `json:"format,omitempty"`
+	ContentEncoding      string                 `json:"contentEncoding,omitempty"`
+	Const                any                    `json:"const,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties any                    `json:"additionalProperties,omitempty"` // bool ou *JSONSchema
+	Items                *JSONSchema            `json:"items,omitempty"`
+	AnyOf                []*JSONSchema          `json:"anyOf,omitempty"`
+	Defs                 map[string]*JSONSchema `json:"$defs,omitempty"`
+}
+
+// SchemaBuilder gera schemas para tipos Go, acumulando as structs referenciadas em Defs.
+type SchemaBuilder struct {
+	RefPrefix string                 // Prefixo das referências (padrão: "#/$defs/")
+	Defs      map[string]*JSONSchema // Nome da struct -> schema
+}
+
+// NewSchemaBuilder cria um builder com referências para refPrefix ("" = "#/$defs/").
+func NewSchemaBuilder(refPrefix string) *SchemaBuilder {
+	if refPrefix == "" {
+		refPrefix = "#/$defs/"
+	}
+	return &SchemaBuilder{RefPrefix: refPrefix, Defs: make(map[string]*JSONSchema)}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// SchemaOf retorna o schema de t. Structs nomeadas viram referências para Defs.
+func (b *SchemaBuilder) SchemaOf(t reflect.Type) *JSONSchema {
+	switch {
+	case t == timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case t == rawType:
+		return &JSONSchema{} // Qualquer valor JSON
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(b.SchemaOf(t.Elem()))
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.Defs[t.Name()]; !ok {
+			b.Defs[t.Name()] = &JSONSchema{} // Marca antes de gerar: evita recursão infinita
+			b.Defs[t.Name()] = b.structSchema(t)
+		}
+		return &JSONSchema{Ref: b.RefPrefix + t.Name()}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 { // []byte vira base64
+			return &JSONSchema{Type: []string{"string", "null"}, ContentEncoding: "base64"}
+		}
+		return &JSONSchema{Type: []string{"array", "null"}, Items: b.SchemaOf(t.Elem())}
+	case reflect.Array:
+		return &JSONSchema{Type: "array", Items: b.SchemaOf(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: []string{"object", "null"}, AdditionalProperties: b.SchemaOf(t.Elem())}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	default: // interface{} e afins
+		return &JSONSchema{}
+	}
+}
+
+func (b *SchemaBuilder) structSchema(t reflect.Type) *JSONSchema {
+	s := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema), AdditionalProperties: false}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, omitEmpty, skip := jsonFieldName(field)
+		if skip {
+			continue
+		}
+		if field.Anonymous && field.Tag.Get("json") == "" && field.Type.Kind() == reflect.Struct {
+			embedded := b.structSchema(field.Type)
+			for prop, propSchema := range embedded.Properties {
+				s.Properties[prop] = propSchema
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		s.Properties[name] = b.SchemaOf(field.Type)
+		if !omitEmpty {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+func jsonFieldName(field reflect.StructField) (name string, omitEmpty, skip bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = field.Name
+	}
+	for _, option := range parts[1:] {
+		if option == "omitempty" || option == "omitzero" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty, false
+}
+
+func nullable(s *JSONSchema) *JSONSchema {
+	switch typ := s.Type.(type) {
+	case string:
+		s.Type = []string{typ, "null"}
+		return s
+	case []string:
+		for _, t := range typ {
+			if t == "null" {
+				return s
+			}
+		}
+		s.Type = append(typ, "null")
+		return s
+	}
+	if s.Ref == "" && s.Type == nil && s.AnyOf == nil {
+		return s // Já aceita qualquer valor
+	}
+	return &JSONSchema{AnyOf: []*JSONSchema{s, {Type: "null"}}}
+}
+
+// SchemaFor gera o documento JSON Schema completo (com $defs) do tipo de v.
+func SchemaFor(v any) *JSONSchema {
+	return SchemaForType(reflect.TypeOf(v))
+}
+
+// SchemaForType gera o documento JSON Schema completo (com $defs) da struct t.
+func SchemaForType(t reflect.Type) *JSONSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	b := NewSchemaBuilder("")
+	b.SchemaOf(t)
+
+	root := *b.Defs[t.Name()]
+	root.Schema = JSONSchemaDraft
+	root.Title = t.Name()
+	delete(b.Defs, t.Name())
+	if len(b.Defs) > 0 {
+		root.Defs = b.Defs
+	}
+	return &root
+}
+
+// --- VALIDAÇÃO ---
+
+// SchemaError descreve uma violação do schema.
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidateJSON valida data contra o schema. Em modo leniente (mensagens legadas), campos
+// obrigatórios ausentes e campos desconhecidos são tolerados; tipos continuam conferidos.
+func (s *JSONSchema) ValidateJSON(data []byte, lenient bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return &SchemaError{Message: "JSON inválido: " + err.Error()}
+	}
+	v := validation{root: s, lenient: lenient}
+	return v.validate(s, value, "")
+}
+
+type validation struct {
+	root    *JSONSchema
+	lenient bool
+}
+
+func (v validation) validate(s *JSONSchema, value any, path string) error {
+	if s.Ref != "" {
+		resolved, err := v.resolve(s.Ref)
+		if err != nil {
+			return &SchemaError{Path: path, Message: err.Error()}
+		}
+		s = resolved
+	}
+	if len(s.AnyOf) > 0 {
+		var firstErr error
+		for _, alternative := range s.AnyOf {
+			err := v.validate(alternative, value, path)
+			if err == nil {
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	if s.Type != nil && !typeMatches(s.Type, value) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("esperado %s, recebido %s", describeType(s.Type), jsonTypeOf(value))}
+	}
+	if s.Const != nil && fmt.Sprint(s.Const) != fmt.Sprint(value) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("esperado o valor '%v'", s.Const)}
+	}
+
+	switch val := value.(type) {
+	case string:
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, val); err != nil {
+				return &SchemaError{Path: path, Message: "data/hora inválida (RFC 3339)"}
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range val {
+				if err := v.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		if !v.lenient {
+			for _, required := range s.Required {
+				if _, ok := val[required]; !ok {
+					return &SchemaError{Path: path, Message: fmt.Sprintf("campo obrigatório '%s' ausente", required)}
+				}
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys) // Erros determinísticos
+		for _, key := range keys {
+			childPath := joinPath(path, key)
+			if prop, ok := s.Properties[key]; ok {
+				if err := v.validate(prop, val[key], childPath); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case bool:
+				if !additional && !v.lenient {
+					return &SchemaError{Path: childPath, Message: "campo desconhecido"}
+				}
+			case *JSONSchema:
+				if err := v.validate(additional, val[key], childPath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (v validation) resolve(ref string) (*JSONSchema, error) {
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	if def, ok := v.root.Defs[name]; ok {
+		return def, nil
+	}
+	return nil, fmt.Errorf("referência não resolvida: %s", ref)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func typeMatches(schemaType any, value any) bool {
+	switch typ := schemaType.(type) {
+	case string:
+		return singleTypeMatches(typ, value)
+	case []string:
+		for _, t := range typ {
+			if singleTypeMatches(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func singleTypeMatches(typ string, value any) bool {
+	switch typ {
+	case "null":
+		return value == nil
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		if _, err := number.Int64(); err == nil {
+			return true
+		}
+		f, err := number.Float64()
+		return err == nil && f == float64(int64(f))
+	}
+	return false
+}
+
+func describeType(schemaType any) string {
+	if types, ok := schemaType.([]string); ok {
+		return strings.Join(types, " ou ")
+	}
+	return fmt.Sprint(schemaType)
+}
+
+func jsonTypeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,450 @@
+package schemas
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// --- ESTRUTURAS DE COMUNICAÇÃO API <-> CHARGING POINT WORKER (via MQTT) ---
+//
+// Comandos: enterprise/<empresa>/cp/<worker>/command
+// Eventos:  enterprise/<empresa>/cp/<worker>/event
+// Presença: enterprise/<empresa>/cp/<worker>/status (retido) e .../heartbeat
+
+// Comandos enviados pela API ao worker.
+const (
+	WorkerCommandPrepare = "PREPARE_RESERVE_WINDOW"
+	WorkerCommandCommit  = "COMMIT"
+	WorkerCommandAbort   = "ABORT"
+)
+
+// Tipos de conector.
+const (
+	ConnectorCCS2    = "CCS2"
+	ConnectorType2   = "Type2"
+	ConnectorCHAdeMO = "CHAdeMO"
+)
+
+// Estados de um conector.
+const (
+	ConnectorAvailable = "available"
+	ConnectorReserved  = "reserved"
+	ConnectorCharging  = "charging"
+	ConnectorOccupied  = "occupied" // Veículo no conector sem recarregar (antes ou depois da sessão)
+	ConnectorFaulted   = "faulted"  // Em falha: não recebe novas reservas
+)
+
+// ConnectorStatus descreve um conector do ponto de recarga e sua ocupação.
+type ConnectorStatus struct {
+	ConnectorID  int                 `json:"connector_id"`
+	Type         string              `json:"type"`                   // CCS2, Type2 ou CHAdeMO
+	PowerKW      float64             `json:"power_kw"`               // Potência nominal
+	Status       string              `json:"status"`                 // available, reserved, charging, occupied ou faulted
+	Reservations []ReservationWindow `json:"reservations,omitempty"` // Janelas que ainda ocupam o conector
+}
+
+// PrepareReserveWindowCommand pede ao worker que reserve provisoriamente uma janela.
+type PrepareReserveWindowCommand struct {
+	TransactionID string            `json:"transaction_id"`
+	Window        ReservationWindow `json:"window"`
+	ResponseTopic string            `json:"response_topic"`           // Onde o worker deve publicar a resposta
+	CorrelationID string            `json:"correlation_id,omitempty"` // Devolvido na resposta para associá-la ao pedido
+	Vehicle       *VehicleProfile   `json:"vehicle,omitempty"`        // Bateria do veículo; ausente, o worker usa um perfil padrão
+	AttemptID     string            `json:"attempt_id,omitempty"`     // Tentativa de PREPARE; o worker a guarda com a reserva
+}
+
+// SetReplyTo preenche o endereço de resposta; usado pelo cliente request/reply de api/mqtt.
+func (c *PrepareReserveWindowCommand) SetReplyTo(correlationID, responseTopic string) {
+	c.CorrelationID = correlationID
+	c.ResponseTopic = responseTopic
+}
+
+func (c PrepareReserveWindowCommand) Validate() error {
+	if c.TransactionID == "" || c.ResponseTopic == "" {
+		return errors.New("'transaction_id' e 'response_topic' são obrigatórios")
+	}
+	if !c.Window.EndTimeUTC.After(c.Window.StartTimeUTC) {
+		return errors.New("janela de reserva inválida")
+	}
+	if c.Vehicle != nil {
+		return c.Vehicle.Validate()
+	}
+	return nil
+}
+
+// CommitCommand confirma a reserva preparada da transação.
+type CommitCommand struct {
+	TransactionID string `json:"transaction_id"`
+	AttemptID     string `json:"attempt_id,omitempty"` // Só a reserva desta tentativa; vazio, qualquer uma da transação
+}
+
+func (c CommitCommand) Validate() error {
+	if c.TransactionID == "" {
+		return errors.New("'transaction_id' é obrigatório")
+	}
+	return nil
+}
+
+// AbortCommand desfaz a reserva preparada da transação.
+type AbortCommand struct {
+	TransactionID string `json:"transaction_id"`
+	AttemptID     string `json:"attempt_id,omitempty"` // Só a reserva desta tentativa; vazio, qualquer uma da transação
+}
+
+func (c AbortCommand) Validate() error {
+	if c.TransactionID == "" {
+		return errors.New("'transaction_id' é obrigatório")
+	}
+	return nil
+}
+
+// SameAttempt informa se um COMMIT ou ABORT da tentativa attemptID vale para a reserva
+// preparada na tentativa reserved. Uma transação pode ter mais de uma tentativa de PREPARE
+// (a migração de um worker em falha faz outra): o ABORT atrasado de uma não pode desfazer
+// a reserva de outra no mesmo worker. Comandos sem attempt_id valem para qualquer reserva.
+func SameAttempt(reserved, attemptID string) bool {
+	return attemptID == "" || attemptID == reserved
+}
+
+// PrepareResponse é a resposta do worker a um PrepareReserveWindowCommand.
+type PrepareResponse struct {
+	Success       bool   `json:"success"`
+	TransactionID string `json:"transaction_id"`
+	WorkerID      string `json:"worker_id"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ConnectorID   int    `json:"connector_id,omitempty"` // Conector reservado, quando Success
+}
+
+func (r PrepareResponse) Validate() error {
+	if r.TransactionID == "" || r.WorkerID == "" {
+		return errors.New("'transaction_id' e 'worker_id' são obrigatórios")
+	}
+	return nil
+}
+
+// QueryScheduleCommand pede ao worker a agenda dos conectores no intervalo [From, To).
+type QueryScheduleCommand struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	ResponseTopic string    `json:"response_topic"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+}
+
+// SetReplyTo preenche o endereço de resposta; usado pelo cliente request/reply de api/mqtt.
+func (c *QueryScheduleCommand) SetReplyTo(correlationID, responseTopic string) {
+	c.CorrelationID = correlationID
+	c.ResponseTopic = responseTopic
+}
+
+// Validate implementa Validator.
+func (c QueryScheduleCommand) Validate() error {
+	if !c.To.After(c.From) {
+		return errors.New("'to' deve ser posterior a 'from'")
+	}
+	return nil
+}
+
+// ScheduledWindow é uma janela ocupada na agenda de um conector.
+type ScheduledWindow struct {
+	Window ReservationWindow `json:"window"`
+	Status string            `json:"status,omitempty"` // Estado da reserva no worker (prepared, committed, charging...)
+}
+
+// ConnectorSchedule é a agenda de um conector.
+type ConnectorSchedule struct {
+	ConnectorID  int               `json:"connector_id"`
+	Type         string            `json:"type"`
+	PowerKW      float64           `json:"power_kw"`
+	Status       string            `json:"status"` // Ocupação atual: available, reserved, charging, occupied ou faulted
+	Reservations []ScheduledWindow `json:"reservations"`
+}
+
+// Origens de uma agenda.
+const (
+	ScheduleFromWorker    = "worker"    // Consulta em tempo real (QUERY_SCHEDULE)
+	ScheduleFromAnnounced = "announced" // Última info publicada pelo worker
+)
+
+// ScheduleResponse é a resposta do worker a um QueryScheduleCommand, também servida em
+// GET /workers/{id}/schedule.
+type ScheduleResponse struct {
+	WorkerID      string              `json:"worker_id"`
+	CorrelationID string              `json:"correlation_id,omitempty"`
+	From          time.Time           `json:"from"`
+	To            time.Time           `json:"to"`
+	GeneratedAt   time.Time           `json:"generated_at"`
+	Source        string              `json:"source,omitempty"` // worker ou announced; preenchido pela API
+	Connectors    []ConnectorSchedule `json:"connectors"`
+}
+
+// Validate implementa Validator.
+func (r ScheduleResponse) Validate() error {
+	if r.WorkerID == "" {
+		return errors.New("'worker_id' é obrigatório")
+	}
+	return nil
+}
+
+// QueryWindowCommand pergunta ao worker, sem reservar, se ele atende a janela.
+type QueryWindowCommand struct {
+	Window        ReservationWindow `json:"window"`
+	Vehicle       *VehicleProfile   `json:"vehicle,omitempty"` // Filtra pelo tipo de conector do veículo
+	ResponseTopic string            `json:"response_topic"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+}
+
+// SetReplyTo preenche o endereço de resposta; usado pelo cliente request/reply de api/mqtt.
+func (c *QueryWindowCommand) SetReplyTo(correlationID, responseTopic string) {
+	c.CorrelationID = correlationID
+	c.ResponseTopic = responseTopic
+}
+
+// Validate implementa Validator.
+func (c QueryWindowCommand) Validate() error {
+	if !c.Window.EndTimeUTC.After(c.Window.StartTimeUTC) {
+		return errors.New("a janela deve terminar depois de começar")
+	}
+	return nil
+}
+
+// WindowResponse é a resposta do worker a um QueryWindowCommand.
+type WindowResponse struct {
+	WorkerID      string            `json:"worker_id"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Window        ReservationWindow `json:"window"`
+	Available     bool              `json:"available"`
+	ConnectorIDs  []int             `json:"connector_ids,omitempty"` // Conectores compatíveis livres na janela
+}
+
+// Validate implementa Validator.
+func (r WindowResponse) Validate() error {
+	if r.WorkerID == "" {
+		return errors.New("'worker_id' é obrigatório")
+	}
+	return nil
+}
+
+// VehiclePassedAndChargedEvent é publicado pelo worker quando o veículo é desconectado
+// e o trecho é cobrado. Cost inclui a taxa de ociosidade.
+type VehiclePassedAndChargedEvent struct {
+	TransactionID  string            `json:"transaction_id"`
+	Cost           float64           `json:"cost"`
+	Window         ReservationWindow `json:"window"`
+	WorkerID       string            `json:"worker_id"`
+	ConnectorID    int               `json:"connector_id,omitempty"`
+	EnergyKWh      float64           `json:"energy_kwh,omitempty"`       // Energia entregue na sessão
+	PluggedInAt    *time.Time        `json:"plugged_in_at,omitempty"`    // Início da sessão (veículo conectado)
+	SessionEndedAt *time.Time        `json:"session_ended_at,omitempty"` // Fim da sessão
+	FinalSOCPct    float64           `json:"final_soc_pct,omitempty"`    // Carga do veículo ao fim da sessão
+	UnpluggedAt    *time.Time        `json:"unplugged_at,omitempty"`     // Veículo desconectado
+	IdleMinutes    float64           `json:"idle_minutes,omitempty"`     // Permanência além da janela, em minutos simulados
+	IdleFee        float64           `json:"idle_fee,omitempty"`         // Taxa de ociosidade, já somada a Cost
+}
+
+func (e VehiclePassedAndChargedEvent) Validate() error {
+	if e.TransactionID == "" || e.WorkerID == "" {
+		return errors.New("'transaction_id' e 'worker_id' são obrigatórios")
+	}
+	if e.Cost < 0 || e.EnergyKWh < 0 || e.IdleMinutes < 0 || e.IdleFee < 0 {
+		return errors.New("'cost', 'energy_kwh', 'idle_minutes' e 'idle_fee' não podem ser negativos")
+	}
+	return nil
+}
+
+// SessionEvent marca uma etapa da passagem do veículo pelo ponto de recarga:
+// VEHICLE_ARRIVED, VEHICLE_PLUGGED_IN ou VEHICLE_UNPLUGGED.
+type SessionEvent struct {
+	TransactionID string    `json:"transaction_id"`
+	WorkerID      string    `json:"worker_id"`
+	ConnectorID   int       `json:"connector_id,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+func (e SessionEvent) Validate() error {
+	if e.TransactionID == "" || e.WorkerID == "" {
+		return errors.New("'transaction_id' e 'worker_id' são obrigatórios")
+	}
+	return nil
+}
+
+// VehicleSignal é enviado pelo carro ao chegar ao ponto de recarga (CAR_ARRIVED) e ao
+// desconectar e sair (CAR_UNPLUGGED). O worker o associa à reserva pela transação e pela janela.
+type VehicleSignal struct {
+	TransactionID string            `json:"transaction_id"`
+	VehicleID     string            `json:"vehicle_id"`
+	Window        ReservationWindow `json:"window"`
+	Timestamp     time.Time         `json:"timestamp"`
+}
+
+func (s VehicleSignal) Validate() error {
+	if s.TransactionID == "" || s.VehicleID == "" {
+		return errors.New("'transaction_id' e 'vehicle_id' são obrigatórios")
+	}
+	return nil
+}
+
+// NoShowEvent é publicado quando o veículo não chega até o fim da tolerância: a
+// reserva é liberada e o trecho não é cobrado.
+type NoShowEvent struct {
+	TransactionID      string            `json:"transaction_id"`
+	WorkerID           string            `json:"worker_id"`
+	ConnectorID        int               `json:"connector_id,omitempty"`
+	Window             ReservationWindow `json:"window"`
+	GracePeriodSeconds int               `json:"grace_period_seconds"`
+	ReleasedAt         time.Time         `json:"released_at"`
+}
+
+func (e NoShowEvent) Validate() error {
+	if e.TransactionID == "" || e.WorkerID == "" {
+		return errors.New("'transaction_id' e 'worker_id' são obrigatórios")
+	}
+	return nil
+}
+
+// MeterValuesEvent é a leitura periódica do medidor durante uma sessão de recarga.
+type MeterValuesEvent struct {
+	TransactionID    string    `json:"transaction_id"`
+	WorkerID         string    `json:"worker_id"`
+	ConnectorID      int       `json:"connector_id,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+	EnergyKWh        float64   `json:"energy_kwh"`          // Energia acumulada desde o início da sessão
+	PowerKW          float64   `json:"power_kw"`            // Potência instantânea
+	StateOfChargePct float64   `json:"state_of_charge_pct"` // Carga estimada do veículo
+}
+
+func (e MeterValuesEvent) Validate() error {
+	if e.TransactionID == "" || e.WorkerID == "" {
+		return errors.New("'transaction_id' e 'worker_id' são obrigatórios")
+	}
+	if e.EnergyKWh < 0 || e.PowerKW < 0 {
+		return errors.New("'energy_kwh' e 'power_kw' não podem ser negativos")
+	}
+	return nil
+}
+
+// Estados do worker no tópico de status.
+const (
+	WorkerOnline  = "online"
+	WorkerOffline = "offline"
+)
+
+// WorkerStatus é a mensagem retida do tópico de status do worker. O worker publica
+// "online" a cada conexão com o broker (birth) e registra "offline" como last will,
+// publicado pelo broker se a conexão cair; ao desligar, ele mesmo publica "offline".
+type WorkerStatus struct {
+	WorkerID   string `json:"worker_id"`
+	Enterprise string `json:"enterprise"`
+	Status     string `json:"status"`
+}
+
+// Validate implementa Validator.
+func (s WorkerStatus) Validate() error {
+	if s.WorkerID == "" {
+		return errors.New("'worker_id' é obrigatório")
+	}
+	if s.Status != WorkerOnline && s.Status != WorkerOffline {
+		return fmt.Errorf("status de worker desconhecido: '%s'", s.Status)
+	}
+	return nil
+}
+
+// WorkerCapabilities resume o que o worker oferece, para a alocação de reservas.
+type WorkerCapabilities struct {
+	ProtocolVersion int      `json:"protocol_version,omitempty"` // Maior versão de mensagem entendida
+	Connectors      int      `json:"connectors"`
+	ConnectorTypes  []string `json:"connector_types,omitempty"`
+	MaxPowerKW      float64  `json:"max_power_kw,omitempty"`
+	OCPP            bool     `json:"ocpp,omitempty"`    // Ponto de recarga OCPP atendido pela central da API
+	Queries         bool     `json:"queries,omitempty"` // Atende QUERY_SCHEDULE e QUERY_WINDOW
+}
+
+// WorkerHeartbeat é publicado periodicamente enquanto o worker está no ar. Sem heartbeat
+// por três intervalos, a API considera o worker offline.
+type WorkerHeartbeat struct {
+	WorkerID        string             `json:"worker_id"`
+	Enterprise      string             `json:"enterprise"`
+	Timestamp       time.Time          `json:"timestamp"`
+	IntervalSeconds int                `json:"interval_seconds"`
+	Capabilities    WorkerCapabilities `json:"capabilities"`
+}
+
+// Validate implementa Validator.
+func (h WorkerHeartbeat) Validate() error {
+	if h.WorkerID == "" {
+		return errors.New("'worker_id' é obrigatório")
+	}
+	if h.IntervalSeconds <= 0 {
+		return errors.New("'interval_seconds' deve ser positivo")
+	}
+	return nil
+}
+
+// Estados de telemetria do ponto de recarga e dos conectores (os nomes do OCPP 1.6).
+const (
+	TelemetryAvailable   = "Available"
+	TelemetryOccupied    = "Occupied"
+	TelemetryFaulted     = "Faulted"
+	TelemetryUnavailable = "Unavailable"
+)
+
+func validTelemetryStatus(status string) bool {
+	switch status {
+	case TelemetryAvailable, TelemetryOccupied, TelemetryFaulted, TelemetryUnavailable:
+		return true
+	}
+	return false
+}
+
+// ConnectorTelemetry é o estado e as medições de um conector.
+type ConnectorTelemetry struct {
+	ConnectorID  int     `json:"connector_id"`
+	Status       string  `json:"status"`
+	ErrorCode    string  `json:"error_code,omitempty"` // ChargePointErrorCode do OCPP, quando Faulted
+	VoltageV     float64 `json:"voltage_v"`
+	CurrentA     float64 `json:"current_a"`
+	PowerKW      float64 `json:"power_kw"`
+	TemperatureC float64 `json:"temperature_c"`
+}
+
+// WorkerTelemetry é publicada periodicamente e a cada mudança de estado. O ponto de
+// recarga está Faulted quando todos os conectores estão em falha, Occupied quando nenhum
+// está livre e Unavailable quando não aceita reservas (por exemplo, ao desligar).
+type WorkerTelemetry struct {
+	WorkerID   string               `json:"worker_id"`
+	Enterprise string               `json:"enterprise"`
+	Timestamp  time.Time            `json:"timestamp"`
+	Status     string               `json:"status"`
+	Connectors []ConnectorTelemetry `json:"connectors"`
+}
+
+// Validate implementa Validator.
+func (t WorkerTelemetry) Validate() error {
+	if t.WorkerID == "" {
+		return errors.New("'worker_id' é obrigatório")
+	}
+	if !validTelemetryStatus(t.Status) {
+		return fmt.Errorf("estado de telemetria desconhecido: '%s'", t.Status)
+	}
+	for _, c := range t.Connectors {
+		if !validTelemetryStatus(c.Status) {
+			return fmt.Errorf("estado de telemetria desconhecido no conector %d: '%s'", c.ConnectorID, c.Status)
+		}
+		if c.VoltageV < 0 || c.CurrentA < 0 || c.PowerKW < 0 {
+			return fmt.Errorf("medições negativas no conector %d", c.ConnectorID)
+		}
+	}
+	return nil
+}
+
+// WorkerEntry é um worker no registro da API (GET /workers).
+type WorkerEntry struct {
+	WorkerID      string              `json:"worker_id"`
+	Online        bool                `json:"online"`
+	Eligible      bool                `json:"eligible"`         // Online e sem falha: recebe PREPARE
+	Status        string              `json:"status,omitempty"` // Último status publicado pelo worker
+	LastSeen      *time.Time          `json:"last_seen,omitempty"`
+	LastHeartbeat *time.Time          `json:"last_heartbeat,omitempty"`
+	Capabilities  *WorkerCapabilities `json:"capabilities,omitempty"`
+	Telemetry     *WorkerTelemetry    `json:"telemetry,omitempty"` // Última telemetria recebida
+}